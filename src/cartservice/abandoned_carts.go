@@ -0,0 +1,187 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const defaultAbandonedCartScanInterval = time.Minute
+
+var (
+	// abandonedCarts and cartsEmptied together give the abandonment rate:
+	// carts are emptied at checkout, so
+	// abandoned_carts_total / (abandoned_carts_total + carts_emptied_total)
+	// is the share of carts left behind.
+	abandonedCarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Name:      "abandoned_carts_total",
+		Help:      "Number of carts holding items left unchanged for ABANDONED_CART_AFTER.",
+	})
+	abandonedCartItems = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Name:      "abandoned_cart_items_total",
+		Help:      "Number of units in abandoned carts.",
+	})
+	cartsEmptied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Name:      "carts_emptied_total",
+		Help:      "Number of EmptyCart calls, which checkout makes once an order is placed.",
+	})
+	abandonedCartScanErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Name:      "abandoned_cart_scan_errors_total",
+		Help:      "Number of failed scans for abandoned carts.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(abandonedCarts, abandonedCartItems, cartsEmptied, abandonedCartScanErrors)
+}
+
+// idleCart is a cart found by an idleCartFinder.
+type idleCart struct {
+	key       string // as returned by cartKey
+	cart      storedCart
+	updatedAt time.Time
+}
+
+// idleCartFinder is implemented by stores that can find carts by when they
+// last changed. Memcached can't list its keys, so it doesn't.
+type idleCartFinder interface {
+	// IdleCarts returns the carts holding items that last changed in
+	// [from, to). Stores stamping carts in Unix seconds compare at that
+	// resolution.
+	IdleCarts(ctx context.Context, from, to time.Time) ([]idleCart, error)
+}
+
+// changedBetween reports whether a cart stamped updatedAt, in Unix seconds,
+// falls in [from, to). Unstamped carts never do.
+func changedBetween(updatedAt int64, from, to time.Time) bool {
+	return updatedAt != 0 && updatedAt >= from.Unix() && updatedAt < to.Unix()
+}
+
+// abandonedCartAfterFromEnv reads ABANDONED_CART_AFTER, how long a cart
+// holding items must go unchanged to count as abandoned. Unset or zero turns
+// detection off.
+func abandonedCartAfterFromEnv() time.Duration {
+	v := os.Getenv("ABANDONED_CART_AFTER")
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid ABANDONED_CART_AFTER %q, abandoned cart detection is off", v)
+		return 0
+	}
+	return d
+}
+
+// abandonedCartScanIntervalFromEnv reads ABANDONED_CART_SCAN_INTERVAL, how
+// often the store is scanned for abandoned carts.
+func abandonedCartScanIntervalFromEnv() time.Duration {
+	v := os.Getenv("ABANDONED_CART_SCAN_INTERVAL")
+	if v == "" {
+		return defaultAbandonedCartScanInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("Ignoring invalid ABANDONED_CART_SCAN_INTERVAL %q, using %v", v, defaultAbandonedCartScanInterval)
+		return defaultAbandonedCartScanInterval
+	}
+	return d
+}
+
+// abandonedCartWatcher periodically looks for carts that went idle since
+// its last scan and reports each with a CartAbandoned event. A cart is
+// reported once per idle spell: changing it and leaving it again reports it
+// again.
+//
+// Carts that went idle before the watcher started, or while the service
+// was down, are not reported. Every replica running a watcher reports the
+// same carts, so either enable it on one replica only or have consumers
+// deduplicate on user, cart and last_updated_at.
+type abandonedCartWatcher struct {
+	finder    idleCartFinder
+	events    eventPublisher // nil leaves only metrics and logs
+	idleAfter time.Duration
+
+	// scannedTo is where the next scan's window starts.
+	scannedTo time.Time
+}
+
+func newAbandonedCartWatcher(finder idleCartFinder, events eventPublisher, idleAfter time.Duration, now time.Time) *abandonedCartWatcher {
+	return &abandonedCartWatcher{finder: finder, events: events, idleAfter: idleAfter, scannedTo: now.Add(-idleAfter)}
+}
+
+// run scans every interval until ctx is cancelled.
+func (w *abandonedCartWatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := w.scan(ctx, now); err != nil {
+				log.Warnf("Failed to scan for abandoned carts: %v", err)
+			}
+		}
+	}
+}
+
+// scan reports the carts that went idle since the last scan. A failed scan
+// leaves its window to the next one.
+func (w *abandonedCartWatcher) scan(ctx context.Context, now time.Time) error {
+	to := now.Add(-w.idleAfter)
+	carts, err := w.finder.IdleCarts(ctx, w.scannedTo, to)
+	if err != nil {
+		abandonedCartScanErrors.Inc()
+		return err
+	}
+	for _, c := range carts {
+		w.report(ctx, c, now)
+	}
+	w.scannedTo = to
+	return nil
+}
+
+func (w *abandonedCartWatcher) report(ctx context.Context, c idleCart, now time.Time) {
+	userID, cartName := splitCartKey(c.key)
+	var units int32
+	for _, item := range c.cart.Items {
+		units += item.Quantity
+	}
+	log.Infof("Cart abandoned: userID=%s, cart=%s, items=%d, last changed %v", userID, cartName, units, c.updatedAt)
+	abandonedCarts.Inc()
+	abandonedCartItems.Add(float64(units))
+	if w.events == nil {
+		return
+	}
+	w.events.publish(ctx, userID, &pb.CartAbandoned{
+		UserId:        userID,
+		CartName:      eventCartName(cartName),
+		Items:         cartItemsToProto(c.cart.Items),
+		LastUpdatedAt: timestamppb.New(c.updatedAt),
+		OccurredAt:    timestamppb.New(now),
+	})
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestIdleCarts(t *testing.T) {
+	stores := map[string]func(t *testing.T) idleCartFinder{
+		"redis": func(t *testing.T) idleCartFinder {
+			store, mr := newTestRedisStore(t)
+			// Not a cart, so skipped by the scan.
+			mr.Set(store.key(redisIdempotencyKeyPrefix+"user-1:abc"), "1")
+			return store
+		},
+		"memory":   func(*testing.T) idleCartFinder { return newMemoryCartStore() },
+		"postgres": func(t *testing.T) idleCartFinder { return newTestPostgresStore(t) },
+		"spanner":  func(t *testing.T) idleCartFinder { return newTestSpannerStore(t) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			finder := newStore(t)
+			store := finder.(cartStore)
+			ctx := context.Background()
+			for _, key := range []string{"user-1", "user-1:gifts", "user-2"} {
+				if err := store.AddItem(ctx, key, "OLJCESPC7Z", 1, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.EmptyCart(ctx, "user-2"); err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Now()
+			carts, err := finder.IdleCarts(ctx, now.Add(-time.Minute), now.Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, c := range carts {
+				keys = append(keys, c.key)
+				if len(c.cart.Items) != 1 || c.cart.Items[0].ProductID != "OLJCESPC7Z" {
+					t.Errorf("%s: got items %v", c.key, c.cart.Items)
+				}
+				if d := now.Sub(c.updatedAt); d < -time.Second || d > time.Minute {
+					t.Errorf("%s: updatedAt %v, want about %v", c.key, c.updatedAt, now)
+				}
+			}
+			// Later writes to the store leave the returned carts alone.
+			if err := store.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range carts {
+				if q := c.cart.Items[0].Quantity; q != 1 {
+					t.Errorf("%s: returned quantity changed to %d by a later write", c.key, q)
+				}
+			}
+			sort.Strings(keys)
+			if want := []string{"user-1", "user-1:gifts"}; len(keys) != 2 || keys[0] != want[0] || keys[1] != want[1] {
+				t.Errorf("got idle carts %v, want %v", keys, want)
+			}
+
+			carts, err = finder.IdleCarts(ctx, now.Add(-time.Hour), now.Add(-time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(carts) != 0 {
+				t.Errorf("carts changed now reported as idle an hour ago: %v", carts)
+			}
+		})
+	}
+}
+
+func TestAbandonedCartWatcher(t *testing.T) {
+	store := newMemoryCartStore()
+	ctx := context.Background()
+	if err := store.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddItem(ctx, "user-1:gifts", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	events := &fakePublisher{}
+	start := time.Now()
+	w := newAbandonedCartWatcher(store, events, time.Hour, start)
+	before, beforeItems := testutil.ToFloat64(abandonedCarts), testutil.ToFloat64(abandonedCartItems)
+
+	// Not idle for an hour yet.
+	if err := w.scan(ctx, start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.events) != 0 {
+		t.Fatalf("got %d events before carts went idle", len(events.events))
+	}
+
+	later := start.Add(time.Hour + 2*time.Second)
+	if err := w.scan(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]*pb.CartAbandoned{}
+	for _, e := range events.events {
+		event := e.event.(*pb.CartAbandoned)
+		if e.key != event.UserId {
+			t.Errorf("event keyed %q, want user %q", e.key, event.UserId)
+		}
+		got[event.UserId+"/"+event.CartName] = event
+	}
+	if len(got) != 2 || got["user-1/"] == nil || got["user-1/gifts"] == nil {
+		t.Fatalf("got events %v, want one each for user-1's default and gifts carts", got)
+	}
+	if items := got["user-1/"].Items; len(items) != 1 || items[0].Quantity != 2 {
+		t.Errorf("default cart event has items %v", items)
+	}
+	if at := got["user-1/"].OccurredAt.AsTime(); !at.Equal(later) {
+		t.Errorf("occurred_at = %v, want %v", at, later)
+	}
+	if d := testutil.ToFloat64(abandonedCarts) - before; d != 2 {
+		t.Errorf("abandoned_carts_total went up by %v, want 2", d)
+	}
+	if d := testutil.ToFloat64(abandonedCartItems) - beforeItems; d != 3 {
+		t.Errorf("abandoned_cart_items_total went up by %v, want 3", d)
+	}
+
+	// Each idle spell is reported once.
+	if err := w.scan(ctx, later.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.events) != 2 {
+		t.Errorf("got %d events after rescanning, want the same 2", len(events.events))
+	}
+}
+
+func TestAbandonedCartWatcherWithRedisAuditLog(t *testing.T) {
+	t.Setenv("CART_AUDIT_LOG", "redis")
+	store, mr := newTestRedisStore(t)
+	srv := &cartServer{store: store, audit: newAuditLogFromEnv(store)}
+	ctx := context.Background()
+	if _, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	// A stream where audit logs used to be written, under the cart prefix.
+	mr.XAdd(store.key("audit:user-1"), "*", []string{redisAuditField, "x"})
+
+	events := &fakePublisher{}
+	start := time.Now()
+	w := newAbandonedCartWatcher(store, events, time.Hour, start)
+	if err := w.scan(ctx, start.Add(time.Hour+2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.events) != 1 || events.events[0].key != "user-1" {
+		t.Errorf("got events %v, want one for user-1", events.events)
+	}
+}
+
+type failingFinder struct {
+	err   error
+	froms []time.Time
+}
+
+func (f *failingFinder) IdleCarts(ctx context.Context, from, to time.Time) ([]idleCart, error) {
+	f.froms = append(f.froms, from)
+	return nil, f.err
+}
+
+func TestAbandonedCartWatcherRetriesFailedWindow(t *testing.T) {
+	finder := &failingFinder{err: errors.New("store down")}
+	start := time.Now()
+	w := newAbandonedCartWatcher(finder, nil, time.Hour, start)
+	ctx := context.Background()
+	before := testutil.ToFloat64(abandonedCartScanErrors)
+
+	if err := w.scan(ctx, start.Add(time.Minute)); err == nil {
+		t.Fatal("scan succeeded against a failing store")
+	}
+	finder.err = nil
+	if err := w.scan(ctx, start.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.scan(ctx, start.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{start.Add(-time.Hour), start.Add(-time.Hour), start.Add(2*time.Minute - time.Hour)}
+	for i := range want {
+		if !finder.froms[i].Equal(want[i]) {
+			t.Errorf("scan %d started at %v, want %v", i, finder.froms[i], want[i])
+		}
+	}
+	if d := testutil.ToFloat64(abandonedCartScanErrors) - before; d != 1 {
+		t.Errorf("abandoned_cart_scan_errors_total went up by %v, want 1", d)
+	}
+}
+
+func TestAbandonedCartAfterFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"2h", 2 * time.Hour},
+		{"0", 0},
+		{"-1h", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("ABANDONED_CART_AFTER", tt.value)
+		if got := abandonedCartAfterFromEnv(); got != tt.want {
+			t.Errorf("ABANDONED_CART_AFTER=%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
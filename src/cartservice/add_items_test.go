@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func cartQuantities(t *testing.T, store cartStore, userID string) map[string]int32 {
+	t.Helper()
+	cart, err := store.GetCart(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int32)
+	for _, item := range cart.GetItems() {
+		got[item.GetProductId()] = item.GetQuantity()
+	}
+	return got
+}
+
+func TestAddItems(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			if err := store.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			price := &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}
+			if err := store.AddItems(ctx, "user-1", []*pb.CartItem{
+				{ProductId: "OLJCESPC7Z", Quantity: 2},
+				{ProductId: "66VCHSJNUP", Quantity: 1, PriceSnapshot: price},
+				{ProductId: "OLJCESPC7Z", Quantity: 3},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]int32{"OLJCESPC7Z": 6, "66VCHSJNUP": 1}
+			if got := cartQuantities(t, store, "user-1"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			cart, err := store.GetCart(ctx, "user-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range cart.GetItems() {
+				if item.GetProductId() == "66VCHSJNUP" && item.GetPriceSnapshot().GetUnits() != 19 {
+					t.Errorf("price snapshot = %v, want %v", item.GetPriceSnapshot(), price)
+				}
+			}
+		})
+	}
+}
+
+func TestAddItemsLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		items      []*pb.CartItem
+		wantReason string
+	}{
+		{"fits", []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 4}, {ProductId: "66VCHSJNUP", Quantity: 5}}, ""},
+		{"too many products", []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}, {ProductId: "1YMWWN1N4O", Quantity: 1}}, reasonCartItemsLimit},
+		{"repeated product over cap", []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 3}, {ProductId: "OLJCESPC7Z", Quantity: 3}}, reasonItemQuantityLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := &cartServer{store: newMemoryCartStore(), maxItemQuantity: 5, maxCartItems: 2}
+			if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}}); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := s.AddItems(ctx, &pb.AddItemsRequest{UserId: "user-1", Items: tt.items})
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if got, want := status.Code(err), codes.ResourceExhausted; got != want {
+				t.Fatalf("got %s (%v), want %s", got, err, want)
+			}
+			if reason, _ := cartLimitReason(t, err); reason != tt.wantReason {
+				t.Errorf("reason = %s, want %s", reason, tt.wantReason)
+			}
+			// Nothing from a rejected batch may be added.
+			if got, want := cartQuantities(t, s.store, "user-1"), map[string]int32{"OLJCESPC7Z": 1}; !reflect.DeepEqual(got, want) {
+				t.Errorf("cart after rejected batch = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAddItemsRedisConcurrent(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	ctx := context.Background()
+
+	const workers = 8
+	var wg sync.WaitGroup
+	committed := make([]bool, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := store.AddItems(ctx, "user-1", []*pb.CartItem{
+				{ProductId: "OLJCESPC7Z", Quantity: 1},
+				{ProductId: fmt.Sprintf("product-%d", i), Quantity: 2},
+			})
+			if err != nil {
+				if got := status.Code(err); got != codes.Aborted {
+					t.Errorf("AddItems: got %s, want OK or %s", got, codes.Aborted)
+				}
+				return
+			}
+			committed[i] = true
+		}(i)
+	}
+	wg.Wait()
+
+	// Each batch must land whole or not at all.
+	got := cartQuantities(t, store, "user-1")
+	var n int32
+	for i, ok := range committed {
+		want := int32(0)
+		if ok {
+			want = 2
+			n++
+		}
+		if q := got[fmt.Sprintf("product-%d", i)]; q != want {
+			t.Errorf("product-%d quantity = %d, want %d", i, q, want)
+		}
+	}
+	if got["OLJCESPC7Z"] != n {
+		t.Errorf("OLJCESPC7Z quantity = %d, want %d (committed batches)", got["OLJCESPC7Z"], n)
+	}
+	if n == 0 {
+		t.Error("no AddItems call committed")
+	}
+}
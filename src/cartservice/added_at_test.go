@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAddedAt(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			before := time.Now().Unix()
+			if err := store.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			after := time.Now().Unix()
+
+			// Adding more, changing the quantity and merging in an older
+			// line must all keep the first added-at time.
+			if err := store.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.UpdateItemQuantity(ctx, "user-1", "OLJCESPC7Z", 5); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.ImportCart(ctx, "guest", storedCart{Items: []cartItem{{ProductID: "OLJCESPC7Z", Quantity: 1, AddedAt: 1000}}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.MergeCarts(ctx, "guest", "user-1"); err != nil {
+				t.Fatal(err)
+			}
+
+			cart, err := store.GetCart(ctx, "user-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			item := cart.GetItems()[0]
+			if item.GetQuantity() != 6 {
+				t.Errorf("got quantity %d, want 6", item.GetQuantity())
+			}
+			if got := item.GetAddedAt().GetSeconds(); got < before || got > after {
+				t.Errorf("added_at = %d, want between %d and %d", got, before, after)
+			}
+		})
+	}
+}
+
+func TestAddedAtUnsetForLegacyItems(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	if err := mr.Set(store.key("user-1"), `[{"product_id":"OLJCESPC7Z","quantity":1}]`); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := store.GetCart(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cart.GetItems()[0].GetAddedAt(); got != nil {
+		t.Errorf("added_at = %v, want unset", got)
+	}
+}
+
+func TestMergeCartLineKeepsFirstMetadata(t *testing.T) {
+	snapshot := &priceSnapshot{CurrencyCode: "USD", Units: 5}
+	tests := []struct {
+		name string
+		cart []cartItem
+		line cartItem
+		want cartItem
+	}{
+		{"new line", nil,
+			cartItem{ProductID: "A", Quantity: 1, PriceSnapshot: snapshot, AddedAt: 200},
+			cartItem{ProductID: "A", Quantity: 1, PriceSnapshot: snapshot, AddedAt: 200}},
+		{"existing line wins", []cartItem{{ProductID: "A", Quantity: 1, AddedAt: 100}},
+			cartItem{ProductID: "A", Quantity: 2, PriceSnapshot: snapshot, AddedAt: 200},
+			cartItem{ProductID: "A", Quantity: 3, PriceSnapshot: snapshot, AddedAt: 100}},
+		{"legacy line takes added_at", []cartItem{{ProductID: "A", Quantity: 1}},
+			cartItem{ProductID: "A", Quantity: 1, AddedAt: 200},
+			cartItem{ProductID: "A", Quantity: 2, AddedAt: 200}},
+	}
+	for _, tt := range tests {
+		got := mergeCartLine(tt.cart, tt.line)
+		if len(got) != 1 || got[0].ProductID != tt.want.ProductID || got[0].Quantity != tt.want.Quantity ||
+			got[0].PriceSnapshot != tt.want.PriceSnapshot || got[0].AddedAt != tt.want.AddedAt {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
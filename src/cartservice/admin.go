@@ -0,0 +1,186 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 1000
+	defaultTopProducts   = 10
+
+	// statsPageSize is how many carts GetCartStats reads at a time.
+	statsPageSize = 500
+)
+
+// cartLister is implemented by stores that can page through every cart.
+// Memcached can't list its keys, so it doesn't.
+type cartLister interface {
+	// ListCartKeys returns the keys of up to about pageSize carts following
+	// pageToken, and the token of the next page, empty after the last.
+	ListCartKeys(ctx context.Context, pageToken string, pageSize int) ([]string, string, error)
+}
+
+// adminTokenFromEnv reads ADMIN_TOKEN, which turns on CartAdminService for
+// callers presenting it. Unset leaves the service off.
+func adminTokenFromEnv() string {
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// adminAuthInterceptor rejects CartAdminService calls that don't carry
+// token as "authorization: Bearer <token>" metadata. Other services' calls
+// pass through.
+func adminAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+	prefix := "/" + pb.CartAdminService_ServiceDesc.ServiceName + "/"
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, prefix) {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if got, ok := strings.CutPrefix(v, "Bearer "); ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "a valid admin token is required")
+	}
+}
+
+// cartAdminServer implements CartAdminService over the store.
+type cartAdminServer struct {
+	pb.UnimplementedCartAdminServiceServer
+	store cartStore
+}
+
+func (s *cartAdminServer) lister() (cartLister, error) {
+	lister, ok := s.store.(cartLister)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "this cart store can't list carts")
+	}
+	return lister, nil
+}
+
+// page reads one page of carts.
+func (s *cartAdminServer) page(ctx context.Context, lister cartLister, pageToken string, pageSize int) ([]*pb.Cart, string, error) {
+	keys, next, err := lister.ListCartKeys(ctx, pageToken, pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) == 0 {
+		return nil, next, nil
+	}
+	carts, err := s.store.GetCarts(ctx, keys)
+	return carts, next, err
+}
+
+func (s *cartAdminServer) ListCarts(ctx context.Context, req *pb.AdminListCartsRequest) (*pb.AdminListCartsResponse, error) {
+	pageSize := int(req.GetPageSize())
+	switch {
+	case pageSize < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "page_size must not be negative, got %d", pageSize)
+	case pageSize == 0:
+		pageSize = defaultAdminPageSize
+	case pageSize > maxAdminPageSize:
+		pageSize = maxAdminPageSize
+	}
+	lister, err := s.lister()
+	if err != nil {
+		return nil, err
+	}
+	carts, next, err := s.page(ctx, lister, req.GetPageToken(), pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AdminListCartsResponse{Carts: carts, NextPageToken: next}, nil
+}
+
+// GetCartStats reads every cart, so its cost grows with the store.
+func (s *cartAdminServer) GetCartStats(ctx context.Context, req *pb.GetCartStatsRequest) (*pb.CartStats, error) {
+	top := int(req.GetTopProducts())
+	switch {
+	case top < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "top_products must not be negative, got %d", top)
+	case top == 0:
+		top = defaultTopProducts
+	}
+	lister, err := s.lister()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		stats    pb.CartStats
+		units    int64
+		products = make(map[string]*pb.ProductCount)
+	)
+	token := ""
+	for {
+		carts, next, err := s.page(ctx, lister, token, statsPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, cart := range carts {
+			stats.CartCount++
+			for _, item := range cart.GetItems() {
+				units += int64(item.GetQuantity())
+				p, ok := products[item.GetProductId()]
+				if !ok {
+					p = &pb.ProductCount{ProductId: item.GetProductId()}
+					products[item.GetProductId()] = p
+				}
+				p.Quantity += int64(item.GetQuantity())
+				p.Carts++
+			}
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if stats.CartCount > 0 {
+		stats.AverageItems = float64(units) / float64(stats.CartCount)
+	}
+	for _, p := range products {
+		stats.TopProducts = append(stats.TopProducts, p)
+	}
+	sort.Slice(stats.TopProducts, func(i, j int) bool {
+		a, b := stats.TopProducts[i], stats.TopProducts[j]
+		if a.Quantity != b.Quantity {
+			return a.Quantity > b.Quantity
+		}
+		if a.Carts != b.Carts {
+			return a.Carts > b.Carts
+		}
+		return a.ProductId < b.ProductId
+	})
+	if len(stats.TopProducts) > top {
+		stats.TopProducts = stats.TopProducts[:top]
+	}
+	return &stats, nil
+}
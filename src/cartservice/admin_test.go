@@ -0,0 +1,224 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestAdminAuth(t *testing.T) {
+	store := newMemoryCartStore()
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(adminAuthInterceptor("s3cret")))
+	pb.RegisterCartServiceServer(srv, &cartServer{store: store})
+	pb.RegisterCartAdminServiceServer(srv, &cartAdminServer{store: store})
+	conn := newTestGRPCConn(t, srv)
+	admin := pb.NewCartAdminServiceClient(conn)
+
+	tests := []struct {
+		name     string
+		md       []string
+		wantCode codes.Code
+	}{
+		{"no token", nil, codes.Unauthenticated},
+		{"wrong token", []string{"authorization", "Bearer guess"}, codes.Unauthenticated},
+		{"token without scheme", []string{"authorization", "s3cret"}, codes.Unauthenticated},
+		{"valid token", []string{"authorization", "Bearer s3cret"}, codes.OK},
+	}
+	for _, tt := range tests {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), tt.md...)
+		_, err := admin.GetCartStats(ctx, &pb.GetCartStatsRequest{})
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("%s: got %s, want %s", tt.name, code, tt.wantCode)
+		}
+	}
+
+	// CartService itself needs no token.
+	if _, err := pb.NewCartServiceClient(conn).GetCart(context.Background(), &pb.GetCartRequest{UserId: "user-1"}); err != nil {
+		t.Errorf("GetCart without a token: %v", err)
+	}
+}
+
+func TestAdminListCarts(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			admin := &cartAdminServer{store: store}
+			ctx := context.Background()
+			if rs, ok := store.(*redisCartStore); ok {
+				// Shares the keyspace, but isn't a cart.
+				if err := rs.client.Set(ctx, rs.key(redisIdempotencyKeyPrefix+"user-0:abc"), "1", 0).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var want []string
+			for i := 0; i < 7; i++ {
+				key := fmt.Sprintf("user-%d", i)
+				if err := store.AddItem(ctx, key, "OLJCESPC7Z", int32(i+1), nil); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, key)
+			}
+
+			seen := map[string]int32{}
+			req := &pb.AdminListCartsRequest{PageSize: 3}
+			for pages := 0; ; pages++ {
+				if pages > 20 {
+					t.Fatal("paging never ended")
+				}
+				resp, err := admin.ListCarts(ctx, req)
+				if status.Code(err) == codes.Unimplemented {
+					t.Skip(err)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(resp.Carts) > 3 && name != "redis" {
+					t.Errorf("got %d carts in a page of 3", len(resp.Carts))
+				}
+				for _, cart := range resp.Carts {
+					seen[cart.UserId] = cart.Items[0].Quantity
+				}
+				if resp.NextPageToken == "" {
+					break
+				}
+				req.PageToken = resp.NextPageToken
+			}
+			var got []string
+			for key := range seen {
+				got = append(got, key)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("listed %v, want %v", got, want)
+			}
+			if seen["user-4"] != 5 {
+				t.Errorf("user-4's cart holds %d, want 5", seen["user-4"])
+			}
+		})
+	}
+}
+
+func TestAdminListCartsValidation(t *testing.T) {
+	admin := &cartAdminServer{store: newMemoryCartStore()}
+	ctx := context.Background()
+	if _, err := admin.ListCarts(ctx, &pb.AdminListCartsRequest{PageSize: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("negative page_size: got %v, want InvalidArgument", err)
+	}
+
+	redisStore, _ := newTestRedisStore(t)
+	admin = &cartAdminServer{store: redisStore}
+	if _, err := admin.ListCarts(ctx, &pb.AdminListCartsRequest{PageToken: "not-a-cursor"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("bad page_token: got %v, want InvalidArgument", err)
+	}
+
+	memcachedStore, _ := newTestMemcachedStore(t)
+	admin = &cartAdminServer{store: memcachedStore}
+	if _, err := admin.ListCarts(ctx, &pb.AdminListCartsRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("memcached: got %v, want Unimplemented", err)
+	}
+}
+
+func TestAdminCartStats(t *testing.T) {
+	store := newMemoryCartStore()
+	ctx := context.Background()
+	for _, add := range []struct {
+		user, product string
+		quantity      int32
+	}{
+		{"user-1", "OLJCESPC7Z", 3},
+		{"user-1", "66VCHSJNUP", 1},
+		{"user-2", "OLJCESPC7Z", 1},
+		{"user-2", "1YMWWN1N4O", 4},
+		{"user-3", "66VCHSJNUP", 2},
+	} {
+		if err := store.AddItem(ctx, add.user, add.product, add.quantity, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.EmptyCart(ctx, "user-3"); err != nil {
+		t.Fatal(err)
+	}
+	admin := &cartAdminServer{store: store}
+
+	stats, err := admin.GetCartStats(ctx, &pb.GetCartStatsRequest{TopProducts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CartCount != 3 {
+		t.Errorf("cart_count = %d, want 3", stats.CartCount)
+	}
+	if stats.AverageItems != 3 {
+		t.Errorf("average_items = %v, want 3", stats.AverageItems)
+	}
+	want := []*pb.ProductCount{
+		{ProductId: "OLJCESPC7Z", Quantity: 4, Carts: 2},
+		{ProductId: "1YMWWN1N4O", Quantity: 4, Carts: 1},
+	}
+	if len(stats.TopProducts) != len(want) {
+		t.Fatalf("got top products %v, want %v", stats.TopProducts, want)
+	}
+	for i := range want {
+		got := stats.TopProducts[i]
+		if got.ProductId != want[i].ProductId || got.Quantity != want[i].Quantity || got.Carts != want[i].Carts {
+			t.Errorf("top_products[%d] = %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestAdminSkipsArchivedCarts(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	srv := &cartServer{store: store, archive: newCartArchive(store, time.Hour)}
+	ctx := context.Background()
+	for _, req := range []*pb.AddItemRequest{
+		{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2}},
+		{UserId: "user-2", Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 1}},
+	} {
+		if _, err := srv.AddItem(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "user-1", Archive: true}); err != nil {
+		t.Fatal(err)
+	}
+	admin := &cartAdminServer{store: store}
+
+	list, err := admin.ListCarts(ctx, &pb.AdminListCartsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cart := range list.Carts {
+		if cart.UserId != "user-1" && cart.UserId != "user-2" {
+			t.Errorf("listed %q, which isn't a cart", cart.UserId)
+		}
+	}
+	stats, err := admin.GetCartStats(ctx, &pb.GetCartStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.TopProducts) != 1 || stats.TopProducts[0].ProductId != "66VCHSJNUP" {
+		t.Errorf("got top products %v, want only user-2's item, not the archived cart's", stats.TopProducts)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// defaultCartArchiveTTL is how long an emptied cart can be restored unless
+// CART_ARCHIVE_TTL says otherwise.
+const defaultCartArchiveTTL = time.Hour
+
+// cartArchive keeps the items of carts emptied with EmptyCart's archive
+// set, one archive per cart, until they expire or are restored.
+type cartArchive interface {
+	// save archives cart's items, replacing any earlier archive of it.
+	save(ctx context.Context, key string, cart storedCart) error
+	// take removes cart's archive and returns it, or false if there is
+	// none.
+	take(ctx context.Context, key string) (storedCart, bool, error)
+}
+
+// cartArchiveTTLFromEnv parses CART_ARCHIVE_TTL. Zero turns archiving off:
+// EmptyCart then ignores archive and RestoreLastCart fails.
+func cartArchiveTTLFromEnv() time.Duration {
+	v := os.Getenv("CART_ARCHIVE_TTL")
+	if v == "" {
+		return defaultCartArchiveTTL
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid CART_ARCHIVE_TTL %q, using %v", v, defaultCartArchiveTTL)
+		return defaultCartArchiveTTL
+	}
+	return d
+}
+
+// newCartArchive picks the archive matching the store so that any replica
+// can restore a cart another emptied when carts live in Redis. A store that
+// fell back to memory gets one that follows it back to Redis.
+func newCartArchive(store cartStore, ttl time.Duration) cartArchive {
+	switch store := store.(type) {
+	case *redisCartStore:
+		return &redisCartArchive{client: store.client, prefix: store.keyPrefix, ttl: ttl}
+	case *failoverCartStore:
+		return &failoverCartArchive{archives: newPerActiveStore(store, func(active cartStore) cartArchive {
+			return newCartArchive(active, ttl)
+		})}
+	}
+	return &memoryCartArchive{ttl: ttl, carts: make(map[string]archivedCart)}
+}
+
+// failoverCartArchive uses the archive of the store a failoverCartStore is
+// using. Carts archived in memory can't be restored once it moves to Redis,
+// like the carts themselves unless they are replayed.
+type failoverCartArchive struct {
+	archives *perActiveStore[cartArchive]
+}
+
+func (a *failoverCartArchive) save(ctx context.Context, key string, cart storedCart) error {
+	return a.archives.get().save(ctx, key, cart)
+}
+
+func (a *failoverCartArchive) take(ctx context.Context, key string) (storedCart, bool, error) {
+	return a.archives.get().take(ctx, key)
+}
+
+// redisCartArchive stores each archive under a key named for when it was
+// made, found through a pointer key holding that name. Both expire after
+// ttl.
+type redisCartArchive struct {
+	client redis.UniversalClient
+	prefix string // the store's REDIS_KEY_PREFIX
+	ttl    time.Duration
+}
+
+// redisArchiveKeyPrefix follows the store's prefix on archive keys and
+// their pointers.
+const redisArchiveKeyPrefix = redisAuxKeyPrefix + "archive:"
+
+// lastKey is the pointer to cart's latest archive. Archive keys end in a
+// timestamp, so they never take the form of a pointer.
+func (a *redisCartArchive) lastKey(key string) string {
+	return a.prefix + redisArchiveKeyPrefix + key + ":last"
+}
+
+func (a *redisCartArchive) save(ctx context.Context, key string, cart storedCart) error {
+	data, err := json.Marshal(cart)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to encode archived cart: %v", err)
+	}
+	archiveKey := a.prefix + redisArchiveKeyPrefix + key + ":" + strconv.FormatInt(time.Now().UnixMilli(), 10)
+	// Two commands rather than a transaction, as the keys may be on
+	// different cluster slots. The archive is written first so the
+	// pointer never names a key that was not there.
+	if err := a.client.Set(ctx, archiveKey, data, a.ttl).Err(); err != nil {
+		return status.Errorf(codes.Internal, "failed to archive cart: %v", err)
+	}
+	if err := a.client.Set(ctx, a.lastKey(key), archiveKey, a.ttl).Err(); err != nil {
+		return status.Errorf(codes.Internal, "failed to archive cart: %v", err)
+	}
+	return nil
+}
+
+func (a *redisCartArchive) take(ctx context.Context, key string) (storedCart, bool, error) {
+	// GETDEL on the pointer, so that of two concurrent restores only one
+	// gets the archive.
+	archiveKey, err := a.client.GetDel(ctx, a.lastKey(key)).Result()
+	if err == redis.Nil {
+		return storedCart{}, false, nil
+	}
+	if err != nil {
+		return storedCart{}, false, status.Errorf(codes.Internal, "failed to read archived cart: %v", err)
+	}
+	data, err := a.client.GetDel(ctx, archiveKey).Bytes()
+	if err == redis.Nil {
+		return storedCart{}, false, nil
+	}
+	if err != nil {
+		return storedCart{}, false, status.Errorf(codes.Internal, "failed to read archived cart: %v", err)
+	}
+	var cart storedCart
+	if err := json.Unmarshal(data, &cart); err != nil {
+		return storedCart{}, false, status.Errorf(codes.Internal, "failed to decode archived cart: %v", err)
+	}
+	return cart, true, nil
+}
+
+type archivedCart struct {
+	cart    storedCart
+	expires time.Time
+}
+
+// memoryCartArchive keeps archives in this replica only.
+type memoryCartArchive struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	carts map[string]archivedCart
+}
+
+func (a *memoryCartArchive) save(_ context.Context, key string, cart storedCart) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for k, archived := range a.carts {
+		if !now.Before(archived.expires) {
+			delete(a.carts, k)
+		}
+	}
+	a.carts[key] = archivedCart{cart: cart, expires: now.Add(a.ttl)}
+	return nil
+}
+
+func (a *memoryCartArchive) take(_ context.Context, key string) (storedCart, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	archived, ok := a.carts[key]
+	delete(a.carts, key)
+	if !ok || !time.Now().Before(archived.expires) {
+		return storedCart{}, false, nil
+	}
+	return archived.cart, true, nil
+}
+
+// emptyAndArchive empties the cart with key cart, keeping its items in the
+// archive first. Items added between reading the cart and emptying it are
+// emptied without being archived. The cart is already empty if archiving
+// fails, so that is only logged.
+func (s *cartServer) emptyAndArchive(ctx context.Context, key string, empty func() error) error {
+	cart, err := s.store.ExportCart(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := empty(); err != nil {
+		return err
+	}
+	if len(cart.Items) == 0 {
+		return nil
+	}
+	if err := s.archive.save(ctx, key, storedCart{Currency: cart.Currency, Items: cart.Items}); err != nil {
+		log.Warnf("Failed to archive emptied cart %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *cartServer) RestoreLastCart(ctx context.Context, req *pb.RestoreLastCartRequest) (*pb.RestoreLastCartResponse, error) {
+	if s.archive == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cart archiving is off, CART_ARCHIVE_TTL is 0")
+	}
+	key, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	archived, ok, err := s.archive.take(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no emptied cart to restore for user %s", req.UserId)
+	}
+	items := cartItemsToProto(archived.Items)
+	for _, item := range items {
+		// Restored lines count as added now.
+		item.AddedAt = nil
+	}
+	err = s.checkBatchLimits(ctx, key, items)
+	if err == nil {
+		err = s.audited(ctx, "RestoreLastCart", []string{key}, func() error {
+			return s.store.AddItems(ctx, key, items)
+		})
+	}
+	if err != nil {
+		// Put the archive back so the user can try again.
+		if err := s.archive.save(ctx, key, archived); err != nil {
+			log.Warnf("Failed to re-archive cart %s after a failed restore: %v", key, err)
+		}
+		return nil, err
+	}
+	if s.currencyLock {
+		s.lockCartCurrency(ctx, key, archived.Currency)
+	}
+	for _, item := range items {
+		s.publishItemAdded(ctx, req.UserId, req.CartName, item.ProductId, item.Quantity)
+	}
+	return &pb.RestoreLastCartResponse{Items: items}, nil
+}
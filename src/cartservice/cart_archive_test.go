@@ -0,0 +1,201 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// newArchiveTestServers returns servers archiving for ttl in Redis and in
+// memory, and a function moving each one's clock past expiry.
+func newArchiveTestServers(t *testing.T, ttl time.Duration) map[string]func(t *testing.T) (*cartServer, func()) {
+	return map[string]func(t *testing.T) (*cartServer, func()){
+		"redis": func(t *testing.T) (*cartServer, func()) {
+			store, mr := newTestRedisStore(t)
+			srv := &cartServer{store: store, archive: newCartArchive(store, ttl)}
+			return srv, func() { mr.FastForward(ttl) }
+		},
+		"memory": func(t *testing.T) (*cartServer, func()) {
+			store := newMemoryCartStore()
+			srv := &cartServer{store: store, archive: newCartArchive(store, ttl)}
+			return srv, func() { time.Sleep(ttl) }
+		},
+	}
+}
+
+func TestRestoreLastCart(t *testing.T) {
+	for name, newServer := range newArchiveTestServers(t, 50*time.Millisecond) {
+		t.Run(name, func(t *testing.T) {
+			srv, _ := newServer(t)
+			ctx := context.Background()
+			add := func(productID string, quantity int32) {
+				t.Helper()
+				if _, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", Item: &pb.CartItem{ProductId: productID, Quantity: quantity}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			add("A", 2)
+			add("B", 1)
+			if _, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "u1", Archive: true}); err != nil {
+				t.Fatal(err)
+			}
+			if got := cartQuantities(t, srv.store, "u1"); len(got) != 0 {
+				t.Fatalf("cart after EmptyCart holds %v", got)
+			}
+			add("A", 1)
+			add("C", 1)
+
+			resp, err := srv.RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: "u1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Items) != 2 {
+				t.Errorf("restored %v, want A and B", resp.Items)
+			}
+			want := map[string]int32{"A": 3, "B": 1, "C": 1}
+			got := cartQuantities(t, srv.store, "u1")
+			if len(got) != len(want) {
+				t.Errorf("cart holds %v, want %v", got, want)
+			}
+			for id, q := range want {
+				if got[id] != q {
+					t.Errorf("%s: got quantity %d, want %d", id, got[id], q)
+				}
+			}
+
+			// An archive is restored once.
+			_, err = srv.RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: "u1"})
+			if status.Code(err) != codes.NotFound {
+				t.Errorf("second RestoreLastCart: got %v, want NotFound", err)
+			}
+		})
+	}
+}
+
+func TestRestoreLastCartNothingArchived(t *testing.T) {
+	for name, newServer := range newArchiveTestServers(t, 50*time.Millisecond) {
+		t.Run(name, func(t *testing.T) {
+			srv, expire := newServer(t)
+			ctx := context.Background()
+			for _, archive := range []bool{false, true} {
+				if _, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", Item: &pb.CartItem{ProductId: "A", Quantity: 1}}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "u1", Archive: archive}); err != nil {
+					t.Fatal(err)
+				}
+				if archive {
+					expire()
+				}
+				_, err := srv.RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: "u1"})
+				if status.Code(err) != codes.NotFound {
+					t.Errorf("archive %v: got %v, want NotFound", archive, err)
+				}
+			}
+			// Emptying an empty cart archives nothing.
+			if _, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "u2", Archive: true}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := srv.RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: "u2"}); status.Code(err) != codes.NotFound {
+				t.Errorf("empty cart: got %v, want NotFound", err)
+			}
+		})
+	}
+}
+
+func TestRestoreLastCartOverLimit(t *testing.T) {
+	store := newMemoryCartStore()
+	srv := &cartServer{store: store, archive: newCartArchive(store, time.Hour), maxCartItems: 2}
+	ctx := context.Background()
+	add := func(productID string) {
+		t.Helper()
+		if _, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", Item: &pb.CartItem{ProductId: productID, Quantity: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("A")
+	add("B")
+	if _, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "u1", Archive: true}); err != nil {
+		t.Fatal(err)
+	}
+	add("C")
+	if _, err := srv.RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: "u1"}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("restore into a cart without room: got %v, want ResourceExhausted", err)
+	}
+	// The failed restore left the archive in place.
+	if _, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: "u1"}); err != nil {
+		t.Fatalf("restore after making room: %v", err)
+	}
+	if got := cartQuantities(t, srv.store, "u1"); len(got) != 2 || got["A"] != 1 || got["B"] != 1 {
+		t.Errorf("cart holds %v, want A and B", got)
+	}
+}
+
+func TestRestoreLastCartArchivingOff(t *testing.T) {
+	srv := &cartServer{store: newMemoryCartStore()}
+	ctx := context.Background()
+	if _, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "u1", Archive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: "u1"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestRedisCartArchiveKeysExpire(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	archive := newCartArchive(store, time.Minute)
+	if err := archive.save(context.Background(), "u1", storedCart{Items: []cartItem{{ProductID: "A", Quantity: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	keys := mr.Keys()
+	if len(keys) != 2 {
+		t.Fatalf("got keys %v, want an archive and its pointer", keys)
+	}
+	for _, key := range keys {
+		if ttl := mr.TTL(key); ttl != time.Minute {
+			t.Errorf("%s: got TTL %v, want %v", key, ttl, time.Minute)
+		}
+	}
+}
+
+func TestCartArchiveTTLFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", defaultCartArchiveTTL},
+		{"10m", 10 * time.Minute},
+		{"0", 0},
+		{"-1s", defaultCartArchiveTTL},
+		{"soon", defaultCartArchiveTTL},
+	}
+	for _, tt := range tests {
+		t.Setenv("CART_ARCHIVE_TTL", tt.value)
+		if got := cartArchiveTTLFromEnv(); got != tt.want {
+			t.Errorf("CART_ARCHIVE_TTL=%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
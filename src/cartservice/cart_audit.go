@@ -0,0 +1,383 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const (
+	// defaultAuditMaxEntries is how many entries the Redis audit log keeps
+	// per cart unless CART_AUDIT_MAX_ENTRIES says otherwise.
+	defaultAuditMaxEntries = 1000
+
+	defaultCartHistoryLimit = 100
+	maxCartHistoryLimit     = 1000
+)
+
+// auditWriteFailures counts changes made to carts that the audit log
+// failed to record.
+var auditWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Subsystem: "audit",
+	Name:      "write_failures_total",
+	Help:      "Number of cart changes the audit log failed to record.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(auditWriteFailures)
+}
+
+// auditLog is an append-only record of cart changes.
+type auditLog interface {
+	// append records entries, all for the cart with key cart.
+	append(ctx context.Context, cart string, entries []*pb.CartAuditEntry) error
+	// history returns up to limit of the newest entries for cart, newest
+	// first.
+	history(ctx context.Context, cart string, limit int) ([]*pb.CartAuditEntry, error)
+}
+
+// newAuditLogFromEnv reads CART_AUDIT_LOG. "redis" keeps each cart's
+// entries in a Redis stream next to the cart, which needs the Redis store;
+// any other value is the path of a file entries are appended to, one JSON
+// object per line. It returns nil, auditing nothing, when CART_AUDIT_LOG is
+// unset or can't be used.
+func newAuditLogFromEnv(store cartStore) auditLog {
+	v := os.Getenv("CART_AUDIT_LOG")
+	switch {
+	case v == "":
+		return nil
+	case v == "redis":
+		maxEntries := auditMaxEntriesFromEnv()
+		switch store := store.(type) {
+		case *redisCartStore:
+			log.Info("Recording cart changes in Redis streams")
+			return &redisAuditLog{client: store.client, prefix: store.keyPrefix, maxEntries: maxEntries}
+		case *failoverCartStore:
+			if store.backend == backendRedis {
+				log.Info("Recording cart changes in Redis streams once the cart store reconnects to Redis")
+				return &failoverAuditLog{logs: newPerActiveStore(store, func(active cartStore) auditLog {
+					rs, ok := active.(*redisCartStore)
+					if !ok {
+						return nil
+					}
+					return &redisAuditLog{client: rs.client, prefix: rs.keyPrefix, maxEntries: maxEntries}
+				})}
+			}
+		}
+		log.Warn("CART_AUDIT_LOG=redis needs the Redis cart store, the cart audit log is off")
+		return nil
+	}
+	f, err := os.OpenFile(v, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Warnf("Failed to open CART_AUDIT_LOG, the cart audit log is off: %v", err)
+		return nil
+	}
+	log.Infof("Recording cart changes in %s", v)
+	return &fileAuditLog{path: v, f: f}
+}
+
+// auditMaxEntriesFromEnv reads CART_AUDIT_MAX_ENTRIES, how many entries the
+// Redis audit log keeps per cart. Older entries are trimmed as new ones
+// arrive.
+func auditMaxEntriesFromEnv() int64 {
+	v := os.Getenv("CART_AUDIT_MAX_ENTRIES")
+	if v == "" {
+		return defaultAuditMaxEntries
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		log.Warnf("Ignoring invalid CART_AUDIT_MAX_ENTRIES %q, using %d", v, defaultAuditMaxEntries)
+		return defaultAuditMaxEntries
+	}
+	return n
+}
+
+// redisAuditLog keeps each cart's entries in its own stream, trimmed to
+// about maxEntries.
+type redisAuditLog struct {
+	client     redis.UniversalClient
+	prefix     string // the store's REDIS_KEY_PREFIX
+	maxEntries int64
+}
+
+// redisAuditKeyPrefix follows the store's prefix on audit streams.
+const redisAuditKeyPrefix = redisAuxKeyPrefix + "audit:"
+
+// redisAuditField is the stream field holding an encoded CartAuditEntry.
+const redisAuditField = "entry"
+
+func (l *redisAuditLog) key(cart string) string {
+	return l.prefix + redisAuditKeyPrefix + cart
+}
+
+func (l *redisAuditLog) append(ctx context.Context, cart string, entries []*pb.CartAuditEntry) error {
+	_, err := l.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			data, err := proto.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: l.key(cart),
+				MaxLen: l.maxEntries,
+				Approx: true,
+				Values: []interface{}{redisAuditField, data},
+			})
+		}
+		return nil
+	})
+	return err
+}
+
+func (l *redisAuditLog) history(ctx context.Context, cart string, limit int) ([]*pb.CartAuditEntry, error) {
+	msgs, err := l.client.XRevRangeN(ctx, l.key(cart), "+", "-", int64(limit)).Result()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read cart history: %v", err)
+	}
+	entries := make([]*pb.CartAuditEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		data, _ := msg.Values[redisAuditField].(string)
+		entry := new(pb.CartAuditEntry)
+		if err := proto.Unmarshal([]byte(data), entry); err != nil {
+			log.Warnf("Skipping unreadable audit entry %s of %s: %v", msg.ID, cart, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// failoverAuditLog records changes in Redis streams while a
+// failoverCartStore uses Redis, and nothing while it holds carts in memory.
+type failoverAuditLog struct {
+	logs *perActiveStore[auditLog] // nil while on memory
+}
+
+func (l *failoverAuditLog) append(ctx context.Context, cart string, entries []*pb.CartAuditEntry) error {
+	if audit := l.logs.get(); audit != nil {
+		return audit.append(ctx, cart, entries)
+	}
+	return nil
+}
+
+func (l *failoverAuditLog) history(ctx context.Context, cart string, limit int) ([]*pb.CartAuditEntry, error) {
+	audit := l.logs.get()
+	if audit == nil {
+		return nil, status.Error(codes.Unavailable, "cart history is unavailable while carts are held in memory")
+	}
+	return audit.history(ctx, cart, limit)
+}
+
+// fileAuditLog appends entries to a file as JSON lines. Reading a cart's
+// history scans the whole file, which suits debugging rather than serving
+// the history to shoppers.
+type fileAuditLog struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (l *fileAuditLog) append(_ context.Context, cart string, entries []*pb.CartAuditEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		line, err := protojson.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.f.Write(buf)
+	return err
+}
+
+func (l *fileAuditLog) history(_ context.Context, cart string, limit int) ([]*pb.CartAuditEntry, error) {
+	userID, name := splitCartKey(cart)
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read cart history: %v", err)
+	}
+	defer f.Close()
+	// The file is oldest first, so keep the last limit matches.
+	var entries []*pb.CartAuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		entry := new(pb.CartAuditEntry)
+		if err := protojson.Unmarshal(scanner.Bytes(), entry); err != nil {
+			log.Warnf("Skipping unreadable line in %s: %v", l.path, err)
+			continue
+		}
+		if entry.GetUserId() != userID || entry.GetCartName() != eventCartName(name) {
+			continue
+		}
+		if entries = append(entries, entry); len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read cart history: %v", err)
+	}
+	slices.Reverse(entries)
+	return entries, nil
+}
+
+// Close closes the file.
+func (l *fileAuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// audited runs change, made by action to the carts with the given keys,
+// and when the audit log is on records how the quantity of every product it
+// touched moved. The carts are read just before and after change, so a
+// concurrent change to the same cart may be folded into its entries.
+// Auditing is best effort: the change stands even if it can't be recorded.
+func (s *cartServer) audited(ctx context.Context, action string, carts []string, change func() error) error {
+	if s.audit == nil {
+		return change()
+	}
+	before, beforeErr := s.auditSnapshot(ctx, carts)
+	if err := change(); err != nil {
+		return err
+	}
+	record := func() error {
+		if beforeErr != nil {
+			return beforeErr
+		}
+		after, err := s.auditSnapshot(ctx, carts)
+		if err != nil {
+			return err
+		}
+		return s.recordChanges(ctx, action, carts, before, after)
+	}
+	if err := record(); err != nil {
+		auditWriteFailures.Inc()
+		log.Warnf("Failed to audit %s of %v: %v", action, carts, err)
+	}
+	return nil
+}
+
+func (s *cartServer) auditSnapshot(ctx context.Context, carts []string) ([]storedCart, error) {
+	snapshot := make([]storedCart, len(carts))
+	for i, key := range carts {
+		cart, err := s.store.ExportCart(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		snapshot[i] = cart
+	}
+	return snapshot, nil
+}
+
+// recordChanges appends an entry for every product whose quantity differs
+// between before and after, cart by cart.
+func (s *cartServer) recordChanges(ctx context.Context, action string, carts []string, before, after []storedCart) error {
+	now := timestamppb.New(time.Now())
+	var errs []error
+	for i, key := range carts {
+		userID, name := splitCartKey(key)
+		var entries []*pb.CartAuditEntry
+		for _, change := range quantityChanges(before[i].Items, after[i].Items) {
+			entries = append(entries, &pb.CartAuditEntry{
+				UserId:      userID,
+				CartName:    eventCartName(name),
+				Action:      action,
+				ProductId:   change.productID,
+				OldQuantity: change.old,
+				NewQuantity: change.new,
+				Version:     after[i].Version,
+				OccurredAt:  now,
+			})
+		}
+		if len(entries) > 0 {
+			errs = append(errs, s.audit.append(ctx, key, entries))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type quantityChange struct {
+	productID string
+	old, new  int32
+}
+
+// quantityChanges lists the products whose quantity differs between the
+// lines before and after, in the order they appear before and then after.
+func quantityChanges(before, after []cartItem) []quantityChange {
+	old := make(map[string]int32, len(before))
+	for _, item := range before {
+		old[item.ProductID] += item.Quantity
+	}
+	cur := make(map[string]int32, len(after))
+	for _, item := range after {
+		cur[item.ProductID] += item.Quantity
+	}
+	var changes []quantityChange
+	seen := make(map[string]bool, len(old)+len(cur))
+	for _, items := range [][]cartItem{before, after} {
+		for _, item := range items {
+			id := item.ProductID
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if old[id] != cur[id] {
+				changes = append(changes, quantityChange{productID: id, old: old[id], new: cur[id]})
+			}
+		}
+	}
+	return changes
+}
+
+func (s *cartServer) GetCartHistory(ctx context.Context, req *pb.GetCartHistoryRequest) (*pb.GetCartHistoryResponse, error) {
+	if s.audit == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the cart audit log is off, set CART_AUDIT_LOG to turn it on")
+	}
+	key, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultCartHistoryLimit
+	}
+	entries, err := s.audit.history(ctx, key, min(limit, maxCartHistoryLimit))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetCartHistoryResponse{Entries: entries}, nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestQuantityChanges(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after []cartItem
+		want          []quantityChange
+	}{
+		{"no change", []cartItem{{ProductID: "A", Quantity: 1}}, []cartItem{{ProductID: "A", Quantity: 1}}, nil},
+		{"added", nil, []cartItem{{ProductID: "A", Quantity: 2}}, []quantityChange{{"A", 0, 2}}},
+		{"removed", []cartItem{{ProductID: "A", Quantity: 2}}, nil, []quantityChange{{"A", 2, 0}}},
+		{
+			"mixed",
+			[]cartItem{{ProductID: "A", Quantity: 1}, {ProductID: "B", Quantity: 3}},
+			[]cartItem{{ProductID: "C", Quantity: 1}, {ProductID: "B", Quantity: 4}, {ProductID: "A", Quantity: 1}},
+			[]quantityChange{{"B", 3, 4}, {"C", 0, 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quantityChanges(tt.before, tt.after); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCartAudit(t *testing.T) {
+	servers := map[string]func(t *testing.T) *cartServer{
+		"redis": func(t *testing.T) *cartServer {
+			store, _ := newTestRedisStore(t)
+			return &cartServer{store: store, audit: &redisAuditLog{client: store.client, prefix: store.keyPrefix, maxEntries: 100}}
+		},
+		"file": func(t *testing.T) *cartServer {
+			t.Setenv("CART_AUDIT_LOG", filepath.Join(t.TempDir(), "audit.jsonl"))
+			audit := newAuditLogFromEnv(newMemoryCartStore())
+			if audit == nil {
+				t.Fatal("no audit log")
+			}
+			t.Cleanup(func() { audit.(*fileAuditLog).Close() })
+			return &cartServer{store: newMemoryCartStore(), audit: audit}
+		},
+	}
+	for name, newServer := range servers {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer(t)
+			ctx := context.Background()
+			item := func(id string, quantity int32) *pb.CartItem {
+				return &pb.CartItem{ProductId: id, Quantity: quantity}
+			}
+			calls := []func() error{
+				func() error {
+					_, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", Item: item("A", 2)})
+					return err
+				},
+				func() error {
+					_, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", Item: item("A", 1)})
+					return err
+				},
+				func() error {
+					_, err := srv.UpdateItemQuantity(ctx, &pb.UpdateItemQuantityRequest{UserId: "u1", ProductId: "A", Quantity: 5})
+					return err
+				},
+				func() error {
+					_, err := srv.AddItems(ctx, &pb.AddItemsRequest{UserId: "u1", Items: []*pb.CartItem{item("B", 1)}})
+					return err
+				},
+				func() error {
+					_, err := srv.SaveForLater(ctx, &pb.SaveForLaterRequest{UserId: "u1", ProductId: "B"})
+					return err
+				},
+				// Other carts have their own history.
+				func() error {
+					_, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", CartName: "wishlist", Item: item("C", 1)})
+					return err
+				},
+				func() error {
+					_, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u2", Item: item("C", 1)})
+					return err
+				},
+				func() error {
+					_, err := srv.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "u1"})
+					return err
+				},
+			}
+			for i, call := range calls {
+				if err := call(); err != nil {
+					t.Fatalf("call %d: %v", i, err)
+				}
+			}
+			// A change that fails records nothing.
+			stale := int64(1)
+			_, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", Item: item("A", 1), ExpectedVersion: &stale})
+			if status.Code(err) != codes.Aborted {
+				t.Fatalf("AddItem at a stale version: got %v, want Aborted", err)
+			}
+
+			type change struct {
+				action    string
+				productID string
+				old, new  int32
+			}
+			want := []change{
+				{"EmptyCart", "A", 5, 0},
+				{"SaveForLater", "B", 1, 0},
+				{"AddItems", "B", 0, 1},
+				{"UpdateItemQuantity", "A", 3, 5},
+				{"AddItem", "A", 2, 3},
+				{"AddItem", "A", 0, 2},
+			}
+			history, err := srv.GetCartHistory(ctx, &pb.GetCartHistoryRequest{UserId: "u1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []change
+			for _, e := range history.Entries {
+				if e.UserId != "u1" || e.CartName != "" || e.OccurredAt == nil || e.Version == 0 {
+					t.Errorf("unexpected entry %v", e)
+				}
+				got = append(got, change{e.Action, e.ProductId, e.OldQuantity, e.NewQuantity})
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("got history %v, want %v", got, want)
+			}
+
+			limited, err := srv.GetCartHistory(ctx, &pb.GetCartHistoryRequest{UserId: "u1", Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(limited.Entries) != 2 || !proto.Equal(limited.Entries[0], history.Entries[0]) || !proto.Equal(limited.Entries[1], history.Entries[1]) {
+				t.Errorf("limit 2 got %v, want the 2 newest entries", limited.Entries)
+			}
+
+			named, err := srv.GetCartHistory(ctx, &pb.GetCartHistoryRequest{UserId: "u1", CartName: "wishlist"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(named.Entries) != 1 || named.Entries[0].CartName != "wishlist" || named.Entries[0].ProductId != "C" {
+				t.Errorf("wishlist history got %v, want one entry adding C", named.Entries)
+			}
+		})
+	}
+}
+
+func TestCartAuditMergeCarts(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	srv := &cartServer{store: store, audit: &redisAuditLog{client: store.client, prefix: store.keyPrefix, maxEntries: 100}}
+	ctx := context.Background()
+	for _, user := range []string{"guest", "member"} {
+		if _, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: user, Item: &pb.CartItem{ProductId: "A", Quantity: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := srv.MergeCarts(ctx, &pb.MergeCartsRequest{FromUserId: "guest", ToUserId: "member"}); err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string][2]int32{"guest": {1, 0}, "member": {1, 2}} {
+		history, err := srv.GetCartHistory(ctx, &pb.GetCartHistoryRequest{UserId: user, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := history.Entries[0]
+		if e.Action != "MergeCarts" || e.OldQuantity != want[0] || e.NewQuantity != want[1] {
+			t.Errorf("%s: got %s %d→%d, want MergeCarts %d→%d", user, e.Action, e.OldQuantity, e.NewQuantity, want[0], want[1])
+		}
+	}
+}
+
+func TestCartAuditRedisTrim(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	srv := &cartServer{store: store, audit: &redisAuditLog{client: store.client, prefix: store.keyPrefix, maxEntries: 3}}
+	ctx := context.Background()
+	for i := range 10 {
+		if _, err := srv.AddItem(ctx, &pb.AddItemRequest{UserId: "u1", Item: &pb.CartItem{ProductId: "A", Quantity: 1}}); err != nil {
+			t.Fatalf("add %d: %v", i, err)
+		}
+	}
+	history, err := srv.GetCartHistory(ctx, &pb.GetCartHistoryRequest{UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Entries) != 3 || history.Entries[0].NewQuantity != 10 {
+		t.Errorf("got %d entries, newest %v; want the 3 newest", len(history.Entries), history.Entries)
+	}
+}
+
+func TestGetCartHistoryAuditOff(t *testing.T) {
+	srv := &cartServer{store: newMemoryCartStore()}
+	_, err := srv.GetCartHistory(context.Background(), &pb.GetCartHistoryRequest{UserId: "u1"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestNewAuditLogFromEnv(t *testing.T) {
+	redisStore, _ := newTestRedisStore(t)
+	tests := []struct {
+		name  string
+		value string
+		store cartStore
+		want  string // the log's type, "" for none
+	}{
+		{"unset", "", redisStore, ""},
+		{"redis", "redis", redisStore, "redis"},
+		{"redis without the Redis store", "redis", newMemoryCartStore(), ""},
+		{"file", filepath.Join(t.TempDir(), "audit.jsonl"), newMemoryCartStore(), "file"},
+		{"unwritable file", filepath.Join(t.TempDir(), "missing", "audit.jsonl"), newMemoryCartStore(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CART_AUDIT_LOG", tt.value)
+			got := ""
+			switch l := newAuditLogFromEnv(tt.store).(type) {
+			case *redisAuditLog:
+				got = "redis"
+			case *fileAuditLog:
+				got = "file"
+				l.Close()
+			}
+			if got != tt.want {
+				t.Errorf("got %q log, want %q", got, tt.want)
+			}
+		})
+	}
+}
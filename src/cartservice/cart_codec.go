@@ -0,0 +1,131 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// protobufCartMagic prefixes carts stored as protobuf. JSON never starts
+// with a NUL byte, so a cart is read back in whichever form it was written,
+// whatever CART_CODEC says now.
+const protobufCartMagic = "\x00cp1"
+
+// cartCodec encodes carts for storage. Decoding doesn't depend on it: see
+// unmarshalCart.
+type cartCodec interface {
+	name() string
+	marshal(cart storedCart) ([]byte, error)
+}
+
+// cartCodecFromEnv reads CART_CODEC, "json", the default, or "protobuf",
+// which is smaller and faster to encode.
+func cartCodecFromEnv() cartCodec {
+	switch v := os.Getenv("CART_CODEC"); v {
+	case "", "json":
+		return jsonCartCodec{}
+	case "protobuf":
+		log.Info("Storing carts as protobuf")
+		return protobufCartCodec{}
+	default:
+		log.Warnf("Ignoring unknown CART_CODEC %q, storing carts as JSON", v)
+		return jsonCartCodec{}
+	}
+}
+
+type jsonCartCodec struct{}
+
+func (jsonCartCodec) name() string { return "json" }
+
+// marshal writes carts with nothing but items as a bare array of them, the
+// format used before currency locking existed.
+func (jsonCartCodec) marshal(cart storedCart) ([]byte, error) {
+	var v interface{} = cart.Items
+	if cart.Currency != "" || len(cart.Saved) > 0 || cart.UpdatedAt != 0 || cart.Version != 0 {
+		v = cart
+	}
+	return json.Marshal(v)
+}
+
+type protobufCartCodec struct{}
+
+func (protobufCartCodec) name() string { return "protobuf" }
+
+func (protobufCartCodec) marshal(cart storedCart) ([]byte, error) {
+	data, err := proto.Marshal(&pb.StoredCart{
+		Items:        cartItemsToProto(cart.Items),
+		CurrencyCode: cart.Currency,
+		Saved:        cartItemsToProto(cart.Saved),
+		UpdatedAt:    cart.UpdatedAt,
+		Version:      cart.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(protobufCartMagic), data...), nil
+}
+
+// unmarshalCart decodes a cart written by either codec, and reports which
+// one wrote it. JSON carts may be a bare array of items or an object also
+// carrying the currency and saved list.
+func unmarshalCart(data []byte) (storedCart, cartCodec, error) {
+	var cart storedCart
+	if bytes.HasPrefix(data, []byte(protobufCartMagic)) {
+		var stored pb.StoredCart
+		if err := proto.Unmarshal(data[len(protobufCartMagic):], &stored); err != nil {
+			return storedCart{}, nil, err
+		}
+		cart.Items = cartItemsFromProto(stored.GetItems())
+		cart.Currency = stored.GetCurrencyCode()
+		cart.Saved = cartItemsFromProto(stored.GetSaved())
+		cart.UpdatedAt = stored.GetUpdatedAt()
+		cart.Version = stored.GetVersion()
+		if cart.Items == nil {
+			cart.Items = []cartItem{}
+		}
+		return cart, protobufCartCodec{}, nil
+	}
+
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(data, &cart)
+	} else {
+		err = json.Unmarshal(data, &cart.Items)
+	}
+	if err != nil {
+		return storedCart{}, nil, err
+	}
+	return cart, jsonCartCodec{}, nil
+}
+
+func cartItemsFromProto(items []*pb.CartItem) []cartItem {
+	var out []cartItem
+	for _, item := range items {
+		out = append(out, cartItem{
+			ProductID:     item.GetProductId(),
+			Quantity:      item.GetQuantity(),
+			PriceSnapshot: newPriceSnapshot(item.GetPriceSnapshot()),
+			AddedAt:       item.GetAddedAt().GetSeconds(),
+			Source:        item.GetSource(),
+		})
+	}
+	return out
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCartCodecRoundTrip(t *testing.T) {
+	carts := map[string]storedCart{
+		"empty": {Items: []cartItem{}},
+		"items only": {Items: []cartItem{
+			{ProductID: "OLJCESPC7Z", Quantity: 2, AddedAt: 1700000000},
+		}},
+		"locked with saved": {
+			Currency: "EUR",
+			Items: []cartItem{{
+				ProductID:     "66VCHSJNUP",
+				Quantity:      1,
+				PriceSnapshot: &priceSnapshot{CurrencyCode: "EUR", Units: 12, Nanos: 500000000},
+			}},
+			Saved:     []cartItem{{ProductID: "1YMWWN1N4O", Quantity: 3}},
+			UpdatedAt: 1700000100,
+		},
+	}
+	for _, codec := range []cartCodec{jsonCartCodec{}, protobufCartCodec{}} {
+		for name, want := range carts {
+			data, err := codec.marshal(want)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", codec.name(), name, err)
+			}
+			got, readBy, err := unmarshalCart(data)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", codec.name(), name, err)
+			}
+			if readBy.name() != codec.name() {
+				t.Errorf("%s/%s: read as %s", codec.name(), name, readBy.name())
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s/%s: got %+v, want %+v", codec.name(), name, got, want)
+			}
+		}
+	}
+}
+
+func TestCartCodecFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"", "json"},
+		{"json", "json"},
+		{"protobuf", "protobuf"},
+		{"msgpack", "json"},
+	}
+	for _, tt := range tests {
+		t.Setenv("CART_CODEC", tt.env)
+		if got := cartCodecFromEnv().name(); got != tt.want {
+			t.Errorf("CART_CODEC=%q: got %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestRedisCartCodecMigratesOnRead(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	ctx := context.Background()
+	store.codec = protobufCartCodec{}
+
+	mr.Set(store.key("array-user"), `[{"product_id":"OLJCESPC7Z","quantity":2}]`)
+	mr.Set(store.key("object-user"), `{"currency_code":"USD","items":[{"product_id":"66VCHSJNUP","quantity":1}],"saved":[{"product_id":"1YMWWN1N4O","quantity":1}]}`)
+
+	for user, want := range map[string]string{"array-user": "OLJCESPC7Z", "object-user": "66VCHSJNUP"} {
+		cart, err := store.GetCart(ctx, user)
+		if err != nil {
+			t.Fatalf("%s: %v", user, err)
+		}
+		if len(cart.Items) != 1 || cart.Items[0].ProductId != want {
+			t.Errorf("%s: got items %v, want %s", user, cart.Items, want)
+		}
+		raw, err := mr.Get(store.key(user))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(raw, protobufCartMagic) {
+			t.Errorf("%s: stored value not rewritten as protobuf: %q", user, raw)
+		}
+	}
+
+	saved, err := store.GetSavedItems(ctx, "object-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ProductId != "1YMWWN1N4O" {
+		t.Errorf("saved list lost in migration: %v", saved)
+	}
+	cart, err := store.GetCart(ctx, "object-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.CurrencyCode != "USD" {
+		t.Errorf("currency lost in migration: got %q", cart.CurrencyCode)
+	}
+
+	// Switching back reads the protobuf carts and returns them to JSON.
+	store.codec = jsonCartCodec{}
+	if _, err := store.GetCart(ctx, "array-user"); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := mr.Get(store.key("array-user")); !strings.HasPrefix(raw, "[") {
+		t.Errorf("stored value not rewritten as JSON: %q", raw)
+	}
+}
+
+func TestRedisCartCodecCompressed(t *testing.T) {
+	t.Setenv("CART_CODEC", "protobuf")
+	t.Setenv("CART_COMPRESSION", "true")
+	store, mr := newTestRedisStore(t)
+	ctx := context.Background()
+
+	const products = 60
+	for i := 0; i < products; i++ {
+		if err := store.AddItem(ctx, "user-1", fmt.Sprintf("PRODUCT-%03d", i), 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, err := mr.Get(store.key("user-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, compressedCartMagic) {
+		t.Errorf("large protobuf cart not compressed")
+	}
+	cart, err := store.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != products {
+		t.Errorf("got %d items back, want %d", len(cart.Items), products)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+)
+
+// compressedCartMagic prefixes gzip-compressed cart values in Redis. A JSON
+// cart never starts with a NUL byte, so values written before compression
+// was enabled are still read as plain JSON.
+const compressedCartMagic = "\x00cz1"
+
+// cartCompressionThreshold is the marshaled size above which carts are
+// compressed. Smaller carts would only grow from the gzip overhead.
+const cartCompressionThreshold = 256
+
+// cartCompressionFromEnv parses CART_COMPRESSION. Compression is off by
+// default; compressed values are read back either way.
+func cartCompressionFromEnv() bool {
+	v := os.Getenv("CART_COMPRESSION")
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid CART_COMPRESSION %q, cart compression disabled", v)
+		return false
+	}
+	return on
+}
+
+func compressCart(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(compressedCartMagic)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressCart returns the JSON held in val, which may or may not have
+// been compressed.
+func decompressCart(val []byte) ([]byte, error) {
+	if !bytes.HasPrefix(val, []byte(compressedCartMagic)) {
+		return val, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(val[len(compressedCartMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
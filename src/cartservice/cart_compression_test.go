@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRedisCartCompression(t *testing.T) {
+	tests := []struct {
+		name           string
+		compress       bool
+		products       int
+		wantCompressed bool
+	}{
+		{"large cart compressed", true, 30, true},
+		{"small cart left as JSON", true, 1, false},
+		{"compression disabled", false, 30, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("CART_COMPRESSION", fmt.Sprint(tt.compress))
+		store, mr := newTestRedisStore(t)
+		ctx := context.Background()
+		for i := 0; i < tt.products; i++ {
+			if err := store.AddItem(ctx, "user-1", fmt.Sprintf("PRODUCT-%03d", i), 1, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		raw, err := mr.Get(store.key("user-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.HasPrefix(raw, compressedCartMagic); got != tt.wantCompressed {
+			t.Errorf("%s: stored value compressed = %v, want %v", tt.name, got, tt.wantCompressed)
+		}
+		cart, err := store.GetCart(ctx, "user-1")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(cart.Items) != tt.products {
+			t.Errorf("%s: got %d items back, want %d", tt.name, len(cart.Items), tt.products)
+		}
+	}
+}
+
+func TestRedisCartCompressionReadsBothFormats(t *testing.T) {
+	t.Setenv("CART_COMPRESSION", "true")
+	store, mr := newTestRedisStore(t)
+	ctx := context.Background()
+
+	legacy := `[{"product_id":"OLJCESPC7Z","quantity":2}]`
+	compressed, err := compressCart([]byte(`[{"product_id":"66VCHSJNUP","quantity":3}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Set(store.key("legacy-user"), legacy)
+	mr.Set(store.key("compressed-user"), string(compressed))
+
+	// Turning compression off must not strand carts already compressed.
+	store.compress = false
+	for user, want := range map[string]string{"legacy-user": "OLJCESPC7Z", "compressed-user": "66VCHSJNUP"} {
+		cart, err := store.GetCart(ctx, user)
+		if err != nil {
+			t.Fatalf("%s: %v", user, err)
+		}
+		if len(cart.Items) != 1 || cart.Items[0].ProductId != want {
+			t.Errorf("%s: got %v, want one line of %s", user, cart.Items, want)
+		}
+	}
+}
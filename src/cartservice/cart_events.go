@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/eventbus"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const defaultCartEventsTopic = "cart-events"
+
+// eventPublisher sends cart change events. Publishing is best effort: the
+// change has already been stored, so failures are logged rather than
+// returned.
+type eventPublisher interface {
+	publish(ctx context.Context, key string, event proto.Message)
+}
+
+// cartEventsTopicFromEnv reads CART_EVENTS_TOPIC, the topic, or NATS
+// subject, cart events go to.
+func cartEventsTopicFromEnv() string {
+	if topic := os.Getenv("CART_EVENTS_TOPIC"); topic != "" {
+		return topic
+	}
+	return defaultCartEventsTopic
+}
+
+// eventQueueSize is how many events may wait to be published before new
+// ones are dropped.
+const eventQueueSize = 1024
+
+// eventPublishTimeout bounds each publish, so a broker that stops answering
+// holds up the queue only so long. Tests shorten it.
+var eventPublishTimeout = 5 * time.Second
+
+// eventsDropped counts events not published because the queue was full.
+var eventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Subsystem: "events",
+	Name:      "dropped_total",
+	Help:      "Number of cart events dropped because the publish queue was full.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(eventsDropped)
+}
+
+// busPublisher publishes events to one topic of an event bus, keyed by
+// user so that each user's events stay in order. Events are queued and
+// published by a single goroutine, in order, so a slow or unreachable bus
+// never holds up the request whose change is already stored.
+type busPublisher struct {
+	bus     eventbus.Publisher
+	topic   string
+	timeout time.Duration
+	done    chan struct{}
+
+	mu sync.Mutex
+	// queue is nil once closed.
+	queue chan eventbus.Message
+}
+
+func newBusPublisher(bus eventbus.Publisher, topic string) *busPublisher {
+	p := &busPublisher{
+		bus:     bus,
+		topic:   topic,
+		timeout: eventPublishTimeout,
+		queue:   make(chan eventbus.Message, eventQueueSize),
+		done:    make(chan struct{}),
+	}
+	go p.run(p.queue)
+	return p
+}
+
+func (p *busPublisher) publish(ctx context.Context, key string, event proto.Message) {
+	// Encoded now, to carry the request's trace context.
+	msg, err := eventbus.NewMessage(ctx, key, event)
+	if err != nil {
+		log.Errorf("Failed to encode cart event: %v", err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queue == nil {
+		log.Warnf("Event publisher is closed, dropping %s event", proto.MessageName(event))
+		return
+	}
+	select {
+	case p.queue <- msg:
+	default:
+		eventsDropped.Inc()
+		log.Warnf("Cart event queue is full, dropping %s event", proto.MessageName(event))
+	}
+}
+
+func (p *busPublisher) run(queue <-chan eventbus.Message) {
+	defer close(p.done)
+	for msg := range queue {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		if err := p.bus.Publish(ctx, p.topic, msg); err != nil {
+			log.Warnf("Failed to publish %s event: %v", msg.Headers[eventbus.EventTypeHeader], err)
+		}
+		cancel()
+	}
+}
+
+// close publishes the events still queued and stops. Events published
+// after are dropped.
+func (p *busPublisher) close() {
+	p.mu.Lock()
+	if p.queue != nil {
+		close(p.queue)
+		p.queue = nil
+	}
+	p.mu.Unlock()
+	<-p.done
+}
+
+// eventCartName is cartName as events carry it: empty for the default cart.
+func eventCartName(cartName string) string {
+	if cartName == defaultCartName {
+		return ""
+	}
+	return cartName
+}
+
+func (s *cartServer) publishItemAdded(ctx context.Context, userID, cartName, productID string, quantity int32) {
+	if s.events == nil {
+		return
+	}
+	s.events.publish(ctx, userID, &pb.CartItemAdded{
+		UserId:     userID,
+		CartName:   eventCartName(cartName),
+		Item:       &pb.CartItem{ProductId: productID, Quantity: quantity},
+		OccurredAt: timestamppb.New(time.Now()),
+	})
+}
+
+func (s *cartServer) publishCartEmptied(ctx context.Context, userID, cartName string) {
+	if s.events == nil {
+		return
+	}
+	s.events.publish(ctx, userID, &pb.CartEmptied{
+		UserId:     userID,
+		CartName:   eventCartName(cartName),
+		OccurredAt: timestamppb.New(time.Now()),
+	})
+}
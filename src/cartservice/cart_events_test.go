@@ -0,0 +1,181 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/eventbus"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+type recordedEvent struct {
+	key   string
+	event proto.Message
+}
+
+type fakePublisher struct {
+	mu     sync.Mutex
+	events []recordedEvent
+}
+
+func (p *fakePublisher) publish(ctx context.Context, key string, event proto.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, recordedEvent{key, event})
+}
+
+func TestBusPublisher(t *testing.T) {
+	bus := eventbus.NewMemory()
+	var got []eventbus.Message
+	bus.Subscribe("cart-events", func(msg eventbus.Message) { got = append(got, msg) })
+	p := newBusPublisher(bus, "cart-events")
+
+	event := &pb.CartEmptied{UserId: "user-1", CartName: "gifts"}
+	p.publish(context.Background(), "user-1", event)
+	p.close()
+	// Dropped rather than published once closed.
+	p.publish(context.Background(), "user-1", event)
+
+	if len(got) != 1 {
+		t.Fatalf("got %d messages, want 1", len(got))
+	}
+	if got[0].Key != "user-1" {
+		t.Errorf("key = %q, want user-1", got[0].Key)
+	}
+	if typ := got[0].Headers[eventbus.EventTypeHeader]; typ != "hipstershop.CartEmptied" {
+		t.Errorf("event type = %q, want hipstershop.CartEmptied", typ)
+	}
+	var decoded pb.CartEmptied
+	if err := proto.Unmarshal(got[0].Data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&decoded, event) {
+		t.Errorf("decoded %v, want %v", &decoded, event)
+	}
+}
+
+// stuckBus never acknowledges a publish until its context ends.
+type stuckBus struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (b *stuckBus) Publish(ctx context.Context, topic string, msg eventbus.Message) error {
+	<-ctx.Done()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errs = append(b.errs, ctx.Err())
+	return ctx.Err()
+}
+
+func (b *stuckBus) Close() error { return nil }
+
+func TestBusPublisherDoesNotWaitForTheBus(t *testing.T) {
+	defer func(d time.Duration) { eventPublishTimeout = d }(eventPublishTimeout)
+	eventPublishTimeout = 10 * time.Millisecond
+	bus := &stuckBus{}
+	p := newBusPublisher(bus, "cart-events")
+
+	// The request is done with its context as soon as publish returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	p.publish(ctx, "user-1", &pb.CartEmptied{UserId: "user-1"})
+	p.publish(ctx, "user-1", &pb.CartEmptied{UserId: "user-1"})
+	cancel()
+	if d := time.Since(start); d > eventPublishTimeout {
+		t.Errorf("publish took %v, want it not to wait for the bus", d)
+	}
+
+	p.close()
+	if len(bus.errs) != 2 {
+		t.Fatalf("bus saw %d publishes, want 2", len(bus.errs))
+	}
+	for _, err := range bus.errs {
+		if err != context.DeadlineExceeded {
+			t.Errorf("publish ended with %v, want the publish timeout rather than the request's cancellation", err)
+		}
+	}
+}
+
+func TestCartServerPublishesEvents(t *testing.T) {
+	events := &fakePublisher{}
+	s := &cartServer{
+		store:           newMemoryCartStore(),
+		events:          events,
+		maxItemQuantity: 10,
+		dedupe:          newAddDeduper(newMemoryCartStore(), time.Minute),
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(idempotencyKeyHeader, "k1"))
+
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", CartName: "default", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	// A retry with the same idempotency key adds nothing, so it has nothing
+	// to announce either.
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	// Rejected adds publish nothing.
+	if _, err := s.AddItem(context.Background(), &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 9}}); err == nil {
+		t.Fatal("expected adding past the quantity cap to fail")
+	}
+	if _, err := s.AddItems(context.Background(), &pb.AddItemsRequest{UserId: "user-1", CartName: "gifts", Items: []*pb.CartItem{
+		{ProductId: "66VCHSJNUP", Quantity: 1},
+		{ProductId: "1YMWWN1N4O", Quantity: 3},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.EmptyCart(context.Background(), &pb.EmptyCartRequest{UserId: "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []proto.Message{
+		&pb.CartItemAdded{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2}},
+		&pb.CartItemAdded{UserId: "user-1", CartName: "gifts", Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 1}},
+		&pb.CartItemAdded{UserId: "user-1", CartName: "gifts", Item: &pb.CartItem{ProductId: "1YMWWN1N4O", Quantity: 3}},
+		&pb.CartEmptied{UserId: "user-1"},
+	}
+	if len(events.events) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(events.events), len(want), events.events)
+	}
+	for i, got := range events.events {
+		if got.key != "user-1" {
+			t.Errorf("event %d key = %q, want user-1", i, got.key)
+		}
+		// Compare without the timestamp, which only has to be set.
+		switch e := got.event.(type) {
+		case *pb.CartItemAdded:
+			if e.OccurredAt == nil {
+				t.Errorf("event %d has no occurred_at", i)
+			}
+			e.OccurredAt = nil
+		case *pb.CartEmptied:
+			if e.OccurredAt == nil {
+				t.Errorf("event %d has no occurred_at", i)
+			}
+			e.OccurredAt = nil
+		}
+		if !proto.Equal(got.event, want[i]) {
+			t.Errorf("event %d = %v, want %v", i, got.event, want[i])
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// cartSnapshotVersion is the CartSnapshot layout this service writes and
+// the newest it reads.
+const cartSnapshotVersion = 1
+
+// marshalCartExport renders cart in format, as ExportCart returns it.
+func marshalCartExport(cart storedCart, format pb.CartExportFormat) ([]byte, error) {
+	switch format {
+	case pb.CartExportFormat_CART_EXPORT_FORMAT_JSON:
+		items := cart.Items
+		if items == nil {
+			items = []cartItem{}
+		}
+		data, err := json.Marshal(items)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to marshal cart: %v", err)
+		}
+		return data, nil
+	case pb.CartExportFormat_CART_EXPORT_FORMAT_SNAPSHOT:
+		data, err := proto.Marshal(&pb.CartSnapshot{
+			Version:    cartSnapshotVersion,
+			Items:      cartItemsToProto(cart.Items),
+			Saved:      cartItemsToProto(cart.Saved),
+			ExportedAt: timestamppb.Now(),
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to marshal cart snapshot: %v", err)
+		}
+		return data, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown export format %v", format)
+	}
+}
+
+// parseCartImport validates an ImportCart payload: either a well-formed JSON
+// array of items, told apart by its leading '[', or a CartSnapshot. Each
+// list must hold items with a product ID, a positive quantity, and no
+// product listed twice. Items without an added_at are stamped with the
+// import time. The saved list is nil for JSON, which doesn't carry one.
+func parseCartImport(data []byte) (storedCart, error) {
+	now := time.Now().Unix()
+	if bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("[")) {
+		var items []cartItem
+		if err := json.Unmarshal(data, &items); err != nil {
+			return storedCart{}, status.Errorf(codes.InvalidArgument, "cart is not a JSON array of items: %v", err)
+		}
+		items, err := checkImportedItems("item", items, now)
+		return storedCart{Items: items}, err
+	}
+
+	var snapshot pb.CartSnapshot
+	if err := proto.Unmarshal(data, &snapshot); err != nil {
+		return storedCart{}, status.Errorf(codes.InvalidArgument, "cart is neither a JSON array of items nor a cart snapshot: %v", err)
+	}
+	if v := snapshot.GetVersion(); v < 1 || v > cartSnapshotVersion {
+		return storedCart{}, status.Errorf(codes.InvalidArgument, "unsupported cart snapshot version %d", v)
+	}
+	items, err := checkImportedItems("item", cartItemsFromProto(snapshot.GetItems()), now)
+	if err != nil {
+		return storedCart{}, err
+	}
+	saved, err := checkImportedItems("saved item", cartItemsFromProto(snapshot.GetSaved()), now)
+	if err != nil {
+		return storedCart{}, err
+	}
+	return storedCart{Items: items, Saved: saved}, nil
+}
+
+// checkImportedItems applies parseCartImport's rules to one list, called
+// what in errors, and returns it non-nil.
+func checkImportedItems(what string, items []cartItem, now int64) ([]cartItem, error) {
+	seen := make(map[string]bool, len(items))
+	for i, item := range items {
+		switch {
+		case item.ProductID == "":
+			return nil, status.Errorf(codes.InvalidArgument, "%s %d has no product_id", what, i)
+		case item.Quantity <= 0:
+			return nil, status.Errorf(codes.InvalidArgument, "%s %d (%s) has quantity %d, want at least 1", what, i, item.ProductID, item.Quantity)
+		case seen[item.ProductID]:
+			return nil, status.Errorf(codes.InvalidArgument, "product %s is listed more than once", item.ProductID)
+		}
+		seen[item.ProductID] = true
+		if item.AddedAt == 0 {
+			items[i].AddedAt = now
+		}
+	}
+	if items == nil {
+		items = []cartItem{}
+	}
+	return items, nil
+}
+
+// importedCart is the cart left by importing imported over cart, as
+// ImportCart describes.
+func importedCart(cart, imported storedCart) storedCart {
+	saved := imported.Saved
+	if saved == nil {
+		saved = cart.Saved
+	}
+	return storedCart{Items: imported.Items, Saved: saved}
+}
+
+func (s *cartServer) ExportCart(ctx context.Context, req *pb.ExportCartRequest) (*pb.ExportCartResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	key, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	cart, err := s.store.ExportCart(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := marshalCartExport(cart, req.Format)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ExportCartResponse{Data: data}, nil
+}
+
+func (s *cartServer) ImportCart(ctx context.Context, req *pb.ImportCartRequest) (*pb.Empty, error) {
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	key, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	cart, err := parseCartImport(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	if req.KeepSaved {
+		cart.Saved = nil
+	}
+	if err := s.checkImportLimits(cart); err != nil {
+		return nil, err
+	}
+	if !s.priceSnapshots {
+		// Prices are only taken from the caller when snapshots are on.
+		for _, items := range [][]cartItem{cart.Items, cart.Saved} {
+			for i := range items {
+				items[i].PriceSnapshot = nil
+			}
+		}
+	}
+	for _, items := range [][]cartItem{cart.Items, cart.Saved} {
+		for _, item := range items {
+			if err := s.checkProducts(ctx, item.ProductID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = s.audited(ctx, "ImportCart", []string{key}, func() error {
+		return s.store.ImportCart(withExpectedVersion(ctx, req.ExpectedVersion), key, cart)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestExportImportCart(t *testing.T) {
+	for storeName, newStore := range testCartStores() {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.Background()
+			s := &cartServer{store: newStore(t)}
+			for _, item := range []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "66VCHSJNUP", Quantity: 1}} {
+				if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "source", Item: item}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The destination's existing items must be replaced, not merged.
+			if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "dest", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 5}}); err != nil {
+				t.Fatal(err)
+			}
+
+			exported, err := s.ExportCart(ctx, &pb.ExportCartRequest{UserId: "source"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "dest", Data: exported.Data}); err != nil {
+				t.Fatal(err)
+			}
+			cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "dest"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int32)
+			for _, item := range cart.Items {
+				got[item.ProductId] = item.Quantity
+			}
+			if len(got) != 2 || got["OLJCESPC7Z"] != 2 || got["66VCHSJNUP"] != 1 {
+				t.Errorf("got cart %v after import, want OLJCESPC7Z x2 and 66VCHSJNUP x1", got)
+			}
+
+			empty, err := s.ExportCart(ctx, &pb.ExportCartRequest{UserId: "nobody"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(empty.Data) != "[]" {
+				t.Errorf("missing cart exported as %s, want []", empty.Data)
+			}
+		})
+	}
+}
+
+func TestExportImportCartSnapshot(t *testing.T) {
+	for storeName, newStore := range testCartStores() {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.Background()
+			s := &cartServer{store: newStore(t)}
+			for _, item := range []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "66VCHSJNUP", Quantity: 1}} {
+				if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "source", Item: item}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.SaveForLater(ctx, &pb.SaveForLaterRequest{UserId: "source", ProductId: "66VCHSJNUP"}); err != nil {
+				t.Fatal(err)
+			}
+			for _, userID := range []string{"copy", "shared"} {
+				if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: userID, Item: &pb.CartItem{ProductId: "L9ECAV7KIM", Quantity: 1}}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := s.SaveForLater(ctx, &pb.SaveForLaterRequest{UserId: userID, ProductId: "L9ECAV7KIM"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			exported, err := s.ExportCart(ctx, &pb.ExportCartRequest{UserId: "source", Format: pb.CartExportFormat_CART_EXPORT_FORMAT_SNAPSHOT})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "copy", Data: exported.Data}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "shared", Data: exported.Data, KeepSaved: true}); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				userID    string
+				wantSaved string
+			}{
+				{"copy", "66VCHSJNUP"},
+				{"shared", "L9ECAV7KIM"},
+			}
+			for _, tt := range tests {
+				cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: tt.userID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(cart.Items) != 1 || cart.Items[0].ProductId != "OLJCESPC7Z" || cart.Items[0].Quantity != 2 {
+					t.Errorf("%s: got items %v, want OLJCESPC7Z x2", tt.userID, cart.Items)
+				}
+				saved, err := s.GetSavedItems(ctx, &pb.GetSavedItemsRequest{UserId: tt.userID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(saved.Items) != 1 || saved.Items[0].ProductId != tt.wantSaved {
+					t.Errorf("%s: got saved items %v, want %s", tt.userID, saved.Items, tt.wantSaved)
+				}
+			}
+		})
+	}
+}
+
+func TestImportCartRejectsBadInput(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"malformed JSON", `[{"product_id": "OLJCESPC7Z"`},
+		{"not an array", `{"product_id": "OLJCESPC7Z", "quantity": 1}`},
+		{"negative quantity", `[{"product_id": "OLJCESPC7Z", "quantity": -1}]`},
+		{"zero quantity", `[{"product_id": "OLJCESPC7Z", "quantity": 0}]`},
+		{"snapshot with a zero quantity saved item", snapshot(t, &pb.CartSnapshot{Version: 1, Saved: []*pb.CartItem{{ProductId: "OLJCESPC7Z"}}})},
+		{"duplicate product", `[{"product_id": "OLJCESPC7Z", "quantity": 1}, {"product_id": "OLJCESPC7Z", "quantity": 2}]`},
+		{"missing product ID", `[{"quantity": 1}]`},
+		{"neither JSON nor a snapshot", "\xff\xff"},
+		{"snapshot without a version", snapshot(t, &pb.CartSnapshot{Items: []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}})},
+		{"snapshot from the future", snapshot(t, &pb.CartSnapshot{Version: cartSnapshotVersion + 1})},
+		{"snapshot with a duplicate saved item", snapshot(t, &pb.CartSnapshot{Version: 1, Saved: []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}, {ProductId: "OLJCESPC7Z", Quantity: 1}}})},
+	}
+	ctx := context.Background()
+	s := &cartServer{store: newMemoryCartStore()}
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		_, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "user-1", Data: []byte(tt.data)})
+		if got := status.Code(err); got != codes.InvalidArgument {
+			t.Errorf("%s: got %s, want %s", tt.name, got, codes.InvalidArgument)
+		}
+	}
+
+	cart, _ := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+	if len(cart.Items) != 1 || cart.Items[0].ProductId != "66VCHSJNUP" || cart.Items[0].Quantity != 3 {
+		t.Errorf("rejected imports changed the cart to %v", cart.Items)
+	}
+}
+
+func TestImportCartLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"quantity over the limit", `[{"product_id": "OLJCESPC7Z", "quantity": 2000000000}]`},
+		{"too many products", `[{"product_id": "OLJCESPC7Z", "quantity": 1}, {"product_id": "66VCHSJNUP", "quantity": 1}]`},
+		{"saved quantity over the limit", snapshot(t, &pb.CartSnapshot{Version: 1, Saved: []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 11}}})},
+	}
+	ctx := context.Background()
+	s := &cartServer{store: newMemoryCartStore(), maxItemQuantity: 10, maxCartItems: 1}
+	for _, tt := range tests {
+		_, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "user-1", Data: []byte(tt.data)})
+		if got := status.Code(err); got != codes.ResourceExhausted {
+			t.Errorf("%s: got %s, want %s", tt.name, got, codes.ResourceExhausted)
+		}
+	}
+	cart, _ := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+	if len(cart.Items) != 0 {
+		t.Errorf("rejected imports changed the cart to %v", cart.Items)
+	}
+
+	// The import replaces the cart, so a full cart can take a new product.
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "user-1", Data: []byte(`[{"product_id": "OLJCESPC7Z", "quantity": 10}]`)}); err != nil {
+		t.Errorf("import within the limits: %v", err)
+	}
+}
+
+func TestImportCartPriceSnapshots(t *testing.T) {
+	data := []byte(`[{"product_id": "OLJCESPC7Z", "quantity": 1, "price_snapshot": {"currency_code": "USD", "units": 0, "nanos": 10000000}}]`)
+	for _, on := range []bool{false, true} {
+		ctx := context.Background()
+		s := &cartServer{store: newMemoryCartStore(), priceSnapshots: on}
+		if _, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "user-1", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cart.Items[0].GetPriceSnapshot() != nil; got != on {
+			t.Errorf("PRICE_SNAPSHOT %v: got a stored snapshot %v, want %v", on, got, on)
+		}
+	}
+}
+
+func snapshot(t *testing.T, s *pb.CartSnapshot) string {
+	t.Helper()
+	data, err := proto.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// cartLimitDomain and the reasons below identify cart limit errors in the
+// google.rpc.ErrorInfo detail of a RESOURCE_EXHAUSTED status.
+const (
+	cartLimitDomain         = "cartservice.hipstershop"
+	reasonItemQuantityLimit = "ITEM_QUANTITY_LIMIT"
+	reasonCartItemsLimit    = "CART_ITEMS_LIMIT"
+)
+
+// maxCartItemsFromEnv reads MAX_CART_ITEMS, the most distinct products a
+// cart may hold. Unset or zero means no limit.
+func maxCartItemsFromEnv() int {
+	v := os.Getenv("MAX_CART_ITEMS")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("Ignoring invalid MAX_CART_ITEMS %q, carts are unlimited", v)
+		return 0
+	}
+	if n > 0 {
+		log.Infof("Carts hold at most %d distinct products", n)
+	}
+	return n
+}
+
+// cartLimitError is the RESOURCE_EXHAUSTED status returned when a change
+// would take a cart past one of its limits. The ErrorInfo detail carries
+// reason and the limit, so clients can explain it without parsing text.
+func cartLimitError(reason string, limit int32, format string, args ...interface{}) error {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf(format, args...))
+	if withDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   cartLimitDomain,
+		Metadata: map[string]string{"limit": strconv.Itoa(int(limit))},
+	}); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// checkCartLimits rejects adding quantity units of productID to the cart
+// stored under key if that would take the product's line over
+// maxItemQuantity, or need a new line in a cart already holding
+// maxCartItems products. A zero quantity only checks there is room for the
+// line.
+func (s *cartServer) checkCartLimits(ctx context.Context, key, productID string, quantity int32) error {
+	return s.checkBatchLimits(ctx, key, []*pb.CartItem{{ProductId: productID, Quantity: quantity}})
+}
+
+// checkBatchLimits is checkCartLimits for adding all of items at once, so
+// a product listed twice counts twice and each new product takes a line.
+func (s *cartServer) checkBatchLimits(ctx context.Context, key string, items []*pb.CartItem) error {
+	if s.maxItemQuantity == 0 && s.maxCartItems == 0 {
+		return nil
+	}
+	cart, err := s.store.GetCart(ctx, key)
+	if err != nil {
+		return err
+	}
+	held := make(map[string]int64, len(cart.GetItems()))
+	for _, item := range cart.GetItems() {
+		held[item.GetProductId()] = int64(item.GetQuantity())
+	}
+	lines := len(held)
+	for _, item := range items {
+		productID, quantity := item.GetProductId(), item.GetQuantity()
+		have, ok := held[productID]
+		if !ok {
+			if s.maxCartItems > 0 && lines >= s.maxCartItems {
+				return cartLimitError(reasonCartItemsLimit, int32(s.maxCartItems),
+					"cart already holds the limit of %d products", s.maxCartItems)
+			}
+			lines++
+		}
+		if s.maxItemQuantity > 0 && have+int64(quantity) > int64(s.maxItemQuantity) {
+			return cartLimitError(reasonItemQuantityLimit, s.maxItemQuantity,
+				"cart already holds %d of product %s, adding %d would exceed the limit of %d",
+				have, productID, quantity, s.maxItemQuantity)
+		}
+		held[productID] = have + int64(quantity)
+	}
+	return nil
+}
+
+// checkMergeLimits rejects merging the cart stored under fromKey into the
+// one under toKey if the merged cart would break either limit. Merging adds
+// quantities together, so it is checked like adding the whole source cart.
+func (s *cartServer) checkMergeLimits(ctx context.Context, fromKey, toKey string) error {
+	if s.maxItemQuantity == 0 && s.maxCartItems == 0 {
+		return nil
+	}
+	from, err := s.store.GetCart(ctx, fromKey)
+	if err != nil {
+		return err
+	}
+	return s.checkBatchLimits(ctx, toKey, from.GetItems())
+}
+
+// checkImportLimits rejects an imported cart holding more than
+// maxCartItems products, or any line over maxItemQuantity. The import
+// replaces the cart, so what it held before doesn't count.
+func (s *cartServer) checkImportLimits(cart storedCart) error {
+	if s.maxCartItems > 0 && len(cart.Items) > s.maxCartItems {
+		return cartLimitError(reasonCartItemsLimit, int32(s.maxCartItems),
+			"imported cart holds %d products, over the limit of %d", len(cart.Items), s.maxCartItems)
+	}
+	for _, items := range [][]cartItem{cart.Items, cart.Saved} {
+		for _, item := range items {
+			if err := s.validateQuantity(item.Quantity); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// cartLimitReason returns the ErrorInfo reason and limit of a cart limit
+// error.
+func cartLimitReason(t *testing.T, err error) (reason, limit string) {
+	t.Helper()
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetDomain() == cartLimitDomain {
+			return info.GetReason(), info.GetMetadata()["limit"]
+		}
+	}
+	t.Fatalf("%v carries no ErrorInfo", err)
+	return "", ""
+}
+
+func TestCartItemsLimit(t *testing.T) {
+	add := func(id string) func(s *cartServer) error {
+		return func(s *cartServer) error {
+			_, err := s.AddItem(context.Background(), &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: id, Quantity: 1}})
+			return err
+		}
+	}
+	tests := []struct {
+		name string
+		call func(s *cartServer) error
+		want codes.Code
+	}{
+		{"add new product", add("1YMWWN1N4O"), codes.ResourceExhausted},
+		{"add more of a product in the cart", add("OLJCESPC7Z"), codes.OK},
+		{"update new product", func(s *cartServer) error {
+			_, err := s.UpdateItemQuantity(context.Background(), &pb.UpdateItemQuantityRequest{UserId: "user-1", ProductId: "1YMWWN1N4O", Quantity: 1})
+			return err
+		}, codes.ResourceExhausted},
+		{"update product in the cart", func(s *cartServer) error {
+			_, err := s.UpdateItemQuantity(context.Background(), &pb.UpdateItemQuantityRequest{UserId: "user-1", ProductId: "OLJCESPC7Z", Quantity: 4})
+			return err
+		}, codes.OK},
+		{"move saved product back", func(s *cartServer) error {
+			if err := s.store.AddItem(context.Background(), "saver", "1YMWWN1N4O", 1, nil); err != nil {
+				return err
+			}
+			if err := s.store.SaveForLater(context.Background(), "saver", "1YMWWN1N4O"); err != nil {
+				return err
+			}
+			for _, id := range []string{"OLJCESPC7Z", "66VCHSJNUP"} {
+				if err := s.store.AddItem(context.Background(), "saver", id, 1, nil); err != nil {
+					return err
+				}
+			}
+			_, err := s.MoveToCart(context.Background(), &pb.MoveToCartRequest{UserId: "saver", ProductId: "1YMWWN1N4O"})
+			return err
+		}, codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		s := &cartServer{store: newMemoryCartStore(), maxCartItems: 2}
+		for _, id := range []string{"OLJCESPC7Z", "66VCHSJNUP"} {
+			if err := s.store.AddItem(ctx, "user-1", id, 1, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := tt.call(s)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+			continue
+		}
+		if tt.want == codes.ResourceExhausted {
+			if reason, limit := cartLimitReason(t, err); reason != reasonCartItemsLimit || limit != "2" {
+				t.Errorf("%s: got reason %s, limit %s, want %s, 2", tt.name, reason, limit, reasonCartItemsLimit)
+			}
+		}
+	}
+}
+
+func TestItemQuantityLimitDetail(t *testing.T) {
+	s := &cartServer{store: newMemoryCartStore(), maxItemQuantity: 10}
+	_, err := s.AddItem(context.Background(), &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 11}})
+	if reason, limit := cartLimitReason(t, err); reason != reasonItemQuantityLimit || limit != "10" {
+		t.Errorf("got reason %s, limit %s, want %s, 10", reason, limit, reasonItemQuantityLimit)
+	}
+}
+
+func TestMergeCartsLimits(t *testing.T) {
+	ctx := context.Background()
+	s := &cartServer{store: newMemoryCartStore(), maxItemQuantity: 10, maxCartItems: 2}
+	for _, user := range []string{"guest", "user-1"} {
+		if err := s.store.AddItem(ctx, user, "OLJCESPC7Z", 10, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := s.MergeCarts(ctx, &pb.MergeCartsRequest{FromUserId: "guest", ToUserId: "user-1"})
+	if reason, limit := cartLimitReason(t, err); reason != reasonItemQuantityLimit || limit != "10" {
+		t.Errorf("got reason %s, limit %s, want %s, 10", reason, limit, reasonItemQuantityLimit)
+	}
+	cart, err := s.store.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quantities(cart.GetItems()); !sameQuantities(got, map[string]int32{"OLJCESPC7Z": 10}) {
+		t.Errorf("after a rejected merge, cart = %v", got)
+	}
+
+	// Within both limits, the merge goes through.
+	if err := s.store.EmptyCart(ctx, "guest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.AddItem(ctx, "guest", "66VCHSJNUP", 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MergeCarts(ctx, &pb.MergeCartsRequest{FromUserId: "guest", ToUserId: "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.AddItem(ctx, "guest", "1YMWWN1N4O", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.MergeCarts(ctx, &pb.MergeCartsRequest{FromUserId: "guest", ToUserId: "user-1"})
+	if reason, _ := cartLimitReason(t, err); reason != reasonCartItemsLimit {
+		t.Errorf("got reason %s, want %s", reason, reasonCartItemsLimit)
+	}
+}
+
+func TestMaxCartItemsFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{"", 0},
+		{"50", 50},
+		{"0", 0},
+		{"-1", 0},
+		{"lots", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_CART_ITEMS", tt.env)
+		if got := maxCartItemsFromEnv(); got != tt.want {
+			t.Errorf("MAX_CART_ITEMS=%q: got %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const defaultCartName = "default"
+
+// cartNamePattern matches the names of carts other than the default one.
+// They can't hold ':', so a named cart's key splits back into user and name
+// unambiguously.
+var cartNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// cartKey returns the storage key of userID's cart called name. The default
+// cart keeps the bare user ID it has always been stored under; named carts
+// are stored under "userID:name". User IDs can't hold ':', or user "a:b"'s
+// default cart would be user "a"'s cart "b".
+func cartKey(userID, name string) (string, error) {
+	if strings.Contains(userID, ":") {
+		return "", status.Errorf(codes.InvalidArgument, "invalid user_id %q: must not contain ':'", userID)
+	}
+	if name == "" || name == defaultCartName {
+		return userID, nil
+	}
+	if !cartNamePattern.MatchString(name) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid cart_name %q: want lowercase letters, digits, '-' and '_', at most 64 long", name)
+	}
+	return userID + ":" + name, nil
+}
+
+// cartNameFromKey returns the cart name in key, one of userID's named cart
+// keys, or false if key isn't one.
+func cartNameFromKey(userID, key string) (string, bool) {
+	name, ok := strings.CutPrefix(key, userID+":")
+	if !ok || name == defaultCartName || !cartNamePattern.MatchString(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// splitCartKey is cartKey in reverse. Keys are read as a named cart
+// whenever what follows their last ':' is a valid cart name.
+func splitCartKey(key string) (userID, name string) {
+	if i := strings.LastIndexByte(key, ':'); i > 0 {
+		if name := key[i+1:]; name != defaultCartName && cartNamePattern.MatchString(name) {
+			return key[:i], name
+		}
+	}
+	return key, defaultCartName
+}
+
+func (s *cartServer) ListCarts(ctx context.Context, req *pb.ListCartsRequest) (*pb.ListCartsResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	names, err := s.store.ListCartNames(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return &pb.ListCartsResponse{CartNames: append([]string{defaultCartName}, names...)}, nil
+}
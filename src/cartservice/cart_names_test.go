@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestCartKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		want     string
+		wantCode codes.Code
+	}{
+		{"", "user-1", codes.OK},
+		{"default", "user-1", codes.OK},
+		{"gifts", "user-1:gifts", codes.OK},
+		{"work_2024-q1", "user-1:work_2024-q1", codes.OK},
+		{"Gifts", "", codes.InvalidArgument},
+		{"-gifts", "", codes.InvalidArgument},
+		{"a:b", "", codes.InvalidArgument},
+		{"a*", "", codes.InvalidArgument},
+		{string(make([]byte, 65)), "", codes.InvalidArgument},
+	}
+	if _, err := cartKey("user-1:gifts", ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf(`cartKey("user-1:gifts", ""): got %v, want InvalidArgument, as it would be user-1's gifts cart`, err)
+	}
+	for _, tt := range tests {
+		got, err := cartKey("user-1", tt.name)
+		if code := status.Code(err); code != tt.wantCode {
+			t.Errorf("cartKey(%q): got %s, want %s", tt.name, code, tt.wantCode)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cartKey(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitCartKey(t *testing.T) {
+	tests := []struct {
+		key, user, name string
+	}{
+		{"user-1", "user-1", "default"},
+		{"user-1:gifts", "user-1", "gifts"},
+		{"user-1:default", "user-1:default", "default"},
+		{"user-1:Gifts", "user-1:Gifts", "default"},
+		{":gifts", ":gifts", "default"},
+	}
+	for _, tt := range tests {
+		if user, name := splitCartKey(tt.key); user != tt.user || name != tt.name {
+			t.Errorf("splitCartKey(%q) = %q, %q; want %q, %q", tt.key, user, name, tt.user, tt.name)
+		}
+	}
+}
+
+func TestNamedCarts(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := &cartServer{store: newStore(t)}
+			for _, req := range []*pb.AddItemRequest{
+				{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}},
+				{UserId: "user-1", CartName: "gifts", Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 2}},
+				{UserId: "user-1", CartName: "work", Item: &pb.CartItem{ProductId: "1YMWWN1N4O", Quantity: 3}},
+				// Another user whose ID starts with "user-1" must not show up.
+				{UserId: "user-10", CartName: "other", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}},
+			} {
+				if _, err := s.AddItem(ctx, req); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// User "user-1:gifts" would otherwise share a key with user-1's
+			// gifts cart.
+			if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1:gifts",
+				Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 5}}); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("colliding user ID: got %v, want InvalidArgument", err)
+			}
+
+			def, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := quantities(def.GetItems()); !sameQuantities(got, map[string]int32{"OLJCESPC7Z": 1}) {
+				t.Errorf("default cart = %v", got)
+			}
+			gifts, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1", CartName: "gifts"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := quantities(gifts.GetItems()); !sameQuantities(got, map[string]int32{"66VCHSJNUP": 2}) {
+				t.Errorf("gifts cart = %v", got)
+			}
+			if gifts.GetUserId() != "user-1" || gifts.GetCartName() != "gifts" {
+				t.Errorf("gifts cart is (%q, %q), want (user-1, gifts)", gifts.GetUserId(), gifts.GetCartName())
+			}
+
+			if _, err := s.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "user-1", CartName: "work"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", CartName: "Bad Name",
+				Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}}); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("bad cart name: got %v, want InvalidArgument", err)
+			}
+
+			list, err := s.ListCarts(ctx, &pb.ListCartsRequest{UserId: "user-1"})
+			if status.Code(err) == codes.Unimplemented {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := list.GetCartNames(), []string{"default", "gifts", "work"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ListCarts = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestListCartsMemcachedUnimplemented(t *testing.T) {
+	store, _ := newTestMemcachedStore(t)
+	s := &cartServer{store: store}
+	_, err := s.ListCarts(context.Background(), &pb.ListCartsRequest{UserId: "user-1"})
+	if got, want := status.Code(err), codes.Unimplemented; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
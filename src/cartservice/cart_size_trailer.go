@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// Trailer keys set on GetCart responses when CART_SIZE_TRAILER is enabled.
+const (
+	cartItemsTrailer = "x-cart-items"
+	cartBytesTrailer = "x-cart-bytes"
+)
+
+// cartSizeTrailerFromEnv parses CART_SIZE_TRAILER. The trailer is off by
+// default.
+func cartSizeTrailerFromEnv() bool {
+	v := os.Getenv("CART_SIZE_TRAILER")
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid CART_SIZE_TRAILER %q, cart size trailer disabled", v)
+		return false
+	}
+	return on
+}
+
+// setCartSizeTrailer reports the number of cart lines and the serialized
+// size of cart in the response trailer, so clients and proxies can log cart
+// sizes without decoding the body.
+func setCartSizeTrailer(ctx context.Context, cart *pb.Cart) {
+	md := metadata.Pairs(
+		cartItemsTrailer, strconv.Itoa(len(cart.GetItems())),
+		cartBytesTrailer, strconv.Itoa(proto.Size(cart)),
+	)
+	if err := grpc.SetTrailer(ctx, md); err != nil {
+		log.Debugf("Failed to set cart size trailer: %v", err)
+	}
+}
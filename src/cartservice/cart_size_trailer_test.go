@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestGetCartSizeTrailer(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		store := newMemoryCartStore()
+		ctx := context.Background()
+		for _, id := range []string{"OLJCESPC7Z", "66VCHSJNUP"} {
+			if err := store.AddItem(ctx, "user-1", id, 2, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		srv := grpc.NewServer()
+		pb.RegisterCartServiceServer(srv, &cartServer{store: store, cartSizeTrailer: enabled})
+		client := pb.NewCartServiceClient(newTestGRPCConn(t, srv))
+
+		var trailer metadata.MD
+		cart, err := client.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"}, grpc.Trailer(&trailer))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantItems, wantBytes := "", ""
+		if enabled {
+			wantItems, wantBytes = "2", strconv.Itoa(proto.Size(cart))
+		}
+		if got := firstValue(trailer, cartItemsTrailer); got != wantItems {
+			t.Errorf("enabled=%v: got %s %q, want %q", enabled, cartItemsTrailer, got, wantItems)
+		}
+		if got := firstValue(trailer, cartBytesTrailer); got != wantBytes {
+			t.Errorf("enabled=%v: got %s %q, want %q", enabled, cartBytesTrailer, got, wantBytes)
+		}
+	}
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
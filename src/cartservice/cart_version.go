@@ -0,0 +1,45 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type expectedVersionKey struct{}
+
+// withExpectedVersion makes store writes made with the returned context
+// fail with Aborted unless the cart is at version *v when they change it.
+// A nil v leaves ctx alone, so writes happen whatever the version.
+func withExpectedVersion(ctx context.Context, v *int64) context.Context {
+	if v == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, expectedVersionKey{}, *v)
+}
+
+// checkCartVersion is how stores enforce withExpectedVersion: it is called
+// with the version of the cart about to be changed, inside whatever makes
+// the change atomic.
+func checkCartVersion(ctx context.Context, version int64) error {
+	want, ok := ctx.Value(expectedVersionKey{}).(int64)
+	if !ok || want == version {
+		return nil
+	}
+	return status.Errorf(codes.Aborted, "cart is at version %d, not the expected %d: it was changed since it was read", version, want)
+}
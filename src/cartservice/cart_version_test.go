@@ -0,0 +1,215 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func cartVersion(t *testing.T, store cartStore, userID string) int64 {
+	t.Helper()
+	cart, err := store.GetCart(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cart.GetVersion()
+}
+
+func TestCartVersionAdvancesOnWrites(t *testing.T) {
+	writes := []struct {
+		name string
+		op   func(ctx context.Context, store cartStore) error
+	}{
+		{"AddItem", func(ctx context.Context, store cartStore) error {
+			return store.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil)
+		}},
+		{"AddItems", func(ctx context.Context, store cartStore) error {
+			return store.AddItems(ctx, "user-1", []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 2}})
+		}},
+		{"UpdateItemQuantity", func(ctx context.Context, store cartStore) error {
+			return store.UpdateItemQuantity(ctx, "user-1", "66VCHSJNUP", 3)
+		}},
+		{"SaveForLater", func(ctx context.Context, store cartStore) error {
+			return store.SaveForLater(ctx, "user-1", "66VCHSJNUP")
+		}},
+		{"MoveToCart", func(ctx context.Context, store cartStore) error {
+			return store.MoveToCart(ctx, "user-1", "66VCHSJNUP")
+		}},
+		{"LockCurrency", func(ctx context.Context, store cartStore) error {
+			_, err := store.LockCurrency(ctx, "user-1", "EUR")
+			return err
+		}},
+		{"EmptyCart", func(ctx context.Context, store cartStore) error {
+			return store.EmptyCart(ctx, "user-1")
+		}},
+		{"ImportCart", func(ctx context.Context, store cartStore) error {
+			return store.ImportCart(ctx, "user-1", storedCart{Items: []cartItem{{ProductID: "OLJCESPC7Z", Quantity: 1}}})
+		}},
+	}
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			last := cartVersion(t, store, "user-1")
+			if last != 0 {
+				t.Fatalf("new cart at version %d, want 0", last)
+			}
+			for _, w := range writes {
+				if err := w.op(ctx, store); err != nil {
+					t.Fatalf("%s: %v", w.name, err)
+				}
+				v := cartVersion(t, store, "user-1")
+				if v <= last {
+					t.Errorf("%s: version went from %d to %d, want it to go up", w.name, last, v)
+				}
+				last = v
+			}
+		})
+	}
+}
+
+func TestExpectedVersion(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+
+			// Zero is the version of a cart that was never written.
+			zero := int64(0)
+			if err := store.AddItem(withExpectedVersion(ctx, &zero), "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+				t.Fatalf("first add expecting version 0: %v", err)
+			}
+			before, err := store.GetCart(ctx, "user-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stale := before.GetVersion() - 1
+			staleCtx := withExpectedVersion(ctx, &stale)
+			writes := map[string]func() error{
+				"AddItem": func() error { return store.AddItem(staleCtx, "user-1", "66VCHSJNUP", 1, nil) },
+				"AddItems": func() error {
+					return store.AddItems(staleCtx, "user-1", []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}})
+				},
+				"UpdateItemQuantity": func() error { return store.UpdateItemQuantity(staleCtx, "user-1", "OLJCESPC7Z", 5) },
+				"EmptyCart":          func() error { return store.EmptyCart(staleCtx, "user-1") },
+				"SaveForLater":       func() error { return store.SaveForLater(staleCtx, "user-1", "OLJCESPC7Z") },
+				"ImportCart":         func() error { return store.ImportCart(staleCtx, "user-1", storedCart{Items: []cartItem{}}) },
+			}
+			for op, write := range writes {
+				if got := status.Code(write()); got != codes.Aborted {
+					t.Errorf("%s with a stale version: got %s, want Aborted", op, got)
+				}
+			}
+			after, err := store.GetCart(ctx, "user-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(before, after) {
+				t.Errorf("rejected writes changed the cart: got %v, want %v", after, before)
+			}
+
+			current := after.GetVersion()
+			if err := store.UpdateItemQuantity(withExpectedVersion(ctx, &current), "user-1", "OLJCESPC7Z", 5); err != nil {
+				t.Errorf("write at the current version: %v", err)
+			}
+		})
+	}
+}
+
+// Of several writers that read the same version, exactly one gets to
+// change the cart.
+func TestExpectedVersionConcurrentWriters(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			if err := store.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			version := cartVersion(t, store, "user-1")
+
+			const writers = 8
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				won      int
+				rejected int
+			)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := store.AddItem(withExpectedVersion(ctx, &version), "user-1", "66VCHSJNUP", 1, nil)
+					mu.Lock()
+					defer mu.Unlock()
+					switch status.Code(err) {
+					case codes.OK:
+						won++
+					case codes.Aborted:
+						rejected++
+					default:
+						t.Errorf("AddItem: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			if won != 1 || rejected != writers-1 {
+				t.Errorf("got %d writes through and %d rejected, want 1 and %d", won, rejected, writers-1)
+			}
+		})
+	}
+}
+
+func TestCartServerExpectedVersion(t *testing.T) {
+	s := &cartServer{store: newMemoryCartStore()}
+	ctx := context.Background()
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := cart.GetVersion()
+
+	// Another tab changes the cart after this one read it.
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "user-1", ExpectedVersion: proto.Int64(read)})
+	if got := status.Code(err); got != codes.Aborted {
+		t.Fatalf("EmptyCart with a stale version: got %v, want Aborted", err)
+	}
+
+	cart, err = s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.GetItems()) != 2 {
+		t.Errorf("rejected EmptyCart emptied the cart: %v", cart.GetItems())
+	}
+	if _, err := s.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "user-1", ExpectedVersion: proto.Int64(cart.GetVersion())}); err != nil {
+		t.Errorf("EmptyCart at the current version: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+)
+
+// currencyLockFromEnv parses CART_CURRENCY_LOCK. When on, a cart remembers
+// the currency its first item was added in so the frontend can warn users
+// who later switch currency. Off by default.
+func currencyLockFromEnv() bool {
+	v := os.Getenv("CART_CURRENCY_LOCK")
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid CART_CURRENCY_LOCK %q, currency lock disabled", v)
+		return false
+	}
+	if on {
+		log.Info("Locking carts to the currency they were created in")
+	}
+	return on
+}
+
+// lockCartCurrency pins the user's cart to currency if it isn't pinned yet.
+// The item has already been added by now, so a failure is only logged: the
+// cart simply stays unlocked rather than failing an add the client would
+// retry.
+func (s *cartServer) lockCartCurrency(ctx context.Context, userID, currency string) {
+	if currency == "" {
+		return
+	}
+	locked, err := s.store.LockCurrency(ctx, userID, currency)
+	if err != nil {
+		log.Warnf("Failed to lock cart currency for user %s: %v", userID, err)
+		return
+	}
+	if locked != currency {
+		log.Debugf("Cart for user %s is locked to %s, item added in %s", userID, locked, currency)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestCurrencyLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		want    string
+	}{
+		{"enabled keeps first currency", true, "EUR"},
+		{"disabled records nothing", false, ""},
+	}
+	for storeName, newStore := range testCartStores() {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				s := &cartServer{store: newStore(t), currencyLock: tt.enabled}
+				for _, currency := range []string{"EUR", "JPY"} {
+					if _, err := s.AddItem(ctx, &pb.AddItemRequest{
+						UserId:       "user-1",
+						Item:         &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1},
+						CurrencyCode: currency,
+					}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cart.CurrencyCode != tt.want {
+					t.Errorf("got currency %q, want %q", cart.CurrencyCode, tt.want)
+				}
+				if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 {
+					t.Errorf("got items %v, want one line with quantity 2", cart.Items)
+				}
+
+				// Emptying the cart releases the lock for the next one.
+				if _, err := s.EmptyCart(ctx, &pb.EmptyCartRequest{UserId: "user-1"}); err != nil {
+					t.Fatal(err)
+				}
+				if cart, _ = s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"}); cart.CurrencyCode != "" {
+					t.Errorf("emptied cart still locked to %q", cart.CurrencyCode)
+				}
+			})
+		}
+	}
+}
+
+func TestRedisReadsUnlockedCartFormat(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	// Carts saved before currency locking are a bare array of items.
+	mr.Set(store.key("user-1"), `[{"product_id":"OLJCESPC7Z","quantity":3}]`)
+	ctx := context.Background()
+
+	if _, err := store.LockCurrency(ctx, "user-1", "CAD"); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := store.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.CurrencyCode != "CAD" || len(cart.Items) != 1 || cart.Items[0].Quantity != 3 {
+		t.Errorf("got cart %v, want 3 x OLJCESPC7Z locked to CAD", cart)
+	}
+}
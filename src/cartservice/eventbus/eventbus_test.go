@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventbus
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestNewMessage(t *testing.T) {
+	prev := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(prev) })
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	event := wrapperspb.String("hello")
+
+	msg, err := NewMessage(ctx, "user-1", event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Key != "user-1" {
+		t.Errorf("key = %q, want user-1", msg.Key)
+	}
+	want := map[string]string{
+		EventTypeHeader: "google.protobuf.StringValue",
+		"traceparent":   "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01",
+	}
+	if !reflect.DeepEqual(msg.Headers, want) {
+		t.Errorf("headers = %v, want %v", msg.Headers, want)
+	}
+	var decoded wrapperspb.StringValue
+	if err := proto.Unmarshal(msg.Data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.GetValue() != "hello" {
+		t.Errorf("decoded %q, want hello", decoded.GetValue())
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		bus, brokers string
+		want         string
+		wantErr      bool
+	}{
+		{"", "", "<nil>", false},
+		{"", "kafka:9092", "*eventbus.Kafka", false},
+		{"kafka", "a:9092, b:9092", "*eventbus.Kafka", false},
+		{"kafka", "", "", true},
+		{"memory", "", "*eventbus.Memory", false},
+		{"rabbitmq", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("EVENT_BUS", tt.bus)
+		t.Setenv("KAFKA_BROKERS", tt.brokers)
+		p, err := FromEnv(context.Background())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("EVENT_BUS=%q KAFKA_BROKERS=%q: error %v, want error %v", tt.bus, tt.brokers, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := "<nil>"
+		if p != nil {
+			got = reflect.TypeOf(p).String()
+			p.Close()
+		}
+		if got != tt.want {
+			t.Errorf("EVENT_BUS=%q KAFKA_BROKERS=%q: got %s, want %s", tt.bus, tt.brokers, got, tt.want)
+		}
+	}
+}
+
+func TestKafkaBrokersFromEnv(t *testing.T) {
+	t.Setenv("EVENT_BUS", "kafka")
+	t.Setenv("KAFKA_BROKERS", "a:9092, b:9092,")
+	p, err := FromEnv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if got, want := p.(*Kafka).brokers, []string{"a:9092", "b:9092"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("brokers = %v, want %v", got, want)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	bus := NewMemory()
+	var gotA, gotB []string
+	bus.Subscribe("a", func(msg Message) { gotA = append(gotA, msg.Key) })
+	bus.Subscribe("b", func(msg Message) { gotB = append(gotB, msg.Key) })
+
+	for _, p := range []struct{ topic, key string }{{"a", "1"}, {"b", "2"}, {"a", "3"}, {"c", "4"}} {
+		if err := bus.Publish(context.Background(), p.topic, Message{Key: p.key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"1", "3"}; !reflect.DeepEqual(gotA, want) {
+		t.Errorf("topic a got %v, want %v", gotA, want)
+	}
+	if want := []string{"2"}; !reflect.DeepEqual(gotB, want) {
+		t.Errorf("topic b got %v, want %v", gotB, want)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventbus
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes to Kafka topics, partitioning by message key.
+type Kafka struct {
+	brokers []string
+
+	mu      sync.Mutex
+	writers map[string]*kafka.Writer
+}
+
+func NewKafka(brokers []string) *Kafka {
+	return &Kafka{brokers: brokers, writers: make(map[string]*kafka.Writer)}
+}
+
+// writer returns the topic's writer, creating it on first use.
+func (k *Kafka) writer(topic string) *kafka.Writer {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	w, ok := k.writers[topic]
+	if !ok {
+		w = &kafka.Writer{
+			Addr:         kafka.TCP(k.brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// Events are published one at a time; the default one-second
+			// batch wait would stall each of them.
+			BatchTimeout: 10 * time.Millisecond,
+		}
+		k.writers[topic] = w
+	}
+	return w
+}
+
+func (k *Kafka) Publish(ctx context.Context, topic string, msg Message) error {
+	km := kafka.Message{Key: []byte(msg.Key), Value: msg.Data}
+	for _, name := range sortedKeys(msg.Headers) {
+		km.Headers = append(km.Headers, kafka.Header{Key: name, Value: []byte(msg.Headers[name])})
+	}
+	return k.writer(topic).WriteMessages(ctx, km)
+}
+
+func (k *Kafka) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var firstErr error
+	for _, w := range k.writers {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventbus
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process bus, for tests and for running the demo without
+// a broker. Subscribers run synchronously inside Publish.
+type Memory struct {
+	mu   sync.RWMutex
+	subs map[string][]func(Message)
+}
+
+func NewMemory() *Memory {
+	return &Memory{subs: make(map[string][]func(Message))}
+}
+
+// Subscribe calls handler with every message later published to topic.
+func (m *Memory) Subscribe(topic string, handler func(Message)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subs[topic] = append(m.subs[topic], handler)
+}
+
+func (m *Memory) Publish(ctx context.Context, topic string, msg Message) error {
+	m.mu.RLock()
+	handlers := m.subs[topic]
+	m.mu.RUnlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
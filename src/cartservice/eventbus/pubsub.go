@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventbus
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub/v2"
+)
+
+// PubSub publishes to Google Cloud Pub/Sub topics of one project, using the
+// message key as the ordering key. It talks to the emulator when
+// PUBSUB_EMULATOR_HOST is set.
+type PubSub struct {
+	client *pubsub.Client
+
+	mu         sync.Mutex
+	publishers map[string]*pubsub.Publisher
+}
+
+func NewPubSub(ctx context.Context, projectID string) (*PubSub, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &PubSub{client: client, publishers: make(map[string]*pubsub.Publisher)}, nil
+}
+
+// publisher returns the topic's publisher, creating it on first use.
+func (p *PubSub) publisher(topic string) *pubsub.Publisher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pub, ok := p.publishers[topic]
+	if !ok {
+		pub = p.client.Publisher(topic)
+		pub.EnableMessageOrdering = true
+		p.publishers[topic] = pub
+	}
+	return pub
+}
+
+func (p *PubSub) Publish(ctx context.Context, topic string, msg Message) error {
+	pub := p.publisher(topic)
+	_, err := pub.Publish(ctx, &pubsub.Message{
+		Data:        msg.Data,
+		Attributes:  msg.Headers,
+		OrderingKey: msg.Key,
+	}).Get(ctx)
+	if err != nil && msg.Key != "" {
+		// A failure pauses the ordering key; let the key's next event
+		// through rather than failing every later one.
+		pub.ResumePublish(msg.Key)
+	}
+	return err
+}
+
+func (p *PubSub) Close() error {
+	p.mu.Lock()
+	for _, pub := range p.publishers {
+		pub.Stop()
+	}
+	p.mu.Unlock()
+	return p.client.Close()
+}
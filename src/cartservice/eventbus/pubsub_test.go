@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventbus
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/v2/pstest"
+)
+
+func TestPubSub(t *testing.T) {
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	ctx := context.Background()
+
+	p, err := NewPubSub(ctx, "demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := p.client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: "projects/demo/topics/cart-events"}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := Message{Key: "user-1", Data: []byte("event"), Headers: map[string]string{EventTypeHeader: "hipstershop.CartEmptied"}}
+	if err := p.Publish(ctx, "cart-events", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	got := srv.Messages()
+	if len(got) != 1 {
+		t.Fatalf("got %d messages, want 1", len(got))
+	}
+	if string(got[0].Data) != "event" || got[0].OrderingKey != "user-1" || !reflect.DeepEqual(got[0].Attributes, msg.Headers) {
+		t.Errorf("got data %q, ordering key %q, attributes %v; want %q, %q, %v",
+			got[0].Data, got[0].OrderingKey, got[0].Attributes, msg.Data, msg.Key, msg.Headers)
+	}
+}
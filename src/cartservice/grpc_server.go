@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// grpcServerConfig holds the connection management settings of the gRPC
+// server. Zero values leave gRPC's defaults in place.
+type grpcServerConfig struct {
+	// keepalive pings idle connections after keepaliveTime and closes them
+	// when a ping isn't answered within keepaliveTimeout, so connections
+	// dropped by an L4 load balancer don't linger.
+	keepaliveTime, keepaliveTimeout time.Duration
+	// maxConnectionIdle closes connections without RPCs for that long.
+	maxConnectionIdle time.Duration
+	// maxConnectionAge closes connections after that long, letting
+	// in-flight RPCs finish within maxConnectionAgeGrace, so clients
+	// reconnect and spread over new replicas.
+	maxConnectionAge, maxConnectionAgeGrace time.Duration
+	// keepaliveMinTime is the shortest client ping interval tolerated,
+	// gRPC's 5m if zero; clients pinging more often are disconnected.
+	// permitWithoutStream allows client pings on connections with no RPCs
+	// in flight.
+	keepaliveMinTime    time.Duration
+	permitWithoutStream bool
+	// maxConcurrentStreams caps the RPCs in flight on one connection.
+	maxConcurrentStreams uint32
+}
+
+// grpcServerConfigFromEnv reads GRPC_KEEPALIVE_TIME, GRPC_KEEPALIVE_TIMEOUT,
+// GRPC_MAX_CONNECTION_IDLE, GRPC_MAX_CONNECTION_AGE,
+// GRPC_MAX_CONNECTION_AGE_GRACE, GRPC_KEEPALIVE_MIN_TIME,
+// GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM and GRPC_MAX_CONCURRENT_STREAMS.
+func grpcServerConfigFromEnv() grpcServerConfig {
+	var c grpcServerConfig
+	durationFromEnv("GRPC_KEEPALIVE_TIME", &c.keepaliveTime)
+	durationFromEnv("GRPC_KEEPALIVE_TIMEOUT", &c.keepaliveTimeout)
+	durationFromEnv("GRPC_MAX_CONNECTION_IDLE", &c.maxConnectionIdle)
+	durationFromEnv("GRPC_MAX_CONNECTION_AGE", &c.maxConnectionAge)
+	durationFromEnv("GRPC_MAX_CONNECTION_AGE_GRACE", &c.maxConnectionAgeGrace)
+	durationFromEnv("GRPC_KEEPALIVE_MIN_TIME", &c.keepaliveMinTime)
+	if v := os.Getenv("GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM"); v != "" {
+		if on, err := strconv.ParseBool(v); err != nil {
+			log.Warnf("Ignoring invalid GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM %q", v)
+		} else {
+			c.permitWithoutStream = on
+		}
+	}
+	if v := os.Getenv("GRPC_MAX_CONCURRENT_STREAMS"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err != nil {
+			log.Warnf("Ignoring invalid GRPC_MAX_CONCURRENT_STREAMS %q, streams are unlimited", v)
+		} else {
+			c.maxConcurrentStreams = uint32(n)
+		}
+	}
+	return c
+}
+
+// durationFromEnv sets *d from the duration in key, leaving it as it is
+// when key is unset or invalid.
+func durationFromEnv(key string, d *time.Duration) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil || parsed < 0 {
+		log.Warnf("Ignoring invalid %s %q", key, v)
+		return
+	}
+	*d = parsed
+}
+
+// serverOptions returns the grpc.ServerOptions applying c.
+func (c grpcServerConfig) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	params := keepalive.ServerParameters{
+		Time:                  c.keepaliveTime,
+		Timeout:               c.keepaliveTimeout,
+		MaxConnectionIdle:     c.maxConnectionIdle,
+		MaxConnectionAge:      c.maxConnectionAge,
+		MaxConnectionAgeGrace: c.maxConnectionAgeGrace,
+	}
+	if params != (keepalive.ServerParameters{}) {
+		log.Infof("gRPC keepalive: time=%v timeout=%v max_idle=%v max_age=%v max_age_grace=%v",
+			c.keepaliveTime, c.keepaliveTimeout, c.maxConnectionIdle, c.maxConnectionAge, c.maxConnectionAgeGrace)
+		opts = append(opts, grpc.KeepaliveParams(params))
+	}
+	if c.keepaliveMinTime > 0 || c.permitWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             c.keepaliveMinTime,
+			PermitWithoutStream: c.permitWithoutStream,
+		}))
+	}
+	if c.maxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.maxConcurrentStreams))
+	}
+	return opts
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCServerConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want grpcServerConfig
+	}{
+		{"unset", nil, grpcServerConfig{}},
+		{
+			"all set",
+			map[string]string{
+				"GRPC_KEEPALIVE_TIME":                  "30s",
+				"GRPC_KEEPALIVE_TIMEOUT":               "10s",
+				"GRPC_MAX_CONNECTION_IDLE":             "5m",
+				"GRPC_MAX_CONNECTION_AGE":              "30m",
+				"GRPC_MAX_CONNECTION_AGE_GRACE":        "1m",
+				"GRPC_KEEPALIVE_MIN_TIME":              "20s",
+				"GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM": "true",
+				"GRPC_MAX_CONCURRENT_STREAMS":          "100",
+			},
+			grpcServerConfig{
+				keepaliveTime:         30 * time.Second,
+				keepaliveTimeout:      10 * time.Second,
+				maxConnectionIdle:     5 * time.Minute,
+				maxConnectionAge:      30 * time.Minute,
+				maxConnectionAgeGrace: time.Minute,
+				keepaliveMinTime:      20 * time.Second,
+				permitWithoutStream:   true,
+				maxConcurrentStreams:  100,
+			},
+		},
+		{
+			"invalid values ignored",
+			map[string]string{
+				"GRPC_KEEPALIVE_TIME":                  "often",
+				"GRPC_MAX_CONNECTION_AGE":              "-1m",
+				"GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM": "maybe",
+				"GRPC_MAX_CONCURRENT_STREAMS":          "-5",
+			},
+			grpcServerConfig{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{
+				"GRPC_KEEPALIVE_TIME", "GRPC_KEEPALIVE_TIMEOUT", "GRPC_MAX_CONNECTION_IDLE",
+				"GRPC_MAX_CONNECTION_AGE", "GRPC_MAX_CONNECTION_AGE_GRACE", "GRPC_KEEPALIVE_MIN_TIME",
+				"GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM", "GRPC_MAX_CONCURRENT_STREAMS",
+			} {
+				t.Setenv(key, tt.env[key])
+			}
+			if got := grpcServerConfigFromEnv(); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCServerConfigOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  grpcServerConfig
+		want int
+	}{
+		{"defaults", grpcServerConfig{}, 0},
+		{"keepalive", grpcServerConfig{keepaliveTime: time.Minute, maxConnectionAge: time.Hour}, 1},
+		{"enforcement", grpcServerConfig{permitWithoutStream: true}, 1},
+		{"all", grpcServerConfig{keepaliveTime: time.Minute, keepaliveMinTime: time.Second, maxConcurrentStreams: 10}, 3},
+	}
+	for _, tt := range tests {
+		if got := len(tt.cfg.serverOptions()); got != tt.want {
+			t.Errorf("%s: got %d options, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGRPCMaxConnectionAgeClosesConnections(t *testing.T) {
+	cfg := grpcServerConfig{maxConnectionAge: 50 * time.Millisecond, maxConnectionAgeGrace: 50 * time.Millisecond}
+	srv := grpc.NewServer(cfg.serverOptions()...)
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	conn := newTestGRPCConn(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	// The server sends GOAWAY once the connection is old enough, which
+	// leaves the client idle until its next call.
+	for state := conn.GetState(); state == connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			t.Fatal("connection still open after its max age")
+		}
+	}
+}
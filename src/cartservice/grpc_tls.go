@@ -0,0 +1,62 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcServerTLSFromEnv returns the credentials of the gRPC listener: TLS
+// with the certificate in GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE, and
+// mutual TLS when GRPC_TLS_CLIENT_CA_FILE names the CA bundle client
+// certificates must be signed by. It returns nil, for plaintext, when none
+// of them is set.
+func grpcServerTLSFromEnv() (credentials.TransportCredentials, error) {
+	certFile, keyFile := os.Getenv("GRPC_TLS_CERT_FILE"), os.Getenv("GRPC_TLS_KEY_FILE")
+	clientCAFile := os.Getenv("GRPC_TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("GRPC_TLS_CLIENT_CA_FILE is set but TLS is off: set GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("GRPC_TLS_CERT_FILE and GRPC_TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load gRPC server certificate: %v", err)
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GRPC_TLS_CLIENT_CA_FILE: %v", err)
+		}
+		cas := x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("GRPC_TLS_CLIENT_CA_FILE %s holds no PEM certificates", clientCAFile)
+		}
+		cfg.ClientCAs = cas
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(cfg), nil
+}
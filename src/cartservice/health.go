@@ -0,0 +1,252 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const defaultHealthCheckInterval = 5 * time.Second
+
+// healthCheckTimeout bounds the store ping made by a unary Check so that a
+// hung backend makes the probe fail rather than time out.
+const healthCheckTimeout = time.Second
+
+// storeHealthService is the health service name that also reports
+// NOT_SERVING while carts are kept in the in-memory fallback rather than the
+// configured backend.
+const storeHealthService = "cartservice.store"
+
+// healthServices are the service names health checks answer for: the
+// server as a whole (""), CartService and storeHealthService. All follow
+// the cart store.
+var healthServices = map[string]bool{
+	"":                                     true,
+	pb.CartService_ServiceDesc.ServiceName: true,
+	storeHealthService:                     true,
+}
+
+// fallbackReporter is implemented by stores that can be running on the
+// in-memory fallback.
+type fallbackReporter interface {
+	onFallback() bool
+}
+
+// healthServer implements the gRPC health protocol on top of the cart
+// store's Ping. Check pings the store directly; watchStore pings it
+// periodically and every Watch stream is told about each status change.
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	store cartStore
+
+	mu       sync.Mutex
+	status   grpc_health_v1.HealthCheckResponse_ServingStatus
+	watchers map[chan grpc_health_v1.HealthCheckResponse_ServingStatus]struct{}
+	// stopping pins the status to NOT_SERVING once the server is shutting
+	// down, whatever the store says.
+	stopping bool
+}
+
+func newHealthServer(store cartStore) *healthServer {
+	return &healthServer{
+		store:    store,
+		status:   grpc_health_v1.HealthCheckResponse_SERVING,
+		watchers: make(map[chan grpc_health_v1.HealthCheckResponse_ServingStatus]struct{}),
+	}
+}
+
+func (h *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if !healthServices[req.GetService()] {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return &grpc_health_v1.HealthCheckResponse{Status: h.statusFor(req.GetService(), h.probe(ctx))}, nil
+}
+
+func (h *healthServer) Watch(req *grpc_health_v1.HealthCheckRequest, srv grpc_health_v1.Health_WatchServer) error {
+	if !healthServices[req.GetService()] {
+		// As the protocol asks, report the service unknown and keep the
+		// stream open rather than failing it.
+		if err := srv.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN}); err != nil {
+			return err
+		}
+		<-srv.Context().Done()
+		return nil
+	}
+	// A buffer of one is enough: setStatus replaces any update the stream
+	// hasn't picked up yet, so a slow watcher only ever sees the latest.
+	updates := make(chan grpc_health_v1.HealthCheckResponse_ServingStatus, 1)
+
+	h.mu.Lock()
+	h.watchers[updates] = struct{}{}
+	current := h.statusFor(req.GetService(), h.status)
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.watchers, updates)
+		h.mu.Unlock()
+	}()
+
+	last := current
+	if err := srv.Send(&grpc_health_v1.HealthCheckResponse{Status: current}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-srv.Context().Done():
+			return nil
+		case st := <-updates:
+			st = h.statusFor(req.GetService(), st)
+			if st == last {
+				continue
+			}
+			if err := srv.Send(&grpc_health_v1.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+	}
+}
+
+// statusFor is the status reported for service when the store's is st.
+func (h *healthServer) statusFor(service string, st grpc_health_v1.HealthCheckResponse_ServingStatus) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	if service != storeHealthService {
+		return st
+	}
+	if fr, ok := h.store.(fallbackReporter); ok && fr.onFallback() {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return st
+}
+
+// storeChanged tells every Watch stream to recompute its status, as after
+// the store moves off the in-memory fallback.
+func (h *healthServer) storeChanged() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- h.status
+	}
+}
+
+func (h *healthServer) isStopping() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stopping
+}
+
+func (h *healthServer) getStatus() grpc_health_v1.HealthCheckResponse_ServingStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+func (h *healthServer) setStatus(st grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopping {
+		st = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	if h.status == st {
+		return
+	}
+	h.status = st
+	for ch := range h.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- st
+	}
+}
+
+// shutdown reports NOT_SERVING from now on, so load balancers and Watch
+// clients move away while in-flight calls drain.
+func (h *healthServer) shutdown() {
+	h.mu.Lock()
+	h.stopping = true
+	h.mu.Unlock()
+	h.setStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+}
+
+// probe pings the store, records the resulting status and returns it.
+func (h *healthServer) probe(ctx context.Context) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	if h.isStopping() {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	err := h.store.Ping(ctx)
+	prev := h.getStatus()
+	if err != nil {
+		if prev == grpc_health_v1.HealthCheckResponse_SERVING {
+			log.Warnf("Cart store health check failed, reporting NOT_SERVING: %v", err)
+		}
+		h.setStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	if prev != grpc_health_v1.HealthCheckResponse_SERVING {
+		log.Info("Cart store is reachable again, reporting SERVING")
+	}
+	h.setStatus(grpc_health_v1.HealthCheckResponse_SERVING)
+	return grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+// watchStore probes the store every interval so that Watch streams learn
+// about outages without anyone calling Check. When ctx is cancelled, as on
+// SIGTERM, it marks the server as shutting down and returns.
+func (h *healthServer) watchStore(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, min(interval, healthCheckTimeout))
+		h.probe(pingCtx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			h.shutdown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthCheckIntervalFromEnv reads HEALTH_CHECK_INTERVAL, the period between
+// store pings, falling back to defaultHealthCheckInterval.
+func healthCheckIntervalFromEnv() time.Duration {
+	v := os.Getenv("HEALTH_CHECK_INTERVAL")
+	if v == "" {
+		return defaultHealthCheckInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("Ignoring invalid HEALTH_CHECK_INTERVAL %q, using %v", v, defaultHealthCheckInterval)
+		return defaultHealthCheckInterval
+	}
+	return d
+}
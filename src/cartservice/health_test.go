@@ -0,0 +1,256 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// flakyStore is a memory store whose pings fail while down is set.
+type flakyStore struct {
+	*memoryCartStore
+
+	mu   sync.Mutex
+	down bool
+}
+
+func newFlakyStore() *flakyStore {
+	return &flakyStore{memoryCartStore: newMemoryCartStore()}
+}
+
+func (p *flakyStore) setDown(down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = down
+}
+
+func (p *flakyStore) Ping(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// newTestGRPCConn serves srv on an in-memory listener and dials it.
+func newTestGRPCConn(t *testing.T, srv *grpc.Server) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHealthWatchFollowsStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newFlakyStore()
+	health := newHealthServer(store)
+	go health.watchStore(ctx, 10*time.Millisecond)
+
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, health)
+	client := grpc_health_v1.NewHealthClient(newTestGRPCConn(t, srv))
+
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []grpc_health_v1.HealthCheckResponse_ServingStatus{
+		grpc_health_v1.HealthCheckResponse_SERVING,
+		grpc_health_v1.HealthCheckResponse_NOT_SERVING,
+		grpc_health_v1.HealthCheckResponse_SERVING,
+	}
+	for i, w := range want {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.GetStatus(); got != w {
+			t.Fatalf("update %d: got %s, want %s", i, got, w)
+		}
+		// Flip the backend after each observed status to drive the next one.
+		store.setDown(i == 0)
+	}
+
+	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.GetStatus(), grpc_health_v1.HealthCheckResponse_SERVING; got != want {
+		t.Errorf("Check: got %s, want %s", got, want)
+	}
+}
+
+func TestHealthCheckPingsStore(t *testing.T) {
+	store := newFlakyStore()
+	health := newHealthServer(store)
+	ctx := context.Background()
+
+	tests := []struct {
+		down bool
+		want grpc_health_v1.HealthCheckResponse_ServingStatus
+	}{
+		{false, grpc_health_v1.HealthCheckResponse_SERVING},
+		{true, grpc_health_v1.HealthCheckResponse_NOT_SERVING},
+		{false, grpc_health_v1.HealthCheckResponse_SERVING},
+	}
+	for _, tt := range tests {
+		store.setDown(tt.down)
+		resp, err := health.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.GetStatus(); got != tt.want {
+			t.Errorf("down=%v: got %s, want %s", tt.down, got, tt.want)
+		}
+	}
+}
+
+func TestHealthCheckRedisDown(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	health := newHealthServer(store)
+
+	mr.Close()
+	resp, err := health.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.GetStatus(), grpc_health_v1.HealthCheckResponse_NOT_SERVING; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestHealthWatchEndsWithStream(t *testing.T) {
+	health := newHealthServer(newMemoryCartStore())
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, health)
+	client := grpc_health_v1.NewHealthClient(newTestGRPCConn(t, srv))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// The server side must unregister the watcher once the client leaves.
+	deadline := time.Now().Add(time.Second)
+	for {
+		health.mu.Lock()
+		n := len(health.watchers)
+		health.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d watchers still registered after stream ended", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthServiceNames(t *testing.T) {
+	health := newHealthServer(newMemoryCartStore())
+	tests := []struct {
+		service  string
+		want     grpc_health_v1.HealthCheckResponse_ServingStatus
+		wantCode codes.Code
+	}{
+		{"", grpc_health_v1.HealthCheckResponse_SERVING, codes.OK},
+		{"hipstershop.CartService", grpc_health_v1.HealthCheckResponse_SERVING, codes.OK},
+		{"cartservice.store", grpc_health_v1.HealthCheckResponse_SERVING, codes.OK},
+		{"hipstershop.CheckoutService", grpc_health_v1.HealthCheckResponse_UNKNOWN, codes.NotFound},
+	}
+	for _, tt := range tests {
+		resp, err := health.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: tt.service})
+		if got := status.Code(err); got != tt.wantCode {
+			t.Errorf("%q: got %s, want %s", tt.service, got, tt.wantCode)
+			continue
+		}
+		if got := resp.GetStatus(); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.service, got, tt.want)
+		}
+	}
+}
+
+func TestHealthWatchUnknownService(t *testing.T) {
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, newHealthServer(newMemoryCartStore()))
+	client := grpc_health_v1.NewHealthClient(newTestGRPCConn(t, srv))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{Service: "hipstershop.CheckoutService"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.GetStatus(), grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestHealthNotServingAfterShutdown(t *testing.T) {
+	health := newHealthServer(newMemoryCartStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		health.watchStore(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	// The store is still fine, but a stopping server must not report
+	// SERVING again.
+	resp, err := health.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.GetStatus(), grpc_health_v1.HealthCheckResponse_NOT_SERVING; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
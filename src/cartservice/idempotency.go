@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// idempotencyKeyHeader is the gRPC metadata key clients set on AddItem or
+// AddItems to make retries safe: a second call carrying a key already seen
+// for the same user within the window is acknowledged without adding
+// anything.
+const idempotencyKeyHeader = "x-idempotency-key"
+
+// addDeduper remembers recently seen AddItem idempotency keys.
+type addDeduper interface {
+	// claim records key for userID and reports whether it was unseen.
+	claim(ctx context.Context, userID, key string) (bool, error)
+	// release forgets key so that a retry of a failed add is not dropped.
+	release(ctx context.Context, userID, key string)
+}
+
+// maxIdempotencyKeyLen bounds idempotency keys, which end up in Redis key
+// names.
+const maxIdempotencyKeyLen = 128
+
+// idempotencyKey returns the request's idempotency key: field, the
+// request's idempotency_key, when set, else the x-idempotency-key metadata.
+func idempotencyKey(ctx context.Context, field string) string {
+	if field != "" {
+		return field
+	}
+	return idempotencyKeyFromContext(ctx)
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(idempotencyKeyHeader); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// idempotencyWindowFromEnv parses IDEMPOTENT_ADD_WINDOW. Zero, the default,
+// leaves AddItem purely additive.
+func idempotencyWindowFromEnv() time.Duration {
+	v := os.Getenv("IDEMPOTENT_ADD_WINDOW")
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid IDEMPOTENT_ADD_WINDOW %q, idempotent adds disabled", v)
+		return 0
+	}
+	return d
+}
+
+// newAddDeduper picks the deduper matching the store so that keys are shared
+// by every replica when carts live in Redis. A store that fell back to
+// memory gets one that follows it back to Redis.
+func newAddDeduper(store cartStore, window time.Duration) addDeduper {
+	switch store := store.(type) {
+	case *redisCartStore:
+		return &redisAddDeduper{client: store.client, prefix: store.keyPrefix, window: window}
+	case *failoverCartStore:
+		return &failoverAddDeduper{dedupers: newPerActiveStore(store, func(active cartStore) addDeduper {
+			return newAddDeduper(active, window)
+		})}
+	}
+	return &memoryAddDeduper{window: window, seen: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+// failoverAddDeduper uses the deduper of the store a failoverCartStore is
+// using. Keys claimed in memory are forgotten once it moves to Redis.
+type failoverAddDeduper struct {
+	dedupers *perActiveStore[addDeduper]
+}
+
+func (d *failoverAddDeduper) claim(ctx context.Context, userID, key string) (bool, error) {
+	return d.dedupers.get().claim(ctx, userID, key)
+}
+
+func (d *failoverAddDeduper) release(ctx context.Context, userID, key string) {
+	d.dedupers.get().release(ctx, userID, key)
+}
+
+type redisAddDeduper struct {
+	client redis.UniversalClient
+	prefix string // the store's REDIS_KEY_PREFIX
+	window time.Duration
+}
+
+// redisIdempotencyKeyPrefix follows the store's prefix on idempotency keys.
+const redisIdempotencyKeyPrefix = redisAuxKeyPrefix + "idempotency:"
+
+func (d *redisAddDeduper) key(userID, key string) string {
+	return d.prefix + redisIdempotencyKeyPrefix + userID + ":" + key
+}
+
+func (d *redisAddDeduper) claim(ctx context.Context, userID, key string) (bool, error) {
+	ok, err := d.client.SetNX(ctx, d.key(userID, key), 1, d.window).Result()
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "failed to record idempotency key: %v", err)
+	}
+	return ok, nil
+}
+
+func (d *redisAddDeduper) release(ctx context.Context, userID, key string) {
+	if err := d.client.Del(ctx, d.key(userID, key)).Err(); err != nil {
+		log.Warnf("Failed to release idempotency key %s for user %s: %v", key, userID, err)
+	}
+}
+
+type memoryAddDeduper struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func (d *memoryAddDeduper) claim(_ context.Context, userID, key string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	// Drop expired keys once per window rather than on every claim.
+	if now.Sub(d.lastSweep) > d.window {
+		for k, at := range d.seen {
+			if now.Sub(at) > d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	k := userID + ":" + key
+	if at, ok := d.seen[k]; ok && now.Sub(at) <= d.window {
+		return false, nil
+	}
+	d.seen[k] = now
+	return true, nil
+}
+
+func (d *memoryAddDeduper) release(_ context.Context, userID, key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, userID+":"+key)
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func addWithKey(t *testing.T, s *cartServer, key string) {
+	t.Helper()
+	ctx := context.Background()
+	if key != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(idempotencyKeyHeader, key))
+	}
+	_, err := s.AddItem(ctx, &pb.AddItemRequest{
+		UserId: "user-1",
+		Item:   &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdempotentAddItem(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		want int32
+	}{
+		{"duplicate key", []string{"req-1", "req-1"}, 1},
+		{"distinct keys", []string{"req-1", "req-2"}, 2},
+		{"no key", []string{"", ""}, 2},
+	}
+	for storeName, newStore := range testCartStores() {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				store := newStore(t)
+				s := &cartServer{store: store, dedupe: newAddDeduper(store, time.Minute)}
+				for _, k := range tt.keys {
+					addWithKey(t, s, k)
+				}
+
+				cart, err := store.GetCart(context.Background(), "user-1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := cart.Items[0].Quantity; got != tt.want {
+					t.Errorf("got quantity %d, want %d", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestIdempotencyKeyField(t *testing.T) {
+	store := newMemoryCartStore()
+	s := &cartServer{store: store, dedupe: newAddDeduper(store, time.Minute)}
+	tests := []struct {
+		field, header string
+	}{
+		{"req-1", ""},
+		// A repeat through the request field is dropped, whatever the
+		// metadata says.
+		{"req-1", "req-2"},
+		// So is one naming the same key through the metadata only.
+		{"", "req-1"},
+		// The field takes precedence: this is a new key.
+		{"req-3", "req-1"},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.header != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(idempotencyKeyHeader, tt.header))
+		}
+		if _, err := s.AddItem(ctx, &pb.AddItemRequest{
+			UserId:         "user-1",
+			Item:           &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1},
+			IdempotencyKey: tt.field,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cart, err := store.GetCart(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cart.Items[0].Quantity; got != 2 {
+		t.Errorf("got quantity %d, want 2", got)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	s := &cartServer{store: store, dedupe: newAddDeduper(store, time.Minute)}
+
+	addWithKey(t, s, "req-1")
+	mr.FastForward(2 * time.Minute)
+	addWithKey(t, s, "req-1")
+
+	cart, err := store.GetCart(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cart.Items[0].Quantity; got != 2 {
+		t.Errorf("got quantity %d, want 2 once the window has passed", got)
+	}
+}
+
+func TestMemoryAddDeduperSweep(t *testing.T) {
+	ctx := context.Background()
+	d := newAddDeduper(newMemoryCartStore(), 50*time.Millisecond).(*memoryAddDeduper)
+	for i := 0; i < 100; i++ {
+		if first, err := d.claim(ctx, "user-1", strconv.Itoa(i)); err != nil || !first {
+			t.Fatalf("claim %d: got %v, %v, want first", i, first, err)
+		}
+	}
+	if first, _ := d.claim(ctx, "user-1", "0"); first {
+		t.Error("key claimed twice within the window")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if first, _ := d.claim(ctx, "user-1", "0"); !first {
+		t.Error("expired key not claimable again")
+	}
+	if got := len(d.seen); got != 1 {
+		t.Errorf("%d keys held after the window, want 1", got)
+	}
+}
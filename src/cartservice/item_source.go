@@ -0,0 +1,47 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// itemSourcePattern matches the values AddItemRequest.source may take. The
+// frontend sends "product_page", "recommendation", "ad" and "search", but any
+// short identifier is kept, so new sources need no cartservice release.
+var itemSourcePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// addItem adds quantity of productID to the cart, recording source, when
+// set, on the cart item and the current span. The store's AddItem has no
+// room for a source, so an item with one is added with AddItems, which adds
+// a single item just as AddItem would.
+func (s *cartServer) addItem(ctx context.Context, cart, productID string, quantity int32, price *pb.Money, source string) error {
+	if source == "" {
+		return s.store.AddItem(ctx, cart, productID, quantity, price)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("cart.item.source", source))
+	return s.store.AddItems(ctx, cart, []*pb.CartItem{{
+		ProductId:     productID,
+		Quantity:      quantity,
+		PriceSnapshot: price,
+		Source:        source,
+	}})
+}
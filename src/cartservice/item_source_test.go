@@ -0,0 +1,104 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestItemSource(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			srv := &cartServer{store: newStore(t)}
+			ctx := context.Background()
+			adds := []struct {
+				productID string
+				source    string
+			}{
+				{"OLJCESPC7Z", "ad"},
+				// The first source of a product is kept.
+				{"OLJCESPC7Z", "search"},
+				{"66VCHSJNUP", ""},
+				{"66VCHSJNUP", "recommendation"},
+			}
+			for _, add := range adds {
+				req := &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: add.productID, Quantity: 1}, Source: add.source}
+				if _, err := srv.AddItem(ctx, req); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Moving a line keeps its source.
+			if err := srv.store.SaveForLater(ctx, "user-1", "OLJCESPC7Z"); err != nil {
+				t.Fatal(err)
+			}
+			if err := srv.store.MoveToCart(ctx, "user-1", "OLJCESPC7Z"); err != nil {
+				t.Fatal(err)
+			}
+
+			cart, err := srv.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]struct {
+				quantity int32
+				source   string
+			}{
+				"OLJCESPC7Z": {2, "ad"},
+				"66VCHSJNUP": {2, "recommendation"},
+			}
+			if len(cart.Items) != len(want) {
+				t.Fatalf("got %d lines, want %d: %v", len(cart.Items), len(want), cart.Items)
+			}
+			for _, item := range cart.Items {
+				w := want[item.ProductId]
+				if item.Quantity != w.quantity || item.Source != w.source {
+					t.Errorf("%s: got quantity %d from %q, want %d from %q", item.ProductId, item.Quantity, item.Source, w.quantity, w.source)
+				}
+			}
+		})
+	}
+}
+
+func TestItemSourceSpanAttribute(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	srv := &cartServer{store: store}
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	for _, source := range []string{"ad", ""} {
+		ctx, span := tracer.Start(context.Background(), "AddItem")
+		req := &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}, Source: source}
+		if _, err := srv.AddItem(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		span.End()
+		ended := recorder.Ended()
+		got := ""
+		for _, kv := range ended[len(ended)-1].Attributes() {
+			if kv.Key == "cart.item.source" {
+				got = kv.Value.AsString()
+			}
+		}
+		if got != source {
+			t.Errorf("AddItem from %q: span has cart.item.source %q", source, got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// defaultLogLevel keeps the service as chatty as it has always been. Busy
+// deployments will want LOG_LEVEL=info, as AddItem and GetCart log every
+// call.
+const defaultLogLevel = logrus.DebugLevel
+
+// logLevelFromEnv reads LOG_LEVEL, a logrus level name such as "info".
+func logLevelFromEnv() logrus.Level {
+	v := os.Getenv("LOG_LEVEL")
+	if v == "" {
+		return defaultLogLevel
+	}
+	level, err := logrus.ParseLevel(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid LOG_LEVEL %q, using %s", v, defaultLogLevel)
+		return defaultLogLevel
+	}
+	return level
+}
+
+// toggleDebugOnSIGHUP switches between debug logging and base on every
+// SIGHUP until ctx is done, for a closer look at a running pod without a
+// restart. With base itself debug, it switches to info instead.
+func toggleDebugOnSIGHUP(ctx context.Context, base logrus.Level) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.SetLevel(nextLogLevel(log.GetLevel(), base))
+			log.Warnf("SIGHUP received, log level is now %s", log.GetLevel())
+		}
+	}
+}
+
+// nextLogLevel is the level a SIGHUP switches current to.
+func nextLogLevel(current, base logrus.Level) logrus.Level {
+	if current != logrus.DebugLevel {
+		return logrus.DebugLevel
+	}
+	if base == logrus.DebugLevel {
+		return logrus.InfoLevel
+	}
+	return base
+}
+
+// SetLogLevel changes the log level of this replica, or only reports it
+// when the request's level is empty.
+func (s *cartAdminServer) SetLogLevel(ctx context.Context, req *pb.SetLogLevelRequest) (*pb.SetLogLevelResponse, error) {
+	previous := log.GetLevel()
+	if req.GetLevel() == "" {
+		return &pb.SetLogLevelResponse{PreviousLevel: previous.String(), Level: previous.String()}, nil
+	}
+	level, err := logrus.ParseLevel(req.GetLevel())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown log level %q", req.GetLevel())
+	}
+	log.SetLevel(level)
+	log.Warnf("Log level changed from %s to %s", previous, level)
+	return &pb.SetLogLevelResponse{PreviousLevel: previous.String(), Level: level.String()}, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestLogLevelFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want logrus.Level
+	}{
+		{"", defaultLogLevel},
+		{"info", logrus.InfoLevel},
+		{"WARN", logrus.WarnLevel},
+		{"chatty", defaultLogLevel},
+	}
+	for _, tt := range tests {
+		t.Setenv("LOG_LEVEL", tt.env)
+		if got := logLevelFromEnv(); got != tt.want {
+			t.Errorf("LOG_LEVEL=%q: got %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestNextLogLevel(t *testing.T) {
+	tests := []struct {
+		current, base, want logrus.Level
+	}{
+		{logrus.InfoLevel, logrus.InfoLevel, logrus.DebugLevel},
+		{logrus.DebugLevel, logrus.InfoLevel, logrus.InfoLevel},
+		{logrus.DebugLevel, logrus.WarnLevel, logrus.WarnLevel},
+		{logrus.DebugLevel, logrus.DebugLevel, logrus.InfoLevel},
+		// Changed over RPC since startup.
+		{logrus.ErrorLevel, logrus.InfoLevel, logrus.DebugLevel},
+	}
+	for _, tt := range tests {
+		if got := nextLogLevel(tt.current, tt.base); got != tt.want {
+			t.Errorf("nextLogLevel(%s, %s) = %s, want %s", tt.current, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	ctx := context.Background()
+	saved := log.GetLevel()
+	t.Cleanup(func() { log.SetLevel(saved) })
+	log.SetLevel(logrus.DebugLevel)
+	srv := &cartAdminServer{store: newMemoryCartStore()}
+
+	resp, err := srv.SetLogLevel(ctx, &pb.SetLogLevelRequest{Level: "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PreviousLevel != "debug" || resp.Level != "info" || log.GetLevel() != logrus.InfoLevel {
+		t.Errorf("got %v with the logger at %s, want debug to info", resp, log.GetLevel())
+	}
+
+	resp, err = srv.SetLogLevel(ctx, &pb.SetLogLevelRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PreviousLevel != "info" || resp.Level != "info" {
+		t.Errorf("reading the level: got %v, want info unchanged", resp)
+	}
+
+	if _, err := srv.SetLogLevel(ctx, &pb.SetLogLevelRequest{Level: "chatty"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unknown level: got %v, want InvalidArgument", err)
+	}
+	if log.GetLevel() != logrus.InfoLevel {
+		t.Errorf("unknown level changed the logger to %s", log.GetLevel())
+	}
+}
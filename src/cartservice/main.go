@@ -16,27 +16,33 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/redis/go-redis/extra/redisotel/v9"
-	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"google.golang.org/grpc"
+	channelz "google.golang.org/grpc/channelz/service"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/eventbus"
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
 )
 
@@ -44,7 +50,6 @@ var log *logrus.Logger
 
 func init() {
 	log = logrus.New()
-	log.Level = logrus.DebugLevel
 	log.Formatter = &logrus.JSONFormatter{
 		FieldMap: logrus.FieldMap{
 			logrus.FieldKeyTime:  "timestamp",
@@ -54,228 +59,559 @@ func init() {
 		TimestampFormat: time.RFC3339Nano,
 	}
 	log.Out = os.Stdout
+	log.SetLevel(logLevelFromEnv())
 }
 
 type cartStore interface {
-	AddItem(ctx context.Context, userID, productID string, quantity int32) error
+	// AddItem adds quantity of productID to the cart. price, when non-nil,
+	// is kept as the item's price snapshot unless it already has one.
+	AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error
+	// AddItems adds each of items as AddItem would, in one atomic change:
+	// on error the cart is left as it was. Each item's PriceSnapshot, when
+	// set, is kept as AddItem keeps price.
+	AddItems(ctx context.Context, userID string, items []*pb.CartItem) error
 	GetCart(ctx context.Context, userID string) (*pb.Cart, error)
+	// GetCarts returns one cart per user ID, in order. Users without a cart
+	// get an empty one rather than being left out.
+	GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error)
+	// CartExists reports whether the user has a cart at all, which GetCart
+	// can't tell apart from an emptied one.
+	CartExists(ctx context.Context, userID string) (bool, error)
+	// MergeCarts atomically moves the items and saved items of
+	// fromUserID's cart into toUserID's and deletes the source cart. A
+	// missing source cart is a no-op.
+	MergeCarts(ctx context.Context, fromUserID, toUserID string) error
+	// UpdateItemQuantity sets productID's quantity to exactly quantity,
+	// adding the product if needed. Zero removes it from the cart.
+	UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error
+	// EmptyCart removes every item and the cart's currency lock. The saved
+	// list is kept.
 	EmptyCart(ctx context.Context, userID string) error
-}
-
-type redisCartStore struct {
-	client *redis.Client
+	// LockCurrency pins the cart to currency unless it is already pinned,
+	// and returns the currency the cart is pinned to.
+	LockCurrency(ctx context.Context, userID, currency string) (string, error)
+	// ExportCart returns the user's items and saved list, both empty when
+	// the user has no cart.
+	ExportCart(ctx context.Context, userID string) (storedCart, error)
+	// ImportCart replaces the user's cart items with cart.Items and drops
+	// its currency lock. The saved list is replaced with cart.Saved, or
+	// kept when that is nil.
+	ImportCart(ctx context.Context, userID string, cart storedCart) error
+	// SaveForLater moves productID's line from the cart to the saved list,
+	// adding to any quantity already saved. NotFound if it isn't in the
+	// cart.
+	SaveForLater(ctx context.Context, userID, productID string) error
+	// MoveToCart moves productID's line from the saved list back into the
+	// cart. NotFound if it isn't saved.
+	MoveToCart(ctx context.Context, userID, productID string) error
+	// GetSavedItems returns the user's saved list, empty if there is none.
+	GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error)
+	// ListCartNames returns the names of userID's named carts, those stored
+	// under "userID:name", in any order.
+	ListCartNames(ctx context.Context, userID string) ([]string, error)
+	// Ping reports whether the backing storage is reachable.
+	Ping(ctx context.Context) error
 }
 
 // Cart item stored in Redis
 type cartItem struct {
-	ProductID string `json:"product_id"`
-	Quantity  int32  `json:"quantity"`
+	ProductID     string         `json:"product_id"`
+	Quantity      int32          `json:"quantity"`
+	PriceSnapshot *priceSnapshot `json:"price_snapshot,omitempty"`
+	// AddedAt is when the product was first added, in Unix seconds. Zero
+	// for items stored before it was recorded.
+	AddedAt int64 `json:"added_at,omitempty"`
+	// Source is where the product was first added from, such as "ad".
+	Source string `json:"source,omitempty"`
 }
 
-func newRedisCartStore(addr string) (*redisCartStore, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr: addr,
-	})
+// storedCart is a cart's items plus the currency it is locked to, if any,
+// and the user's saved-for-later list.
+type storedCart struct {
+	Currency string     `json:"currency_code,omitempty"`
+	Items    []cartItem `json:"items"`
+	Saved    []cartItem `json:"saved,omitempty"`
+	// UpdatedAt is when the cart last changed, in Unix seconds, for
+	// abandoned cart detection. Zero for carts stored before it was
+	// recorded.
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+	// Version goes up with every write, for optimistic concurrency. Zero
+	// for carts never written since it was recorded.
+	Version int64 `json:"version,omitempty"`
+}
 
-	// Add OpenTelemetry instrumentation to Redis client
-	if err := redisotel.InstrumentTracing(client); err != nil {
-		log.Warnf("Failed to instrument Redis with tracing: %v", err)
-	}
+// addCartItem merges quantity of productID into cart, stamping a new line
+// with the current time.
+func addCartItem(cart []cartItem, productID string, quantity int32, price *pb.Money) []cartItem {
+	return mergeCartLine(cart, cartItem{
+		ProductID:     productID,
+		Quantity:      quantity,
+		PriceSnapshot: newPriceSnapshot(price),
+		AddedAt:       time.Now().Unix(),
+	})
+}
 
-	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := client.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis at %s: %v", addr, err)
+// addCartItems merges each of items into cart as addCartItem does, also
+// keeping each item's source.
+func addCartItems(cart []cartItem, items []*pb.CartItem) []cartItem {
+	now := time.Now().Unix()
+	for _, item := range items {
+		cart = mergeCartLine(cart, cartItem{
+			ProductID:     item.GetProductId(),
+			Quantity:      item.GetQuantity(),
+			PriceSnapshot: newPriceSnapshot(item.GetPriceSnapshot()),
+			AddedAt:       now,
+			Source:        item.GetSource(),
+		})
 	}
-
-	log.Infof("Connected to Redis at %s", addr)
-	return &redisCartStore{client: client}, nil
+	return cart
 }
 
-func (s *redisCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32) error {
-	log.Infof("AddItem called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
-
-	cart, err := s.getCartItems(ctx, userID)
-	if err != nil {
-		return err
+// mergeCartLine adds line to cart. The first recorded price snapshot,
+// added-at time and source for a product win so later adds don't hide a
+// price change, make the item look newer than it is or take the credit for
+// it.
+func mergeCartLine(cart []cartItem, line cartItem) []cartItem {
+	for i, item := range cart {
+		if item.ProductID == line.ProductID {
+			cart[i].Quantity += line.Quantity
+			if cart[i].PriceSnapshot == nil {
+				cart[i].PriceSnapshot = line.PriceSnapshot
+			}
+			if cart[i].AddedAt == 0 {
+				cart[i].AddedAt = line.AddedAt
+			}
+			if cart[i].Source == "" {
+				cart[i].Source = line.Source
+			}
+			return cart
+		}
 	}
+	return append(cart, line)
+}
 
-	// Check if item already exists
-	found := false
+// setCartItemQuantity sets productID's line to quantity, keeping its price
+// snapshot, added-at time and source. A zero quantity removes the line.
+func setCartItemQuantity(cart []cartItem, productID string, quantity int32) []cartItem {
 	for i, item := range cart {
 		if item.ProductID == productID {
-			cart[i].Quantity += quantity
-			found = true
-			break
+			if quantity == 0 {
+				return append(cart[:i], cart[i+1:]...)
+			}
+			cart[i].Quantity = quantity
+			return cart
 		}
 	}
-
-	if !found {
-		cart = append(cart, cartItem{ProductID: productID, Quantity: quantity})
+	if quantity == 0 {
+		return cart
 	}
-
-	return s.saveCart(ctx, userID, cart)
+	return append(cart, cartItem{ProductID: productID, Quantity: quantity, AddedAt: time.Now().Unix()})
 }
 
-func (s *redisCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
-	log.Infof("GetCart called: userID=%s", userID)
-
-	items, err := s.getCartItems(ctx, userID)
-	if err != nil {
-		return nil, err
+// mergeCartItems adds every line of from into to, keeping to's price
+// snapshots, added-at times and sources for products both carts hold.
+func mergeCartItems(to, from []cartItem) []cartItem {
+	for _, item := range from {
+		to = mergeCartLine(to, item)
 	}
+	return to
+}
+
+// cartToProto converts a stored cart to the API representation.
+func cartToProto(userID string, stored storedCart) *pb.Cart {
+	return &pb.Cart{UserId: userID, CurrencyCode: stored.Currency, Items: cartItemsToProto(stored.Items), Version: stored.Version}
+}
 
-	cart := &pb.Cart{UserId: userID}
+func cartItemsToProto(items []cartItem) []*pb.CartItem {
+	var out []*pb.CartItem
 	for _, item := range items {
-		cart.Items = append(cart.Items, &pb.CartItem{
-			ProductId: item.ProductID,
-			Quantity:  item.Quantity,
+		out = append(out, &pb.CartItem{
+			ProductId:     item.ProductID,
+			Quantity:      item.Quantity,
+			PriceSnapshot: item.PriceSnapshot.proto(),
+			AddedAt:       addedAtToProto(item.AddedAt),
+			Source:        item.Source,
 		})
 	}
-
-	return cart, nil
+	return out
 }
 
-func (s *redisCartStore) EmptyCart(ctx context.Context, userID string) error {
-	log.Infof("EmptyCart called: userID=%s", userID)
-	return s.saveCart(ctx, userID, []cartItem{})
+func addedAtToProto(unix int64) *timestamppb.Timestamp {
+	if unix == 0 {
+		return nil
+	}
+	return timestamppb.New(time.Unix(unix, 0))
 }
 
-func (s *redisCartStore) getCartItems(ctx context.Context, userID string) ([]cartItem, error) {
-	val, err := s.client.Get(ctx, userID).Result()
-	if err == redis.Nil {
-		return []cartItem{}, nil
+// newCartStore picks the backend named by CART_STORE. Left unset, it
+// connects to Redis at redisAddr, or uses the in-memory store if Redis isn't
+// configured. A configured backend that can't be reached falls back to the
+// in-memory store.
+func newCartStore(redisAddr string) cartStore {
+	kind := cartStoreKindFromEnv()
+	if kind == backendPostgres {
+		connect := func(ctx context.Context) (cartStore, error) {
+			return newPostgresCartStore(ctx, os.Getenv("DATABASE_URL"))
+		}
+		store, err := connect(context.Background())
+		if err != nil {
+			return fallBackToMemory(backendPostgres, err, connect)
+		}
+		setStoreMode(backendPostgres)
+		return store
 	}
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get cart: %v", err)
+	if kind == backendMemcached {
+		connect := func(context.Context) (cartStore, error) {
+			return newMemcachedCartStore(os.Getenv("MEMCACHED_ADDR"))
+		}
+		store, err := connect(context.Background())
+		if err != nil {
+			return fallBackToMemory(backendMemcached, err, connect)
+		}
+		setStoreMode(backendMemcached)
+		return store
 	}
-
-	var items []cartItem
-	if err := json.Unmarshal([]byte(val), &items); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to unmarshal cart: %v", err)
+	if kind == backendSpanner {
+		connect := func(ctx context.Context) (cartStore, error) {
+			return newSpannerCartStore(ctx, os.Getenv("SPANNER_DATABASE"))
+		}
+		store, err := connect(context.Background())
+		if err != nil {
+			return fallBackToMemory(backendSpanner, err, connect)
+		}
+		setStoreMode(backendSpanner)
+		return store
 	}
-
-	return items, nil
-}
-
-func (s *redisCartStore) saveCart(ctx context.Context, userID string, items []cartItem) error {
-	data, err := json.Marshal(items)
+	if kind == backendMemory || !redisConfigured(redisAddr) {
+		if kind == backendRedis {
+			log.Warn("CART_STORE=redis but REDIS_ADDR is not set")
+		}
+		log.Info("Using in-memory cart store")
+		setStoreMode(backendMemory)
+		store := newMemoryCartStore()
+		if path := memoryStorePathFromEnv(); path != "" {
+			store.persistTo(path)
+		}
+		return store
+	}
+	connect := func(context.Context) (cartStore, error) {
+		return newRedisCartStore(redisAddr)
+	}
+	store, err := connect(context.Background())
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to marshal cart: %v", err)
+		return fallBackToMemory(backendRedis, err, connect)
 	}
+	setStoreMode(backendRedis)
+	return store
+}
 
-	if err := s.client.Set(ctx, userID, data, 0).Err(); err != nil {
-		return status.Errorf(codes.Internal, "failed to save cart: %v", err)
+// fallBackToMemory returns the store to use when from can't be reached at
+// startup: one that keeps carts in memory until connect succeeds, or plain
+// memory if STORE_RECONNECT_INTERVAL is zero.
+func fallBackToMemory(from string, err error, connect func(context.Context) (cartStore, error)) cartStore {
+	log.WithFields(logrus.Fields{
+		"from":  from,
+		"to":    backendMemory,
+		"error": err,
+	}).Warnf("Failed to connect to %s, falling back to in-memory store", from)
+	storeFallbacks.Inc()
+	setStoreMode(backendMemory)
+	if storeReconnectIntervalFromEnv() == 0 {
+		return newMemoryCartStore()
 	}
-
-	return nil
+	return newFailoverCartStore(from, connect, storeReconnectReplayFromEnv())
 }
 
-// In-memory cart store (fallback when Redis is not available)
-type memoryCartStore struct {
-	carts map[string][]cartItem
-}
+type cartServer struct {
+	pb.UnimplementedCartServiceServer
+	store cartStore
 
-func newMemoryCartStore() *memoryCartStore {
-	log.Info("Using in-memory cart store")
-	return &memoryCartStore{carts: make(map[string][]cartItem)}
-}
+	// dedupe, when set, makes AddItem calls carrying an idempotency key
+	// safe to retry.
+	dedupe addDeduper
 
-func (s *memoryCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32) error {
-	log.Infof("AddItem called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+	// priceSnapshots makes AddItem record the price sent with each item.
+	priceSnapshots bool
 
-	cart := s.carts[userID]
-	found := false
-	for i, item := range cart {
-		if item.ProductID == productID {
-			cart[i].Quantity += quantity
-			found = true
-			break
-		}
-	}
+	// maxItemQuantity caps how many units of one product a cart may hold.
+	// Zero means no cap.
+	maxItemQuantity int32
 
-	if !found {
-		cart = append(cart, cartItem{ProductID: productID, Quantity: quantity})
-	}
+	// maxCartItems caps how many distinct products a cart may hold. Zero
+	// means no cap.
+	maxCartItems int
 
-	s.carts[userID] = cart
-	return nil
-}
+	// cartSizeTrailer makes GetCart report the cart's size in its trailer.
+	cartSizeTrailer bool
 
-func (s *memoryCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
-	log.Infof("GetCart called: userID=%s", userID)
+	// currencyLock makes AddItem pin each new cart to the currency it was
+	// created in.
+	currencyLock bool
 
-	cart := &pb.Cart{UserId: userID}
-	for _, item := range s.carts[userID] {
-		cart.Items = append(cart.Items, &pb.CartItem{
-			ProductId: item.ProductID,
-			Quantity:  item.Quantity,
-		})
-	}
+	// events, when set, receives an event for every item added and cart
+	// emptied.
+	events eventPublisher
 
-	return cart, nil
+	// products, when set, rejects items for products not in the catalog.
+	products productChecker
+
+	// audit, when set, records every change to a cart's quantities.
+	audit auditLog
+
+	// archive, when set, keeps the items of carts emptied with archive set
+	// so RestoreLastCart can put them back.
+	archive cartArchive
 }
 
-func (s *memoryCartStore) EmptyCart(ctx context.Context, userID string) error {
-	log.Infof("EmptyCart called: userID=%s", userID)
-	s.carts[userID] = []cartItem{}
-	return nil
+func (s *cartServer) AddItem(ctx context.Context, req *pb.AddItemRequest) (_ *pb.Empty, err error) {
+	defer func() { otelMetrics.recordAddItem(ctx, status.Code(err)) }()
+	if err := s.validateQuantity(req.Item.GetQuantity()); err != nil {
+		return nil, err
+	}
+	cart, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkProducts(ctx, req.Item.GetProductId()); err != nil {
+		return nil, err
+	}
+	key := idempotencyKey(ctx, req.IdempotencyKey)
+	if s.dedupe != nil && key != "" {
+		first, err := s.dedupe.claim(ctx, req.UserId, key)
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			log.Infof("AddItem with idempotency key %s already applied for user %s, skipping", key, req.UserId)
+			return &pb.Empty{}, nil
+		}
+	}
+	if err := s.checkCartLimits(ctx, cart, req.Item.ProductId, req.Item.Quantity); err != nil {
+		if s.dedupe != nil && key != "" {
+			s.dedupe.release(ctx, req.UserId, key)
+		}
+		return nil, err
+	}
+	var price *pb.Money
+	if s.priceSnapshots {
+		price = req.Item.GetPriceSnapshot()
+	}
+	err = s.audited(ctx, "AddItem", []string{cart}, func() error {
+		return s.addItem(withExpectedVersion(ctx, req.ExpectedVersion), cart, req.Item.ProductId, req.Item.Quantity, price, req.Source)
+	})
+	if err != nil {
+		if s.dedupe != nil && key != "" {
+			s.dedupe.release(ctx, req.UserId, key)
+		}
+		return nil, err
+	}
+	if s.currencyLock {
+		s.lockCartCurrency(ctx, cart, req.GetCurrencyCode())
+	}
+	s.publishItemAdded(ctx, req.UserId, req.CartName, req.Item.ProductId, req.Item.Quantity)
+	return &pb.Empty{}, nil
 }
 
-type cartServer struct {
-	pb.UnimplementedCartServiceServer
-	store cartStore
+func (s *cartServer) AddItems(ctx context.Context, req *pb.AddItemsRequest) (*pb.Empty, error) {
+	items := make([]*pb.CartItem, len(req.Items))
+	for i, item := range req.Items {
+		if err := s.validateQuantity(item.GetQuantity()); err != nil {
+			return nil, err
+		}
+		items[i] = &pb.CartItem{ProductId: item.GetProductId(), Quantity: item.GetQuantity(), Source: item.GetSource()}
+		if s.priceSnapshots {
+			items[i].PriceSnapshot = item.GetPriceSnapshot()
+		}
+	}
+	cart, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if err := s.checkProducts(ctx, item.ProductId); err != nil {
+			return nil, err
+		}
+	}
+	key := idempotencyKeyFromContext(ctx)
+	if s.dedupe != nil && key != "" {
+		first, err := s.dedupe.claim(ctx, req.UserId, key)
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			log.Infof("AddItems with idempotency key %s already applied for user %s, skipping", key, req.UserId)
+			return &pb.Empty{}, nil
+		}
+	}
+	if err := s.checkBatchLimits(ctx, cart, items); err != nil {
+		if s.dedupe != nil && key != "" {
+			s.dedupe.release(ctx, req.UserId, key)
+		}
+		return nil, err
+	}
+	err = s.audited(ctx, "AddItems", []string{cart}, func() error {
+		return s.store.AddItems(withExpectedVersion(ctx, req.ExpectedVersion), cart, items)
+	})
+	if err != nil {
+		if s.dedupe != nil && key != "" {
+			s.dedupe.release(ctx, req.UserId, key)
+		}
+		return nil, err
+	}
+	if s.currencyLock {
+		s.lockCartCurrency(ctx, cart, req.GetCurrencyCode())
+	}
+	for _, item := range items {
+		s.publishItemAdded(ctx, req.UserId, req.CartName, item.ProductId, item.Quantity)
+	}
+	return &pb.Empty{}, nil
 }
 
-func (s *cartServer) AddItem(ctx context.Context, req *pb.AddItemRequest) (*pb.Empty, error) {
-	if err := s.store.AddItem(ctx, req.UserId, req.Item.ProductId, req.Item.Quantity); err != nil {
+func (s *cartServer) UpdateItemQuantity(ctx context.Context, req *pb.UpdateItemQuantityRequest) (*pb.Empty, error) {
+	if req.UserId == "" || req.ProductId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id and product_id are required")
+	}
+	if req.Quantity < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "quantity must not be negative, got %d", req.Quantity)
+	}
+	if req.Quantity > 0 {
+		if err := s.validateQuantity(req.Quantity); err != nil {
+			return nil, err
+		}
+	}
+	cart, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	if req.Quantity > 0 {
+		if err := s.checkProducts(ctx, req.ProductId); err != nil {
+			return nil, err
+		}
+		if err := s.checkCartLimits(ctx, cart, req.ProductId, 0); err != nil {
+			return nil, err
+		}
+	}
+	err = s.audited(ctx, "UpdateItemQuantity", []string{cart}, func() error {
+		return s.store.UpdateItemQuantity(withExpectedVersion(ctx, req.ExpectedVersion), cart, req.ProductId, req.Quantity)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &pb.Empty{}, nil
 }
 
 func (s *cartServer) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
-	return s.store.GetCart(ctx, req.UserId)
+	key, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	cart, err := s.store.GetCart(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if key != req.UserId {
+		cart.UserId, cart.CartName = req.UserId, req.CartName
+	}
+	otelMetrics.recordCartSize(ctx, int64(len(cart.GetItems())))
+	if s.cartSizeTrailer {
+		setCartSizeTrailer(ctx, cart)
+	}
+	return cart, nil
 }
 
-func (s *cartServer) EmptyCart(ctx context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
-	if err := s.store.EmptyCart(ctx, req.UserId); err != nil {
+func (s *cartServer) BatchGetCart(ctx context.Context, req *pb.BatchGetCartRequest) (*pb.BatchGetCartResponse, error) {
+	carts, err := s.store.GetCarts(ctx, req.UserIds)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.BatchGetCartResponse{Carts: carts}, nil
+}
+func (s *cartServer) CartExists(ctx context.Context, req *pb.CartExistsRequest) (*pb.CartExistsResponse, error) {
+	cart, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := s.store.CartExists(ctx, cart)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CartExistsResponse{Exists: exists}, nil
+}
+func (s *cartServer) MergeCarts(ctx context.Context, req *pb.MergeCartsRequest) (*pb.Empty, error) {
+	if req.FromUserId == "" || req.ToUserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "both from_user_id and to_user_id are required")
+	}
+	err := s.audited(ctx, "MergeCarts", []string{req.FromUserId, req.ToUserId}, func() error {
+		if err := s.checkMergeLimits(ctx, req.FromUserId, req.ToUserId); err != nil {
+			return err
+		}
+		return s.store.MergeCarts(ctx, req.FromUserId, req.ToUserId)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &pb.Empty{}, nil
 }
-
-type healthServer struct {
-	grpc_health_v1.UnimplementedHealthServer
+func (s *cartServer) EmptyCart(ctx context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	cart, err := cartKey(req.UserId, req.CartName)
+	if err != nil {
+		return nil, err
+	}
+	empty := func() error {
+		return s.store.EmptyCart(withExpectedVersion(ctx, req.ExpectedVersion), cart)
+	}
+	err = s.audited(ctx, "EmptyCart", []string{cart}, func() error {
+		if req.Archive && s.archive != nil {
+			return s.emptyAndArchive(ctx, cart, empty)
+		}
+		return empty()
+	})
+	if err != nil {
+		return nil, err
+	}
+	cartsEmptied.Inc()
+	s.publishCartEmptied(ctx, req.UserId, req.CartName)
+	return &pb.Empty{}, nil
 }
 
-func (h *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
-	return &grpc_health_v1.HealthCheckResponse{
-		Status: grpc_health_v1.HealthCheckResponse_SERVING,
-	}, nil
-}
+func initTracing(ctx context.Context) (*sdktrace.TracerProvider, *shutdownExporter, error) {
+	exporterCfg, err := otlpExporterConfigFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
 
-func (h *healthServer) Watch(req *grpc_health_v1.HealthCheckRequest, srv grpc_health_v1.Health_WatchServer) error {
-	return status.Errorf(codes.Unimplemented, "health watch is not implemented")
-}
+	log.Infof("Initializing tracing for cartservice, exporting to %s", exporterCfg)
 
-func initTracing(ctx context.Context) (*sdktrace.TracerProvider, error) {
-	collectorAddr := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	if collectorAddr == "" {
-		collectorAddr = "opentelemetry-collector:4317"
+	sampler, err := samplerFromEnv()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	log.Infof("Initializing tracing for cartservice, exporting to %s", collectorAddr)
+	otlpExporter, err := newOTLPTraceExporter(ctx, exporterCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	exporter := newShutdownExporter(otlpExporter, traceShutdownAttemptsFromEnv(), traceShutdownTimeoutFromEnv())
 
-	exporter, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpoint(collectorAddr),
-		otlptracegrpc.WithInsecure(),
-	)
+	res, err := serviceResource()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		return nil, nil, err
 	}
 
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	)
+
+	otel.SetTracerProvider(tp)
+	log.Info("Tracing initialized successfully")
+	return tp, exporter, nil
+}
+
+// serviceResource describes cartservice to the collector, for traces and
+// metrics alike.
+func serviceResource() (*resource.Resource, error) {
 	res, err := resource.Merge(
 		resource.Default(),
 		resource.NewWithAttributes(
@@ -288,27 +624,59 @@ func initTracing(ctx context.Context) (*sdktrace.TracerProvider, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create resource: %w", err)
 	}
+	return res, nil
+}
 
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exporter),
-		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-	)
+// samplerFromEnv builds the trace sampler from OTEL_TRACES_SAMPLER and
+// OTEL_TRACES_SAMPLER_ARG. The default, parent-based ratio sampling at 1.0,
+// samples everything while still following an upstream service's decision so
+// traces stay whole across service hops.
+func samplerFromEnv() (sdktrace.Sampler, error) {
+	ratio := 1.0
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q: want a number between 0 and 1", v)
+		}
+		ratio = r
+	}
 
-	otel.SetTracerProvider(tp)
-	log.Info("Tracing initialized successfully")
-	return tp, nil
+	switch v := os.Getenv("OTEL_TRACES_SAMPLER"); v {
+	case "", "parentbased_traceidratio":
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", v)
+	}
 }
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go toggleDebugOnSIGHUP(ctx, log.GetLevel())
+
+	// Extract incoming trace context so the parent-based sampler can follow
+	// the caller's sampling decision.
+	otel.SetTextMapPropagator(
+		propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{}, propagation.Baggage{}))
 
 	// Initialize tracing
-	tp, err := initTracing(ctx)
+	tp, exporter, err := initTracing(ctx)
 	if err != nil {
 		log.Warnf("Failed to initialize tracing: %v", err)
-	} else {
-		defer tp.Shutdown(ctx)
+	}
+
+	var mp *sdkmetric.MeterProvider
+	if otelMetricsEnabledFromEnv() {
+		if mp, err = initMetrics(ctx); err != nil {
+			log.Warnf("Failed to initialize metrics: %v", err)
+		}
 	}
 
 	port := os.Getenv("PORT")
@@ -316,27 +684,132 @@ func main() {
 		port = "7070"
 	}
 
-	// Initialize cart store
-	var store cartStore
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr != "" {
-		store, err = newRedisCartStore(redisAddr)
-		if err != nil {
-			log.Warnf("Failed to connect to Redis: %v, falling back to in-memory store", err)
-			store = newMemoryCartStore()
+	store := newCartStore(os.Getenv("REDIS_ADDR"))
+
+	if active := memoryStoreActive(store); active != nil {
+		if env := os.Getenv("DEPLOYMENT_ENV"); isProductionEnv(env, productionEnvsFromEnv()) {
+			go warnMemoryStoreInProduction(ctx, env, memoryStoreWarnIntervalFromEnv(), active)
+		}
+	}
+	if mem, ok := store.(*memoryCartStore); ok {
+		if interval := memorySnapshotIntervalFromEnv(); mem.path != "" && interval > 0 {
+			log.Infof("Saving carts to %s every %v", mem.path, interval)
+			go mem.persist(ctx, interval)
 		}
-	} else {
-		log.Info("REDIS_ADDR not set, using in-memory cart store")
-		store = newMemoryCartStore()
 	}
 
 	// Create gRPC server with OTEL instrumentation
-	srv := grpc.NewServer(
+	opts := []grpc.ServerOption{
 		grpc.StatsHandler(otelgrpc.NewServerHandler()),
-	)
+	}
+	opts = append(opts, grpcServerConfigFromEnv().serverOptions()...)
+	creds, err := grpcServerTLSFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid gRPC TLS settings: %v", err)
+	}
+	if creds != nil {
+		if os.Getenv("GRPC_TLS_CLIENT_CA_FILE") != "" {
+			log.Info("Serving gRPC over mutual TLS")
+		} else {
+			log.Info("Serving gRPC over TLS")
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	metricsPort := metricsPortFromEnv()
+	if metricsPort != "" {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(grpcMetrics.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(grpcMetrics.StreamServerInterceptor()),
+		)
+	}
+	// After the metrics interceptor, so rejected requests are still counted.
+	adminToken := adminTokenFromEnv()
+	if adminToken != "" {
+		opts = append(opts, grpc.ChainUnaryInterceptor(adminAuthInterceptor(adminToken)))
+	}
+	if limit, burst := rateLimitFromEnv(); limit > 0 {
+		opts = append(opts, grpc.ChainUnaryInterceptor(newUserRateLimiter(limit, burst).unaryInterceptor))
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(validationInterceptor))
+	srv := grpc.NewServer(opts...)
 
-	pb.RegisterCartServiceServer(srv, &cartServer{store: store})
-	grpc_health_v1.RegisterHealthServer(srv, &healthServer{})
+	svcStore := store
+	if metricsPort != "" || mp != nil {
+		svcStore = instrumentStore(store)
+	}
+	// Outermost, so store metrics only time calls that reach the store.
+	if failures := storeBreakerFailuresFromEnv(); failures > 0 {
+		svcStore = newBreakerCartStore(svcStore, failures, storeBreakerOpenForFromEnv(), storeBreakerCacheSizeFromEnv())
+	}
+	cartSvc := &cartServer{
+		store:           svcStore,
+		priceSnapshots:  priceSnapshotsFromEnv(),
+		maxItemQuantity: maxItemQuantityFromEnv(),
+		maxCartItems:    maxCartItemsFromEnv(),
+		cartSizeTrailer: cartSizeTrailerFromEnv(),
+		currencyLock:    currencyLockFromEnv(),
+	}
+	if products, err := newProductCheckerFromEnv(); err != nil {
+		log.Warnf("Failed to connect to the product catalog, product IDs are not checked: %v", err)
+	} else if products != nil {
+		cartSvc.products = products
+	}
+	if window := idempotencyWindowFromEnv(); window > 0 {
+		log.Infof("Idempotent AddItem enabled (window: %v)", window)
+		cartSvc.dedupe = newAddDeduper(store, window)
+	}
+	cartSvc.audit = newAuditLogFromEnv(store)
+	if ttl := cartArchiveTTLFromEnv(); ttl > 0 {
+		cartSvc.archive = newCartArchive(store, ttl)
+	}
+	bus, err := eventbus.FromEnv(ctx)
+	if err != nil {
+		log.Warnf("Failed to set up the event bus, cart events are off: %v", err)
+	} else if bus != nil {
+		topic := cartEventsTopicFromEnv()
+		log.Infof("Publishing cart events to topic %s", topic)
+		cartSvc.events = newBusPublisher(bus, topic)
+	}
+	if after := abandonedCartAfterFromEnv(); after > 0 {
+		if finder, ok := store.(idleCartFinder); ok {
+			log.Infof("Reporting carts left unchanged for %v as abandoned", after)
+			w := newAbandonedCartWatcher(finder, cartSvc.events, after, time.Now())
+			go w.run(ctx, abandonedCartScanIntervalFromEnv())
+		} else {
+			log.Warn("ABANDONED_CART_AFTER is set but this cart store can't find idle carts, abandoned cart detection is off")
+		}
+	}
+	pb.RegisterCartServiceServer(srv, cartSvc)
+	if adminToken != "" {
+		log.Info("Cart admin service enabled")
+		pb.RegisterCartAdminServiceServer(srv, &cartAdminServer{store: store})
+	}
+	health := newHealthServer(store)
+	go health.watchStore(ctx, healthCheckIntervalFromEnv())
+	if failover, ok := store.(*failoverCartStore); ok {
+		failover.setOnSwap(health.storeChanged)
+		interval := storeReconnectIntervalFromEnv()
+		log.Infof("Retrying the %s cart store every %v", failover.backend, interval)
+		go failover.reconnect(ctx, interval)
+	}
+	grpc_health_v1.RegisterHealthServer(srv, health)
+	if reflectionFromEnv() {
+		log.Info("gRPC server reflection enabled")
+		reflection.Register(srv)
+	}
+	if channelzFromEnv() {
+		log.Info("gRPC channelz service enabled")
+		channelz.RegisterChannelzServiceToServer(srv)
+	}
+
+	if metricsPort != "" {
+		grpcMetrics.InitializeMetrics(srv)
+		go func() {
+			if err := serveMetrics(metricsPort); err != nil {
+				log.Errorf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
 	if err != nil {
@@ -344,7 +817,41 @@ func main() {
 	}
 
 	log.Infof("Cart service listening on port %s", port)
-	if err := srv.Serve(lis); err != nil {
+	if err := serveUntilDone(ctx, srv, lis, shutdownGracePeriodFromEnv()); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+
+	if tp != nil {
+		if err := shutdownTracing(tp, exporter); err != nil {
+			log.Warnf("Error shutting down tracer provider, buffered spans may be lost: %v", err)
+		} else {
+			log.Info("Tracer provider shut down, buffered spans flushed")
+		}
+	}
+	if mp != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := mp.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Error shutting down meter provider, buffered metrics may be lost: %v", err)
+		}
+		cancel()
+	}
+	if c, ok := cartSvc.audit.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Warnf("Error closing cart audit log: %v", err)
+		}
+	}
+	if p, ok := cartSvc.events.(*busPublisher); ok {
+		p.close()
+	}
+	if bus != nil {
+		if err := bus.Close(); err != nil {
+			log.Warnf("Error closing event bus, pending cart events may be lost: %v", err)
+		}
+	}
+	if c, ok := store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Warnf("Error closing cart store: %v", err)
+		}
+	}
+	log.Info("Cart service stopped")
 }
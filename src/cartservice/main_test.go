@@ -0,0 +1,57 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestSamplerFromEnv(t *testing.T) {
+	tests := []struct {
+		sampler string
+		arg     string
+		want    sdktrace.Sampler // nil means an error is expected
+	}{
+		{"", "", sdktrace.ParentBased(sdktrace.TraceIDRatioBased(1))},
+		{"", "0.25", sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0.25))},
+		{"parentbased_traceidratio", "0.1", sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0.1))},
+		{"traceidratio", "0.5", sdktrace.TraceIDRatioBased(0.5)},
+		{"always_on", "", sdktrace.AlwaysSample()},
+		{"always_off", "", sdktrace.NeverSample()},
+		{"", "1.5", nil},
+		{"", "half", nil},
+		{"sometimes", "", nil},
+	}
+	for _, tt := range tests {
+		t.Setenv("OTEL_TRACES_SAMPLER", tt.sampler)
+		t.Setenv("OTEL_TRACES_SAMPLER_ARG", tt.arg)
+		got, err := samplerFromEnv()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("sampler=%q arg=%q: got %s, want error", tt.sampler, tt.arg, got.Description())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sampler=%q arg=%q: %v", tt.sampler, tt.arg, err)
+			continue
+		}
+		if got.Description() != tt.want.Description() {
+			t.Errorf("sampler=%q arg=%q: got %s, want %s", tt.sampler, tt.arg, got.Description(), tt.want.Description())
+		}
+	}
+}
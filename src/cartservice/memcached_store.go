@@ -0,0 +1,353 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// memcachedMaxRelativeTTL is the longest expiration memcached reads as
+// seconds from now. Anything longer is taken as a Unix timestamp.
+const memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+
+// memcachedCartStore keeps each cart as one JSON item. Writes are
+// read-modify-write cycles guarded by memcached's CAS tokens, retried like
+// the Redis store's WATCH transactions when another writer gets in first.
+//
+// Memcached has no multi-key transactions, so MergeCarts updates the
+// destination and then deletes the source: an item added to the source
+// cart while a merge is running can be lost.
+type memcachedCartStore struct {
+	client *memcache.Client
+
+	// ttl is the expiration applied on every cart write. Zero means carts
+	// stay until memcached evicts them.
+	ttl time.Duration
+}
+
+// newMemcachedCartStore connects to the comma-separated memcached servers in
+// addrs. Carts are spread across the servers by key.
+func newMemcachedCartStore(addrs string) (*memcachedCartStore, error) {
+	servers := splitAddrs(addrs)
+	if len(servers) == 0 {
+		return nil, errors.New("CART_STORE=memcached requires MEMCACHED_ADDR")
+	}
+	client := memcache.New(servers...)
+	if err := client.Ping(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to memcached at %s: %v", strings.Join(servers, ","), err)
+	}
+	log.Infof("Connected to memcached at %s", strings.Join(servers, ","))
+	return &memcachedCartStore{client: client, ttl: cartTTLFromEnv()}, nil
+}
+
+// memcachedKey maps a user ID to a legal memcached key. IDs that are too
+// long or hold spaces or control characters are hashed.
+func memcachedKey(userID string) string {
+	key := "cart:" + userID
+	if len(key) <= 250 && !strings.ContainsFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		return key
+	}
+	sum := sha256.Sum256([]byte(userID))
+	return "cart-sha256:" + hex.EncodeToString(sum[:])
+}
+
+// expiration converts the store's TTL to memcached's expiration field.
+func (s *memcachedCartStore) expiration() int32 {
+	if s.ttl <= 0 {
+		return 0
+	}
+	if s.ttl > memcachedMaxRelativeTTL {
+		return int32(time.Now().Add(s.ttl).Unix())
+	}
+	secs := int32(s.ttl / time.Second)
+	if secs == 0 {
+		secs = 1
+	}
+	return secs
+}
+
+// memcachedError maps a failed memcached call to a gRPC status.
+func memcachedError(msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+func decodeMemcachedCart(val []byte) (storedCart, error) {
+	var cart storedCart
+	if err := json.Unmarshal(val, &cart); err != nil {
+		storeSerializationErrors.WithLabelValues(opUnmarshal, backendMemcached).Inc()
+		return storedCart{}, status.Errorf(codes.Internal, "failed to unmarshal cart: %v", err)
+	}
+	if cart.Items == nil {
+		cart.Items = []cartItem{}
+	}
+	return cart, nil
+}
+
+func (s *memcachedCartStore) newItem(userID string, cart storedCart) (*memcache.Item, error) {
+	data, err := json.Marshal(cart)
+	if err != nil {
+		storeSerializationErrors.WithLabelValues(opMarshal, backendMemcached).Inc()
+		return nil, status.Errorf(codes.Internal, "failed to marshal cart: %v", err)
+	}
+	return &memcache.Item{Key: memcachedKey(userID), Value: data, Expiration: s.expiration()}, nil
+}
+
+// loadCart reads the user's cart, returning its item as well so the caller
+// can write it back with CompareAndSwap. The item is nil when the user has
+// no cart.
+func (s *memcachedCartStore) loadCart(userID string) (storedCart, *memcache.Item, error) {
+	item, err := s.client.Get(memcachedKey(userID))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return storedCart{Items: []cartItem{}}, nil, nil
+	}
+	if err != nil {
+		return storedCart{}, nil, memcachedError("failed to get cart", err)
+	}
+	cart, err := decodeMemcachedCart(item.Value)
+	return cart, item, err
+}
+
+// updateCart applies fn to the user's cart and writes the result back, one
+// version on, with CAS, or ADD for a new cart. If another writer changed the cart in the
+// meantime the update is retried against the new state, up to
+// maxCartTxAttempts times before giving up with Aborted. An error from fn
+// leaves the cart untouched and is returned as is.
+func (s *memcachedCartStore) updateCart(ctx context.Context, userID string, fn func(*storedCart) error) error {
+	for attempt := 1; attempt <= maxCartTxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		cart, old, err := s.loadCart(userID)
+		if err != nil {
+			return err
+		}
+		if err := checkCartVersion(ctx, cart.Version); err != nil {
+			return err
+		}
+		version := cart.Version
+		if err := fn(&cart); err != nil {
+			return err
+		}
+		cart.Version = version + 1
+		item, err := s.newItem(userID, cart)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			err = s.client.Add(item)
+		} else {
+			item.CasID = old.CasID
+			err = s.client.CompareAndSwap(item)
+		}
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, memcache.ErrNotStored), errors.Is(err, memcache.ErrCASConflict), errors.Is(err, memcache.ErrCacheMiss):
+			log.Debugf("cart %s changed concurrently, retrying (attempt %d/%d)", userID, attempt, maxCartTxAttempts)
+		default:
+			return memcachedError("failed to save cart", err)
+		}
+	}
+	return status.Errorf(codes.Aborted, "cart %s was modified concurrently, giving up after %d attempts", userID, maxCartTxAttempts)
+}
+
+func (s *memcachedCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	log.Infof("AddItem called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		cart.Items = addCartItem(cart.Items, productID, quantity, price)
+		return nil
+	})
+}
+
+func (s *memcachedCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	log.Infof("AddItems called: userID=%s, items=%d", userID, len(items))
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		cart.Items = addCartItems(cart.Items, items)
+		return nil
+	})
+}
+
+func (s *memcachedCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	log.Infof("UpdateItemQuantity called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		cart.Items = setCartItemQuantity(cart.Items, productID, quantity)
+		return nil
+	})
+}
+
+func (s *memcachedCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	log.Infof("GetCart called: userID=%s", userID)
+
+	cart, _, err := s.loadCart(userID)
+	if err != nil {
+		return nil, err
+	}
+	return cartToProto(userID, cart), nil
+}
+
+// GetCarts reads every cart with one GetMulti, which batches the keys per
+// server.
+func (s *memcachedCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	log.Infof("GetCarts called: %d users", len(userIDs))
+	if len(userIDs) == 0 {
+		return []*pb.Cart{}, nil
+	}
+
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = memcachedKey(userID)
+	}
+	items, err := s.client.GetMulti(keys)
+	if err != nil {
+		return nil, memcachedError("failed to get carts", err)
+	}
+	carts := make([]*pb.Cart, len(userIDs))
+	for i, userID := range userIDs {
+		cart := storedCart{Items: []cartItem{}}
+		if item, ok := items[keys[i]]; ok {
+			if cart, err = decodeMemcachedCart(item.Value); err != nil {
+				return nil, err
+			}
+		}
+		carts[i] = cartToProto(userID, cart)
+	}
+	return carts, nil
+}
+
+func (s *memcachedCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	_, item, err := s.loadCart(userID)
+	return item != nil, err
+}
+
+func (s *memcachedCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	log.Infof("MergeCarts called: from=%s, to=%s", fromUserID, toUserID)
+	if fromUserID == toUserID {
+		return nil
+	}
+
+	from, item, err := s.loadCart(fromUserID)
+	if err != nil || item == nil {
+		return err
+	}
+	if len(from.Items) > 0 || len(from.Saved) > 0 {
+		err := s.updateCart(ctx, toUserID, func(to *storedCart) error {
+			to.Items = mergeCartItems(to.Items, from.Items)
+			to.Saved = mergeCartItems(to.Saved, from.Saved)
+			if to.Currency == "" {
+				to.Currency = from.Currency
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.client.Delete(memcachedKey(fromUserID)); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		return memcachedError("failed to delete merged cart", err)
+	}
+	return nil
+}
+
+func (s *memcachedCartStore) EmptyCart(ctx context.Context, userID string) error {
+	log.Infof("EmptyCart called: userID=%s", userID)
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		*cart = storedCart{Items: []cartItem{}, Saved: cart.Saved}
+		return nil
+	})
+}
+
+func (s *memcachedCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	var locked string
+	err := s.updateCart(ctx, userID, func(cart *storedCart) error {
+		if cart.Currency == "" {
+			cart.Currency = currency
+		}
+		locked = cart.Currency
+		return nil
+	})
+	return locked, err
+}
+
+func (s *memcachedCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	cart, _, err := s.loadCart(userID)
+	return cart, err
+}
+
+func (s *memcachedCartStore) ImportCart(ctx context.Context, userID string, imported storedCart) error {
+	log.Infof("ImportCart called: userID=%s", userID)
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		*cart = importedCart(*cart, imported)
+		return nil
+	})
+}
+
+func (s *memcachedCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	log.Infof("SaveForLater called: userID=%s, productID=%s", userID, productID)
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		return saveCartItemForLater(cart, productID)
+	})
+}
+
+func (s *memcachedCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	log.Infof("MoveToCart called: userID=%s, productID=%s", userID, productID)
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		return moveSavedItemToCart(cart, productID)
+	})
+}
+
+func (s *memcachedCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	cart, _, err := s.loadCart(userID)
+	if err != nil {
+		return nil, err
+	}
+	return cartItemsToProto(cart.Saved), nil
+}
+
+// ListCartNames always fails: memcached can't enumerate keys.
+func (s *memcachedCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	return nil, status.Error(codes.Unimplemented, "listing carts is not supported by the memcached store")
+}
+
+func (s *memcachedCartStore) Ping(ctx context.Context) error {
+	return s.client.Ping()
+}
+
+func (s *memcachedCartStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,292 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeMemcachedItem struct {
+	value []byte
+	cas   uint64
+}
+
+// fakeMemcached speaks enough of the memcached text protocol for the cart
+// store: gets, set, add, cas, delete and version.
+type fakeMemcached struct {
+	mu     sync.Mutex
+	items  map[string]fakeMemcachedItem
+	nextID uint64
+
+	// beforeCAS, when set, runs with mu held before each cas command is
+	// applied.
+	beforeCAS func(key string)
+}
+
+func newFakeMemcached(t *testing.T) (*fakeMemcached, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	fm := &fakeMemcached{items: make(map[string]fakeMemcachedItem)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fm.serve(conn)
+		}
+	}()
+	return fm, ln.Addr().String()
+}
+
+// store saves value under key, returning the reply line.
+func (fm *fakeMemcached) store(verb, key string, value []byte, cas uint64) string {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if verb == "cas" && fm.beforeCAS != nil {
+		fm.beforeCAS(key)
+	}
+	old, exists := fm.items[key]
+	switch {
+	case verb == "add" && exists:
+		return "NOT_STORED"
+	case verb == "cas" && !exists:
+		return "NOT_FOUND"
+	case verb == "cas" && old.cas != cas:
+		return "EXISTS"
+	}
+	fm.nextID++
+	fm.items[key] = fakeMemcachedItem{value: value, cas: fm.nextID}
+	return "STORED"
+}
+
+func (fm *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+		switch verb := fields[0]; verb {
+		case "gets":
+			fm.mu.Lock()
+			for _, key := range fields[1:] {
+				if item, ok := fm.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(item.value), item.cas, item.value)
+				}
+			}
+			fm.mu.Unlock()
+			fmt.Fprint(rw, "END\r\n")
+		case "set", "add", "cas":
+			n, _ := strconv.Atoi(fields[4])
+			value := make([]byte, n+2)
+			if _, err := io.ReadFull(rw, value); err != nil {
+				return
+			}
+			var cas uint64
+			if verb == "cas" {
+				cas, _ = strconv.ParseUint(fields[5], 10, 64)
+			}
+			fmt.Fprintf(rw, "%s\r\n", fm.store(verb, fields[1], value[:n], cas))
+		case "delete":
+			fm.mu.Lock()
+			_, ok := fm.items[fields[1]]
+			delete(fm.items, fields[1])
+			fm.mu.Unlock()
+			if ok {
+				fmt.Fprint(rw, "DELETED\r\n")
+			} else {
+				fmt.Fprint(rw, "NOT_FOUND\r\n")
+			}
+		case "version":
+			fmt.Fprint(rw, "VERSION 1.6.0-fake\r\n")
+		default:
+			fmt.Fprint(rw, "ERROR\r\n")
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func newTestMemcachedStore(t *testing.T) (*memcachedCartStore, *fakeMemcached) {
+	t.Helper()
+	fm, addr := newFakeMemcached(t)
+	store, err := newMemcachedCartStore(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, fm
+}
+
+func TestMemcachedStore(t *testing.T) {
+	store, _ := newTestMemcachedStore(t)
+	ctx := context.Background()
+
+	if err := store.AddItem(ctx, "guest", "66VCHSJNUP", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddItem(ctx, "guest", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateItemQuantity(ctx, "guest", "1YMWWN1N4O", 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.LockCurrency(ctx, "guest", "EUR"); err != nil || got != "EUR" {
+		t.Fatalf("LockCurrency = %q, %v; want EUR", got, err)
+	}
+	if err := store.AddItem(ctx, "member", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MergeCarts(ctx, "guest", "member"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := store.CartExists(ctx, "guest"); err != nil || ok {
+		t.Errorf("guest cart exists = %v, %v after merge; want false", ok, err)
+	}
+	carts, err := store.GetCarts(ctx, []string{"guest", "member"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(carts[0].Items) != 0 {
+		t.Errorf("merged guest cart still has %d items", len(carts[0].Items))
+	}
+	want := map[string]int32{"66VCHSJNUP": 4, "1YMWWN1N4O": 4}
+	if len(carts[1].Items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(carts[1].Items), len(want))
+	}
+	for _, item := range carts[1].Items {
+		if item.Quantity != want[item.ProductId] {
+			t.Errorf("%s: got quantity %d, want %d", item.ProductId, item.Quantity, want[item.ProductId])
+		}
+	}
+	if got, err := store.LockCurrency(ctx, "member", "USD"); err != nil || got != "EUR" {
+		t.Errorf("merged cart currency = %q, %v; want EUR", got, err)
+	}
+
+	if err := store.EmptyCart(ctx, "member"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.CartExists(ctx, "member"); err != nil || !ok {
+		t.Errorf("emptied cart exists = %v, %v; want true", ok, err)
+	}
+}
+
+func TestMemcachedAddItemRetriesOnCASConflict(t *testing.T) {
+	tests := []struct {
+		name      string
+		conflicts int
+		wantCode  codes.Code
+		want      int32
+	}{
+		{"one conflict", 1, codes.OK, 3},
+		{"conflict on every attempt", maxCartTxAttempts, codes.Aborted, 1},
+	}
+	for _, tt := range tests {
+		store, fm := newTestMemcachedStore(t)
+		ctx := context.Background()
+		if err := store.AddItem(ctx, "user-1", "66VCHSJNUP", 1, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// Another writer rewrites the cart between our read and our CAS.
+		conflicts := 0
+		fm.mu.Lock()
+		fm.beforeCAS = func(key string) {
+			if conflicts == tt.conflicts {
+				return
+			}
+			conflicts++
+			fm.nextID++
+			item := fm.items[key]
+			item.cas = fm.nextID
+			fm.items[key] = item
+		}
+		fm.mu.Unlock()
+
+		err := store.AddItem(ctx, "user-1", "66VCHSJNUP", 2, nil)
+		if got := status.Code(err); got != tt.wantCode {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.wantCode)
+		}
+		cart, err := store.GetCart(ctx, "user-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cart.Items[0].Quantity; got != tt.want {
+			t.Errorf("%s: got quantity %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemcachedKey(t *testing.T) {
+	tests := []struct {
+		userID string
+		hashed bool
+	}{
+		{"6b5c4b2e-6a3d-4d3f-9a4f-0b1f2a3c4d5e", false},
+		{"user with spaces", true},
+		{strings.Repeat("a", 300), true},
+	}
+	for _, tt := range tests {
+		key := memcachedKey(tt.userID)
+		if got := strings.HasPrefix(key, "cart-sha256:"); got != tt.hashed {
+			t.Errorf("%.20q: got key %q, hashed = %v, want %v", tt.userID, key, got, tt.hashed)
+		}
+		if len(key) > 250 || strings.ContainsAny(key, " \t\r\n") {
+			t.Errorf("%.20q: %q is not a legal memcached key", tt.userID, key)
+		}
+	}
+}
+
+func TestMemcachedExpiration(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want func(int32) bool
+	}{
+		{0, func(e int32) bool { return e == 0 }},
+		{500 * time.Millisecond, func(e int32) bool { return e == 1 }},
+		{48 * time.Hour, func(e int32) bool { return e == 172800 }},
+		{60 * 24 * time.Hour, func(e int32) bool { return int64(e) > time.Now().Unix() }},
+	}
+	for _, tt := range tests {
+		s := &memcachedCartStore{ttl: tt.ttl}
+		if got := s.expiration(); !tt.want(got) {
+			t.Errorf("ttl %v: got expiration %d", tt.ttl, got)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultMemorySnapshotInterval is how often a persisted in-memory store
+// writes its carts to disk, besides once more on shutdown.
+const defaultMemorySnapshotInterval = 30 * time.Second
+
+// memorySnapshotFailures counts snapshots of the in-memory store that could
+// not be written.
+var memorySnapshotFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Subsystem: "store",
+	Name:      "memory_snapshot_failures_total",
+	Help:      "Number of in-memory store snapshots that failed to be written to disk.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(memorySnapshotFailures)
+}
+
+// memoryStorePathFromEnv reads MEMORY_STORE_PATH, the file the in-memory
+// store keeps its carts in across restarts. Unset keeps them in memory only.
+func memoryStorePathFromEnv() string {
+	return os.Getenv("MEMORY_STORE_PATH")
+}
+
+// memorySnapshotIntervalFromEnv reads MEMORY_STORE_SNAPSHOT_INTERVAL, falling
+// back to defaultMemorySnapshotInterval. Zero writes the carts only on
+// shutdown.
+func memorySnapshotIntervalFromEnv() time.Duration {
+	v := os.Getenv("MEMORY_STORE_SNAPSHOT_INTERVAL")
+	if v == "" {
+		return defaultMemorySnapshotInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid MEMORY_STORE_SNAPSHOT_INTERVAL %q, using %v", v, defaultMemorySnapshotInterval)
+		return defaultMemorySnapshotInterval
+	}
+	return d
+}
+
+// persistTo loads the carts snapshotted at path, if there are any, and makes
+// Close snapshot the store there. A snapshot that can't be read is logged
+// and the store starts empty.
+func (s *memoryCartStore) persistTo(path string) {
+	s.path = path
+	n, err := s.load(path)
+	if err != nil {
+		log.Warnf("Failed to load carts from %s, starting with none: %v", path, err)
+		return
+	}
+	log.Infof("Loaded %d carts from %s", n, path)
+}
+
+// load adds the carts snapshotted at path to the store, least recently
+// changed first so the LRU order survives the restart, and reports how many
+// it holds afterwards. A missing file is an empty snapshot.
+func (s *memoryCartStore) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var carts map[string]storedCart
+	if err := json.Unmarshal(data, &carts); err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(carts))
+	for key := range carts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := carts[keys[i]], carts[keys[j]]
+		if a.UpdatedAt != b.UpdatedAt {
+			return a.UpdatedAt < b.UpdatedAt
+		}
+		return keys[i] < keys[j]
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := s.carts[key]; ok {
+			continue
+		}
+		s.carts[key] = s.lru.PushFront(&memoryCart{userID: key, cart: carts[key]})
+	}
+	for s.maxCarts > 0 && s.lru.Len() > s.maxCarts {
+		s.remove(s.lru.Back().Value.(*memoryCart).userID)
+	}
+	memoryCarts.Set(float64(s.lru.Len()))
+	// The loaded carts are already on disk.
+	s.savedChanges = s.changes
+	return s.lru.Len(), nil
+}
+
+// saveSnapshot writes every cart to s.path, unless nothing has changed
+// since the last snapshot. The file is replaced atomically, so a crash
+// mid-write leaves the previous snapshot intact.
+func (s *memoryCartStore) saveSnapshot() error {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	s.mu.Lock()
+	changes := s.changes
+	s.mu.Unlock()
+	if changes == s.savedChanges {
+		return nil
+	}
+	// Any change made from here on is picked up by the next snapshot.
+	carts := s.snapshot()
+	data, err := json.Marshal(carts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+	s.savedChanges = changes
+	log.Debugf("Saved %d carts to %s", len(carts), s.path)
+	return nil
+}
+
+// persist snapshots the store every interval until ctx is done. Close
+// writes the last snapshot, once no more RPCs can change the carts.
+func (s *memoryCartStore) persist(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.saveSnapshot(); err != nil {
+				memorySnapshotFailures.Inc()
+				log.Warnf("Failed to save carts to %s: %v", s.path, err)
+			}
+		}
+	}
+}
+
+// Close writes a final snapshot if the store is persisted.
+func (s *memoryCartStore) Close() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := s.saveSnapshot(); err != nil {
+		memorySnapshotFailures.Inc()
+		return err
+	}
+	log.Infof("Saved carts to %s", s.path)
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySnapshotIntervalFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", defaultMemorySnapshotInterval},
+		{"5s", 5 * time.Second},
+		{"0", 0},
+		{"-1s", defaultMemorySnapshotInterval},
+		{"often", defaultMemorySnapshotInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("MEMORY_STORE_SNAPSHOT_INTERVAL", tt.value)
+			if got := memorySnapshotIntervalFromEnv(); got != tt.want {
+				t.Errorf("memorySnapshotIntervalFromEnv() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "carts.json")
+
+	s := newMemoryCartStore()
+	s.persistTo(path)
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveForLater(ctx, "user-1", "OLJCESPC7Z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "user-2", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newMemoryCartStore()
+	restarted.persistTo(path)
+	for userID, want := range s.snapshot() {
+		got, ok := restarted.get(userID, false)
+		if !ok {
+			t.Errorf("cart %q was not restored", userID)
+			continue
+		}
+		if got.Version != want.Version || len(got.Items) != len(want.Items) || len(got.Saved) != len(want.Saved) {
+			t.Errorf("cart %q restored as %+v, want %+v", userID, got, want)
+		}
+	}
+	if n, _ := restarted.CountCarts(ctx); n != 2 {
+		t.Errorf("restored %d carts, want 2", n)
+	}
+}
+
+func TestMemoryStoreSnapshotIsACopy(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryCartStore()
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	snap := s.snapshot()
+	// Merges into the existing line, in place.
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := snap["user-1"].Items[0].Quantity; got != 1 {
+		t.Errorf("snapshot quantity changed to %d by a later write, want 1", got)
+	}
+}
+
+func TestMemoryStoreLoadKeepsMostRecentCarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "carts.json")
+	data := `{"old":{"items":[],"updated_at":100},"newest":{"items":[],"updated_at":300},"newer":{"items":[],"updated_at":200}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MEMORY_STORE_MAX_CARTS", "2")
+	s := newMemoryCartStore()
+	n, err := s.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("loaded %d carts, want 2", n)
+	}
+	if _, ok := s.get("old", false); ok {
+		t.Error("least recently changed cart was kept over MEMORY_STORE_MAX_CARTS")
+	}
+}
+
+func TestMemoryStoreLoad(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"missing file", filepath.Join(dir, "missing.json"), false},
+		{"corrupt file", bad, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := newMemoryCartStore().load(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n != 0 {
+				t.Errorf("load() = %d carts, want 0", n)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSnapshotSkipsUnchangedStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "carts.json")
+	s := newMemoryCartStore()
+	s.persistTo(path)
+
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("an empty, unchanged store was written: %v", err)
+	}
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("changed store was not written: %v", err)
+	}
+	// Reads don't count as changes.
+	if _, err := s.GetCart(ctx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("store was written again without changes: %v", err)
+	}
+}
+
+func TestMemoryStorePersistsPeriodically(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "carts.json")
+	s := newMemoryCartStore()
+	s.persistTo(path)
+	go s.persist(ctx, 10*time.Millisecond)
+
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("carts were not snapshotted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
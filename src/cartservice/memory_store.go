@@ -0,0 +1,375 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// In-memory cart store (fallback when Redis is not available). When
+// maxCarts is set, the least recently used cart is evicted once the store
+// holds more than that many. When path is set, the carts are snapshotted
+// there so they survive restarts.
+type memoryCartStore struct {
+	mu       sync.Mutex
+	carts    map[string]*list.Element // values are *memoryCart
+	lru      *list.List               // most recently used at the front
+	maxCarts int                      // zero means unbounded
+	changes  uint64                   // bumped on every write
+
+	path         string
+	snapshotMu   sync.Mutex // serializes snapshots
+	savedChanges uint64     // changes as of the last snapshot
+}
+
+type memoryCart struct {
+	userID string
+	cart   storedCart
+}
+
+func newMemoryCartStore() *memoryCartStore {
+	log.Info("Using in-memory cart store")
+	s := &memoryCartStore{
+		carts:    make(map[string]*list.Element),
+		lru:      list.New(),
+		maxCarts: memoryStoreMaxCartsFromEnv(),
+	}
+	if s.maxCarts > 0 {
+		log.Infof("In-memory store keeps at most %d carts", s.maxCarts)
+	}
+	return s
+}
+
+// memoryStoreMaxCartsFromEnv reads MEMORY_STORE_MAX_CARTS. Unset or zero
+// leaves the store unbounded.
+func memoryStoreMaxCartsFromEnv() int {
+	v := os.Getenv("MEMORY_STORE_MAX_CARTS")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("Ignoring invalid MEMORY_STORE_MAX_CARTS %q, the in-memory store is unbounded", v)
+		return 0
+	}
+	return n
+}
+
+// get returns the user's cart, marking it recently used when touch is set.
+// The caller must hold s.mu.
+func (s *memoryCartStore) get(userID string, touch bool) (storedCart, bool) {
+	e, ok := s.carts[userID]
+	if !ok {
+		return storedCart{}, false
+	}
+	if touch {
+		s.lru.MoveToFront(e)
+	}
+	return e.Value.(*memoryCart).cart, true
+}
+
+// getForWrite is get for a cart about to be changed: it fails if the cart
+// isn't at the version ctx expects. The caller must hold s.mu.
+func (s *memoryCartStore) getForWrite(ctx context.Context, userID string) (storedCart, error) {
+	cart, _ := s.get(userID, false)
+	if err := checkCartVersion(ctx, cart.Version); err != nil {
+		return storedCart{}, err
+	}
+	return cart, nil
+}
+
+// put stores the user's cart, stamped as changed now and one version on
+// from the stored one, as the most recently used one, evicting the least
+// recently used carts over maxCarts. The caller must hold s.mu.
+func (s *memoryCartStore) put(userID string, cart storedCart) {
+	s.changes++
+	cart.UpdatedAt = time.Now().Unix()
+	cart.Version = 1
+	if e, ok := s.carts[userID]; ok {
+		cart.Version = e.Value.(*memoryCart).cart.Version + 1
+		e.Value.(*memoryCart).cart = cart
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.carts[userID] = s.lru.PushFront(&memoryCart{userID: userID, cart: cart})
+	for s.maxCarts > 0 && s.lru.Len() > s.maxCarts {
+		oldest := s.lru.Back()
+		s.remove(oldest.Value.(*memoryCart).userID)
+		memoryEvictions.Inc()
+	}
+	memoryCarts.Set(float64(s.lru.Len()))
+}
+
+// remove drops the user's cart. The caller must hold s.mu.
+func (s *memoryCartStore) remove(userID string) {
+	if e, ok := s.carts[userID]; ok {
+		s.lru.Remove(e)
+		delete(s.carts, userID)
+		s.changes++
+	}
+	memoryCarts.Set(float64(s.lru.Len()))
+}
+
+func (s *memoryCartStore) CountCarts(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.carts), nil
+}
+
+func (s *memoryCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	log.Infof("AddItem called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, err := s.getForWrite(ctx, userID)
+	if err != nil {
+		return err
+	}
+	cart.Items = addCartItem(cart.Items, productID, quantity, price)
+	s.put(userID, cart)
+	return nil
+}
+
+func (s *memoryCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	log.Infof("AddItems called: userID=%s, items=%d", userID, len(items))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, err := s.getForWrite(ctx, userID)
+	if err != nil {
+		return err
+	}
+	cart.Items = addCartItems(cart.Items, items)
+	s.put(userID, cart)
+	return nil
+}
+
+func (s *memoryCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	log.Infof("UpdateItemQuantity called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, err := s.getForWrite(ctx, userID)
+	if err != nil {
+		return err
+	}
+	cart.Items = setCartItemQuantity(cart.Items, productID, quantity)
+	s.put(userID, cart)
+	return nil
+}
+
+func (s *memoryCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	log.Infof("GetCart called: userID=%s", userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, _ := s.get(userID, true)
+	return cartToProto(userID, cart), nil
+}
+
+// GetCarts reads carts for bulk export without changing their LRU order.
+func (s *memoryCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	log.Infof("GetCarts called: %d users", len(userIDs))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	carts := make([]*pb.Cart, len(userIDs))
+	for i, userID := range userIDs {
+		cart, _ := s.get(userID, false)
+		carts[i] = cartToProto(userID, cart)
+	}
+	return carts, nil
+}
+
+func (s *memoryCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.get(userID, false)
+	return ok, nil
+}
+
+func (s *memoryCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	log.Infof("MergeCarts called: from=%s, to=%s", fromUserID, toUserID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, ok := s.get(fromUserID, false)
+	if !ok || fromUserID == toUserID {
+		return nil
+	}
+	s.remove(fromUserID)
+	if len(from.Items) > 0 || len(from.Saved) > 0 {
+		to, _ := s.get(toUserID, false)
+		to.Items = mergeCartItems(to.Items, from.Items)
+		to.Saved = mergeCartItems(to.Saved, from.Saved)
+		if to.Currency == "" {
+			to.Currency = from.Currency
+		}
+		s.put(toUserID, to)
+	}
+	return nil
+}
+
+func (s *memoryCartStore) EmptyCart(ctx context.Context, userID string) error {
+	log.Infof("EmptyCart called: userID=%s", userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, err := s.getForWrite(ctx, userID)
+	if err != nil {
+		return err
+	}
+	s.put(userID, storedCart{Items: []cartItem{}, Saved: cart.Saved})
+	return nil
+}
+
+func (s *memoryCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, _ := s.get(userID, false)
+	if cart.Currency != "" {
+		return cart.Currency, nil
+	}
+	cart.Currency = currency
+	s.put(userID, cart)
+	return currency, nil
+}
+
+func (s *memoryCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, _ := s.get(userID, false)
+	// Copied, as writes update the stored lines in place.
+	cart.Items, cart.Saved = slices.Clone(cart.Items), slices.Clone(cart.Saved)
+	return cart, nil
+}
+
+func (s *memoryCartStore) ImportCart(ctx context.Context, userID string, imported storedCart) error {
+	log.Infof("ImportCart called: userID=%s", userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, err := s.getForWrite(ctx, userID)
+	if err != nil {
+		return err
+	}
+	s.put(userID, importedCart(cart, imported))
+	return nil
+}
+
+func (s *memoryCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	log.Infof("SaveForLater called: userID=%s, productID=%s", userID, productID)
+	return s.moveLine(ctx, userID, productID, saveCartItemForLater)
+}
+
+func (s *memoryCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	log.Infof("MoveToCart called: userID=%s, productID=%s", userID, productID)
+	return s.moveLine(ctx, userID, productID, moveSavedItemToCart)
+}
+
+// moveLine applies move to the user's cart, storing the result unless move
+// fails.
+func (s *memoryCartStore) moveLine(ctx context.Context, userID, productID string, move func(*storedCart, string) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, err := s.getForWrite(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := move(&cart, productID); err != nil {
+		return err
+	}
+	s.put(userID, cart)
+	return nil
+}
+
+func (s *memoryCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart, _ := s.get(userID, false)
+	return cartItemsToProto(cart.Saved), nil
+}
+
+func (s *memoryCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for key := range s.carts {
+		if name, ok := cartNameFromKey(userID, key); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *memoryCartStore) IdleCarts(ctx context.Context, from, to time.Time) ([]idleCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var carts []idleCart
+	for key, e := range s.carts {
+		cart := e.Value.(*memoryCart).cart
+		if len(cart.Items) > 0 && changedBetween(cart.UpdatedAt, from, to) {
+			// Copied, as the watcher reads it after the lock is released.
+			cart.Items, cart.Saved = slices.Clone(cart.Items), slices.Clone(cart.Saved)
+			carts = append(carts, idleCart{key: key, cart: cart, updatedAt: time.Unix(cart.UpdatedAt, 0)})
+		}
+	}
+	return carts, nil
+}
+
+// ListCartKeys pages through the carts in key order. The page token is the
+// last key of the previous page.
+func (s *memoryCartStore) ListCartKeys(ctx context.Context, pageToken string, pageSize int) ([]string, string, error) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.carts))
+	for key := range s.carts {
+		if key > pageToken {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+	if len(keys) <= pageSize {
+		return keys, "", nil
+	}
+	return keys[:pageSize], keys[pageSize-1], nil
+}
+
+// snapshot returns a copy of every cart, keyed by user ID.
+func (s *memoryCartStore) snapshot() map[string]storedCart {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	carts := make(map[string]storedCart, len(s.carts))
+	for key, e := range s.carts {
+		cart := e.Value.(*memoryCart).cart
+		// Copied, as it is marshalled after the lock is released.
+		cart.Items, cart.Saved = slices.Clone(cart.Items), slices.Clone(cart.Saved)
+		carts[key] = cart
+	}
+	return carts
+}
+
+func (s *memoryCartStore) Ping(ctx context.Context) error {
+	return nil
+}
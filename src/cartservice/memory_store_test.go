@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Setenv("MEMORY_STORE_MAX_CARTS", "3")
+	ctx := context.Background()
+	s := newMemoryCartStore()
+
+	for _, userID := range []string{"user-1", "user-2", "user-3"} {
+		if err := s.AddItem(ctx, userID, "OLJCESPC7Z", 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reading user-1 makes user-2 the least recently used cart.
+	if _, err := s.GetCart(ctx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "user-4", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		userID string
+		want   bool
+	}{
+		{"user-1", true},
+		{"user-2", false},
+		{"user-3", true},
+		{"user-4", true},
+	}
+	for _, tt := range tests {
+		got, err := s.CartExists(ctx, tt.userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("CartExists(%q) = %v, want %v", tt.userID, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryStoreMaxCartsFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{"", 0},
+		{"100", 100},
+		{"0", 0},
+		{"-1", 0},
+		{"lots", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEMORY_STORE_MAX_CARTS", tt.env)
+		if got := memoryStoreMaxCartsFromEnv(); got != tt.want {
+			t.Errorf("MEMORY_STORE_MAX_CARTS=%q: got %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryStoreConcurrentUse(t *testing.T) {
+	t.Setenv("MEMORY_STORE_MAX_CARTS", "8")
+	ctx := context.Background()
+	s := newMemoryCartStore()
+	before := testutil.ToFloat64(memoryEvictions)
+
+	// Run under -race: every method touches the shared map and LRU list.
+	const workers = 16
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				userID := fmt.Sprintf("user-%d-%d", i, j%4)
+				if err := s.AddItem(ctx, userID, "OLJCESPC7Z", 1, nil); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.GetCart(ctx, userID); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.GetCarts(ctx, []string{userID, "user-0-0"}); err != nil {
+					t.Error(err)
+				}
+				if j%5 == 0 {
+					if err := s.MergeCarts(ctx, userID, "user-0-0"); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	n := len(s.carts)
+	s.mu.Unlock()
+	if n > 8 {
+		t.Errorf("store holds %d carts, want at most 8", n)
+	}
+	if got := testutil.ToFloat64(memoryEvictions); got <= before {
+		t.Errorf("memory_evictions did not increase (still %v)", got)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProductionEnvs          = "production,prod"
+	defaultMemoryStoreWarnInterval = 5 * time.Minute
+)
+
+// productionEnvsFromEnv reads PRODUCTION_ENVS, the comma-separated
+// DEPLOYMENT_ENV values that count as production.
+func productionEnvsFromEnv() []string {
+	v := os.Getenv("PRODUCTION_ENVS")
+	if v == "" {
+		v = defaultProductionEnvs
+	}
+	var envs []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			envs = append(envs, strings.ToLower(e))
+		}
+	}
+	return envs
+}
+
+func isProductionEnv(env string, productionEnvs []string) bool {
+	env = strings.ToLower(strings.TrimSpace(env))
+	for _, p := range productionEnvs {
+		if env == p {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryStoreWarnIntervalFromEnv reads MEMORY_STORE_WARN_INTERVAL. Zero
+// logs the warning once at startup only.
+func memoryStoreWarnIntervalFromEnv() time.Duration {
+	v := os.Getenv("MEMORY_STORE_WARN_INTERVAL")
+	if v == "" {
+		return defaultMemoryStoreWarnInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid MEMORY_STORE_WARN_INTERVAL %q, using %v", v, defaultMemoryStoreWarnInterval)
+		return defaultMemoryStoreWarnInterval
+	}
+	return d
+}
+
+// memoryStoreActive returns a func reporting whether store holds carts in
+// process memory, or nil if it never does.
+func memoryStoreActive(store cartStore) func() bool {
+	switch store := store.(type) {
+	case *memoryCartStore:
+		return func() bool { return true }
+	case *failoverCartStore:
+		return store.onFallback
+	}
+	return nil
+}
+
+// warnMemoryStoreInProduction keeps reminding operators that carts live only
+// in process memory and will be lost on restart. It logs immediately and then
+// every interval until ctx is cancelled or active reports carts have moved
+// off memory.
+func warnMemoryStoreInProduction(ctx context.Context, env string, interval time.Duration, active func() bool) {
+	entry := log.WithFields(logrus.Fields{
+		"store":          "memory",
+		"deployment_env": env,
+		"impact":         "all carts are lost when this process restarts",
+		"remedy":         "set REDIS_ADDR to a reachable Redis instance",
+	})
+	entry.Warn("In-memory cart store is active in a production environment")
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !active() {
+				return
+			}
+			entry.Warn("In-memory cart store is active in a production environment")
+		}
+	}
+}
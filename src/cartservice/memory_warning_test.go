@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestIsProductionEnv(t *testing.T) {
+	tests := []struct {
+		envs string
+		env  string
+		want bool
+	}{
+		{"", "production", true},
+		{"", "Prod", true},
+		{"", "staging", false},
+		{"", "", false},
+		{"live, staging", "staging", true},
+		{"live, staging", "production", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("PRODUCTION_ENVS", tt.envs)
+		if got := isProductionEnv(tt.env, productionEnvsFromEnv()); got != tt.want {
+			t.Errorf("PRODUCTION_ENVS=%q env=%q: got %v, want %v", tt.envs, tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryStoreProductionWarning(t *testing.T) {
+	hook := test.NewLocal(log)
+	defer hook.Reset()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go warnMemoryStoreInProduction(ctx, "production", 10*time.Millisecond, func() bool { return true })
+
+	// One warning at startup plus at least one repeat.
+	deadline := time.Now().Add(time.Second)
+	for countMemoryWarnings(hook) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d warnings, want at least 2", countMemoryWarnings(hook))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel && e.Data["store"] == "memory" && e.Data["deployment_env"] != "production" {
+			t.Errorf("warning carries deployment_env=%v, want production", e.Data["deployment_env"])
+		}
+	}
+}
+
+func TestMemoryStoreWarningFollowsFailover(t *testing.T) {
+	if memoryStoreActive(newMemoryCartStore()) == nil {
+		t.Error("no warning for the memory store")
+	}
+	redisStore, _ := newTestRedisStore(t)
+	if memoryStoreActive(redisStore) != nil {
+		t.Error("warning for the Redis store")
+	}
+
+	ctx := context.Background()
+	s, backend := newTestFailoverStore(t, false)
+	active := memoryStoreActive(s)
+	if active == nil || !active() {
+		t.Fatal("no warning for a store that fell back to memory")
+	}
+	backend.setUp()
+	if !s.tryPromote(ctx) {
+		t.Fatal("not promoted once the backend is up")
+	}
+	if active() {
+		t.Error("still warning after moving back to Redis")
+	}
+
+	// Stops after the startup warning once carts are off memory.
+	hook := test.NewLocal(log)
+	defer hook.Reset()
+	warnMemoryStoreInProduction(ctx, "production", time.Millisecond, active)
+	if n := countMemoryWarnings(hook); n != 1 {
+		t.Errorf("got %d warnings, want 1", n)
+	}
+}
+
+func countMemoryWarnings(hook *test.Hook) int {
+	n := 0
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel && e.Data["store"] == "memory" {
+			n++
+		}
+	}
+	return n
+}
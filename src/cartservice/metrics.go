@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	backendRedis     = "redis"
+	backendMemory    = "memory"
+	backendPostgres  = "postgres"
+	backendMemcached = "memcached"
+	backendSpanner   = "spanner"
+
+	opMarshal   = "marshal"
+	opUnmarshal = "unmarshal"
+
+	opGet    = "get"
+	opMGet   = "mget"
+	opExists = "exists"
+	opSet    = "set"
+	opWatch  = "watch"
+	opExec   = "exec"
+	opScan   = "scan"
+)
+
+// metricsRegistry holds every cartservice metric so they can be exposed
+// from a single place.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	// storeSerializationErrors counts failures to encode or decode a stored
+	// cart. A spike usually means the backing store holds corrupted data.
+	storeSerializationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "serialization_errors_total",
+		Help:      "Number of cart marshal/unmarshal failures in the store layer.",
+	}, []string{"operation", "backend"})
+
+	// redisErrors counts Redis commands that failed for reasons other than
+	// a lost optimistic-locking race.
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "redis_errors_total",
+		Help:      "Number of failed Redis commands issued by the cart store.",
+	}, []string{"operation"})
+
+	// memoryCarts tracks how many carts the in-memory store is holding.
+	memoryCarts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "memory_carts",
+		Help:      "Number of carts held by the in-memory store.",
+	})
+
+	// memoryEvictions counts carts dropped by the in-memory store to stay
+	// within MEMORY_STORE_MAX_CARTS.
+	memoryEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "memory_evictions_total",
+		Help:      "Number of least recently used carts evicted from the in-memory store.",
+	})
+
+	// storeFallbacks counts startups that wanted Redis but fell back to the
+	// in-memory store because Redis could not be reached.
+	storeFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "fallbacks_total",
+		Help:      "Number of times the cart store fell back from Redis to memory.",
+	})
+
+	// storeMode is 1 for the backend currently holding carts and 0 for the
+	// others.
+	storeMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "mode",
+		Help:      "Cart store backend in use (1) or not (0).",
+	}, []string{"backend"})
+
+	// grpcMetrics records per-method request counts and latencies.
+	grpcMetrics = grpc_prometheus.NewServerMetrics()
+)
+
+func init() {
+	grpcMetrics.EnableHandlingTimeHistogram()
+	metricsRegistry.MustRegister(storeSerializationErrors, redisErrors, memoryCarts, memoryEvictions, storeFallbacks, storeMode, grpcMetrics)
+}
+
+// setStoreMode marks backend as the one holding carts.
+func setStoreMode(backend string) {
+	for _, b := range []string{backendRedis, backendMemory, backendPostgres, backendMemcached, backendSpanner} {
+		v := 0.0
+		if b == backend {
+			v = 1
+		}
+		storeMode.WithLabelValues(b).Set(v)
+	}
+}
+
+// serveMetrics exposes metricsRegistry on /metrics at port. It only returns
+// if the listener fails.
+func serveMetrics(port string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	log.Infof("Serving metrics on port %s", port)
+	return http.ListenAndServe(fmt.Sprintf(":%s", port), mux)
+}
+
+// metricsPortFromEnv returns METRICS_PORT. Empty disables metrics entirely.
+func metricsPortFromEnv() string {
+	return os.Getenv("METRICS_PORT")
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestUnmarshalErrorIncrementsCounter(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	if err := mr.Set(store.key("user-1"), "{not json"); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := storeSerializationErrors.WithLabelValues(opUnmarshal, backendRedis)
+	before := testutil.ToFloat64(counter)
+
+	_, err := store.GetCart(context.Background(), "user-1")
+	if got, want := status.Code(err), codes.Internal; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got, want := testutil.ToFloat64(counter), before+1; got != want {
+		t.Errorf("got %v errors, want %v", got, want)
+	}
+}
+
+func TestRedisErrorsCounter(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+	mr.Close()
+
+	tests := []struct {
+		op   string
+		call func() error
+	}{
+		{opGet, func() error { _, err := store.GetCart(context.Background(), "user-1"); return err }},
+		{opMGet, func() error { _, err := store.GetCarts(context.Background(), []string{"user-1"}); return err }},
+		{opExists, func() error { _, err := store.CartExists(context.Background(), "user-1"); return err }},
+		{opWatch, func() error { return store.EmptyCart(context.Background(), "user-1") }},
+		{opWatch, func() error { return store.AddItem(context.Background(), "user-1", "OLJCESPC7Z", 1, nil) }},
+	}
+	for _, tt := range tests {
+		counter := redisErrors.WithLabelValues(tt.op)
+		before := testutil.ToFloat64(counter)
+		if err := tt.call(); err == nil {
+			t.Fatalf("%s: expected an error with Redis down", tt.op)
+		}
+		if got := testutil.ToFloat64(counter); got <= before {
+			t.Errorf("%s: counter did not increase (still %v)", tt.op, got)
+		}
+	}
+}
+
+func TestGRPCMetricsInterceptor(t *testing.T) {
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcMetrics.UnaryServerInterceptor()))
+	pb.RegisterCartServiceServer(srv, &cartServer{store: newMemoryCartStore()})
+	grpcMetrics.InitializeMetrics(srv)
+	client := pb.NewCartServiceClient(newTestGRPCConn(t, srv))
+
+	before := testutil.ToFloat64(memoryCarts)
+	if _, err := client.AddItem(context.Background(), &pb.AddItemRequest{
+		UserId: "metrics-user",
+		Item:   &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(memoryCarts); got != 1 {
+		t.Errorf("memory_carts = %v (was %v), want 1", got, before)
+	}
+
+	n, err := testutil.GatherAndCount(metricsRegistry, "grpc_server_handled_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("no grpc_server_handled_total series were exported")
+	}
+}
+
+func TestStoreFallbackMetrics(t *testing.T) {
+	t.Setenv("REDIS_CONNECT_RETRIES", "0")
+	up := miniredis.RunT(t)
+	down := miniredis.RunT(t)
+	downAddr := down.Addr()
+	down.Close()
+
+	tests := []struct {
+		name         string
+		addr         string
+		wantBackend  string
+		wantFallback bool
+	}{
+		{"redis reachable", up.Addr(), backendRedis, false},
+		{"redis unreachable", downAddr, backendMemory, true},
+		{"redis not configured", "", backendMemory, false},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(storeFallbacks)
+		store := newCartStore(tt.addr)
+		if c, ok := store.(io.Closer); ok {
+			c.Close()
+		}
+
+		want := before
+		if tt.wantFallback {
+			want++
+		}
+		if got := testutil.ToFloat64(storeFallbacks); got != want {
+			t.Errorf("%s: got %v fallbacks, want %v", tt.name, got, want)
+		}
+		for _, b := range []string{backendRedis, backendMemory} {
+			want := 0.0
+			if b == tt.wantBackend {
+				want = 1
+			}
+			if got := testutil.ToFloat64(storeMode.WithLabelValues(b)); got != want {
+				t.Errorf("%s: store mode %s = %v, want %v", tt.name, b, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+const otlpHTTPMetricsPath = "/v1/metrics"
+
+// cartInstruments are the OpenTelemetry instruments cartservice records
+// to. They are no-ops until initMetrics swaps in real ones.
+type cartInstruments struct {
+	addItemCalls  metric.Int64Counter
+	cartSize      metric.Int64Histogram
+	storeDuration metric.Float64Histogram
+}
+
+var otelMetrics = newCartInstruments(noop.NewMeterProvider().Meter("cartservice"))
+
+func newCartInstruments(meter metric.Meter) *cartInstruments {
+	// Instrument creation only fails on invalid names or units, which are
+	// fixed here.
+	addItemCalls, _ := meter.Int64Counter("cartservice.additem.calls",
+		metric.WithDescription("AddItem calls, by gRPC status code."),
+		metric.WithUnit("{call}"))
+	cartSize, _ := meter.Int64Histogram("cartservice.cart.size",
+		metric.WithDescription("Distinct products in a cart when it is read with GetCart."),
+		metric.WithUnit("{product}"),
+		metric.WithExplicitBucketBoundaries(0, 1, 2, 5, 10, 20, 50, 100))
+	storeDuration, _ := meter.Float64Histogram("cartservice.store.duration",
+		metric.WithDescription("Duration of cart store operations."),
+		metric.WithUnit("s"))
+	return &cartInstruments{addItemCalls: addItemCalls, cartSize: cartSize, storeDuration: storeDuration}
+}
+
+func (m *cartInstruments) recordAddItem(ctx context.Context, code codes.Code) {
+	m.addItemCalls.Add(ctx, 1, metric.WithAttributes(attribute.String("rpc.grpc.status_code", code.String())))
+}
+
+func (m *cartInstruments) recordCartSize(ctx context.Context, lines int64) {
+	m.cartSize.Record(ctx, lines)
+}
+
+func (m *cartInstruments) recordStoreDuration(ctx context.Context, op, backend string, seconds float64) {
+	m.storeDuration.Record(ctx, seconds, metric.WithAttributes(
+		attribute.String("operation", op), attribute.String("backend", backend)))
+}
+
+// otelMetricsEnabledFromEnv reads OTEL_METRICS_EXPORTER. Metrics are
+// exported over OTLP unless it is "none".
+func otelMetricsEnabledFromEnv() bool {
+	switch v := os.Getenv("OTEL_METRICS_EXPORTER"); v {
+	case "", "otlp":
+		return true
+	case "none":
+		return false
+	default:
+		log.Warnf("Ignoring unsupported OTEL_METRICS_EXPORTER %q, exporting over OTLP", v)
+		return true
+	}
+}
+
+// initMetrics starts pushing metrics to the collector the trace exporter
+// uses, on the SDK's default interval (OTEL_METRIC_EXPORT_INTERVAL), and
+// makes otelMetrics record to it.
+func initMetrics(ctx context.Context) (*sdkmetric.MeterProvider, error) {
+	cfg, err := otlpExporterConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.protocol == otlpProtocolHTTP {
+		cfg.urlPath = strings.TrimSuffix(cfg.urlPath, otlpHTTPTracesPath) + otlpHTTPMetricsPath
+	}
+	log.Infof("Initializing metrics for cartservice, exporting to %s", cfg)
+
+	exporter, err := newOTLPMetricExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric exporter: %w", err)
+	}
+	res, err := serviceResource()
+	if err != nil {
+		return nil, err
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	otelMetrics = newCartInstruments(mp.Meter("cartservice"))
+	log.Info("Metrics initialized successfully")
+	return mp, nil
+}
+
+// newOTLPMetricExporter creates an OTLP metric exporter as
+// newOTLPTraceExporter does for traces.
+func newOTLPMetricExporter(ctx context.Context, cfg otlpExporterConfig) (sdkmetric.Exporter, error) {
+	if cfg.protocol == otlpProtocolHTTP {
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(cfg.endpoint),
+			otlpmetrichttp.WithURLPath(cfg.urlPath),
+		}
+		if cfg.insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else if cfg.tls != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(cfg.tls))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(cfg.endpoint)}
+	if cfg.insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else {
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(cfg.tls)))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// useTestMeter points otelMetrics at a manual reader for the rest of the
+// test.
+func useTestMeter(t *testing.T) *sdkmetric.ManualReader {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	old := otelMetrics
+	otelMetrics = newCartInstruments(mp.Meter("cartservice"))
+	t.Cleanup(func() { otelMetrics = old })
+	return reader
+}
+
+func TestOTelMetrics(t *testing.T) {
+	reader := useTestMeter(t)
+	ctx := context.Background()
+	s := &cartServer{store: &timedCartStore{cartStore: newMemoryCartStore(), backend: backendMemory}}
+
+	for _, q := range []int32{1, 0} { // the second call is rejected
+		s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: q}})
+	}
+	if _, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			got[m.Name] = m.Data
+		}
+	}
+
+	calls, ok := got["cartservice.additem.calls"].(metricdata.Sum[int64])
+	if !ok {
+		t.Fatalf("cartservice.additem.calls missing or not a sum: %v", got["cartservice.additem.calls"])
+	}
+	byCode := make(map[string]int64)
+	for _, dp := range calls.DataPoints {
+		code, _ := dp.Attributes.Value("rpc.grpc.status_code")
+		byCode[code.AsString()] = dp.Value
+	}
+	if byCode["OK"] != 1 || byCode["InvalidArgument"] != 1 {
+		t.Errorf("AddItem calls by code = %v, want one OK and one InvalidArgument", byCode)
+	}
+
+	size, ok := got["cartservice.cart.size"].(metricdata.Histogram[int64])
+	if !ok || len(size.DataPoints) != 1 || size.DataPoints[0].Count != 1 || size.DataPoints[0].Sum != 1 {
+		t.Errorf("cartservice.cart.size = %+v, want one cart of 1 product", got["cartservice.cart.size"])
+	}
+
+	ops := make(map[string]bool)
+	if store, ok := got["cartservice.store.duration"].(metricdata.Histogram[float64]); ok {
+		for _, dp := range store.DataPoints {
+			op, _ := dp.Attributes.Value("operation")
+			ops[op.AsString()] = true
+		}
+	}
+	for _, op := range []string{"AddItem", "GetCart"} {
+		if !ops[op] {
+			t.Errorf("no store duration recorded for %s (got %v)", op, ops)
+		}
+	}
+}
+
+func TestOTelMetricsEnabledFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want bool
+	}{
+		{"", true},
+		{"otlp", true},
+		{"none", false},
+		{"prometheus", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("OTEL_METRICS_EXPORTER", tt.env)
+		if got := otelMetricsEnabledFromEnv(); got != tt.want {
+			t.Errorf("OTEL_METRICS_EXPORTER=%q: got %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
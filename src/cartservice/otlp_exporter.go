@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"google.golang.org/grpc/credentials"
+)
+
+// This file, its test and samplerFromEnv have identical copies in
+// src/frontend. Each service is its own module, built from its own directory,
+// so there is no shared package both could import: change the copies together.
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http/protobuf"
+
+	defaultOTLPGRPCEndpoint = "opentelemetry-collector:4317"
+	defaultOTLPHTTPEndpoint = "opentelemetry-collector:4318"
+	otlpHTTPTracesPath      = "/v1/traces"
+)
+
+// otlpExporterConfig says how traces reach the collector. It is read from
+// the standard OTEL_EXPORTER_OTLP_* variables; this file is kept identical
+// in every Go service that exports traces.
+type otlpExporterConfig struct {
+	protocol string // otlpProtocolGRPC or otlpProtocolHTTP
+	endpoint string // host:port
+	urlPath  string // only used over HTTP
+	insecure bool
+	tls      *tls.Config // nil uses the system roots
+}
+
+// String describes the destination for startup logs.
+func (c otlpExporterConfig) String() string {
+	scheme := "https"
+	if c.insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s (%s)", scheme, c.endpoint, c.urlPath, c.protocol)
+}
+
+// otlpExporterConfigFromEnv reads OTEL_EXPORTER_OTLP_PROTOCOL,
+// OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_INSECURE and
+// OTEL_EXPORTER_OTLP_CERTIFICATE. With none of them set it keeps the old
+// behaviour: plaintext gRPC to opentelemetry-collector:4317.
+//
+// An endpoint with an http:// or https:// scheme decides transport security
+// itself; a bare host:port is plaintext unless OTEL_EXPORTER_OTLP_INSECURE
+// is false.
+func otlpExporterConfigFromEnv() (otlpExporterConfig, error) {
+	cfg := otlpExporterConfig{protocol: otlpProtocolGRPC, insecure: true}
+
+	switch v := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); v {
+	case "", otlpProtocolGRPC:
+	case otlpProtocolHTTP:
+		cfg.protocol = otlpProtocolHTTP
+	default:
+		return cfg, fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %q: want %q or %q", v, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_INSECURE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_INSECURE %q: %w", v, err)
+		}
+		cfg.insecure = b
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	switch {
+	case endpoint == "" && cfg.protocol == otlpProtocolHTTP:
+		cfg.endpoint = defaultOTLPHTTPEndpoint
+	case endpoint == "":
+		cfg.endpoint = defaultOTLPGRPCEndpoint
+	case strings.HasPrefix(endpoint, "http://"), strings.HasPrefix(endpoint, "https://"):
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return cfg, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q", endpoint)
+		}
+		cfg.endpoint = u.Host
+		cfg.insecure = u.Scheme == "http"
+		if cfg.protocol == otlpProtocolHTTP {
+			cfg.urlPath = strings.TrimSuffix(u.Path, "/")
+		}
+	default:
+		cfg.endpoint = endpoint
+	}
+	if cfg.protocol == otlpProtocolHTTP {
+		cfg.urlPath += otlpHTTPTracesPath
+	}
+
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_CERTIFICATE"); v != "" && !cfg.insecure {
+		pem, err := os.ReadFile(v)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read OTEL_EXPORTER_OTLP_CERTIFICATE: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return cfg, fmt.Errorf("no certificates found in OTEL_EXPORTER_OTLP_CERTIFICATE %q", v)
+		}
+		cfg.tls = &tls.Config{RootCAs: roots}
+	}
+	return cfg, nil
+}
+
+// newOTLPTraceExporter creates the OTLP trace exporter described by cfg.
+func newOTLPTraceExporter(ctx context.Context, cfg otlpExporterConfig) (*otlptrace.Exporter, error) {
+	if cfg.protocol == otlpProtocolHTTP {
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(cfg.endpoint),
+			otlptracehttp.WithURLPath(cfg.urlPath),
+		}
+		if cfg.insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else if cfg.tls != nil {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(cfg.tls))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.endpoint)}
+	if cfg.insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(cfg.tls)))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
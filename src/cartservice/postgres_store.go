@@ -0,0 +1,671 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// cartStoreKindFromEnv reads CART_STORE. Unset picks Redis when it is
+// configured and the in-memory store otherwise, as before CART_STORE
+// existed.
+func cartStoreKindFromEnv() string {
+	v := strings.ToLower(os.Getenv("CART_STORE"))
+	switch v {
+	case "", backendRedis, backendMemory, backendPostgres, backendMemcached, backendSpanner:
+		return v
+	default:
+		log.Warnf("Ignoring invalid CART_STORE %q", v)
+		return ""
+	}
+}
+
+// postgresMigrations are applied in order, each once, and recorded in
+// schema_migrations. Append new steps; never edit one that has shipped.
+var postgresMigrations = []string{
+	`CREATE TABLE carts (
+		user_id       TEXT PRIMARY KEY,
+		currency_code TEXT NOT NULL DEFAULT '',
+		updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE cart_items (
+		id                  BIGSERIAL,
+		user_id             TEXT NOT NULL REFERENCES carts (user_id) ON DELETE CASCADE,
+		product_id          TEXT NOT NULL,
+		quantity            INTEGER NOT NULL CHECK (quantity >= 0),
+		price_currency_code TEXT,
+		price_units         BIGINT,
+		price_nanos         INTEGER,
+		PRIMARY KEY (user_id, product_id)
+	);`,
+	`CREATE TABLE saved_items (
+		id                  BIGSERIAL,
+		user_id             TEXT NOT NULL REFERENCES carts (user_id) ON DELETE CASCADE,
+		product_id          TEXT NOT NULL,
+		quantity            INTEGER NOT NULL CHECK (quantity >= 0),
+		price_currency_code TEXT,
+		price_units         BIGINT,
+		price_nanos         INTEGER,
+		PRIMARY KEY (user_id, product_id)
+	);`,
+	// Rows from before this step keep a NULL added_at rather than the time
+	// of the migration.
+	`ALTER TABLE cart_items ADD COLUMN added_at TIMESTAMPTZ;
+	ALTER TABLE cart_items ALTER COLUMN added_at SET DEFAULT now();
+	ALTER TABLE saved_items ADD COLUMN added_at TIMESTAMPTZ;
+	ALTER TABLE saved_items ALTER COLUMN added_at SET DEFAULT now();`,
+	`CREATE INDEX carts_updated_at ON carts (updated_at);`,
+	`ALTER TABLE carts ADD COLUMN version BIGINT NOT NULL DEFAULT 0;`,
+	`ALTER TABLE cart_items ADD COLUMN source TEXT NOT NULL DEFAULT '';
+	ALTER TABLE saved_items ADD COLUMN source TEXT NOT NULL DEFAULT '';`,
+}
+
+// postgresCartStore keeps carts in PostgreSQL: one carts row per user,
+// which survives EmptyCart so CartExists stays true, one cart_items row per
+// product line and one saved_items row per line saved for later.
+type postgresCartStore struct {
+	pool *pgxpool.Pool
+}
+
+func newPostgresCartStore(ctx context.Context, databaseURL string) (*postgresCartStore, error) {
+	if databaseURL == "" {
+		return nil, errors.New("CART_STORE=postgres requires DATABASE_URL")
+	}
+	cfg, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		// The URL may hold a password, so leave it out of the error.
+		return nil, errors.New("failed to parse DATABASE_URL")
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PostgreSQL pool: %v", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to PostgreSQL at %s: %v", cfg.ConnConfig.Host, err)
+	}
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	log.Infof("Connected to PostgreSQL at %s", cfg.ConnConfig.Host)
+	return &postgresCartStore{pool: pool}, nil
+}
+
+// migratePostgres brings the schema up to date. The advisory lock keeps
+// replicas starting together from applying the same step twice.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('cartservice_migrations'))`); err != nil {
+			return fmt.Errorf("failed to lock schema migrations: %v", err)
+		}
+		if _, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+			return fmt.Errorf("failed to create schema_migrations: %v", err)
+		}
+		var applied int
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+			return fmt.Errorf("failed to read schema version: %v", err)
+		}
+		for i := applied; i < len(postgresMigrations); i++ {
+			if _, err := tx.Exec(ctx, postgresMigrations[i]); err != nil {
+				return fmt.Errorf("failed to apply migration %d: %v", i+1, err)
+			}
+			if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+				return fmt.Errorf("failed to record migration %d: %v", i+1, err)
+			}
+			log.Infof("Applied PostgreSQL migration %d", i+1)
+		}
+		return nil
+	})
+}
+
+// postgresError maps a failed query to a gRPC status.
+func postgresError(msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+// touchCart creates the user's cart row if needed and moves it on a
+// version, failing if it wasn't at the version ctx expects. The row stays
+// locked until tx ends, so nobody else changes the cart in between.
+func touchCart(ctx context.Context, tx pgx.Tx, userID string) error {
+	var version int64
+	err := tx.QueryRow(ctx, `INSERT INTO carts (user_id, version) VALUES ($1, 1)
+		ON CONFLICT (user_id) DO UPDATE SET updated_at = now(), version = carts.version + 1
+		RETURNING version`, userID).Scan(&version)
+	if err != nil {
+		return err
+	}
+	return checkCartVersion(ctx, version-1)
+}
+
+// insertCartItems writes items as new lines of the user's cart, or of their
+// saved list when table is saved_items.
+func insertCartItems(ctx context.Context, tx pgx.Tx, table, userID string, items []cartItem) error {
+	for _, item := range items {
+		var currency *string
+		var units *int64
+		var nanos *int32
+		if p := item.PriceSnapshot; p != nil {
+			currency, units, nanos = &p.CurrencyCode, &p.Units, &p.Nanos
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO `+table+` (user_id, product_id, quantity, price_currency_code, price_units, price_nanos, added_at, source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, userID, item.ProductID, item.Quantity, currency, units, nanos, time.Unix(item.AddedAt, 0), item.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *postgresCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	log.Infof("AddItem called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := touchCart(ctx, tx, userID); err != nil {
+			return err
+		}
+		return upsertCartItem(ctx, tx, userID, &pb.CartItem{ProductId: productID, Quantity: quantity, PriceSnapshot: price})
+	})
+	return postgresError("failed to add item", err)
+}
+
+func (s *postgresCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	log.Infof("AddItems called: userID=%s, items=%d", userID, len(items))
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := touchCart(ctx, tx, userID); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := upsertCartItem(ctx, tx, userID, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return postgresError("failed to add items", err)
+}
+
+// upsertCartItem adds item to the user's cart. The first recorded price
+// snapshot and source win, as in mergeCartLine. New rows get added_at from
+// the column default.
+func upsertCartItem(ctx context.Context, tx pgx.Tx, userID string, item *pb.CartItem) error {
+	snapshot := newPriceSnapshot(item.GetPriceSnapshot())
+	var currency *string
+	var units *int64
+	var nanos *int32
+	if snapshot != nil {
+		currency, units, nanos = &snapshot.CurrencyCode, &snapshot.Units, &snapshot.Nanos
+	}
+	_, err := tx.Exec(ctx, `INSERT INTO cart_items (user_id, product_id, quantity, price_currency_code, price_units, price_nanos, source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, product_id) DO UPDATE SET
+			quantity = cart_items.quantity + EXCLUDED.quantity,
+			price_currency_code = COALESCE(cart_items.price_currency_code, EXCLUDED.price_currency_code),
+			price_units = COALESCE(cart_items.price_units, EXCLUDED.price_units),
+			price_nanos = COALESCE(cart_items.price_nanos, EXCLUDED.price_nanos),
+			source = COALESCE(NULLIF(cart_items.source, ''), EXCLUDED.source)`,
+		userID, item.GetProductId(), item.GetQuantity(), currency, units, nanos, item.GetSource())
+	return err
+}
+
+func (s *postgresCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	log.Infof("UpdateItemQuantity called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := touchCart(ctx, tx, userID); err != nil {
+			return err
+		}
+		if quantity == 0 {
+			_, err := tx.Exec(ctx, `DELETE FROM cart_items WHERE user_id = $1 AND product_id = $2`, userID, productID)
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO cart_items (user_id, product_id, quantity) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, product_id) DO UPDATE SET quantity = EXCLUDED.quantity`,
+			userID, productID, quantity)
+		return err
+	})
+	return postgresError("failed to update item", err)
+}
+
+// loadCarts reads the carts of userIDs, keyed by user. Users without a
+// cart are left out.
+func (s *postgresCartStore) loadCarts(ctx context.Context, userIDs []string) (map[string]storedCart, error) {
+	carts := make(map[string]storedCart, len(userIDs))
+	rows, err := s.pool.Query(ctx, `SELECT user_id, currency_code, version FROM carts WHERE user_id = ANY($1)`, userIDs)
+	if err != nil {
+		return nil, postgresError("failed to get carts", err)
+	}
+	for rows.Next() {
+		var userID, currency string
+		var version int64
+		if err := rows.Scan(&userID, &currency, &version); err != nil {
+			rows.Close()
+			return nil, postgresError("failed to read cart", err)
+		}
+		carts[userID] = storedCart{Currency: currency, Items: []cartItem{}, Version: version}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError("failed to get carts", err)
+	}
+
+	rows, err = s.pool.Query(ctx, `SELECT user_id, product_id, quantity, price_currency_code, price_units, price_nanos, added_at, source
+		FROM cart_items WHERE user_id = ANY($1) ORDER BY id`, userIDs)
+	if err != nil {
+		return nil, postgresError("failed to get cart items", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID string
+		item, err := scanPostgresLine(rows, &userID)
+		if err != nil {
+			return nil, postgresError("failed to read cart item", err)
+		}
+		cart := carts[userID]
+		cart.Items = append(cart.Items, item)
+		carts[userID] = cart
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError("failed to get cart items", err)
+	}
+	return carts, nil
+}
+
+func (s *postgresCartStore) getCart(ctx context.Context, userID string) (storedCart, error) {
+	carts, err := s.loadCarts(ctx, []string{userID})
+	if err != nil {
+		return storedCart{}, err
+	}
+	cart, ok := carts[userID]
+	if !ok {
+		cart = storedCart{Items: []cartItem{}}
+	}
+	return cart, nil
+}
+
+func (s *postgresCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	log.Infof("GetCart called: userID=%s", userID)
+
+	cart, err := s.getCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return cartToProto(userID, cart), nil
+}
+
+func (s *postgresCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	log.Infof("GetCarts called: %d users", len(userIDs))
+
+	found, err := s.loadCarts(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	carts := make([]*pb.Cart, len(userIDs))
+	for i, userID := range userIDs {
+		cart, ok := found[userID]
+		if !ok {
+			cart = storedCart{Items: []cartItem{}}
+		}
+		carts[i] = cartToProto(userID, cart)
+	}
+	return carts, nil
+}
+
+func (s *postgresCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	var exists bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM carts WHERE user_id = $1)`, userID).Scan(&exists)
+	return exists, postgresError("failed to check cart", err)
+}
+
+// MergeCarts locks both cart rows, in a fixed order so two opposite merges
+// can't deadlock, then moves the source lines over in one transaction.
+func (s *postgresCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	log.Infof("MergeCarts called: from=%s, to=%s", fromUserID, toUserID)
+	if fromUserID == toUserID {
+		return nil
+	}
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT user_id, currency_code FROM carts WHERE user_id IN ($1, $2) ORDER BY user_id FOR UPDATE`, fromUserID, toUserID)
+		if err != nil {
+			return err
+		}
+		currencies := make(map[string]string, 2)
+		for rows.Next() {
+			var userID, currency string
+			if err := rows.Scan(&userID, &currency); err != nil {
+				rows.Close()
+				return err
+			}
+			currencies[userID] = currency
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		fromCurrency, ok := currencies[fromUserID]
+		if !ok {
+			return nil
+		}
+
+		var lines int
+		if err := tx.QueryRow(ctx, `SELECT (SELECT count(*) FROM cart_items WHERE user_id = $1)
+			+ (SELECT count(*) FROM saved_items WHERE user_id = $1)`, fromUserID).Scan(&lines); err != nil {
+			return err
+		}
+		if lines > 0 {
+			if _, err := tx.Exec(ctx, `INSERT INTO carts (user_id, currency_code, version) VALUES ($1, $2, 1)
+				ON CONFLICT (user_id) DO UPDATE SET
+					currency_code = CASE WHEN carts.currency_code = '' THEN EXCLUDED.currency_code ELSE carts.currency_code END,
+					updated_at = now(),
+					version = carts.version + 1`, toUserID, fromCurrency); err != nil {
+				return err
+			}
+			for _, table := range []string{"cart_items", "saved_items"} {
+				if err := mergePostgresLines(ctx, tx, table, fromUserID, toUserID); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM carts WHERE user_id = $1`, fromUserID)
+		return err
+	})
+	return postgresError("failed to merge carts", err)
+}
+
+// mergePostgresLines copies fromUserID's rows of table, cart_items or
+// saved_items, into toUserID's. Shared products keep the destination's price
+// snapshot, added_at and source, as in mergeCartItems.
+func mergePostgresLines(ctx context.Context, tx pgx.Tx, table, fromUserID, toUserID string) error {
+	_, err := tx.Exec(ctx, `INSERT INTO `+table+` (user_id, product_id, quantity, price_currency_code, price_units, price_nanos, added_at, source)
+		SELECT $2, product_id, quantity, price_currency_code, price_units, price_nanos, added_at, source
+		FROM `+table+` WHERE user_id = $1 ORDER BY id
+		ON CONFLICT (user_id, product_id) DO UPDATE SET
+			quantity = `+table+`.quantity + EXCLUDED.quantity,
+			price_currency_code = COALESCE(`+table+`.price_currency_code, EXCLUDED.price_currency_code),
+			price_units = COALESCE(`+table+`.price_units, EXCLUDED.price_units),
+			price_nanos = COALESCE(`+table+`.price_nanos, EXCLUDED.price_nanos),
+			added_at = COALESCE(`+table+`.added_at, EXCLUDED.added_at),
+			source = COALESCE(NULLIF(`+table+`.source, ''), EXCLUDED.source)`, fromUserID, toUserID)
+	return err
+}
+
+func (s *postgresCartStore) EmptyCart(ctx context.Context, userID string) error {
+	log.Infof("EmptyCart called: userID=%s", userID)
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := touchCart(ctx, tx, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE carts SET currency_code = '' WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM cart_items WHERE user_id = $1`, userID)
+		return err
+	})
+	return postgresError("failed to empty cart", err)
+}
+
+func (s *postgresCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	var locked string
+	err := s.pool.QueryRow(ctx, `INSERT INTO carts (user_id, currency_code, version) VALUES ($1, $2, 1)
+		ON CONFLICT (user_id) DO UPDATE SET
+			currency_code = CASE WHEN carts.currency_code = '' THEN EXCLUDED.currency_code ELSE carts.currency_code END,
+			version = CASE WHEN carts.currency_code = '' THEN carts.version + 1 ELSE carts.version END
+		RETURNING currency_code`, userID, currency).Scan(&locked)
+	return locked, postgresError("failed to lock cart currency", err)
+}
+
+func (s *postgresCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	return s.getCart(ctx, userID)
+}
+
+func (s *postgresCartStore) ImportCart(ctx context.Context, userID string, imported storedCart) error {
+	log.Infof("ImportCart called: userID=%s", userID)
+
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := touchCart(ctx, tx, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE carts SET currency_code = '' WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM cart_items WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		if err := insertCartItems(ctx, tx, "cart_items", userID, imported.Items); err != nil {
+			return err
+		}
+		if imported.Saved == nil {
+			return nil
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM saved_items WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		return insertCartItems(ctx, tx, "saved_items", userID, imported.Saved)
+	})
+	return postgresError("failed to import cart", err)
+}
+
+func (s *postgresCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	log.Infof("SaveForLater called: userID=%s, productID=%s", userID, productID)
+	return s.moveLine(ctx, "cart_items", "saved_items", userID, productID,
+		status.Errorf(codes.NotFound, "product %s is not in the cart", productID))
+}
+
+func (s *postgresCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	log.Infof("MoveToCart called: userID=%s, productID=%s", userID, productID)
+	return s.moveLine(ctx, "saved_items", "cart_items", userID, productID,
+		status.Errorf(codes.NotFound, "product %s is not saved for later", productID))
+}
+
+// moveLine moves productID's row from one of cart_items and saved_items to
+// the other, summing with a row already there. notFound is returned when
+// the source has no such row.
+func (s *postgresCartStore) moveLine(ctx context.Context, from, to, userID, productID string, notFound error) error {
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		// Rolled back with the rest when there is no line to move.
+		if err := touchCart(ctx, tx, userID); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `WITH moved AS (
+				DELETE FROM `+from+` WHERE user_id = $1 AND product_id = $2
+				RETURNING user_id, product_id, quantity, price_currency_code, price_units, price_nanos, added_at, source
+			)
+			INSERT INTO `+to+` (user_id, product_id, quantity, price_currency_code, price_units, price_nanos, added_at, source)
+			SELECT * FROM moved
+			ON CONFLICT (user_id, product_id) DO UPDATE SET
+				quantity = `+to+`.quantity + EXCLUDED.quantity,
+				price_currency_code = COALESCE(`+to+`.price_currency_code, EXCLUDED.price_currency_code),
+				price_units = COALESCE(`+to+`.price_units, EXCLUDED.price_units),
+				price_nanos = COALESCE(`+to+`.price_nanos, EXCLUDED.price_nanos),
+				added_at = COALESCE(`+to+`.added_at, EXCLUDED.added_at),
+				source = COALESCE(NULLIF(`+to+`.source, ''), EXCLUDED.source)`, userID, productID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return notFound
+		}
+		return nil
+	})
+	return postgresError("failed to move item", err)
+}
+
+func (s *postgresCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	rows, err := s.pool.Query(ctx, `SELECT product_id, quantity, price_currency_code, price_units, price_nanos, added_at, source
+		FROM saved_items WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, postgresError("failed to get saved items", err)
+	}
+	defer rows.Close()
+	var items []cartItem
+	for rows.Next() {
+		item, err := scanPostgresLine(rows)
+		if err != nil {
+			return nil, postgresError("failed to read saved item", err)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError("failed to get saved items", err)
+	}
+	return cartItemsToProto(items), nil
+}
+
+// scanPostgresLine reads product_id, quantity, the three price columns,
+// added_at and source.
+func scanPostgresLine(row pgx.Row, dest ...interface{}) (cartItem, error) {
+	var (
+		item     cartItem
+		currency *string
+		units    *int64
+		nanos    *int32
+		addedAt  *time.Time
+	)
+	if err := row.Scan(append(dest, &item.ProductID, &item.Quantity, &currency, &units, &nanos, &addedAt, &item.Source)...); err != nil {
+		return cartItem{}, err
+	}
+	if currency != nil && units != nil && nanos != nil {
+		item.PriceSnapshot = &priceSnapshot{CurrencyCode: *currency, Units: *units, Nanos: *nanos}
+	}
+	if addedAt != nil {
+		item.AddedAt = addedAt.Unix()
+	}
+	return item, nil
+}
+
+func (s *postgresCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	pattern := postgresLikeEscaper.Replace(userID) + ":%"
+	rows, err := s.pool.Query(ctx, `SELECT user_id FROM carts WHERE user_id LIKE $1`, pattern)
+	if err != nil {
+		return nil, postgresError("failed to list carts", err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, postgresError("failed to read cart", err)
+		}
+		if name, ok := cartNameFromKey(userID, key); ok {
+			names = append(names, name)
+		}
+	}
+	return names, postgresError("failed to list carts", rows.Err())
+}
+
+// postgresLikeEscaper quotes the characters LIKE treats as wildcards, using
+// the default escape character.
+var postgresLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ListCartKeys pages through the carts in key order. The page token is the
+// last key of the previous page.
+func (s *postgresCartStore) ListCartKeys(ctx context.Context, pageToken string, pageSize int) ([]string, string, error) {
+	rows, err := s.pool.Query(ctx, `SELECT user_id FROM carts WHERE user_id > $1 ORDER BY user_id LIMIT $2`, pageToken, pageSize+1)
+	if err != nil {
+		return nil, "", postgresError("failed to list carts", err)
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, "", postgresError("failed to read cart", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", postgresError("failed to list carts", err)
+	}
+	if len(keys) <= pageSize {
+		return keys, "", nil
+	}
+	return keys[:pageSize], keys[pageSize-1], nil
+}
+
+func (s *postgresCartStore) Ping(ctx context.Context) error {
+	return postgresError("failed to ping PostgreSQL", s.pool.Ping(ctx))
+}
+
+func (s *postgresCartStore) CountCarts(ctx context.Context) (int, error) {
+	var n int
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM carts`).Scan(&n)
+	return n, postgresError("failed to count carts", err)
+}
+
+func (s *postgresCartStore) IdleCarts(ctx context.Context, from, to time.Time) ([]idleCart, error) {
+	rows, err := s.pool.Query(ctx, `SELECT user_id, updated_at FROM carts c
+		WHERE updated_at >= $1 AND updated_at < $2
+			AND EXISTS (SELECT 1 FROM cart_items i WHERE i.user_id = c.user_id)`, from, to)
+	if err != nil {
+		return nil, postgresError("failed to find idle carts", err)
+	}
+	updated := make(map[string]time.Time)
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		var updatedAt time.Time
+		if err := rows.Scan(&userID, &updatedAt); err != nil {
+			rows.Close()
+			return nil, postgresError("failed to read cart", err)
+		}
+		updated[userID] = updatedAt
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError("failed to find idle carts", err)
+	}
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	found, err := s.loadCarts(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var carts []idleCart
+	for _, userID := range userIDs {
+		// Skip carts emptied since the first query.
+		if cart, ok := found[userID]; ok && len(cart.Items) > 0 {
+			carts = append(carts, idleCart{key: userID, cart: cart, updatedAt: updated[userID]})
+		}
+	}
+	return carts, nil
+}
+
+func (s *postgresCartStore) Close() error {
+	s.pool.Close()
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestPostgresStore connects to the database in
+// CARTSERVICE_TEST_DATABASE_URL, skipping the test when it isn't set. Every
+// cart is removed before the test runs.
+func newTestPostgresStore(t *testing.T) *postgresCartStore {
+	url := os.Getenv("CARTSERVICE_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("CARTSERVICE_TEST_DATABASE_URL not set")
+	}
+	return newTruncatedPostgresStore(t, url)
+}
+
+// newTruncatedPostgresStore connects to the database at url and empties it,
+// so each subtest starts from an empty store.
+func newTruncatedPostgresStore(t *testing.T, url string) *postgresCartStore {
+	store, err := newPostgresCartStore(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if _, err := store.pool.Exec(context.Background(), `TRUNCATE carts CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestCartStoreKindFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"postgres", backendPostgres},
+		{"Redis", backendRedis},
+		{"memory", backendMemory},
+		{"memcached", backendMemcached},
+		{"Spanner", backendSpanner},
+		{"mysql", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("CART_STORE", tt.value)
+		if got := cartStoreKindFromEnv(); got != tt.want {
+			t.Errorf("CART_STORE=%q: got %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewCartStorePostgresFallback(t *testing.T) {
+	t.Setenv("CART_STORE", "postgres")
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"no DATABASE_URL", ""},
+		{"malformed DATABASE_URL", "postgres://%zz"},
+		{"unreachable", "postgres://cart@127.0.0.1:1/carts?connect_timeout=1"},
+	}
+	for _, tt := range tests {
+		t.Setenv("DATABASE_URL", tt.url)
+		before := testutil.ToFloat64(storeFallbacks)
+		store := newCartStore("")
+		if fs, ok := store.(*failoverCartStore); !ok || !fs.onFallback() {
+			t.Errorf("%s: got %T, want the in-memory fallback", tt.name, store)
+		}
+		if got := testutil.ToFloat64(storeFallbacks); got != before+1 {
+			t.Errorf("%s: got %v fallbacks, want %v", tt.name, got, before+1)
+		}
+		if got := testutil.ToFloat64(storeMode.WithLabelValues(backendPostgres)); got != 0 {
+			t.Errorf("%s: store mode postgres = %v, want 0", tt.name, got)
+		}
+	}
+}
+
+func TestNewCartStoreMemoryOverridesRedis(t *testing.T) {
+	t.Setenv("CART_STORE", "memory")
+	store := newCartStore("redis-cart:6379")
+	if _, ok := store.(*memoryCartStore); !ok {
+		t.Errorf("got %T, want the in-memory store", store)
+	}
+}
+
+func TestPostgresStore(t *testing.T) {
+	store := newTestPostgresStore(t)
+	ctx := context.Background()
+
+	if err := store.AddItem(ctx, "guest", "66VCHSJNUP", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddItem(ctx, "guest", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddItem(ctx, "guest", "1YMWWN1N4O", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateItemQuantity(ctx, "guest", "1YMWWN1N4O", 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.LockCurrency(ctx, "guest", "EUR"); err != nil || got != "EUR" {
+		t.Fatalf("LockCurrency = %q, %v; want EUR", got, err)
+	}
+	if err := store.AddItem(ctx, "member", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MergeCarts(ctx, "guest", "member"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := store.CartExists(ctx, "guest"); err != nil || ok {
+		t.Errorf("guest cart exists = %v, %v after merge; want false", ok, err)
+	}
+	cart, err := store.GetCart(ctx, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int32{"66VCHSJNUP": 4, "1YMWWN1N4O": 4}
+	if len(cart.Items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(cart.Items), len(want))
+	}
+	for _, item := range cart.Items {
+		if item.Quantity != want[item.ProductId] {
+			t.Errorf("%s: got quantity %d, want %d", item.ProductId, item.Quantity, want[item.ProductId])
+		}
+	}
+	if got, err := store.LockCurrency(ctx, "member", "USD"); err != nil || got != "EUR" {
+		t.Errorf("merged cart currency = %q, %v; want EUR", got, err)
+	}
+
+	data, err := store.ExportCart(ctx, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EmptyCart(ctx, "member"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.CartExists(ctx, "member"); err != nil || !ok {
+		t.Errorf("emptied cart exists = %v, %v; want true", ok, err)
+	}
+	if err := store.ImportCart(ctx, "member", data); err != nil {
+		t.Fatal(err)
+	}
+	carts, err := store.GetCarts(ctx, []string{"nobody", "member"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(carts[0].Items) != 0 || len(carts[1].Items) != len(want) {
+		t.Errorf("got %d and %d items after import, want 0 and %d", len(carts[0].Items), len(carts[1].Items), len(want))
+	}
+
+	if err := store.SaveForLater(ctx, "member", "66VCHSJNUP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EmptyCart(ctx, "member"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.GetSavedItems(ctx, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ProductId != "66VCHSJNUP" || saved[0].Quantity != 4 {
+		t.Errorf("got saved items %v after EmptyCart, want 4 of 66VCHSJNUP", saved)
+	}
+	if err := store.MoveToCart(ctx, "member", "1YMWWN1N4O"); status.Code(err) != codes.NotFound {
+		t.Errorf("moving an unsaved product: got %v, want NotFound", err)
+	}
+
+	// Importing a snapshot's saved list replaces the saved items too.
+	if err := store.ImportCart(ctx, "member", storedCart{Items: []cartItem{}, Saved: []cartItem{{ProductID: "1YMWWN1N4O", Quantity: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err = store.GetSavedItems(ctx, "member"); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].ProductId != "1YMWWN1N4O" {
+		t.Errorf("got saved items %v after import, want 1YMWWN1N4O", saved)
+	}
+}
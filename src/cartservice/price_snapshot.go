@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// priceSnapshot is the stored form of the unit price an item had when it was
+// added, so the frontend can tell users the price has moved since.
+type priceSnapshot struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+}
+
+func newPriceSnapshot(m *pb.Money) *priceSnapshot {
+	if m == nil {
+		return nil
+	}
+	return &priceSnapshot{CurrencyCode: m.GetCurrencyCode(), Units: m.GetUnits(), Nanos: m.GetNanos()}
+}
+
+func (p *priceSnapshot) proto() *pb.Money {
+	if p == nil {
+		return nil
+	}
+	return &pb.Money{CurrencyCode: p.CurrencyCode, Units: p.Units, Nanos: p.Nanos}
+}
+
+// priceSnapshotsFromEnv parses PRICE_SNAPSHOT. Snapshots are off by default.
+func priceSnapshotsFromEnv() bool {
+	v := os.Getenv("PRICE_SNAPSHOT")
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid PRICE_SNAPSHOT %q, price snapshots disabled", v)
+		return false
+	}
+	if on {
+		log.Info("Recording price snapshots on AddItem")
+	}
+	return on
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestPriceSnapshot(t *testing.T) {
+	first := &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}
+	later := &pb.Money{CurrencyCode: "USD", Units: 24, Nanos: 990000000}
+	tests := []struct {
+		name    string
+		enabled bool
+		want    *pb.Money
+	}{
+		{"enabled keeps first price", true, first},
+		{"disabled stores nothing", false, nil},
+	}
+	for storeName, newStore := range testCartStores() {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				s := &cartServer{store: newStore(t), priceSnapshots: tt.enabled}
+				for _, price := range []*pb.Money{first, later} {
+					if _, err := s.AddItem(ctx, &pb.AddItemRequest{
+						UserId: "user-1",
+						Item:   &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1, PriceSnapshot: price},
+					}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				item := cart.GetItems()[0]
+				if item.GetQuantity() != 2 {
+					t.Errorf("got quantity %d, want 2", item.GetQuantity())
+				}
+				if got := item.GetPriceSnapshot(); !proto.Equal(got, tt.want) {
+					t.Errorf("got snapshot %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const (
+	defaultProductCacheTTL = 5 * time.Minute
+	// productNotFoundTTL is kept short so products added to the catalog
+	// can be bought soon after.
+	productNotFoundTTL   = 30 * time.Second
+	maxCachedProducts    = 10000
+	productLookupTimeout = 2 * time.Second
+)
+
+// productLookups counts product checks by result: hit when answered from
+// the cache, found or not_found when the catalog answered, and error when
+// it couldn't be reached.
+var productLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Name:      "product_lookups_total",
+	Help:      "Number of product existence checks, by result.",
+}, []string{"result"})
+
+func init() {
+	metricsRegistry.MustRegister(productLookups)
+}
+
+// productChecker confirms products exist before they are put in a cart.
+type productChecker interface {
+	// checkProduct returns NotFound if there is no product productID.
+	checkProduct(ctx context.Context, productID string) error
+}
+
+// productCacheTTLFromEnv reads PRODUCT_CACHE_TTL, how long a product found
+// in the catalog is trusted to exist.
+func productCacheTTLFromEnv() time.Duration {
+	v := os.Getenv("PRODUCT_CACHE_TTL")
+	if v == "" {
+		return defaultProductCacheTTL
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid PRODUCT_CACHE_TTL %q, using %v", v, defaultProductCacheTTL)
+		return defaultProductCacheTTL
+	}
+	return d
+}
+
+// newProductCheckerFromEnv connects to the product catalog at
+// PRODUCT_CATALOG_SERVICE_ADDR. It returns nil, leaving product IDs
+// unchecked, when that is unset.
+func newProductCheckerFromEnv() (productChecker, error) {
+	addr := os.Getenv("PRODUCT_CATALOG_SERVICE_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Checking products against the catalog at %s", addr)
+	return newCatalogProductChecker(pb.NewProductCatalogServiceClient(conn), productCacheTTLFromEnv()), nil
+}
+
+// catalogProductChecker looks products up in productcatalogservice,
+// remembering the answers. When the catalog can't be reached products are
+// let through, so a catalog outage doesn't stop carts from filling.
+type catalogProductChecker struct {
+	client pb.ProductCatalogServiceClient
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	known map[string]productLookup
+}
+
+type productLookup struct {
+	found   bool
+	expires time.Time
+}
+
+func newCatalogProductChecker(client pb.ProductCatalogServiceClient, ttl time.Duration) *catalogProductChecker {
+	return &catalogProductChecker{client: client, ttl: ttl, now: time.Now, known: make(map[string]productLookup)}
+}
+
+func (c *catalogProductChecker) checkProduct(ctx context.Context, productID string) error {
+	if found, ok := c.cached(productID); ok {
+		productLookups.WithLabelValues("hit").Inc()
+		if !found {
+			return productNotFound(productID)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, productLookupTimeout)
+	defer cancel()
+	_, err := c.client.GetProduct(ctx, &pb.GetProductRequest{Id: productID})
+	switch status.Code(err) {
+	case codes.OK:
+		productLookups.WithLabelValues("found").Inc()
+		c.remember(productID, true, c.ttl)
+		return nil
+	case codes.NotFound:
+		productLookups.WithLabelValues("not_found").Inc()
+		c.remember(productID, false, min(c.ttl, productNotFoundTTL))
+		return productNotFound(productID)
+	default:
+		productLookups.WithLabelValues("error").Inc()
+		log.Warnf("Could not check product %s with the catalog, allowing it: %v", productID, err)
+		return nil
+	}
+}
+
+func (c *catalogProductChecker) cached(productID string) (found, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookup, ok := c.known[productID]
+	if !ok || !c.now().Before(lookup.expires) {
+		return false, false
+	}
+	return lookup.found, true
+}
+
+func (c *catalogProductChecker) remember(productID string, found bool, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.known) >= maxCachedProducts {
+		for id, lookup := range c.known {
+			if !now.Before(lookup.expires) {
+				delete(c.known, id)
+			}
+		}
+		if len(c.known) >= maxCachedProducts {
+			// The catalog is small; this only happens when callers send
+			// made-up IDs, whose answers aren't worth keeping.
+			clear(c.known)
+		}
+	}
+	c.known[productID] = productLookup{found: found, expires: now.Add(ttl)}
+}
+
+func productNotFound(productID string) error {
+	return status.Errorf(codes.NotFound, "product %s does not exist", productID)
+}
+
+// checkProducts returns NotFound for the first of productIDs that isn't in
+// the catalog, when products are checked at all.
+func (s *cartServer) checkProducts(ctx context.Context, productIDs ...string) error {
+	if s.products == nil {
+		return nil
+	}
+	for _, productID := range productIDs {
+		if err := s.products.checkProduct(ctx, productID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// fakeCatalog knows the products in ids, or fails every call with err.
+type fakeCatalog struct {
+	pb.UnimplementedProductCatalogServiceServer
+	ids map[string]bool
+
+	mu    sync.Mutex
+	err   error
+	calls int
+}
+
+func (c *fakeCatalog) GetProduct(_ context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	if !c.ids[req.GetId()] {
+		return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.GetId())
+	}
+	return &pb.Product{Id: req.GetId()}, nil
+}
+
+func newTestProductChecker(t *testing.T, catalog *fakeCatalog) *catalogProductChecker {
+	t.Helper()
+	srv := grpc.NewServer()
+	pb.RegisterProductCatalogServiceServer(srv, catalog)
+	return newCatalogProductChecker(pb.NewProductCatalogServiceClient(newTestGRPCConn(t, srv)), time.Minute)
+}
+
+func TestCatalogProductChecker(t *testing.T) {
+	ctx := context.Background()
+	catalog := &fakeCatalog{ids: map[string]bool{"OLJCESPC7Z": true}}
+	checker := newTestProductChecker(t, catalog)
+	now := time.Unix(1700000000, 0)
+	checker.now = func() time.Time { return now }
+
+	tests := []struct {
+		productID string
+		wantCode  codes.Code
+		wantCalls int
+	}{
+		{"OLJCESPC7Z", codes.OK, 1},
+		{"OLJCESPC7Z", codes.OK, 1}, // cached
+		{"NOSUCHPROD", codes.NotFound, 2},
+		{"NOSUCHPROD", codes.NotFound, 2}, // cached too
+	}
+	for i, tt := range tests {
+		if got := status.Code(checker.checkProduct(ctx, tt.productID)); got != tt.wantCode {
+			t.Errorf("check %d of %s: got %s, want %s", i, tt.productID, got, tt.wantCode)
+		}
+		if catalog.calls != tt.wantCalls {
+			t.Errorf("check %d of %s: catalog saw %d calls, want %d", i, tt.productID, catalog.calls, tt.wantCalls)
+		}
+	}
+
+	// Missing products are forgotten sooner, in case they are added.
+	now = now.Add(productNotFoundTTL)
+	catalog.ids["NOSUCHPROD"] = true
+	if err := checker.checkProduct(ctx, "NOSUCHPROD"); err != nil {
+		t.Errorf("product added to the catalog: %v", err)
+	}
+	if err := checker.checkProduct(ctx, "OLJCESPC7Z"); err != nil || catalog.calls != 3 {
+		t.Errorf("got %v after %d catalog calls, want the found product still cached", err, catalog.calls)
+	}
+}
+
+func TestCatalogProductCheckerAllowsWhenCatalogDown(t *testing.T) {
+	catalog := &fakeCatalog{err: status.Error(codes.Unavailable, "catalog is down")}
+	checker := newTestProductChecker(t, catalog)
+
+	for i := 0; i < 2; i++ {
+		if err := checker.checkProduct(context.Background(), "OLJCESPC7Z"); err != nil {
+			t.Fatalf("check %d: got %v, want the product let through", i, err)
+		}
+	}
+	if catalog.calls != 2 {
+		t.Errorf("catalog saw %d calls, want 2: failures must not be cached", catalog.calls)
+	}
+}
+
+func TestCartRejectsUnknownProducts(t *testing.T) {
+	ctx := context.Background()
+	catalog := &fakeCatalog{ids: map[string]bool{"OLJCESPC7Z": true}}
+	s := &cartServer{store: newMemoryCartStore(), products: newTestProductChecker(t, catalog)}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"AddItem", func() error {
+			_, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "NOSUCHPROD", Quantity: 1}})
+			return err
+		}},
+		{"AddItems", func() error {
+			_, err := s.AddItems(ctx, &pb.AddItemsRequest{UserId: "user-1", Items: []*pb.CartItem{
+				{ProductId: "OLJCESPC7Z", Quantity: 1},
+				{ProductId: "NOSUCHPROD", Quantity: 1},
+			}})
+			return err
+		}},
+		{"UpdateItemQuantity", func() error {
+			_, err := s.UpdateItemQuantity(ctx, &pb.UpdateItemQuantityRequest{UserId: "user-1", ProductId: "NOSUCHPROD", Quantity: 2})
+			return err
+		}},
+		{"ImportCart", func() error {
+			_, err := s.ImportCart(ctx, &pb.ImportCartRequest{UserId: "user-1", Data: []byte(`[{"product_id":"NOSUCHPROD","quantity":1}]`)})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		if got := status.Code(tt.call()); got != codes.NotFound {
+			t.Errorf("%s: got %s, want NotFound", tt.name, got)
+		}
+	}
+	cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 0 {
+		t.Errorf("rejected calls left items %v in the cart", cart.Items)
+	}
+
+	if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}}); err != nil {
+		t.Errorf("known product: %v", err)
+	}
+	// Removing a line needs no check, so products gone from the catalog
+	// can still be taken out of carts.
+	if _, err := s.UpdateItemQuantity(ctx, &pb.UpdateItemQuantityRequest{UserId: "user-1", ProductId: "GONEPROD00", Quantity: 0}); err != nil {
+		t.Errorf("removing a line: %v", err)
+	}
+}
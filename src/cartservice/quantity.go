@@ -0,0 +1,55 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultMaxItemQuantity matches the largest quantity the frontend's product
+// page offers.
+const defaultMaxItemQuantity = 10
+
+// maxItemQuantityFromEnv reads MAX_ITEM_QUANTITY, the most units of a single
+// product a cart may hold. Zero removes the cap.
+func maxItemQuantityFromEnv() int32 {
+	v := os.Getenv("MAX_ITEM_QUANTITY")
+	if v == "" {
+		return defaultMaxItemQuantity
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n < 0 {
+		log.Warnf("Ignoring invalid MAX_ITEM_QUANTITY %q, using %d", v, defaultMaxItemQuantity)
+		return defaultMaxItemQuantity
+	}
+	return int32(n)
+}
+
+// validateQuantity rejects additions that can never be valid, before any
+// store access.
+func (s *cartServer) validateQuantity(quantity int32) error {
+	if quantity <= 0 {
+		return status.Errorf(codes.InvalidArgument, "quantity must be positive, got %d", quantity)
+	}
+	if s.maxItemQuantity > 0 && quantity > s.maxItemQuantity {
+		return cartLimitError(reasonItemQuantityLimit, s.maxItemQuantity,
+			"quantity %d exceeds the limit of %d per product", quantity, s.maxItemQuantity)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestAddItemQuantityCap(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing int32 // quantity already in the cart
+		quantity int32
+		want     codes.Code
+	}{
+		{"within cap", 0, 5, codes.OK},
+		{"exactly at cap", 6, 4, codes.OK},
+		{"single add over cap", 0, 11, codes.ResourceExhausted},
+		{"repeated adds over cap", 6, 5, codes.ResourceExhausted},
+		{"int32 max", 0, 1<<31 - 1, codes.ResourceExhausted},
+		{"zero", 0, 0, codes.InvalidArgument},
+		{"negative", 0, -3, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		s := &cartServer{store: newMemoryCartStore(), maxItemQuantity: 10}
+		if tt.existing > 0 {
+			if err := s.store.AddItem(ctx, "user-1", "OLJCESPC7Z", tt.existing, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := s.AddItem(ctx, &pb.AddItemRequest{
+			UserId: "user-1",
+			Item:   &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: tt.quantity},
+		})
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+
+		cart, _ := s.store.GetCart(ctx, "user-1")
+		var got int32
+		for _, item := range cart.Items {
+			got += item.Quantity
+		}
+		want := tt.existing
+		if tt.want == codes.OK {
+			want += tt.quantity
+		}
+		if got != want {
+			t.Errorf("%s: cart holds %d, want %d", tt.name, got, want)
+		}
+	}
+}
+
+func TestMaxItemQuantityFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int32
+	}{
+		{"", defaultMaxItemQuantity},
+		{"25", 25},
+		{"0", 0},
+		{"-1", defaultMaxItemQuantity},
+		{"lots", defaultMaxItemQuantity},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_ITEM_QUANTITY", tt.env)
+		if got := maxItemQuantityFromEnv(); got != tt.want {
+			t.Errorf("MAX_ITEM_QUANTITY=%q: got %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const reasonRateLimited = "RATE_LIMITED"
+
+// rateLimitedRequests counts requests rejected by the per-user rate limiter.
+var rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Name:      "rate_limited_requests_total",
+	Help:      "Number of requests rejected because the user exceeded their rate limit.",
+}, []string{"method"})
+
+func init() {
+	metricsRegistry.MustRegister(rateLimitedRequests)
+}
+
+// rateLimitFromEnv reads USER_RATE_LIMIT, the sustained requests per second
+// allowed for each user, and USER_RATE_LIMIT_BURST, how many may arrive at
+// once. Unset or zero turns rate limiting off. The burst defaults to the
+// rate rounded up, and to at least one.
+func rateLimitFromEnv() (rate.Limit, int) {
+	v := os.Getenv("USER_RATE_LIMIT")
+	if v == "" {
+		return 0, 0
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps < 0 || math.IsInf(rps, 0) || math.IsNaN(rps) {
+		log.Warnf("Ignoring invalid USER_RATE_LIMIT %q, requests are not rate limited", v)
+		return 0, 0
+	}
+	if rps == 0 {
+		return 0, 0
+	}
+	burst := int(math.Max(1, math.Ceil(rps)))
+	if v := os.Getenv("USER_RATE_LIMIT_BURST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Warnf("Ignoring invalid USER_RATE_LIMIT_BURST %q, using %d", v, burst)
+		} else {
+			burst = n
+		}
+	}
+	log.Infof("Rate limiting each user to %v requests per second (burst %d)", rps, burst)
+	return rate.Limit(rps), burst
+}
+
+// userRateLimiter keeps a token bucket per user.
+type userRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+// rateLimiterSweepInterval is how often buckets that have refilled, and so
+// would behave exactly like new ones, are dropped.
+const rateLimiterSweepInterval = time.Minute
+
+func newUserRateLimiter(limit rate.Limit, burst int) *userRateLimiter {
+	return &userRateLimiter{
+		limit:     limit,
+		burst:     burst,
+		limiters:  make(map[string]*rate.Limiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// reserve takes a token from userID's bucket. If none is available it
+// returns false and how long until one will be.
+func (l *userRateLimiter) reserve(userID string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		for id, lim := range l.limiters {
+			if lim.TokensAt(now) >= float64(l.burst) {
+				delete(l.limiters, id)
+			}
+		}
+		l.lastSweep = now
+	}
+	lim, ok := l.limiters[userID]
+	if !ok {
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[userID] = lim
+	}
+	r := lim.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// rateLimitedUser returns the user a request acts for, or "" for requests,
+// such as BatchGetCart, that aren't tied to one.
+func rateLimitedUser(req interface{}) string {
+	switch req := req.(type) {
+	case interface{ GetUserId() string }:
+		return req.GetUserId()
+	case interface{ GetToUserId() string }:
+		return req.GetToUserId()
+	}
+	return ""
+}
+
+// unaryInterceptor rejects requests from users who have used up their
+// bucket with RESOURCE_EXHAUSTED, telling them when to retry.
+func (l *userRateLimiter) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	userID := rateLimitedUser(req)
+	if userID == "" {
+		return handler(ctx, req)
+	}
+	if ok, retryAfter := l.reserve(userID, time.Now()); !ok {
+		rateLimitedRequests.WithLabelValues(info.FullMethod).Inc()
+		return nil, rateLimitError(retryAfter)
+	}
+	return handler(ctx, req)
+}
+
+func rateLimitError(retryAfter time.Duration) error {
+	st := status.Newf(codes.ResourceExhausted, "too many requests for this user, retry in %v", retryAfter.Round(time.Millisecond))
+	if withDetails, err := st.WithDetails(
+		&errdetails.ErrorInfo{Reason: reasonRateLimited, Domain: cartLimitDomain},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)},
+	); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
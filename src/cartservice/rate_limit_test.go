@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestRateLimitFromEnv(t *testing.T) {
+	tests := []struct {
+		limit, burst string
+		wantLimit    rate.Limit
+		wantBurst    int
+	}{
+		{"", "", 0, 0},
+		{"0", "5", 0, 0},
+		{"5", "", 5, 5},
+		{"0.5", "", 0.5, 1},
+		{"2.5", "", 2.5, 3},
+		{"10", "20", 10, 20},
+		{"10", "0", 10, 10},
+		{"10", "lots", 10, 10},
+		{"-1", "", 0, 0},
+		{"fast", "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("USER_RATE_LIMIT", tt.limit)
+		t.Setenv("USER_RATE_LIMIT_BURST", tt.burst)
+		limit, burst := rateLimitFromEnv()
+		if limit != tt.wantLimit || burst != tt.wantBurst {
+			t.Errorf("USER_RATE_LIMIT=%q USER_RATE_LIMIT_BURST=%q: got %v, %d; want %v, %d",
+				tt.limit, tt.burst, limit, burst, tt.wantLimit, tt.wantBurst)
+		}
+	}
+}
+
+func TestUserRateLimiter(t *testing.T) {
+	l := newUserRateLimiter(1, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.reserve("user-1", now); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	ok, retryAfter := l.reserve("user-1", now)
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("retry after %v, want within (0, 1s]", retryAfter)
+	}
+	if ok, _ := l.reserve("user-2", now); !ok {
+		t.Error("another user's request was refused")
+	}
+	// A refused request must not use up tokens, or retrying on time would
+	// fail again.
+	if ok, _ := l.reserve("user-1", now.Add(retryAfter)); !ok {
+		t.Error("request after the advertised delay was refused")
+	}
+}
+
+func TestUserRateLimiterSweep(t *testing.T) {
+	l := newUserRateLimiter(1, 1)
+	now := time.Now()
+	l.reserve("idle", now)
+	l.reserve("busy", now.Add(rateLimiterSweepInterval-time.Millisecond))
+
+	l.reserve("busy", now.Add(rateLimiterSweepInterval))
+	if _, ok := l.limiters["idle"]; ok {
+		t.Error("refilled bucket was kept")
+	}
+	if _, ok := l.limiters["busy"]; !ok {
+		t.Error("bucket in use was dropped")
+	}
+}
+
+func TestRateLimitInterceptor(t *testing.T) {
+	l := newUserRateLimiter(rate.Every(time.Hour), 1)
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(l.unaryInterceptor))
+	pb.RegisterCartServiceServer(srv, &cartServer{store: newMemoryCartStore()})
+	client := pb.NewCartServiceClient(newTestGRPCConn(t, srv))
+	ctx := context.Background()
+
+	if _, err := client.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}})
+	if got := status.Code(err); got != codes.ResourceExhausted {
+		t.Fatalf("got %s, want %s", got, codes.ResourceExhausted)
+	}
+	var retry *errdetails.RetryInfo
+	for _, d := range status.Convert(err).Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if retry == nil || retry.GetRetryDelay().AsDuration() <= 0 {
+		t.Errorf("got retry info %v, want a positive delay", retry)
+	}
+
+	// Merges count against the receiving user.
+	if _, err := client.MergeCarts(ctx, &pb.MergeCartsRequest{FromUserId: "guest", ToUserId: "user-1"}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("MergeCarts into a limited user: got %v, want %s", err, codes.ResourceExhausted)
+	}
+	// Requests that aren't for one user pass.
+	for i := 0; i < 3; i++ {
+		if _, err := client.BatchGetCart(ctx, &pb.BatchGetCartRequest{UserIds: []string{"user-1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
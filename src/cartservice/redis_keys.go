@@ -0,0 +1,180 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisKeyPrefix namespaces cart keys unless REDIS_KEY_PREFIX says
+// otherwise.
+const defaultRedisKeyPrefix = "cart:"
+
+// redisAuxKeyPrefix follows the store's prefix on every key that isn't a
+// cart: idempotency keys, archived carts and audit streams. User IDs are
+// never empty and can't hold ':', so no cart key starts with it, and
+// listing or scanning carts can tell the two apart by name alone.
+const redisAuxKeyPrefix = ":"
+
+// isRedisAuxKey reports whether key, with the store's prefix removed, is
+// one of the keys kept beside carts rather than a cart.
+func isRedisAuxKey(key string) bool {
+	return strings.HasPrefix(key, redisAuxKeyPrefix)
+}
+
+// redisKeyPrefixFromEnv reads REDIS_KEY_PREFIX. Setting it to the empty
+// string keeps the bare user ID keys carts were stored under before
+// prefixes existed.
+func redisKeyPrefixFromEnv() string {
+	v, ok := os.LookupEnv("REDIS_KEY_PREFIX")
+	if !ok {
+		return defaultRedisKeyPrefix
+	}
+	if v != "" {
+		log.Infof("Prefixing Redis keys with %q", v)
+	}
+	return v
+}
+
+// redisMigrateKeysFromEnv parses REDIS_MIGRATE_KEYS, which asks for
+// migrateUnprefixedKeys to run at startup.
+func redisMigrateKeysFromEnv() bool {
+	v := os.Getenv("REDIS_MIGRATE_KEYS")
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid REDIS_MIGRATE_KEYS %q, keys will not be migrated", v)
+		return false
+	}
+	return on
+}
+
+// key returns the Redis key of userID's cart.
+func (s *redisCartStore) key(userID string) string {
+	return s.keyPrefix + userID
+}
+
+func (s *redisCartStore) keys(userIDs []string) []string {
+	if s.keyPrefix == "" {
+		return userIDs
+	}
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = s.key(userID)
+	}
+	return keys
+}
+
+// migrateUnprefixedKeys moves carts stored under bare user IDs, as written
+// before REDIS_KEY_PREFIX, to their prefixed keys, keeping any TTL left on
+// them. Only values that decode as carts are moved, and a cart already under
+// the prefixed key wins over the old one, which is then left in place.
+//
+// Every unprefixed cart in the database is moved, so this must not run
+// against a Redis that another deployment still uses without a prefix. It is
+// meant to run once, from one replica, while nothing writes the old keys.
+// Failures are logged and the service starts regardless.
+func (s *redisCartStore) migrateUnprefixedKeys(ctx context.Context) {
+	if s.keyPrefix == "" {
+		log.Warn("REDIS_MIGRATE_KEYS is set but REDIS_KEY_PREFIX is empty, nothing to migrate")
+		return
+	}
+	var (
+		mu    sync.Mutex
+		moved int
+	)
+	scan := func(ctx context.Context, rdb redis.Cmdable) error {
+		iter := rdb.Scan(ctx, 0, "*", 100).Iterator()
+		for iter.Next(ctx) {
+			key := iter.Val()
+			if strings.HasPrefix(key, s.keyPrefix) {
+				continue
+			}
+			ok, err := s.moveKey(ctx, key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				mu.Lock()
+				moved++
+				mu.Unlock()
+			}
+		}
+		return iter.Err()
+	}
+
+	log.Infof("Migrating unprefixed carts to prefix %q", s.keyPrefix)
+	if err := forEachRedisNode(ctx, s.client, scan); err != nil {
+		log.Errorf("Migrating carts to prefix %q failed after moving %d: %v", s.keyPrefix, moved, err)
+		return
+	}
+	log.Infof("Moved %d carts to prefix %q", moved, s.keyPrefix)
+}
+
+// moveKey copies the cart under key to its prefixed key and deletes the
+// original, reporting whether it did. Values that aren't carts, such as
+// unprefixed idempotency keys, are skipped.
+func (s *redisCartStore) moveKey(ctx context.Context, key string) (bool, error) {
+	val, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !isStoredCart(val) {
+		log.Debugf("Not migrating Redis key %s: not a cart", key)
+		return false, nil
+	}
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	switch ttl {
+	case -2:
+		// The cart expired since GET.
+		return false, nil
+	case -1:
+		ttl = 0 // no expiry
+	}
+	ok, err := s.client.SetNX(ctx, s.key(key), val, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		log.Warnf("Not migrating Redis key %s: %s already exists", key, s.key(key))
+		return false, nil
+	}
+	return true, s.client.Del(ctx, key).Err()
+}
+
+// isStoredCart reports whether val decodes as a cart, without counting a
+// failure as a serialization error the way decodeCart does.
+func isStoredCart(val string) bool {
+	data, err := decompressCart([]byte(val))
+	if err != nil {
+		return false
+	}
+	_, _, err = unmarshalCart(data)
+	return err == nil
+}
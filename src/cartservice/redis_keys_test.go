@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisKeyPrefixFromEnv(t *testing.T) {
+	if got := redisKeyPrefixFromEnv(); got != defaultRedisKeyPrefix {
+		t.Errorf("unset: got %q, want %q", got, defaultRedisKeyPrefix)
+	}
+	t.Setenv("REDIS_KEY_PREFIX", "")
+	if got := redisKeyPrefixFromEnv(); got != "" {
+		t.Errorf("empty: got %q, want no prefix", got)
+	}
+	t.Setenv("REDIS_KEY_PREFIX", "staging:cart:")
+	if got := redisKeyPrefixFromEnv(); got != "staging:cart:" {
+		t.Errorf("got %q, want %q", got, "staging:cart:")
+	}
+}
+
+func TestRedisKeyPrefixIsolatesDeployments(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	newStore := func(prefix string) *redisCartStore {
+		t.Setenv("REDIS_KEY_PREFIX", prefix)
+		store, err := newRedisCartStore(mr.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.client.Close() })
+		return store
+	}
+	staging, prod := newStore("staging:"), newStore("prod:")
+
+	if err := staging.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.AddItem(ctx, "user-1:wishlist", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := prod.AddItem(ctx, "user-1", "1YMWWN1N4O", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := mr.Keys(); !slices.Equal(got, []string{"prod:user-1", "staging:user-1", "staging:user-1:wishlist"}) {
+		t.Errorf("got keys %v", got)
+	}
+	cart, err := prod.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].ProductId != "1YMWWN1N4O" {
+		t.Errorf("prod sees %v, want only its own item", cart.Items)
+	}
+	for store, want := range map[*redisCartStore][]string{staging: {"wishlist"}, prod: nil} {
+		names, err := store.ListCartNames(ctx, "user-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("%s: got cart names %v, want %v", store.keyPrefix, names, want)
+		}
+	}
+}
+
+func TestRedisMigrateUnprefixedKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	mr.Set("user-1", `[{"product_id":"OLJCESPC7Z","quantity":1}]`)
+	mr.SetTTL("user-1", time.Hour)
+	mr.Set("user-1:wishlist", `{"items":[],"saved":[{"product_id":"66VCHSJNUP","quantity":1}]}`)
+	mr.Set("user-2", `[{"product_id":"OLD","quantity":1}]`)
+	mr.Set("cart:user-2", `[{"product_id":"NEW","quantity":1}]`)
+	mr.Set("idempotency:user-1:abc", "1")
+
+	t.Setenv("REDIS_MIGRATE_KEYS", "true")
+	store, err := newRedisCartStore(mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.client.Close() })
+
+	want := []string{"cart:user-1", "cart:user-1:wishlist", "cart:user-2", "idempotency:user-1:abc", "user-2"}
+	if got := mr.Keys(); !slices.Equal(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	if got := mr.TTL("cart:user-1"); got != time.Hour {
+		t.Errorf("migrated cart has TTL %v, want the original's %v", got, time.Hour)
+	}
+	cart, err := store.GetCart(ctx, "user-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].ProductId != "NEW" {
+		t.Errorf("existing prefixed cart was overwritten: %v", cart.Items)
+	}
+	saved, err := store.GetSavedItems(ctx, "user-1:wishlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 {
+		t.Errorf("named cart lost its saved list: %v", saved)
+	}
+}
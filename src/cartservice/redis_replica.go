@@ -0,0 +1,137 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisReplicaBackoff is how long reads skip a replica after it fails,
+// so an unreachable replica doesn't cost every read a timeout. Tests
+// shorten it.
+var redisReplicaBackoff = 5 * time.Second
+
+// redisReplicaFallbacks counts reads the replica couldn't serve.
+var redisReplicaFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Subsystem: "store",
+	Name:      "redis_replica_fallbacks_total",
+	Help:      "Number of cart reads sent to the Redis primary because the replica failed.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(redisReplicaFallbacks)
+}
+
+// redisReplica is a read-only Redis serving GetCart and GetCarts. Replicas
+// lag their primary, so a cart read straight after a write may not show it
+// yet.
+type redisReplica struct {
+	client *redis.Client
+	// downUntil is when, in Unix nanoseconds, reads may try the replica
+	// again after it last failed.
+	downUntil atomic.Int64
+}
+
+// newRedisReplicaFromEnv connects to REDIS_REPLICA_ADDR, given like a
+// standalone REDIS_ADDR and using the same credentials and TLS settings.
+// It returns nil, sending every read to the primary, when no replica is
+// configured or its address is invalid. A replica that doesn't answer at
+// startup is still used: reads fall back to the primary until it does.
+func newRedisReplicaFromEnv(mode string) *redisReplica {
+	addr := os.Getenv("REDIS_REPLICA_ADDR")
+	if addr == "" {
+		return nil
+	}
+	if mode != redisModeStandalone {
+		log.Warnf("Ignoring REDIS_REPLICA_ADDR with REDIS_MODE=%s, all reads go to the primary", mode)
+		return nil
+	}
+	opts, err := redisOptions(addr)
+	if err != nil {
+		log.Warnf("Ignoring REDIS_REPLICA_ADDR, all reads go to the primary: %v", err)
+		return nil
+	}
+	client := redis.NewClient(opts)
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		log.Warnf("Failed to instrument Redis replica with tracing: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Warnf("Redis replica at %s is not reachable yet, reading from the primary until it is: %v", opts.Addr, err)
+	} else {
+		log.Infof("Reading carts from Redis replica at %s", opts.Addr)
+	}
+	return &redisReplica{client: client}
+}
+
+// use returns the replica's client, or nil when there is no replica or it
+// failed within the last redisReplicaBackoff.
+func (r *redisReplica) use() *redis.Client {
+	if r == nil || time.Now().UnixNano() < r.downUntil.Load() {
+		return nil
+	}
+	return r.client
+}
+
+// failed reports whether err from the replica should send the read to the
+// primary, and if so stops reads trying the replica for a while. Missing
+// keys and the caller's own cancellation are not the replica's fault.
+func (r *redisReplica) failed(ctx context.Context, err error) bool {
+	if err == nil || err == redis.Nil || ctx.Err() != nil {
+		return false
+	}
+	r.downUntil.Store(time.Now().Add(redisReplicaBackoff).UnixNano())
+	redisReplicaFallbacks.Inc()
+	log.Warnf("Redis replica failed, reading from the primary for %v: %v", redisReplicaBackoff, err)
+	return true
+}
+
+// readCartPreferReplica is readCart from the replica when there is one,
+// and from the primary otherwise or if the replica fails.
+func (s *redisCartStore) readCartPreferReplica(ctx context.Context, userID string) (storedCart, cartCodec, error) {
+	if rdb := s.replica.use(); rdb != nil {
+		val, err := rdb.Get(ctx, s.key(userID)).Result()
+		switch {
+		case err == redis.Nil:
+			return storedCart{Items: []cartItem{}}, nil, nil
+		case err == nil:
+			return decodeCart(val)
+		case !s.replica.failed(ctx, err):
+			return storedCart{}, nil, redisError(opGet, "failed to get cart", err)
+		}
+	}
+	return s.readCart(ctx, s.client, userID)
+}
+
+// mgetPreferReplica is MGET from the replica when there is one, and from
+// the primary otherwise or if the replica fails.
+func (s *redisCartStore) mgetPreferReplica(ctx context.Context, keys []string) ([]interface{}, error) {
+	if rdb := s.replica.use(); rdb != nil {
+		vals, err := rdb.MGet(ctx, keys...).Result()
+		if !s.replica.failed(ctx, err) {
+			return vals, err
+		}
+	}
+	return s.client.MGet(ctx, keys...).Result()
+}
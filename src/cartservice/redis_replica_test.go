@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestReplicatedStore returns a store on a primary and a replica.
+// miniredis doesn't replicate, so tests write each side directly to tell
+// which one a read came from.
+func newTestReplicatedStore(t *testing.T) (*redisCartStore, *miniredis.Miniredis, *miniredis.Miniredis) {
+	t.Helper()
+	primary, replica := miniredis.RunT(t), miniredis.RunT(t)
+	t.Setenv("REDIS_REPLICA_ADDR", replica.Addr())
+	store, err := newRedisCartStore(primary.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if store.replica == nil {
+		t.Fatal("replica not configured")
+	}
+	return store, primary, replica
+}
+
+func TestRedisReplicaServesReads(t *testing.T) {
+	store, primary, replica := newTestReplicatedStore(t)
+	ctx := context.Background()
+	primary.Set(store.key("user-1"), `[{"product_id":"PRIMARY","quantity":1}]`)
+	replica.Set(store.key("user-1"), `[{"product_id":"REPLICA","quantity":1}]`)
+
+	cart, err := store.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].ProductId != "REPLICA" {
+		t.Errorf("GetCart read %v, want the replica's cart", cart.Items)
+	}
+	carts, err := store.GetCarts(ctx, []string{"user-1", "user-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(carts[0].Items) != 1 || carts[0].Items[0].ProductId != "REPLICA" || len(carts[1].Items) != 0 {
+		t.Errorf("GetCarts read %v, want the replica's carts", carts)
+	}
+
+	// Writes go to the primary.
+	if err := store.AddItem(ctx, "user-3", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !primary.Exists(store.key("user-3")) || replica.Exists(store.key("user-3")) {
+		t.Error("AddItem didn't write to the primary only")
+	}
+}
+
+func TestRedisReplicaFallback(t *testing.T) {
+	defer func(d time.Duration) { redisReplicaBackoff = d }(redisReplicaBackoff)
+	redisReplicaBackoff = time.Hour
+
+	store, primary, replica := newTestReplicatedStore(t)
+	ctx := context.Background()
+	primary.Set(store.key("user-1"), `[{"product_id":"PRIMARY","quantity":1}]`)
+	before := testutil.ToFloat64(redisReplicaFallbacks)
+
+	replica.Close()
+	cart, err := store.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("GetCart with the replica down: %v", err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].ProductId != "PRIMARY" {
+		t.Errorf("GetCart read %v, want the primary's cart", cart.Items)
+	}
+	if got := testutil.ToFloat64(redisReplicaFallbacks) - before; got != 1 {
+		t.Errorf("fallbacks went up by %v, want 1", got)
+	}
+
+	// Within the backoff the replica isn't tried, even once it is back.
+	if err := replica.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	replica.Set(store.key("user-1"), `[{"product_id":"REPLICA","quantity":1}]`)
+	carts, err := store.GetCarts(ctx, []string{"user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carts[0].Items[0].ProductId != "PRIMARY" {
+		t.Errorf("GetCarts read %v within the backoff, want the primary's cart", carts[0].Items)
+	}
+
+	store.replica.downUntil.Store(0)
+	cart, err = store.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.Items[0].ProductId != "REPLICA" {
+		t.Errorf("GetCart read %v after the backoff, want the replica's cart", cart.Items)
+	}
+}
+
+func TestRedisReplicaIgnoredOutsideStandalone(t *testing.T) {
+	t.Setenv("REDIS_REPLICA_ADDR", "replica:6379")
+	if r := newRedisReplicaFromEnv(redisModeCluster); r != nil {
+		t.Error("replica configured in cluster mode")
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultRedisConnectRetries is how many times the startup ping is
+	// retried before cartservice falls back to the in-memory store.
+	defaultRedisConnectRetries = 5
+
+	// defaultRedisOpAttempts is how many times a store operation is tried
+	// when Redis fails with a transient error, unless REDIS_RETRY_ATTEMPTS
+	// says otherwise.
+	defaultRedisOpAttempts = 3
+	defaultRedisMaxBackoff = time.Second
+
+	redisPingTimeout       = 5 * time.Second
+	maxRedisConnectBackoff = 5 * time.Second
+)
+
+// Base delays for the exponential backoffs below. Tests shorten them.
+// REDIS_RETRY_BACKOFF overrides redisOpBackoff.
+var (
+	redisConnectBackoff = 200 * time.Millisecond
+	redisOpBackoff      = 50 * time.Millisecond
+)
+
+var (
+	// redisRetries counts store operations retried after a transient Redis
+	// error, once per retry.
+	redisRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "redis_retries_total",
+		Help:      "Number of Redis operations retried after a transient error.",
+	})
+
+	// redisRetriesExhausted counts operations that still failed after
+	// their last attempt and were answered with Unavailable.
+	redisRetriesExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "redis_retries_exhausted_total",
+		Help:      "Number of Redis operations that failed on every attempt.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(redisRetries, redisRetriesExhausted)
+}
+
+// redisConnectRetriesFromEnv reads REDIS_CONNECT_RETRIES, the number of
+// extra attempts made at the startup ping. Zero gives up after the first
+// failure.
+func redisConnectRetriesFromEnv() int {
+	v := os.Getenv("REDIS_CONNECT_RETRIES")
+	if v == "" {
+		return defaultRedisConnectRetries
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("Ignoring invalid REDIS_CONNECT_RETRIES %q, using %d", v, defaultRedisConnectRetries)
+		return defaultRedisConnectRetries
+	}
+	return n
+}
+
+// pingRedis pings Redis until it answers, retrying transient failures up to
+// retries times with exponential backoff. Redis often starts alongside
+// cartservice, so a single failed ping is not a reason to give up on it for
+// the pod's lifetime. Errors that will not clear on their own, such as bad
+// credentials, are returned straight away.
+func pingRedis(client redis.UniversalClient, retries int) error {
+	delay := redisConnectBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+		err := pingRedisNodes(ctx, client)
+		cancel()
+		// The deadline is this attempt's own, so running out of it is
+		// worth another try.
+		retryable := isTransientRedisError(err) || errors.Is(err, context.DeadlineExceeded)
+		if err == nil || attempt == retries || !retryable {
+			return err
+		}
+		log.Warnf("Redis not reachable yet, retrying in %v (attempt %d/%d): %v", delay, attempt+1, retries, err)
+		time.Sleep(delay)
+		delay = min(2*delay, maxRedisConnectBackoff)
+	}
+}
+
+// pingRedisNodes pings client, or every shard of a sharded client, so one
+// unreachable shard fails startup as an unreachable server would.
+func pingRedisNodes(ctx context.Context, client redis.UniversalClient) error {
+	if ring, ok := client.(*redis.Ring); ok {
+		return ring.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+			return shard.Ping(ctx).Err()
+		})
+	}
+	return client.Ping(ctx).Err()
+}
+
+// isTransientRedisError reports whether err is a network failure or a Redis
+// condition that may clear on its own, such as a timeout, a refused or
+// reset connection, or a server still loading its dataset. Missing keys,
+// lost WATCH races, bad cart data and cancelled requests are not transient.
+func isTransientRedisError(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, redis.Nil),
+		errors.Is(err, redis.TxFailedErr),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	if _, ok := status.FromError(err); ok {
+		// Already mapped to a gRPC status, so not a raw Redis failure.
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, prefix := range []string{"LOADING ", "READONLY ", "TRYAGAIN ", "CLUSTERDOWN "} {
+		if redis.HasErrorPrefix(err, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redisRetryPolicy says how store operations retry transient Redis errors.
+type redisRetryPolicy struct {
+	// maxAttempts is how many times an operation is tried in all.
+	maxAttempts int
+	// backoff is the delay before the first retry, doubling for each one
+	// after up to maxBackoff. Each delay is jittered down by up to half.
+	backoff, maxBackoff time.Duration
+}
+
+// redisRetryPolicyFromEnv reads REDIS_RETRY_ATTEMPTS, REDIS_RETRY_BACKOFF
+// and REDIS_RETRY_MAX_BACKOFF. REDIS_RETRY_ATTEMPTS=1 turns retries off.
+func redisRetryPolicyFromEnv() redisRetryPolicy {
+	p := redisRetryPolicy{maxAttempts: defaultRedisOpAttempts, backoff: redisOpBackoff, maxBackoff: defaultRedisMaxBackoff}
+	if v := os.Getenv("REDIS_RETRY_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			log.Warnf("Ignoring invalid REDIS_RETRY_ATTEMPTS %q, using %d", v, p.maxAttempts)
+		} else {
+			p.maxAttempts = n
+		}
+	}
+	if v := os.Getenv("REDIS_RETRY_BACKOFF"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			log.Warnf("Ignoring invalid REDIS_RETRY_BACKOFF %q, using %v", v, p.backoff)
+		} else {
+			p.backoff = d
+		}
+	}
+	if v := os.Getenv("REDIS_RETRY_MAX_BACKOFF"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			log.Warnf("Ignoring invalid REDIS_RETRY_MAX_BACKOFF %q, using %v", v, p.maxBackoff)
+		} else {
+			p.maxBackoff = d
+		}
+	}
+	return p
+}
+
+// delay returns the wait before retry number n, counting from 1.
+func (p redisRetryPolicy) delay(n int) time.Duration {
+	d := p.backoff
+	for i := 1; i < n && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	if d <= 1 {
+		return d
+	}
+	// Equal jitter: keep half, randomise the rest, so replicas retrying the
+	// same outage spread out.
+	return d/2 + rand.N(d/2)
+}
+
+// do runs op, retrying with backoff while it fails with a transient Redis
+// error, which includes network timeouts. Each retry is recorded as an
+// event on the span in ctx. Other errors are returned as they are. Writes
+// only fail transiently before their EXEC is sent, execTx turning later
+// failures into Unknown, so op has not been applied when it is retried. If
+// Redis is still failing after the last attempt the error becomes
+// Unavailable, so callers know nothing was written.
+func (p redisRetryPolicy) do(ctx context.Context, op func() error) error {
+	attempts := max(p.maxAttempts, 1)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = op(); !isTransientRedisError(err) {
+			return err
+		}
+		if attempt == attempts {
+			break
+		}
+		delay := p.delay(attempt)
+		redisRetries.Inc()
+		trace.SpanFromContext(ctx).AddEvent("redis.retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+			attribute.Int64("backoff_ms", delay.Milliseconds()),
+		))
+		log.Debugf("transient Redis error, retrying in %v (attempt %d/%d): %v", delay, attempt, attempts, err)
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(delay):
+		}
+	}
+	redisRetriesExhausted.Inc()
+	return status.Errorf(codes.Unavailable, "redis unavailable after %d attempts: %v", attempts, err)
+}
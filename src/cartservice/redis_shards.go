@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisShardDownAfter is how many failures in a row mark a shard down, as
+// the ring's own heartbeat counts them.
+const redisShardDownAfter = 3
+
+var (
+	// redisShardUp is 1 for each shard answering commands and 0 for those
+	// that have stopped.
+	redisShardUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "redis_shard_up",
+		Help:      "Whether each Redis shard is answering (1) or not (0).",
+	}, []string{"shard"})
+
+	// redisShardCommands shows how evenly carts are spread over the shards.
+	redisShardCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "redis_shard_commands_total",
+		Help:      "Number of Redis commands sent to each shard, heartbeats excluded.",
+	}, []string{"shard"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(redisShardUp, redisShardCommands)
+}
+
+// newRedisShardClient connects to one shard of a sharded store, tracking its
+// health and load. The ring shares one TLS config among the shards, so each
+// gets a copy naming its own host.
+func newRedisShardClient(opts *redis.Options) *redis.Client {
+	if opts.TLSConfig != nil && opts.TLSConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(opts.Addr); err == nil {
+			opts.TLSConfig = opts.TLSConfig.Clone()
+			opts.TLSConfig.ServerName = host
+		}
+	}
+	client := redis.NewClient(opts)
+	client.AddHook(newRedisShardHook(opts.Addr))
+	return client
+}
+
+// redisShardHook watches the commands sent to one shard, the ring's
+// heartbeat PINGs included, so a shard's health is tracked even while no
+// carts hash to it.
+type redisShardHook struct {
+	shard string
+	// failures counts commands failed in a row.
+	failures atomic.Int32
+}
+
+func newRedisShardHook(shard string) *redisShardHook {
+	redisShardUp.WithLabelValues(shard).Set(1)
+	return &redisShardHook{shard: shard}
+}
+
+func (h *redisShardHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *redisShardHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if cmd.Name() != "ping" {
+			redisShardCommands.WithLabelValues(h.shard).Inc()
+		}
+		h.observe(err)
+		return err
+	}
+}
+
+func (h *redisShardHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		redisShardCommands.WithLabelValues(h.shard).Add(float64(len(cmds)))
+		h.observe(err)
+		return err
+	}
+}
+
+// observe records the outcome of a command. Transient errors count against
+// the shard; any other answer shows it is up. A cancelled or timed out
+// caller says nothing about the shard either way.
+func (h *redisShardHook) observe(err error) {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+	case isTransientRedisError(err):
+		if h.failures.Add(1) == redisShardDownAfter {
+			redisShardUp.WithLabelValues(h.shard).Set(0)
+			log.Warnf("Redis shard %s is down, its carts are served by the other shards until it recovers: %v", h.shard, err)
+		}
+	default:
+		if h.failures.Swap(0) >= redisShardDownAfter {
+			redisShardUp.WithLabelValues(h.shard).Set(1)
+			log.Infof("Redis shard %s is back up", h.shard)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestShardedStore shards a store across two miniredis servers.
+func newTestShardedStore(t *testing.T) (*redisCartStore, []*miniredis.Miniredis) {
+	t.Helper()
+	shards := []*miniredis.Miniredis{miniredis.RunT(t), miniredis.RunT(t)}
+	t.Setenv("REDIS_MODE", "sharded")
+	store, err := newRedisCartStore(shards[0].Addr() + "," + shards[1].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, shards
+}
+
+// shardOf returns the index of the shard holding userID's cart, or -1.
+func shardOf(store *redisCartStore, shards []*miniredis.Miniredis, userID string) int {
+	for i, mr := range shards {
+		if mr.Exists(store.key(userID)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRedisShardedStore(t *testing.T) {
+	store, shards := newTestShardedStore(t)
+	if !store.cluster {
+		t.Fatal("sharded store doesn't split up commands touching several carts")
+	}
+	ctx := context.Background()
+
+	// Find a user on each shard.
+	onShard := make([]string, len(shards))
+	for i := 0; i < 100 && (onShard[0] == "" || onShard[1] == ""); i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		if err := store.AddItem(ctx, userID, "OLJCESPC7Z", 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if shard := shardOf(store, shards, userID); shard >= 0 {
+			onShard[shard] = userID
+		}
+	}
+	if onShard[0] == "" || onShard[1] == "" {
+		t.Fatalf("carts of 100 users all landed on one shard: %v", onShard)
+	}
+
+	carts, err := store.GetCarts(ctx, []string{onShard[0], "nobody", onShard[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(carts[0].Items) != 1 || len(carts[1].Items) != 0 || len(carts[2].Items) != 1 {
+		t.Fatalf("got carts %v", carts)
+	}
+
+	// A merge across shards.
+	if err := store.MergeCarts(ctx, onShard[0], onShard[1]); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := store.GetCart(ctx, onShard[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 {
+		t.Errorf("got merged cart %v, want OLJCESPC7Z x2", cart.Items)
+	}
+	if shardOf(store, shards, onShard[0]) >= 0 {
+		t.Error("source cart still exists after merge")
+	}
+
+	if _, _, err := store.ListCartKeys(ctx, "", 10); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ListCartKeys: got %v, want %s", err, codes.Unimplemented)
+	}
+}
+
+func TestRedisShardedStoreScansEveryShard(t *testing.T) {
+	store, shards := newTestShardedStore(t)
+	ctx := context.Background()
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("list-%d", i)
+		names = append(names, name)
+		if err := store.AddItem(ctx, "user-1:"+name, "OLJCESPC7Z", 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, mr := range shards {
+		if len(mr.Keys()) == 0 {
+			t.Fatalf("no carts landed on shard %d", i)
+		}
+	}
+	got, err := store.ListCartNames(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(names) {
+		t.Errorf("ListCartNames found %d carts, want %d", len(got), len(names))
+	}
+}
+
+func TestRedisShardedStoreNeedsEveryShard(t *testing.T) {
+	mr := miniredis.RunT(t)
+	down := miniredis.RunT(t)
+	downAddr := down.Addr()
+	down.Close()
+	t.Setenv("REDIS_MODE", "sharded")
+	t.Setenv("REDIS_CONNECT_RETRIES", "0")
+	if store, err := newRedisCartStore(mr.Addr() + "," + downAddr); err == nil {
+		store.Close()
+		t.Fatal("connected with a shard down")
+	}
+}
+
+func TestRedisShardHook(t *testing.T) {
+	h := newRedisShardHook("test-shard")
+	up := func() float64 { return testutil.ToFloat64(redisShardUp.WithLabelValues("test-shard")) }
+	steps := []struct {
+		err    error
+		wantUp float64
+	}{
+		{io.EOF, 1},
+		{io.EOF, 1},
+		{nil, 1}, // resets the count
+		{io.EOF, 1},
+		{context.DeadlineExceeded, 1},
+		{io.EOF, 1},
+		{io.EOF, 0},
+		{io.EOF, 0},
+		{context.Canceled, 0},
+		{errors.New("WRONGTYPE not a string"), 1},
+	}
+	for i, step := range steps {
+		h.observe(step.err)
+		if got := up(); got != step.wantUp {
+			t.Fatalf("step %d (%v): redis_shard_up = %v, want %v", i, step.err, got, step.wantUp)
+		}
+	}
+}
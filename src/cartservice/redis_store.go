@@ -0,0 +1,801 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// maxCartTxAttempts bounds how many times a cart mutation is retried when a
+// concurrent writer modifies the same cart between WATCH and EXEC.
+const maxCartTxAttempts = 3
+
+// defaultRedisMaxPipelines is the default cap on bulk Redis operations in
+// flight at once.
+const defaultRedisMaxPipelines = 16
+
+type redisCartStore struct {
+	client redis.UniversalClient
+
+	// cluster is set for Redis Cluster and sharded Redis, where commands
+	// touching several carts must be split up by hash slot or shard.
+	cluster bool
+
+	// ttl is the expiration applied on every cart write, so it slides
+	// forward each time the cart changes. Zero means carts never expire.
+	ttl time.Duration
+
+	// compress gzips carts larger than cartCompressionThreshold on save.
+	compress bool
+
+	// retry is how operations ride out transient Redis errors.
+	retry redisRetryPolicy
+
+	// timeouts cap how long reads and writes may take, retries included.
+	// IdleCarts and Ping, which have deadlines of their own, aren't capped.
+	timeouts redisOpTimeouts
+
+	// replica, when set, serves GetCart and GetCarts.
+	replica *redisReplica
+
+	// keyPrefix is prepended to every key the store reads or writes, so
+	// several deployments can share one Redis. See redis_keys.go.
+	keyPrefix string
+
+	// codec encodes carts on save. Carts written by another codec are still
+	// read, and GetCart rewrites them with this one.
+	codec cartCodec
+
+	// pipelines is a semaphore bounding the bulk operations, which touch
+	// many keys in one round trip, running against Redis at once. Nil means
+	// no limit.
+	pipelines chan struct{}
+}
+
+func newRedisCartStore(addr string) (*redisCartStore, error) {
+	client, target, err := newRedisClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Only the target is logged from here on: addr may carry the password.
+	addr = target
+
+	// Add OpenTelemetry instrumentation to Redis client
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		log.Warnf("Failed to instrument Redis with tracing: %v", err)
+	}
+
+	// Test connection
+	if err := pingRedis(client, redisConnectRetriesFromEnv()); err != nil {
+		client.Close()
+		err = explainRedisConnectError(err, redisTLSEnabled(client))
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %v", addr, err)
+	}
+
+	log.Infof("Connected to Redis at %s", addr)
+	var cluster bool
+	switch client.(type) {
+	case *redis.ClusterClient, *redis.Ring:
+		cluster = true
+	}
+	store := &redisCartStore{client: client, cluster: cluster, ttl: cartTTLFromEnv(), compress: cartCompressionFromEnv(), codec: cartCodecFromEnv(), keyPrefix: redisKeyPrefixFromEnv(), retry: redisRetryPolicyFromEnv(), timeouts: redisOpTimeoutsFromEnv()}
+	if n := redisMaxPipelinesFromEnv(); n > 0 {
+		store.pipelines = make(chan struct{}, n)
+	}
+	// newRedisClient has already validated REDIS_MODE.
+	mode, _ := redisModeFromEnv()
+	store.replica = newRedisReplicaFromEnv(mode)
+	if redisMigrateKeysFromEnv() {
+		store.migrateUnprefixedKeys(context.Background())
+	}
+	return store, nil
+}
+
+// redisMaxPipelinesFromEnv reads REDIS_MAX_PIPELINES, the number of bulk
+// operations allowed against Redis at once. Zero removes the limit.
+func redisMaxPipelinesFromEnv() int {
+	v := os.Getenv("REDIS_MAX_PIPELINES")
+	if v == "" {
+		return defaultRedisMaxPipelines
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("Ignoring invalid REDIS_MAX_PIPELINES %q, using %d", v, defaultRedisMaxPipelines)
+		return defaultRedisMaxPipelines
+	}
+	return n
+}
+
+// acquirePipeline takes a bulk operation slot, failing fast with
+// ResourceExhausted when all are in use rather than queueing more work on
+// Redis. The returned func gives the slot back.
+func (s *redisCartStore) acquirePipeline() (func(), error) {
+	if s.pipelines == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.pipelines <- struct{}{}:
+		return func() { <-s.pipelines }, nil
+	default:
+		return nil, status.Errorf(codes.ResourceExhausted, "too many concurrent bulk Redis operations (limit %d)", cap(s.pipelines))
+	}
+}
+
+// redisOptions builds the client options from REDIS_ADDR, which is either a
+// redis:// or rediss:// URL or a bare host:port. A bare address takes its
+// credentials and database from REDIS_USERNAME, REDIS_PASSWORD and REDIS_DB.
+// TLS is used for rediss:// URLs or when REDIS_TLS is true.
+func redisOptions(addr string) (*redis.Options, error) {
+	var opts *redis.Options
+	if strings.HasPrefix(addr, "redis://") || strings.HasPrefix(addr, "rediss://") {
+		var err error
+		if opts, err = redis.ParseURL(addr); err != nil {
+			// The URL may hold a password, so leave it out of the error.
+			return nil, errors.New("failed to parse REDIS_ADDR as a Redis URL")
+		}
+	} else {
+		opts = &redis.Options{
+			Addr:     addr,
+			Username: os.Getenv("REDIS_USERNAME"),
+			Password: os.Getenv("REDIS_PASSWORD"),
+		}
+		if v := os.Getenv("REDIS_DB"); v != "" {
+			db, err := strconv.Atoi(v)
+			if err != nil || db < 0 {
+				return nil, fmt.Errorf("invalid REDIS_DB %q", v)
+			}
+			opts.DB = db
+		}
+	}
+
+	// Let the store's operation timeouts, and callers' deadlines, cut
+	// commands short rather than only the socket timeouts.
+	opts.ContextTimeoutEnabled = true
+
+	if opts.TLSConfig != nil {
+		// A rediss:// URL already turned TLS on.
+		if err := loadRedisTLSFiles(opts.TLSConfig); err != nil {
+			return nil, err
+		}
+		return opts, nil
+	}
+	tlsConfig, err := redisTLSFromEnv("")
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		host, _, err := net.SplitHostPort(opts.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis address %q: %v", opts.Addr, err)
+		}
+		tlsConfig.ServerName = host
+		opts.TLSConfig = tlsConfig
+	}
+	return opts, nil
+}
+
+// cartTTLFromEnv parses CART_TTL (e.g. "48h"). Unset, zero or invalid values
+// keep the historical never-expire behavior.
+func cartTTLFromEnv() time.Duration {
+	v := os.Getenv("CART_TTL")
+	if v == "" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 0 {
+		log.Warnf("Ignoring invalid CART_TTL %q, carts will not expire", v)
+		return 0
+	}
+	if ttl > 0 {
+		log.Infof("Carts expire after %v of inactivity", ttl)
+	}
+	return ttl
+}
+
+func (s *redisCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	log.Infof("AddItem called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	return finish(s.retry.do(ctx, func() error {
+		return s.updateCart(ctx, userID, func(cart []cartItem) []cartItem {
+			return addCartItem(cart, productID, quantity, price)
+		})
+	}))
+}
+
+// AddItems applies the whole batch in a single WATCHed transaction, so
+// either every item lands or, if the transaction keeps conflicting, none
+// does.
+func (s *redisCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	log.Infof("AddItems called: userID=%s, items=%d", userID, len(items))
+
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	return finish(s.retry.do(ctx, func() error {
+		return s.updateCart(ctx, userID, func(cart []cartItem) []cartItem {
+			return addCartItems(cart, items)
+		})
+	}))
+}
+
+func (s *redisCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	log.Infof("UpdateItemQuantity called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	return finish(s.retry.do(ctx, func() error {
+		return s.updateCart(ctx, userID, func(cart []cartItem) []cartItem {
+			return setCartItemQuantity(cart, productID, quantity)
+		})
+	}))
+}
+
+func (s *redisCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	log.Infof("GetCart called: userID=%s", userID)
+
+	var cart storedCart
+	var codec cartCodec
+	readCtx, finish := s.opContext(ctx, redisReadOp)
+	err := finish(s.retry.do(readCtx, func() (err error) {
+		cart, codec, err = s.readCartPreferReplica(readCtx, userID)
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if codec != nil && codec.name() != s.codec.name() {
+		s.migrateCart(ctx, userID)
+	}
+	return cartToProto(userID, cart), nil
+}
+
+// migrateCart rewrites a cart stored by another codec with s.codec, so
+// carts move over to a new CART_CODEC as they are read. The cart is re-read
+// under WATCH and left alone if a writer got there first. The rewrite gives
+// the cart a fresh CART_TTL, as any write does, but doesn't count as a
+// change for abandoned cart detection. Failures are only logged:
+// the cart is still readable as it is.
+func (s *redisCartStore) migrateCart(ctx context.Context, userID string) {
+	txf := func(tx *redis.Tx) error {
+		cart, codec, err := s.readCart(ctx, tx, userID)
+		if err != nil || codec == nil || codec.name() == s.codec.name() {
+			return err
+		}
+		err = execTx(ctx, tx, func(pipe redis.Pipeliner) error {
+			return s.writeCart(ctx, pipe, userID, cart)
+		})
+		return err
+	}
+	if err := s.runTx(ctx, txf, userID); err != nil {
+		log.Warnf("Failed to migrate cart %s to %s encoding: %v", userID, s.codec.name(), err)
+	}
+}
+
+// GetCarts reads every cart with a single MGET.
+func (s *redisCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	log.Infof("GetCarts called: %d users", len(userIDs))
+	if len(userIDs) == 0 {
+		return []*pb.Cart{}, nil
+	}
+
+	release, err := s.acquirePipeline()
+	if err != nil {
+		return nil, err
+	}
+	var vals []interface{}
+	ctx, finish := s.opContext(ctx, redisReadOp)
+	err = finish(s.retry.do(ctx, func() (err error) {
+		if s.cluster {
+			vals, err = clusterMGet(ctx, s.client, s.keys(userIDs))
+		} else {
+			vals, err = s.mgetPreferReplica(ctx, s.keys(userIDs))
+		}
+		return redisError(opMGet, "failed to get carts", err)
+	}))
+	release()
+	if err != nil {
+		return nil, err
+	}
+	carts := make([]*pb.Cart, len(userIDs))
+	for i, userID := range userIDs {
+		// MGET answers nil for missing keys.
+		cart := storedCart{Items: []cartItem{}}
+		if val, ok := vals[i].(string); ok {
+			if cart, _, err = decodeCart(val); err != nil {
+				return nil, err
+			}
+		}
+		carts[i] = cartToProto(userID, cart)
+	}
+	return carts, nil
+}
+
+func (s *redisCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	var n int64
+	ctx, finish := s.opContext(ctx, redisReadOp)
+	err := finish(s.retry.do(ctx, func() (err error) {
+		n, err = s.client.Exists(ctx, s.key(userID)).Result()
+		return redisError(opExists, "failed to check cart", err)
+	}))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// EmptyCart clears the cart under WATCH so the saved list, which shares
+// the key, survives a concurrent SaveForLater.
+func (s *redisCartStore) EmptyCart(ctx context.Context, userID string) error {
+	log.Infof("EmptyCart called: userID=%s", userID)
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	return finish(s.retry.do(ctx, func() error {
+		return s.updateStoredCart(ctx, userID, func(cart *storedCart) error {
+			*cart = storedCart{Items: []cartItem{}, Saved: cart.Saved}
+			return nil
+		})
+	}))
+}
+
+// LockCurrency sets the cart's currency under WATCH, so of two concurrent
+// first adds in different currencies exactly one wins.
+func (s *redisCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	var locked string
+	txf := func(tx *redis.Tx) error {
+		cart, err := s.getCart(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if locked = cart.Currency; locked != "" {
+			return nil
+		}
+		cart.Currency = currency
+		err = execTx(ctx, tx, func(pipe redis.Pipeliner) error {
+			return s.saveCart(ctx, pipe, userID, cart)
+		})
+		if err == nil {
+			locked = currency
+		}
+		return err
+	}
+	err := finish(s.retry.do(ctx, func() error {
+		return s.runTx(ctx, txf, userID)
+	}))
+	return locked, err
+}
+
+func (s *redisCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	var cart storedCart
+	ctx, finish := s.opContext(ctx, redisReadOp)
+	err := finish(s.retry.do(ctx, func() (err error) {
+		cart, err = s.getCart(ctx, s.client, userID)
+		return err
+	}))
+	return cart, err
+}
+
+// ImportCart overwrites the cart, keeping at most its saved list, so the
+// imported cart starts with a fresh TTL and no currency lock.
+func (s *redisCartStore) ImportCart(ctx context.Context, userID string, imported storedCart) error {
+	log.Infof("ImportCart called: userID=%s", userID)
+
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	return finish(s.retry.do(ctx, func() error {
+		return s.updateStoredCart(ctx, userID, func(cart *storedCart) error {
+			*cart = importedCart(*cart, imported)
+			return nil
+		})
+	}))
+}
+
+func (s *redisCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	log.Infof("SaveForLater called: userID=%s, productID=%s", userID, productID)
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	return finish(s.retry.do(ctx, func() error {
+		return s.updateStoredCart(ctx, userID, func(cart *storedCart) error {
+			return saveCartItemForLater(cart, productID)
+		})
+	}))
+}
+
+func (s *redisCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	log.Infof("MoveToCart called: userID=%s, productID=%s", userID, productID)
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	return finish(s.retry.do(ctx, func() error {
+		return s.updateStoredCart(ctx, userID, func(cart *storedCart) error {
+			return moveSavedItemToCart(cart, productID)
+		})
+	}))
+}
+
+func (s *redisCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	var cart storedCart
+	ctx, finish := s.opContext(ctx, redisReadOp)
+	err := finish(s.retry.do(ctx, func() (err error) {
+		cart, err = s.getCart(ctx, s.client, userID)
+		return err
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return cartItemsToProto(cart.Saved), nil
+}
+
+// ListCartNames finds the user's named carts with SCAN. SCAN walks the
+// whole keyspace, on every master or shard, so this is meant for
+// occasional calls such as rendering a cart switcher.
+func (s *redisCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	match := redisGlobEscaper.Replace(s.keyPrefix+userID) + ":*"
+	scan := func(ctx context.Context, rdb redis.Cmdable) error {
+		iter := rdb.Scan(ctx, 0, match, 100).Iterator()
+		for iter.Next(ctx) {
+			if name, ok := cartNameFromKey(userID, strings.TrimPrefix(iter.Val(), s.keyPrefix)); ok {
+				mu.Lock()
+				names = append(names, name)
+				mu.Unlock()
+			}
+		}
+		return iter.Err()
+	}
+	ctx, finish := s.opContext(ctx, redisReadOp)
+	err := finish(s.retry.do(ctx, func() error {
+		names = nil
+		return redisError(opScan, "failed to list carts", forEachRedisNode(ctx, s.client, scan))
+	}))
+	return names, err
+}
+
+// IdleCarts walks the keyspace with SCAN, on every master or shard,
+// decoding each cart. Keys under the prefix that aren't carts, such
+// as idempotency keys and audit streams, are skipped.
+func (s *redisCartStore) IdleCarts(ctx context.Context, from, to time.Time) ([]idleCart, error) {
+	var (
+		mu    sync.Mutex
+		carts []idleCart
+	)
+	match := redisGlobEscaper.Replace(s.keyPrefix) + "*"
+	scan := func(ctx context.Context, rdb redis.Cmdable) error {
+		iter := rdb.Scan(ctx, 0, match, 100).Iterator()
+		for iter.Next(ctx) {
+			if isRedisAuxKey(strings.TrimPrefix(iter.Val(), s.keyPrefix)) {
+				continue
+			}
+			val, err := rdb.Get(ctx, iter.Val()).Result()
+			// WRONGTYPE is some other data sharing the prefix, not a cart.
+			if err == redis.Nil || redis.HasErrorPrefix(err, "WRONGTYPE") {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			data, err := decompressCart([]byte(val))
+			if err != nil {
+				continue
+			}
+			cart, _, err := unmarshalCart(data)
+			if err != nil || len(cart.Items) == 0 || !changedBetween(cart.UpdatedAt, from, to) {
+				continue
+			}
+			mu.Lock()
+			carts = append(carts, idleCart{
+				key:       strings.TrimPrefix(iter.Val(), s.keyPrefix),
+				cart:      cart,
+				updatedAt: time.Unix(cart.UpdatedAt, 0),
+			})
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+	err := s.retry.do(ctx, func() error {
+		carts = nil
+		return redisError(opScan, "failed to scan for idle carts", forEachRedisNode(ctx, s.client, scan))
+	})
+	return carts, err
+}
+
+// ListCartKeys pages through the carts with SCAN, whose cursor is the page
+// token. As with SCAN, pages may be short or empty before the last one, and
+// a cart may appear on more than one page. Redis Cluster and sharded Redis
+// keep a cursor per server, so listing isn't supported there.
+func (s *redisCartStore) ListCartKeys(ctx context.Context, pageToken string, pageSize int) ([]string, string, error) {
+	if s.cluster {
+		return nil, "", status.Error(codes.Unimplemented, "listing carts isn't supported on Redis Cluster or sharded Redis")
+	}
+	var cursor uint64
+	if pageToken != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(pageToken, 10, 64); err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "invalid page_token %q", pageToken)
+		}
+	}
+	var found []string
+	ctx, finish := s.opContext(ctx, redisReadOp)
+	err := finish(s.retry.do(ctx, func() (err error) {
+		found, cursor, err = s.client.Scan(ctx, cursor, redisGlobEscaper.Replace(s.keyPrefix)+"*", int64(pageSize)).Result()
+		return redisError(opScan, "failed to list carts", err)
+	}))
+	if err != nil {
+		return nil, "", err
+	}
+	keys := make([]string, 0, len(found))
+	for _, key := range found {
+		key = strings.TrimPrefix(key, s.keyPrefix)
+		if !isRedisAuxKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	next := ""
+	if cursor != 0 {
+		next = strconv.FormatUint(cursor, 10)
+	}
+	return keys, next, nil
+}
+
+// redisGlobEscaper quotes the characters SCAN MATCH treats as wildcards.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (s *redisCartStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisCartStore) Close() error {
+	if s.replica != nil {
+		s.replica.client.Close()
+	}
+	return s.client.Close()
+}
+
+// updateCart applies fn to the user's cart as an atomic read-modify-write.
+// The key is WATCHed while it is read, so if another client commits a change
+// before our MULTI/EXEC the transaction fails and is retried against the new
+// state.
+func (s *redisCartStore) updateCart(ctx context.Context, userID string, fn func([]cartItem) []cartItem) error {
+	return s.updateStoredCart(ctx, userID, func(cart *storedCart) error {
+		cart.Items = fn(cart.Items)
+		return nil
+	})
+}
+
+// updateStoredCart is updateCart for changes beyond the items, or that can
+// fail: an error from fn leaves the cart untouched and is returned as is.
+func (s *redisCartStore) updateStoredCart(ctx context.Context, userID string, fn func(*storedCart) error) error {
+	txf := func(tx *redis.Tx) error {
+		cart, found, err := s.loadCart(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if err := checkCartVersion(ctx, cart.Version); err != nil {
+			return err
+		}
+		version := cart.Version
+		if err := fn(&cart); err != nil {
+			return err
+		}
+		// fn may build a new cart, but the version carries on.
+		cart.Version = version
+		if !found {
+			s.noteCartCreated(ctx, userID)
+		}
+		err = execTx(ctx, tx, func(pipe redis.Pipeliner) error {
+			return s.saveCart(ctx, pipe, userID, cart)
+		})
+		return err
+	}
+
+	return s.runTx(ctx, txf, userID)
+}
+
+// MergeCarts reads both carts under WATCH and writes the merged cart and
+// deletes the source in one MULTI/EXEC, so a concurrent change to either
+// cart makes the merge retry instead of losing items.
+func (s *redisCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	log.Infof("MergeCarts called: from=%s, to=%s", fromUserID, toUserID)
+	if fromUserID == toUserID {
+		return nil
+	}
+	ctx, finish := s.opContext(ctx, redisWriteOp)
+	if s.cluster {
+		return finish(s.retry.do(ctx, func() error {
+			return s.mergeCartsCluster(ctx, fromUserID, toUserID)
+		}))
+	}
+
+	txf := func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, s.key(fromUserID)).Result()
+		if err != nil {
+			return redisError(opExists, "failed to check cart", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		from, err := s.getCart(ctx, tx, fromUserID)
+		if err != nil {
+			return err
+		}
+		to, err := s.getCart(ctx, tx, toUserID)
+		if err != nil {
+			return err
+		}
+		to.Items = mergeCartItems(to.Items, from.Items)
+		to.Saved = mergeCartItems(to.Saved, from.Saved)
+		if to.Currency == "" {
+			to.Currency = from.Currency
+		}
+		err = execTx(ctx, tx, func(pipe redis.Pipeliner) error {
+			if len(from.Items) > 0 || len(from.Saved) > 0 {
+				if err := s.saveCart(ctx, pipe, toUserID, to); err != nil {
+					return err
+				}
+			}
+			return pipe.Del(ctx, s.key(fromUserID)).Err()
+		})
+		return err
+	}
+	return finish(s.retry.do(ctx, func() error {
+		return s.runTx(ctx, txf, fromUserID, toUserID)
+	}))
+}
+
+// execTx runs fn's commands in MULTI/EXEC on tx. A transient error from
+// it may come after Redis applied the transaction, so it is returned as
+// Unknown instead, which neither redisRetryPolicy.do nor clients retry: a
+// retried AddItem would add the item a second time.
+func execTx(ctx context.Context, tx *redis.Tx, fn func(redis.Pipeliner) error) error {
+	_, err := tx.TxPipelined(ctx, fn)
+	if isTransientRedisError(err) {
+		redisErrors.WithLabelValues(opExec).Inc()
+		return status.Errorf(codes.Unknown, "cart write may or may not have been applied: %v", err)
+	}
+	return err
+}
+
+// runTx runs txf with the carts of userIDs WATCHed, retrying when another
+// client commits a change to one of them first. After maxCartTxAttempts lost
+// races it gives up with Aborted.
+func (s *redisCartStore) runTx(ctx context.Context, txf func(*redis.Tx) error, userIDs ...string) error {
+	keys := s.keys(userIDs)
+	for attempt := 1; attempt <= maxCartTxAttempts; attempt++ {
+		err := s.client.Watch(ctx, txf, keys...)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, redis.TxFailedErr) {
+			if _, ok := status.FromError(err); ok {
+				return err
+			}
+			return redisError(opWatch, "failed to save cart", err)
+		}
+		log.Debugf("carts %v changed concurrently, retrying (attempt %d/%d)", keys, attempt, maxCartTxAttempts)
+	}
+	return status.Errorf(codes.Aborted, "carts %v were modified concurrently, giving up after %d attempts", keys, maxCartTxAttempts)
+}
+
+func (s *redisCartStore) getCart(ctx context.Context, rdb redis.Cmdable, userID string) (storedCart, error) {
+	cart, _, err := s.loadCart(ctx, rdb, userID)
+	return cart, err
+}
+
+// loadCart is getCart that also reports whether the key existed, so writers
+// can tell a cart being created from one being changed.
+func (s *redisCartStore) loadCart(ctx context.Context, rdb redis.Cmdable, userID string) (storedCart, bool, error) {
+	cart, codec, err := s.readCart(ctx, rdb, userID)
+	return cart, codec != nil, err
+}
+
+// readCart is loadCart that reports the codec the cart was stored with, or
+// nil if there is no cart.
+func (s *redisCartStore) readCart(ctx context.Context, rdb redis.Cmdable, userID string) (storedCart, cartCodec, error) {
+	val, err := rdb.Get(ctx, s.key(userID)).Result()
+	if err == redis.Nil {
+		return storedCart{Items: []cartItem{}}, nil, nil
+	}
+	if err != nil {
+		return storedCart{}, nil, redisError(opGet, "failed to get cart", err)
+	}
+	return decodeCart(val)
+}
+
+// noteCartCreated marks the current span when a write finds no cart. With
+// CART_TTL set the cart may have existed and expired, which Redis doesn't
+// let us tell apart from a brand new one, so that case is also logged.
+func (s *redisCartStore) noteCartCreated(ctx context.Context, userID string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cart.created", true))
+	if s.ttl > 0 {
+		log.Infof("Creating cart for user %s: it is new or expired after CART_TTL=%v", userID, s.ttl)
+	}
+}
+
+// decodeCart reads a stored cart, compressed or not, in any format a
+// cartCodec writes, and reports which codec wrote it.
+func decodeCart(val string) (storedCart, cartCodec, error) {
+	data, err := decompressCart([]byte(val))
+	if err != nil {
+		storeSerializationErrors.WithLabelValues(opUnmarshal, backendRedis).Inc()
+		return storedCart{}, nil, status.Errorf(codes.Internal, "failed to decompress cart: %v", err)
+	}
+
+	cart, codec, err := unmarshalCart(data)
+	if err != nil {
+		storeSerializationErrors.WithLabelValues(opUnmarshal, backendRedis).Inc()
+		return storedCart{}, nil, status.Errorf(codes.Internal, "failed to unmarshal cart: %v", err)
+	}
+
+	return cart, codec, nil
+}
+
+// saveCart stamps the cart as changed now, moves it on a version and writes
+// it with rdb using s.codec. When rdb is a transaction pipeline the SET is
+// only queued, so its error surfaces from EXEC rather than here.
+func (s *redisCartStore) saveCart(ctx context.Context, rdb redis.Cmdable, userID string, cart storedCart) error {
+	cart.UpdatedAt = time.Now().Unix()
+	cart.Version++
+	return s.writeCart(ctx, rdb, userID, cart)
+}
+
+// writeCart is saveCart keeping the cart's UpdatedAt and Version.
+func (s *redisCartStore) writeCart(ctx context.Context, rdb redis.Cmdable, userID string, cart storedCart) error {
+	data, err := s.codec.marshal(cart)
+	if err != nil {
+		storeSerializationErrors.WithLabelValues(opMarshal, backendRedis).Inc()
+		return status.Errorf(codes.Internal, "failed to marshal cart: %v", err)
+	}
+	if s.compress && len(data) > cartCompressionThreshold {
+		if data, err = compressCart(data); err != nil {
+			storeSerializationErrors.WithLabelValues(opMarshal, backendRedis).Inc()
+			return status.Errorf(codes.Internal, "failed to compress cart: %v", err)
+		}
+	}
+
+	// SET without KEEPTTL resets the expiration, so every save gives the
+	// cart a fresh TTL instead of inheriting the time left on the old key.
+	if err := rdb.Set(ctx, s.key(userID), data, s.ttl).Err(); err != nil {
+		return redisError(opSet, "failed to save cart", err)
+	}
+
+	return nil
+}
+
+// redisError counts a failed Redis command and maps its error to Internal.
+// Transient errors are returned unwrapped so redisRetryPolicy.do can recognise and
+// retry them.
+func redisError(op, msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	redisErrors.WithLabelValues(op).Inc()
+	if isTransientRedisError(err) {
+		return err
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
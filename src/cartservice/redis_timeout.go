@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRedisReadTimeout  = 2 * time.Second
+	defaultRedisWriteTimeout = 5 * time.Second
+)
+
+// Operation kinds, each with its own timeout.
+const (
+	redisReadOp  = "read"
+	redisWriteOp = "write"
+)
+
+// redisTimeouts counts store operations cut short by their timeout.
+var redisTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Subsystem: "store",
+	Name:      "redis_timeouts_total",
+	Help:      "Number of Redis store operations that ran past their timeout, by kind.",
+}, []string{"kind"})
+
+func init() {
+	metricsRegistry.MustRegister(redisTimeouts)
+}
+
+// redisOpTimeouts caps how long a store operation, retries included, may
+// spend on Redis. Zero leaves that kind of operation bounded only by the
+// caller's context.
+type redisOpTimeouts struct {
+	read, write time.Duration
+}
+
+// redisOpTimeoutsFromEnv reads REDIS_READ_TIMEOUT and REDIS_WRITE_TIMEOUT.
+func redisOpTimeoutsFromEnv() redisOpTimeouts {
+	return redisOpTimeouts{
+		read:  redisOpTimeoutFromEnv("REDIS_READ_TIMEOUT", defaultRedisReadTimeout),
+		write: redisOpTimeoutFromEnv("REDIS_WRITE_TIMEOUT", defaultRedisWriteTimeout),
+	}
+}
+
+func redisOpTimeoutFromEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid %s %q, using %v", key, v, def)
+		return def
+	}
+	return d
+}
+
+// opContext bounds ctx by the timeout for kind. The returned func releases
+// the context and must be given the operation's error: if the operation ran
+// out of time while the caller was still waiting, the error becomes
+// DeadlineExceeded and the span in ctx is marked.
+func (s *redisCartStore) opContext(ctx context.Context, kind string) (context.Context, func(error) error) {
+	timeout := s.timeouts.write
+	if kind == redisReadOp {
+		timeout = s.timeouts.read
+	}
+	if timeout <= 0 {
+		return ctx, func(err error) error { return err }
+	}
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	return opCtx, func(err error) error {
+		defer cancel()
+		if err == nil || ctx.Err() != nil || !errors.Is(opCtx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+		redisTimeouts.WithLabelValues(kind).Inc()
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.Bool("redis.timeout", true))
+		span.AddEvent("redis.timeout", trace.WithAttributes(
+			attribute.String("kind", kind),
+			attribute.Int64("timeout_ms", timeout.Milliseconds()),
+			attribute.String("error", err.Error()),
+		))
+		return status.Errorf(codes.DeadlineExceeded, "redis %s timed out after %v: %v", kind, timeout, err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newStuckRedisStore returns a store whose Redis accepts connections but
+// never answers, as a hung server would.
+func newStuckRedisStore(t *testing.T, timeouts redisOpTimeouts) *redisCartStore {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		lis.Close()
+		for {
+			select {
+			case conn := <-conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	opts, err := redisOptions(lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave the socket timeouts well past the operation timeouts, so only
+	// the latter can end a call.
+	opts.ReadTimeout = time.Minute
+	opts.WriteTimeout = time.Minute
+	client := redis.NewClient(opts)
+	t.Cleanup(func() { client.Close() })
+	return &redisCartStore{
+		client:   client,
+		codec:    cartCodecFromEnv(),
+		retry:    redisRetryPolicy{maxAttempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond},
+		timeouts: timeouts,
+	}
+}
+
+func TestRedisOperationTimeouts(t *testing.T) {
+	store := newStuckRedisStore(t, redisOpTimeouts{read: 50 * time.Millisecond, write: 100 * time.Millisecond})
+
+	tests := []struct {
+		name string
+		kind string
+		max  time.Duration
+		op   func(ctx context.Context) error
+	}{
+		{"GetCart", redisReadOp, 50 * time.Millisecond, func(ctx context.Context) error {
+			_, err := store.GetCart(ctx, "user-1")
+			return err
+		}},
+		{"CartExists", redisReadOp, 50 * time.Millisecond, func(ctx context.Context) error {
+			_, err := store.CartExists(ctx, "user-1")
+			return err
+		}},
+		{"AddItem", redisWriteOp, 100 * time.Millisecond, func(ctx context.Context) error {
+			return store.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil)
+		}},
+		{"LockCurrency", redisWriteOp, 100 * time.Millisecond, func(ctx context.Context) error {
+			_, err := store.LockCurrency(ctx, "user-1", "EUR")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		recorder := tracetest.NewSpanRecorder()
+		tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+		before := testutil.ToFloat64(redisTimeouts.WithLabelValues(tt.kind))
+
+		ctx, span := tracer.Start(context.Background(), tt.name)
+		start := time.Now()
+		err := tt.op(ctx)
+		elapsed := time.Since(start)
+		span.End()
+
+		if got := status.Code(err); got != codes.DeadlineExceeded {
+			t.Errorf("%s: got %v, want DeadlineExceeded", tt.name, err)
+		}
+		// Generous slack: the point is that the call doesn't hang.
+		if elapsed > tt.max+time.Second {
+			t.Errorf("%s: took %v, want about %v", tt.name, elapsed, tt.max)
+		}
+		if got := testutil.ToFloat64(redisTimeouts.WithLabelValues(tt.kind)); got != before+1 {
+			t.Errorf("%s: got %v %s timeouts, want %v", tt.name, got, tt.kind, before+1)
+		}
+		timedOut := false
+		for _, kv := range recorder.Ended()[0].Attributes() {
+			if kv.Key == "redis.timeout" {
+				timedOut = kv.Value.AsBool()
+			}
+		}
+		if !timedOut {
+			t.Errorf("%s: span not marked redis.timeout", tt.name)
+		}
+	}
+}
+
+func TestRedisOperationTimeoutCallerDeadline(t *testing.T) {
+	store := newStuckRedisStore(t, redisOpTimeouts{read: time.Minute, write: time.Minute})
+	before := testutil.ToFloat64(redisTimeouts.WithLabelValues(redisReadOp))
+
+	// The caller giving up first is not the store's timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := store.GetCart(ctx, "user-1"); err == nil {
+		t.Fatal("GetCart against a stuck Redis succeeded")
+	}
+	if got := testutil.ToFloat64(redisTimeouts.WithLabelValues(redisReadOp)); got != before {
+		t.Errorf("got %v read timeouts, want %v", got, before)
+	}
+}
+
+func TestRedisOpTimeoutsFromEnv(t *testing.T) {
+	tests := []struct {
+		read, write string
+		want        redisOpTimeouts
+	}{
+		{"", "", redisOpTimeouts{read: defaultRedisReadTimeout, write: defaultRedisWriteTimeout}},
+		{"500ms", "1s", redisOpTimeouts{read: 500 * time.Millisecond, write: time.Second}},
+		{"0", "0", redisOpTimeouts{}},
+		{"-1s", "soon", redisOpTimeouts{read: defaultRedisReadTimeout, write: defaultRedisWriteTimeout}},
+	}
+	for _, tt := range tests {
+		t.Setenv("REDIS_READ_TIMEOUT", tt.read)
+		t.Setenv("REDIS_WRITE_TIMEOUT", tt.write)
+		if got := redisOpTimeoutsFromEnv(); got != tt.want {
+			t.Errorf("%q, %q: got %+v, want %+v", tt.read, tt.write, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTLSFromEnv returns the TLS config when REDIS_TLS is true, and nil
+// otherwise. An empty serverName is filled in from each node's address.
+func redisTLSFromEnv(serverName string) (*tls.Config, error) {
+	on := false
+	if v := os.Getenv("REDIS_TLS"); v != "" {
+		var err error
+		if on, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid REDIS_TLS %q", v)
+		}
+	}
+	if !on {
+		if name := redisTLSFileVar(); name != "" {
+			return nil, fmt.Errorf("%s is set but TLS is off: set REDIS_TLS=true or use a rediss:// URL", name)
+		}
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+	if err := loadRedisTLSFiles(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// redisTLSFileVar returns the name of the first TLS file variable that is
+// set, or "" if none is.
+func redisTLSFileVar() string {
+	for _, name := range []string{"REDIS_TLS_CA_FILE", "REDIS_TLS_CERT_FILE", "REDIS_TLS_KEY_FILE"} {
+		if os.Getenv(name) != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// loadRedisTLSFiles adds to cfg the CA bundle in REDIS_TLS_CA_FILE, for
+// servers whose certificate isn't signed by a system root, and the client
+// certificate in REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE, for servers
+// that require mutual TLS.
+func loadRedisTLSFiles(cfg *tls.Config) error {
+	if path := os.Getenv("REDIS_TLS_CA_FILE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read REDIS_TLS_CA_FILE: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("REDIS_TLS_CA_FILE %s holds no PEM certificates", path)
+		}
+		cfg.RootCAs = roots
+	}
+
+	certFile, keyFile := os.Getenv("REDIS_TLS_CERT_FILE"), os.Getenv("REDIS_TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load Redis client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// redisTLSEnabled reports whether client connects over TLS.
+func redisTLSEnabled(client redis.UniversalClient) bool {
+	switch c := client.(type) {
+	case *redis.Client:
+		return c.Options().TLSConfig != nil
+	case *redis.ClusterClient:
+		return c.Options().TLSConfig != nil
+	case *redis.Ring:
+		return c.Options().TLSConfig != nil
+	}
+	return false
+}
+
+// explainRedisConnectError adds a hint naming the setting most likely at
+// fault to errors that are otherwise hard to act on from the logs.
+func explainRedisConnectError(err error, tlsOn bool) error {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalidCert      x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+	)
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "WRONGPASS"), strings.Contains(msg, "NOAUTH"), strings.Contains(msg, "invalid password"):
+		return fmt.Errorf("%v (authentication failed: check REDIS_USERNAME and REDIS_PASSWORD)", err)
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("%v (the server certificate is not trusted: set REDIS_TLS_CA_FILE to its CA)", err)
+	case errors.As(err, &hostname):
+		return fmt.Errorf("%v (the server certificate does not match the Redis host name)", err)
+	case errors.As(err, &invalidCert):
+		return fmt.Errorf("%v (the server certificate is invalid or expired)", err)
+	case errors.As(err, &recordHeader):
+		return fmt.Errorf("%v (the server did not answer with TLS: check that it has TLS enabled)", err)
+	case !tlsOn && (errors.Is(err, io.EOF) || strings.Contains(msg, "connection reset")):
+		return fmt.Errorf("%v (the server closed the connection: if it requires TLS, set REDIS_TLS=true)", err)
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestTLSServerConfig returns a server TLS config for 127.0.0.1 signed by
+// a throwaway CA, and the path of that CA's PEM file.
+func newTestTLSServerConfig(t *testing.T) (*tls.Config, string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "redis"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, caFile
+}
+
+func TestRedisTLSFromEnv(t *testing.T) {
+	_, caFile := newTestTLSServerConfig(t)
+	junk := filepath.Join(t.TempDir(), "junk.pem")
+	if err := os.WriteFile(junk, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantTLS bool
+		wantCA  bool
+		wantErr string
+	}{
+		{name: "off"},
+		{name: "on", env: map[string]string{"REDIS_TLS": "true"}, wantTLS: true},
+		{name: "custom CA", env: map[string]string{"REDIS_TLS": "true", "REDIS_TLS_CA_FILE": caFile}, wantTLS: true, wantCA: true},
+		{name: "CA without TLS", env: map[string]string{"REDIS_TLS_CA_FILE": caFile}, wantErr: "TLS is off"},
+		{name: "missing CA file", env: map[string]string{"REDIS_TLS": "true", "REDIS_TLS_CA_FILE": filepath.Join(t.TempDir(), "nope.pem")}, wantErr: "REDIS_TLS_CA_FILE"},
+		{name: "CA file without certificates", env: map[string]string{"REDIS_TLS": "true", "REDIS_TLS_CA_FILE": junk}, wantErr: "no PEM certificates"},
+		{name: "client cert without key", env: map[string]string{"REDIS_TLS": "true", "REDIS_TLS_CERT_FILE": caFile}, wantErr: "must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"REDIS_TLS", "REDIS_TLS_CA_FILE", "REDIS_TLS_CERT_FILE", "REDIS_TLS_KEY_FILE"} {
+				t.Setenv(k, tt.env[k])
+			}
+			cfg, err := redisTLSFromEnv("")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg != nil; got != tt.wantTLS {
+				t.Fatalf("got TLS %v, want %v", got, tt.wantTLS)
+			}
+			if got := cfg != nil && cfg.RootCAs != nil; got != tt.wantCA {
+				t.Errorf("got custom CA %v, want %v", got, tt.wantCA)
+			}
+		})
+	}
+}
+
+func TestRedisConnectErrors(t *testing.T) {
+	t.Setenv("REDIS_CONNECT_RETRIES", "0")
+	serverTLS, caFile := newTestTLSServerConfig(t)
+	tlsServer, err := miniredis.RunTLS(serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsServer.Close()
+	authServer := miniredis.RunT(t)
+	authServer.RequireAuth("s3cret")
+
+	tests := []struct {
+		name     string
+		addr     string
+		env      map[string]string
+		wantHint string // "" means the connection must succeed
+	}{
+		{"untrusted certificate", tlsServer.Addr(), map[string]string{"REDIS_TLS": "true"}, "REDIS_TLS_CA_FILE"},
+		{"trusted with custom CA", tlsServer.Addr(), map[string]string{"REDIS_TLS": "true", "REDIS_TLS_CA_FILE": caFile}, ""},
+		{"wrong password", authServer.Addr(), map[string]string{"REDIS_PASSWORD": "wrong"}, "REDIS_PASSWORD"},
+		{"right password", authServer.Addr(), map[string]string{"REDIS_PASSWORD": "s3cret"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"REDIS_TLS", "REDIS_TLS_CA_FILE", "REDIS_PASSWORD"} {
+				t.Setenv(k, tt.env[k])
+			}
+			store, err := newRedisCartStore(tt.addr)
+			if tt.wantHint == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				store.Close()
+				return
+			}
+			if err == nil {
+				store.Close()
+				t.Fatal("connected, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantHint) {
+				t.Errorf("got error %q, want a hint mentioning %s", err, tt.wantHint)
+			}
+		})
+	}
+}
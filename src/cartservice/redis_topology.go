@@ -0,0 +1,284 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisModeStandalone = "standalone"
+	redisModeSentinel   = "sentinel"
+	redisModeCluster    = "cluster"
+	redisModeSharded    = "sharded"
+)
+
+// redisModeFromEnv reads REDIS_MODE, the Redis topology to connect to.
+// Unset means a single standalone server.
+func redisModeFromEnv() (string, error) {
+	switch v := strings.ToLower(os.Getenv("REDIS_MODE")); v {
+	case "", redisModeStandalone:
+		return redisModeStandalone, nil
+	case redisModeSentinel, redisModeCluster, redisModeSharded:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid REDIS_MODE %q: want %s, %s, %s or %s", v, redisModeStandalone, redisModeSentinel, redisModeCluster, redisModeSharded)
+	}
+}
+
+// redisConfigured reports whether the environment asks for a Redis store.
+// Sentinel mode finds its servers through REDIS_SENTINEL_ADDRS, so it does
+// not need REDIS_ADDR.
+func redisConfigured(addr string) bool {
+	return addr != "" || (strings.ToLower(os.Getenv("REDIS_MODE")) == redisModeSentinel && os.Getenv("REDIS_SENTINEL_ADDRS") != "")
+}
+
+// newRedisClient builds the client for REDIS_MODE:
+//
+//   - standalone: addr is one server, see redisOptions.
+//   - sentinel: the master named REDIS_MASTER_NAME is found through the
+//     comma-separated REDIS_SENTINEL_ADDRS, and followed across failovers.
+//     REDIS_SENTINEL_PASSWORD authenticates to the sentinels themselves.
+//   - cluster: addr is a comma-separated list of seed nodes.
+//   - sharded: addr is a comma-separated list of independent servers, and
+//     carts are spread across them by consistent hashing of their keys.
+//
+// Sentinel, cluster and sharded take credentials and TLS from
+// REDIS_USERNAME, REDIS_PASSWORD and REDIS_TLS. It also returns a description of the
+// target that is safe to log.
+func newRedisClient(addr string) (redis.UniversalClient, string, error) {
+	mode, err := redisModeFromEnv()
+	if err != nil {
+		return nil, "", err
+	}
+	switch mode {
+	case redisModeSentinel:
+		opts, err := redisFailoverOptions()
+		if err != nil {
+			return nil, "", err
+		}
+		return redis.NewFailoverClient(opts),
+			fmt.Sprintf("master %s via sentinels %s", opts.MasterName, strings.Join(opts.SentinelAddrs, ",")), nil
+	case redisModeCluster:
+		opts, err := redisClusterOptions(addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return redis.NewClusterClient(opts), "cluster " + strings.Join(opts.Addrs, ","), nil
+	case redisModeSharded:
+		opts, err := redisRingOptions(addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return redis.NewRing(opts), "shards " + strings.Join(splitAddrs(addr), ","), nil
+	default:
+		opts, err := redisOptions(addr)
+		if err != nil {
+			return nil, "", err
+		}
+		// Only the host is logged: a URL may carry the password.
+		return redis.NewClient(opts), opts.Addr, nil
+	}
+}
+
+func redisFailoverOptions() (*redis.FailoverOptions, error) {
+	opts := &redis.FailoverOptions{
+		MasterName:            os.Getenv("REDIS_MASTER_NAME"),
+		SentinelAddrs:         splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS")),
+		SentinelPassword:      os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		Username:              os.Getenv("REDIS_USERNAME"),
+		Password:              os.Getenv("REDIS_PASSWORD"),
+		ContextTimeoutEnabled: true,
+	}
+	if opts.MasterName == "" {
+		return nil, errors.New("REDIS_MODE=sentinel requires REDIS_MASTER_NAME")
+	}
+	if len(opts.SentinelAddrs) == 0 {
+		return nil, errors.New("REDIS_MODE=sentinel requires REDIS_SENTINEL_ADDRS")
+	}
+	if v := os.Getenv("REDIS_DB"); v != "" {
+		db, err := strconv.Atoi(v)
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid REDIS_DB %q", v)
+		}
+		opts.DB = db
+	}
+	var err error
+	opts.TLSConfig, err = redisTLSFromEnv("")
+	return opts, err
+}
+
+func redisClusterOptions(addr string) (*redis.ClusterOptions, error) {
+	opts := &redis.ClusterOptions{
+		Addrs:                 splitAddrs(addr),
+		Username:              os.Getenv("REDIS_USERNAME"),
+		Password:              os.Getenv("REDIS_PASSWORD"),
+		ContextTimeoutEnabled: true,
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("REDIS_MODE=cluster requires REDIS_ADDR to list at least one node")
+	}
+	if v := os.Getenv("REDIS_DB"); v != "" && v != "0" {
+		return nil, fmt.Errorf("REDIS_DB %q is not supported with REDIS_MODE=cluster", v)
+	}
+	var err error
+	opts.TLSConfig, err = redisTLSFromEnv("")
+	return opts, err
+}
+
+// redisRingOptions shards carts across the servers listed in addr. Each
+// server's address is also its shard name, so reordering the list or adding
+// to it moves no more carts than it has to.
+//
+// The ring stops sending carts to a shard that fails its heartbeats and
+// hashes them onto the remaining shards until it recovers. Carts written
+// meanwhile land on another shard, and those on the recovered shard show
+// again once it is back.
+func redisRingOptions(addr string) (*redis.RingOptions, error) {
+	opts := &redis.RingOptions{
+		Addrs:                 make(map[string]string),
+		NewClient:             newRedisShardClient,
+		Username:              os.Getenv("REDIS_USERNAME"),
+		Password:              os.Getenv("REDIS_PASSWORD"),
+		ContextTimeoutEnabled: true,
+	}
+	for _, a := range splitAddrs(addr) {
+		opts.Addrs[a] = a
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("REDIS_MODE=sharded requires REDIS_ADDR to list at least one server")
+	}
+	if v := os.Getenv("REDIS_DB"); v != "" {
+		db, err := strconv.Atoi(v)
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid REDIS_DB %q", v)
+		}
+		opts.DB = db
+	}
+	var err error
+	opts.TLSConfig, err = redisTLSFromEnv("")
+	return opts, err
+}
+
+// forEachRedisNode calls fn with every server holding carts: each master
+// under Redis Cluster, each live shard when sharded, and otherwise client
+// itself. Commands such as SCAN only see the server they are sent to.
+func forEachRedisNode(ctx context.Context, client redis.UniversalClient, fn func(context.Context, redis.Cmdable) error) error {
+	switch c := client.(type) {
+	case *redis.ClusterClient:
+		return c.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return fn(ctx, master)
+		})
+	case *redis.Ring:
+		return c.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+			return fn(ctx, shard)
+		})
+	default:
+		return fn(ctx, client)
+	}
+}
+
+// splitAddrs splits a comma-separated address list, dropping blanks.
+func splitAddrs(v string) []string {
+	var addrs []string
+	for _, a := range strings.Split(v, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// clusterMGet reads keys like MGET, whose keys must all share a hash slot
+// under Redis Cluster, or a shard when sharded. It pipelines one GET per key
+// instead, which the client routes to each key's node. Missing keys read as
+// nil.
+func clusterMGet(ctx context.Context, client redis.UniversalClient, keys []string) ([]interface{}, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	vals := make([]interface{}, len(keys))
+	for i, cmd := range cmds {
+		if val, err := cmd.Result(); err == nil {
+			vals[i] = val
+		}
+	}
+	return vals, nil
+}
+
+// mergeCartsCluster is MergeCarts for Redis Cluster and sharded Redis,
+// where the two carts usually hash to different slots or shards and can't
+// be WATCHed in one transaction.
+// The source cart is taken with GETDEL, then merged into the destination
+// under WATCH. Should the merge fail, the source is written back so its items
+// are not lost.
+func (s *redisCartStore) mergeCartsCluster(ctx context.Context, fromUserID, toUserID string) error {
+	val, err := s.client.GetDel(ctx, s.key(fromUserID)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return redisError(opGet, "failed to take source cart", err)
+	}
+	restore := func(cause error) error {
+		// The merge may have failed because ctx ran out, which mustn't
+		// stop the source cart from being put back.
+		if err := s.client.Set(context.WithoutCancel(ctx), s.key(fromUserID), val, s.ttl).Err(); err != nil {
+			log.Errorf("MergeCarts failed and cart %s could not be restored: %v", fromUserID, err)
+		}
+		return cause
+	}
+	from, _, err := decodeCart(val)
+	if err != nil {
+		return restore(err)
+	}
+
+	txf := func(tx *redis.Tx) error {
+		to, err := s.getCart(ctx, tx, toUserID)
+		if err != nil {
+			return err
+		}
+		to.Items = mergeCartItems(to.Items, from.Items)
+		to.Saved = mergeCartItems(to.Saved, from.Saved)
+		if to.Currency == "" {
+			to.Currency = from.Currency
+		}
+		if len(from.Items) == 0 && len(from.Saved) == 0 {
+			return nil
+		}
+		err = execTx(ctx, tx, func(pipe redis.Pipeliner) error {
+			return s.saveCart(ctx, pipe, toUserID, to)
+		})
+		return err
+	}
+	if err := s.runTx(ctx, txf, toUserID); err != nil {
+		return restore(err)
+	}
+	return nil
+}
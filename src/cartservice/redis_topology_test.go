@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestNewRedisClientModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr       string
+		env        map[string]string
+		wantTarget string
+		wantErr    bool
+	}{
+		{name: "standalone by default", addr: "redis-cart:6379", wantTarget: "redis-cart:6379"},
+		{
+			name:       "sentinel",
+			env:        map[string]string{"REDIS_MODE": "sentinel", "REDIS_MASTER_NAME": "mymaster", "REDIS_SENTINEL_ADDRS": "s1:26379, s2:26379"},
+			wantTarget: "master mymaster via sentinels s1:26379,s2:26379",
+		},
+		{
+			name:       "cluster",
+			addr:       "node1:6379,node2:6379",
+			env:        map[string]string{"REDIS_MODE": "Cluster"},
+			wantTarget: "cluster node1:6379,node2:6379",
+		},
+		{
+			name:       "sharded",
+			addr:       "shard1:6379, shard2:6379",
+			env:        map[string]string{"REDIS_MODE": "sharded"},
+			wantTarget: "shards shard1:6379,shard2:6379",
+		},
+		{name: "sharded without servers", addr: " , ", env: map[string]string{"REDIS_MODE": "sharded"}, wantErr: true},
+		{name: "unknown mode", addr: "redis-cart:6379", env: map[string]string{"REDIS_MODE": "ring"}, wantErr: true},
+		{name: "sentinel without master", env: map[string]string{"REDIS_MODE": "sentinel", "REDIS_SENTINEL_ADDRS": "s1:26379"}, wantErr: true},
+		{name: "sentinel without sentinels", env: map[string]string{"REDIS_MODE": "sentinel", "REDIS_MASTER_NAME": "mymaster"}, wantErr: true},
+		{name: "cluster without nodes", env: map[string]string{"REDIS_MODE": "cluster"}, wantErr: true},
+		{name: "cluster with a database", addr: "node1:6379", env: map[string]string{"REDIS_MODE": "cluster", "REDIS_DB": "2"}, wantErr: true},
+		{name: "cluster with bad REDIS_TLS", addr: "node1:6379", env: map[string]string{"REDIS_MODE": "cluster", "REDIS_TLS": "maybe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"REDIS_MODE", "REDIS_MASTER_NAME", "REDIS_SENTINEL_ADDRS", "REDIS_DB", "REDIS_TLS"} {
+				t.Setenv(k, tt.env[k])
+			}
+			client, target, err := newRedisClient(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			if target != tt.wantTarget {
+				t.Errorf("got target %q, want %q", target, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestRedisConfigured(t *testing.T) {
+	tests := []struct {
+		addr      string
+		mode      string
+		sentinels string
+		want      bool
+	}{
+		{"", "", "", false},
+		{"redis-cart:6379", "", "", true},
+		{"", "sentinel", "s1:26379", true},
+		{"", "sentinel", "", false},
+		{"", "cluster", "", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("REDIS_MODE", tt.mode)
+		t.Setenv("REDIS_SENTINEL_ADDRS", tt.sentinels)
+		if got := redisConfigured(tt.addr); got != tt.want {
+			t.Errorf("redisConfigured(%q) with REDIS_MODE=%q REDIS_SENTINEL_ADDRS=%q = %v, want %v", tt.addr, tt.mode, tt.sentinels, got, tt.want)
+		}
+	}
+}
+
+// miniredis answers CLUSTER SLOTS as a single node owning every slot, which
+// is enough to drive the cluster client's code paths.
+func TestRedisClusterStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_MODE", "cluster")
+	store, err := newRedisCartStore(mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if !store.cluster {
+		t.Fatal("store is not in cluster mode")
+	}
+
+	ctx := context.Background()
+	if err := store.AddItem(ctx, "guest", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddItem(ctx, "member", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	carts, err := store.GetCarts(ctx, []string{"guest", "nobody", "member"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(carts) != 3 || len(carts[0].Items) != 1 || len(carts[1].Items) != 0 || len(carts[2].Items) != 1 {
+		t.Fatalf("got carts %v", carts)
+	}
+
+	if err := store.MergeCarts(ctx, "guest", "member"); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := store.GetCart(ctx, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 3 {
+		t.Errorf("got merged cart %v, want OLJCESPC7Z x3", cart.Items)
+	}
+	if exists, _ := store.CartExists(ctx, "guest"); exists {
+		t.Error("source cart still exists after merge")
+	}
+	if err := store.MergeCarts(ctx, "guest", "member"); err != nil {
+		t.Errorf("merging a missing cart: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// reflectionFromEnv parses ENABLE_REFLECTION. Unset, reflection is on
+// unless DEPLOYMENT_ENV is one of PRODUCTION_ENVS, so grpcurl works against
+// development deployments without the .proto files.
+func reflectionFromEnv() bool {
+	return boolEnvOr("ENABLE_REFLECTION", !isProductionEnv(os.Getenv("DEPLOYMENT_ENV"), productionEnvsFromEnv()))
+}
+
+// channelzFromEnv parses ENABLE_CHANNELZ, which registers the channelz
+// service for inspecting connections and call counts with grpcurl or
+// grpcdebug. It is off unless asked for, as in the other services.
+func channelzFromEnv() bool {
+	return boolEnvOr("ENABLE_CHANNELZ", false)
+}
+
+// boolEnvOr parses the boolean variable key, returning defaultOn when it is
+// unset or invalid.
+func boolEnvOr(key string, defaultOn bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultOn
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid %s %q", key, v)
+		return defaultOn
+	}
+	return on
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	channelz "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestReflectionFromEnv(t *testing.T) {
+	tests := []struct {
+		deploymentEnv string
+		enable        string
+		want          bool
+	}{
+		{"", "", true},
+		{"staging", "", true},
+		{"production", "", false},
+		{"production", "true", true},
+		{"staging", "false", false},
+		{"staging", "sometimes", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("DEPLOYMENT_ENV", tt.deploymentEnv)
+		t.Setenv("ENABLE_REFLECTION", tt.enable)
+		if got := reflectionFromEnv(); got != tt.want {
+			t.Errorf("DEPLOYMENT_ENV=%q ENABLE_REFLECTION=%q: got %v, want %v", tt.deploymentEnv, tt.enable, got, tt.want)
+		}
+	}
+}
+
+func TestReflectionListsServices(t *testing.T) {
+	srv := grpc.NewServer()
+	store := newMemoryCartStore()
+	pb.RegisterCartServiceServer(srv, &cartServer{store: store})
+	grpc_health_v1.RegisterHealthServer(srv, newHealthServer(store))
+	reflection.Register(srv)
+
+	stream, err := reflectionpb.NewServerReflectionClient(newTestGRPCConn(t, srv)).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		names = append(names, s.GetName())
+	}
+	for _, want := range []string{"hipstershop.CartService", "grpc.health.v1.Health"} {
+		if !slices.Contains(names, want) {
+			t.Errorf("reflection lists %v, missing %s", names, want)
+		}
+	}
+}
+
+func TestChannelzFromEnv(t *testing.T) {
+	tests := []struct {
+		deploymentEnv string
+		enable        string
+		want          bool
+	}{
+		{"", "", false},
+		{"production", "", false},
+		{"production", "1", true},
+		{"", "yes", false},
+		{"staging", "false", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("DEPLOYMENT_ENV", tt.deploymentEnv)
+		t.Setenv("ENABLE_CHANNELZ", tt.enable)
+		if got := channelzFromEnv(); got != tt.want {
+			t.Errorf("DEPLOYMENT_ENV=%q ENABLE_CHANNELZ=%q: got %v, want %v", tt.deploymentEnv, tt.enable, got, tt.want)
+		}
+	}
+}
+
+func TestChannelzListsServer(t *testing.T) {
+	srv := grpc.NewServer()
+	channelz.RegisterChannelzServiceToServer(srv)
+
+	resp, err := channelzpb.NewChannelzClient(newTestGRPCConn(t, srv)).GetServers(context.Background(), &channelzpb.GetServersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetServer()) == 0 {
+		t.Error("channelz reports no servers")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// moveCartLine takes productID's line out of from and adds it to to, summing
+// with a line to already holds. ok is false if from has no such line.
+func moveCartLine(from, to []cartItem, productID string) (newFrom, newTo []cartItem, ok bool) {
+	for i, item := range from {
+		if item.ProductID == productID {
+			from = append(from[:i], from[i+1:]...)
+			return from, mergeCartLine(to, item), true
+		}
+	}
+	return from, to, false
+}
+
+// saveCartItemForLater moves productID from the cart's items to its saved
+// list.
+func saveCartItemForLater(cart *storedCart, productID string) error {
+	var ok bool
+	if cart.Items, cart.Saved, ok = moveCartLine(cart.Items, cart.Saved, productID); !ok {
+		return status.Errorf(codes.NotFound, "product %s is not in the cart", productID)
+	}
+	return nil
+}
+
+// moveSavedItemToCart moves productID from the cart's saved list back to
+// its items.
+func moveSavedItemToCart(cart *storedCart, productID string) error {
+	var ok bool
+	if cart.Saved, cart.Items, ok = moveCartLine(cart.Saved, cart.Items, productID); !ok {
+		return status.Errorf(codes.NotFound, "product %s is not saved for later", productID)
+	}
+	return nil
+}
+
+func (s *cartServer) SaveForLater(ctx context.Context, req *pb.SaveForLaterRequest) (*pb.Empty, error) {
+	if req.UserId == "" || req.ProductId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id and product_id are required")
+	}
+	err := s.audited(ctx, "SaveForLater", []string{req.UserId}, func() error {
+		return s.store.SaveForLater(withExpectedVersion(ctx, req.ExpectedVersion), req.UserId, req.ProductId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *cartServer) MoveToCart(ctx context.Context, req *pb.MoveToCartRequest) (*pb.Empty, error) {
+	if req.UserId == "" || req.ProductId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id and product_id are required")
+	}
+	if s.maxItemQuantity > 0 || s.maxCartItems > 0 {
+		saved, err := s.store.GetSavedItems(ctx, req.UserId)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range saved {
+			if item.GetProductId() != req.ProductId {
+				continue
+			}
+			if err := s.checkCartLimits(ctx, req.UserId, req.ProductId, item.GetQuantity()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	err := s.audited(ctx, "MoveToCart", []string{req.UserId}, func() error {
+		return s.store.MoveToCart(withExpectedVersion(ctx, req.ExpectedVersion), req.UserId, req.ProductId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *cartServer) GetSavedItems(ctx context.Context, req *pb.GetSavedItemsRequest) (*pb.GetSavedItemsResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	items, err := s.store.GetSavedItems(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetSavedItemsResponse{Items: items}, nil
+}
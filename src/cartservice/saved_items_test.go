@@ -0,0 +1,159 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func quantities(items []*pb.CartItem) map[string]int32 {
+	got := make(map[string]int32)
+	for _, item := range items {
+		got[item.GetProductId()] = item.GetQuantity()
+	}
+	return got
+}
+
+func sameQuantities(got, want map[string]int32) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for id, q := range want {
+		if got[id] != q {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSaveForLater(t *testing.T) {
+	type call struct {
+		save      bool  // SaveForLater, else MoveToCart
+		add       int32 // units of productID added to the cart first
+		productID string
+		wantCode  codes.Code
+	}
+	tests := []struct {
+		name      string
+		calls     []call
+		wantCart  map[string]int32
+		wantSaved map[string]int32
+	}{
+		{"save", []call{{true, 0, "OLJCESPC7Z", codes.OK}},
+			map[string]int32{"66VCHSJNUP": 1}, map[string]int32{"OLJCESPC7Z": 3}},
+		{"save and move back", []call{{true, 0, "OLJCESPC7Z", codes.OK}, {false, 0, "OLJCESPC7Z", codes.OK}},
+			map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}, map[string]int32{}},
+		{"save product not in cart", []call{{true, 0, "1YMWWN1N4O", codes.NotFound}},
+			map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}, map[string]int32{}},
+		{"move product not saved", []call{{false, 0, "OLJCESPC7Z", codes.NotFound}},
+			map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}, map[string]int32{}},
+		{"move back over cap", []call{{true, 0, "OLJCESPC7Z", codes.OK}, {false, 8, "OLJCESPC7Z", codes.ResourceExhausted}},
+			map[string]int32{"66VCHSJNUP": 1, "OLJCESPC7Z": 8}, map[string]int32{"OLJCESPC7Z": 3}},
+		{"missing product ID", []call{{true, 0, "", codes.InvalidArgument}},
+			map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}, map[string]int32{}},
+	}
+	for storeName, newStore := range testCartStores() {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				s := &cartServer{store: newStore(t), maxItemQuantity: 10}
+				for _, item := range []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 3}, {ProductId: "66VCHSJNUP", Quantity: 1}} {
+					if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: item}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				for i, c := range tt.calls {
+					if c.add > 0 {
+						if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: c.productID, Quantity: c.add}}); err != nil {
+							t.Fatal(err)
+						}
+					}
+					var err error
+					if c.save {
+						_, err = s.SaveForLater(ctx, &pb.SaveForLaterRequest{UserId: "user-1", ProductId: c.productID})
+					} else {
+						_, err = s.MoveToCart(ctx, &pb.MoveToCartRequest{UserId: "user-1", ProductId: c.productID})
+					}
+					if got := status.Code(err); got != c.wantCode {
+						t.Fatalf("call %d: got %s, want %s", i, got, c.wantCode)
+					}
+				}
+
+				cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := quantities(cart.Items); !sameQuantities(got, tt.wantCart) {
+					t.Errorf("got cart %v, want %v", got, tt.wantCart)
+				}
+				saved, err := s.GetSavedItems(ctx, &pb.GetSavedItemsRequest{UserId: "user-1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := quantities(saved.Items); !sameQuantities(got, tt.wantSaved) {
+					t.Errorf("got saved %v, want %v", got, tt.wantSaved)
+				}
+			})
+		}
+	}
+}
+
+func TestSavedItemsSurviveEmptyAndMerge(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			for _, user := range []string{"guest", "member"} {
+				if err := store.AddItem(ctx, user, "OLJCESPC7Z", 2, nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.SaveForLater(ctx, user, "OLJCESPC7Z"); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.AddItem(ctx, user, "66VCHSJNUP", 1, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := store.EmptyCart(ctx, "member"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.MergeCarts(ctx, "guest", "member"); err != nil {
+				t.Fatal(err)
+			}
+			cart, err := store.GetCart(ctx, "member")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := quantities(cart.Items), map[string]int32{"66VCHSJNUP": 1}; !sameQuantities(got, want) {
+				t.Errorf("got cart %v, want %v", got, want)
+			}
+			saved, err := store.GetSavedItems(ctx, "member")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := quantities(saved), map[string]int32{"OLJCESPC7Z": 4}; !sameQuantities(got, want) {
+				t.Errorf("got saved %v, want %v", got, want)
+			}
+		})
+	}
+}
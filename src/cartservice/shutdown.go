@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// defaultShutdownGracePeriod bounds how long in-flight RPCs may take to
+// finish once the process has been asked to stop. It leaves room within
+// Kubernetes' default 30s termination grace period for flushing traces and
+// closing the store afterwards.
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// shutdownGracePeriodFromEnv reads SHUTDOWN_GRACE_PERIOD, falling back to
+// defaultShutdownGracePeriod.
+func shutdownGracePeriodFromEnv() time.Duration {
+	v := os.Getenv("SHUTDOWN_GRACE_PERIOD")
+	if v == "" {
+		return defaultShutdownGracePeriod
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("Ignoring invalid SHUTDOWN_GRACE_PERIOD %q, using %v", v, defaultShutdownGracePeriod)
+		return defaultShutdownGracePeriod
+	}
+	return d
+}
+
+// serveUntilDone serves srv on lis until ctx is cancelled, then stops
+// accepting new RPCs and waits up to timeout for in-flight ones before
+// cutting them off. It never blocks for much longer than timeout after ctx
+// is done.
+func serveUntilDone(ctx context.Context, srv *grpc.Server, lis net.Listener, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(lis) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("Shutting down, waiting up to %v for in-flight RPCs", timeout)
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return <-errc
+	case <-time.After(timeout):
+		log.Warn("In-flight RPCs did not finish in time, forcing shutdown")
+		// Stop can itself block behind GracefulStop while a handler ignores
+		// cancellation, so don't wait for it; the process is about to exit.
+		go srv.Stop()
+		return nil
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// slowStore is a memory store whose GetCart blocks until release is closed.
+type slowStore struct {
+	*memoryCartStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	close(s.started)
+	<-s.release
+	return s.memoryCartStore.GetCart(ctx, userID)
+}
+
+func TestServeUntilDone(t *testing.T) {
+	tests := []struct {
+		name     string
+		release  time.Duration // how long the in-flight call takes after shutdown starts
+		finishes bool          // whether the call must complete successfully
+	}{
+		{"in-flight call finishes", 50 * time.Millisecond, true},
+		{"call exceeding timeout is abandoned", time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &slowStore{
+				memoryCartStore: newMemoryCartStore(),
+				started:         make(chan struct{}),
+				release:         make(chan struct{}),
+			}
+			releaseStore := sync.OnceFunc(func() { close(store.release) })
+			defer releaseStore()
+			srv := grpc.NewServer()
+			pb.RegisterCartServiceServer(srv, &cartServer{store: store})
+			lis := bufconn.Listen(1 << 20)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() { served <- serveUntilDone(ctx, srv, lis, 200*time.Millisecond) }()
+
+			conn, err := grpc.NewClient("passthrough:///bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return lis.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			callErr := make(chan error, 1)
+			go func() {
+				_, err := pb.NewCartServiceClient(conn).GetCart(context.Background(), &pb.GetCartRequest{UserId: "u1"})
+				callErr <- err
+			}()
+			<-store.started
+
+			// Stands in for SIGTERM, which cancels the context in main.
+			cancel()
+			time.AfterFunc(tt.release, releaseStore)
+
+			select {
+			case err := <-served:
+				if err != nil {
+					t.Fatalf("serveUntilDone: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("serveUntilDone did not return after the shutdown timeout")
+			}
+			if tt.finishes {
+				if err := <-callErr; err != nil {
+					t.Errorf("in-flight call failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownGracePeriodFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultShutdownGracePeriod},
+		{"25s", 25 * time.Second},
+		{"0s", defaultShutdownGracePeriod},
+		{"-5s", defaultShutdownGracePeriod},
+		{"soon", defaultShutdownGracePeriod},
+	}
+	for _, tt := range tests {
+		t.Setenv("SHUTDOWN_GRACE_PERIOD", tt.env)
+		if got := shutdownGracePeriodFromEnv(); got != tt.want {
+			t.Errorf("SHUTDOWN_GRACE_PERIOD=%q: got %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,625 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	databaseadmin "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/admin/database/apiv1/databasepb"
+	instanceadmin "cloud.google.com/go/spanner/admin/instance/apiv1"
+	"cloud.google.com/go/spanner/admin/instance/apiv1/instancepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// spannerSchema creates the cart tables. Apply it to a new database with
+// gcloud spanner databases ddl update; against the emulator the store
+// applies it itself.
+var spannerSchema = []string{
+	`CREATE TABLE Carts (
+		UserId       STRING(MAX) NOT NULL,
+		CurrencyCode STRING(MAX) NOT NULL,
+		Version      INT64 NOT NULL,
+		UpdatedAt    TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp = true),
+	) PRIMARY KEY (UserId)`,
+	`CREATE INDEX CartsByUpdatedAt ON Carts (UpdatedAt)`,
+	`CREATE TABLE CartItems (
+		UserId            STRING(MAX) NOT NULL,
+		ProductId         STRING(MAX) NOT NULL,
+		Position          INT64 NOT NULL,
+		Quantity          INT64 NOT NULL,
+		PriceCurrencyCode STRING(MAX),
+		PriceUnits        INT64,
+		PriceNanos        INT64,
+		AddedAt           TIMESTAMP,
+		Source            STRING(MAX) NOT NULL,
+	) PRIMARY KEY (UserId, ProductId),
+		INTERLEAVE IN PARENT Carts ON DELETE CASCADE`,
+	`CREATE TABLE SavedItems (
+		UserId            STRING(MAX) NOT NULL,
+		ProductId         STRING(MAX) NOT NULL,
+		Position          INT64 NOT NULL,
+		Quantity          INT64 NOT NULL,
+		PriceCurrencyCode STRING(MAX),
+		PriceUnits        INT64,
+		PriceNanos        INT64,
+		AddedAt           TIMESTAMP,
+		Source            STRING(MAX) NOT NULL,
+	) PRIMARY KEY (UserId, ProductId),
+		INTERLEAVE IN PARENT Carts ON DELETE CASCADE`,
+}
+
+var (
+	spannerCartColumns = []string{"UserId", "CurrencyCode", "Version", "UpdatedAt"}
+	spannerLineColumns = []string{"UserId", "ProductId", "Position", "Quantity", "PriceCurrencyCode", "PriceUnits", "PriceNanos", "AddedAt", "Source"}
+
+	spannerDatabaseRE = regexp.MustCompile(`^projects/([^/]+)/instances/([^/]+)/databases/([^/]+)$`)
+)
+
+// spannerConnectTimeout bounds the startup check that the database is
+// reachable, which the client would otherwise retry indefinitely.
+var spannerConnectTimeout = 10 * time.Second
+
+// errCartUnchanged ends a read-write transaction whose callback chose not
+// to write. The callback's own error is returned instead, as the client
+// would retry one with code Aborted, such as a failed version check.
+var errCartUnchanged = errors.New("cart left unchanged")
+
+// spannerCartStore keeps carts in Cloud Spanner: one Carts row per user,
+// which survives EmptyCart so CartExists stays true, with the cart's lines
+// and saved lines in CartItems and SavedItems rows interleaved under it.
+// Writes read the cart and buffer its new rows as mutations in one
+// read-write transaction, which Spanner retries when it conflicts with
+// another.
+type spannerCartStore struct {
+	client *spanner.Client
+}
+
+// newSpannerCartStore connects to database, the full
+// projects/P/instances/I/databases/D name. With SPANNER_EMULATOR_HOST set,
+// the client talks to the emulator instead, and the instance, database and
+// tables are created first if missing.
+func newSpannerCartStore(ctx context.Context, database string) (*spannerCartStore, error) {
+	if database == "" {
+		return nil, errors.New("CART_STORE=spanner requires SPANNER_DATABASE")
+	}
+	if !spannerDatabaseRE.MatchString(database) {
+		return nil, fmt.Errorf("invalid SPANNER_DATABASE %q, want projects/P/instances/I/databases/D", database)
+	}
+	ctx, cancel := context.WithTimeout(ctx, spannerConnectTimeout)
+	defer cancel()
+	if os.Getenv("SPANNER_EMULATOR_HOST") != "" {
+		if err := createSpannerEmulatorDatabase(ctx, database); err != nil {
+			return nil, err
+		}
+	}
+	client, err := spanner.NewClient(ctx, database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Spanner client: %v", err)
+	}
+	store := &spannerCartStore{client: client}
+	if err := store.Ping(ctx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Spanner database %s: %v", database, err)
+	}
+	log.Infof("Connected to Spanner database %s", database)
+	return store, nil
+}
+
+// createSpannerEmulatorDatabase creates database, its instance and the cart
+// tables on the emulator, which starts out empty. Ones that already exist
+// are left alone.
+func createSpannerEmulatorDatabase(ctx context.Context, database string) error {
+	m := spannerDatabaseRE.FindStringSubmatch(database)
+	project := "projects/" + m[1]
+	instance := project + "/instances/" + m[2]
+
+	instances, err := instanceadmin.NewInstanceAdminClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create Spanner instance admin client: %v", err)
+	}
+	defer instances.Close()
+	createInstance, err := instances.CreateInstance(ctx, &instancepb.CreateInstanceRequest{
+		Parent:     project,
+		InstanceId: m[2],
+		Instance: &instancepb.Instance{
+			Config:      project + "/instanceConfigs/emulator-config",
+			DisplayName: m[2],
+			NodeCount:   1,
+		},
+	})
+	if err == nil {
+		_, err = createInstance.Wait(ctx)
+	}
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("failed to create Spanner instance %s: %v", instance, err)
+	}
+
+	databases, err := databaseadmin.NewDatabaseAdminClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create Spanner database admin client: %v", err)
+	}
+	defer databases.Close()
+	createDatabase, err := databases.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
+		Parent:          instance,
+		CreateStatement: "CREATE DATABASE `" + m[3] + "`",
+		ExtraStatements: spannerSchema,
+	})
+	if err == nil {
+		_, err = createDatabase.Wait(ctx)
+	}
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("failed to create Spanner database %s: %v", database, err)
+	}
+	return nil
+}
+
+// spannerError maps a failed Spanner call to a gRPC status, keeping its
+// code.
+func spannerError(msg string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Errorf(spanner.ErrCode(err), "%s: %v", msg, err)
+}
+
+// spannerReader is what loadSpannerCarts needs of a transaction.
+type spannerReader interface {
+	Read(ctx context.Context, table string, keys spanner.KeySet, columns []string) *spanner.RowIterator
+}
+
+// spannerLine is a cart line with its position in the cart, as rows come
+// back in product order.
+type spannerLine struct {
+	position int64
+	item     cartItem
+}
+
+// loadSpannerCarts reads the carts of userIDs, keyed by user. Users without
+// a cart are left out.
+func loadSpannerCarts(ctx context.Context, r spannerReader, userIDs []string) (map[string]storedCart, error) {
+	carts := make(map[string]storedCart, len(userIDs))
+	if len(userIDs) == 0 {
+		return carts, nil
+	}
+	keys := make([]spanner.KeySet, len(userIDs))
+	prefixes := make([]spanner.KeySet, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = spanner.Key{userID}
+		prefixes[i] = spanner.Key{userID}.AsPrefix()
+	}
+
+	err := r.Read(ctx, "Carts", spanner.KeySets(keys...), spannerCartColumns).Do(func(row *spanner.Row) error {
+		var userID, currency string
+		var version int64
+		var updatedAt time.Time
+		if err := row.Columns(&userID, &currency, &version, &updatedAt); err != nil {
+			return err
+		}
+		carts[userID] = storedCart{Currency: currency, Items: []cartItem{}, UpdatedAt: updatedAt.Unix(), Version: version}
+		return nil
+	})
+	if err != nil {
+		return nil, spannerError("failed to get carts", err)
+	}
+
+	for _, table := range []string{"CartItems", "SavedItems"} {
+		lines := make(map[string][]spannerLine)
+		err := r.Read(ctx, table, spanner.KeySets(prefixes...), spannerLineColumns).Do(func(row *spanner.Row) error {
+			var userID string
+			line, err := scanSpannerLine(row, &userID)
+			if err != nil {
+				return err
+			}
+			lines[userID] = append(lines[userID], line)
+			return nil
+		})
+		if err != nil {
+			return nil, spannerError("failed to get cart items", err)
+		}
+		for userID, userLines := range lines {
+			cart, ok := carts[userID]
+			if !ok {
+				continue
+			}
+			slices.SortFunc(userLines, func(a, b spannerLine) int { return cmp.Compare(a.position, b.position) })
+			items := make([]cartItem, len(userLines))
+			for i, line := range userLines {
+				items[i] = line.item
+			}
+			if table == "CartItems" {
+				cart.Items = items
+			} else {
+				cart.Saved = items
+			}
+			carts[userID] = cart
+		}
+	}
+	return carts, nil
+}
+
+// scanSpannerLine reads a row of spannerLineColumns, storing the user ID in
+// userID.
+func scanSpannerLine(row *spanner.Row, userID *string) (spannerLine, error) {
+	var (
+		line         spannerLine
+		quantity     int64
+		currency     spanner.NullString
+		units, nanos spanner.NullInt64
+		addedAt      spanner.NullTime
+	)
+	if err := row.Columns(userID, &line.item.ProductID, &line.position, &quantity, &currency, &units, &nanos, &addedAt, &line.item.Source); err != nil {
+		return spannerLine{}, err
+	}
+	line.item.Quantity = int32(quantity)
+	if currency.Valid && units.Valid && nanos.Valid {
+		line.item.PriceSnapshot = &priceSnapshot{CurrencyCode: currency.StringVal, Units: units.Int64, Nanos: int32(nanos.Int64)}
+	}
+	if addedAt.Valid {
+		line.item.AddedAt = addedAt.Time.Unix()
+	}
+	return line, nil
+}
+
+// spannerCartMutations writes cart as the user's cart at version, replacing
+// the lines stored before. UpdatedAt becomes the commit time.
+func spannerCartMutations(userID string, cart storedCart, version int64) []*spanner.Mutation {
+	ms := []*spanner.Mutation{
+		spanner.InsertOrUpdate("Carts", spannerCartColumns, []interface{}{userID, cart.Currency, version, spanner.CommitTimestamp}),
+		spanner.Delete("CartItems", spanner.Key{userID}.AsPrefix()),
+		spanner.Delete("SavedItems", spanner.Key{userID}.AsPrefix()),
+	}
+	ms = appendSpannerLines(ms, "CartItems", userID, cart.Items)
+	return appendSpannerLines(ms, "SavedItems", userID, cart.Saved)
+}
+
+// appendSpannerLines appends inserts of items into table, numbered in
+// order.
+func appendSpannerLines(ms []*spanner.Mutation, table, userID string, items []cartItem) []*spanner.Mutation {
+	for i, item := range items {
+		var currency spanner.NullString
+		var units, nanos spanner.NullInt64
+		if p := item.PriceSnapshot; p != nil {
+			currency = spanner.NullString{StringVal: p.CurrencyCode, Valid: true}
+			units = spanner.NullInt64{Int64: p.Units, Valid: true}
+			nanos = spanner.NullInt64{Int64: int64(p.Nanos), Valid: true}
+		}
+		var addedAt spanner.NullTime
+		if item.AddedAt != 0 {
+			addedAt = spanner.NullTime{Time: time.Unix(item.AddedAt, 0), Valid: true}
+		}
+		ms = append(ms, spanner.Insert(table, spannerLineColumns, []interface{}{
+			userID, item.ProductID, int64(i), int64(item.Quantity), currency, units, nanos, addedAt, item.Source,
+		}))
+	}
+	return ms
+}
+
+// spannerDeleteCart deletes the user's cart and its lines. Spanner cascades
+// the delete to the interleaved rows; they are listed anyway so the
+// mutations don't depend on the schema.
+func spannerDeleteCart(userID string) []*spanner.Mutation {
+	return []*spanner.Mutation{
+		spanner.Delete("CartItems", spanner.Key{userID}.AsPrefix()),
+		spanner.Delete("SavedItems", spanner.Key{userID}.AsPrefix()),
+		spanner.Delete("Carts", spanner.Key{userID}),
+	}
+}
+
+// updateCart applies fn to the user's cart and writes the result back, one
+// version on, in a read-write transaction. An error from fn leaves the cart
+// untouched and is returned as is.
+func (s *spannerCartStore) updateCart(ctx context.Context, userID string, fn func(*storedCart) error) error {
+	var fnErr error
+	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, tx *spanner.ReadWriteTransaction) error {
+		fnErr = nil
+		carts, err := loadSpannerCarts(ctx, tx, []string{userID})
+		if err != nil {
+			return err
+		}
+		cart, ok := carts[userID]
+		if !ok {
+			cart = storedCart{Items: []cartItem{}}
+		}
+		if fnErr = checkCartVersion(ctx, cart.Version); fnErr != nil {
+			return errCartUnchanged
+		}
+		version := cart.Version
+		if fnErr = fn(&cart); fnErr != nil {
+			return errCartUnchanged
+		}
+		return tx.BufferWrite(spannerCartMutations(userID, cart, version+1))
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return spannerError("failed to save cart", err)
+}
+
+// getCart reads the user's cart in a read-only transaction, so its lines
+// match the Carts row.
+func (s *spannerCartStore) getCart(ctx context.Context, userID string) (storedCart, error) {
+	carts, err := s.loadCarts(ctx, []string{userID})
+	if err != nil {
+		return storedCart{}, err
+	}
+	cart, ok := carts[userID]
+	if !ok {
+		cart = storedCart{Items: []cartItem{}}
+	}
+	return cart, nil
+}
+
+func (s *spannerCartStore) loadCarts(ctx context.Context, userIDs []string) (map[string]storedCart, error) {
+	tx := s.client.ReadOnlyTransaction()
+	defer tx.Close()
+	return loadSpannerCarts(ctx, tx, userIDs)
+}
+
+func (s *spannerCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	log.Infof("AddItem called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		cart.Items = addCartItem(cart.Items, productID, quantity, price)
+		return nil
+	})
+}
+
+func (s *spannerCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	log.Infof("AddItems called: userID=%s, items=%d", userID, len(items))
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		cart.Items = addCartItems(cart.Items, items)
+		return nil
+	})
+}
+
+func (s *spannerCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	log.Infof("UpdateItemQuantity called: userID=%s, productID=%s, quantity=%d", userID, productID, quantity)
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		cart.Items = setCartItemQuantity(cart.Items, productID, quantity)
+		return nil
+	})
+}
+
+func (s *spannerCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	log.Infof("GetCart called: userID=%s", userID)
+
+	cart, err := s.getCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return cartToProto(userID, cart), nil
+}
+
+func (s *spannerCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	log.Infof("GetCarts called: %d users", len(userIDs))
+
+	found, err := s.loadCarts(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	carts := make([]*pb.Cart, len(userIDs))
+	for i, userID := range userIDs {
+		cart, ok := found[userID]
+		if !ok {
+			cart = storedCart{Items: []cartItem{}}
+		}
+		carts[i] = cartToProto(userID, cart)
+	}
+	return carts, nil
+}
+
+func (s *spannerCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	_, err := s.client.Single().ReadRow(ctx, "Carts", spanner.Key{userID}, []string{"UserId"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return false, nil
+	}
+	return err == nil, spannerError("failed to check cart", err)
+}
+
+// MergeCarts reads both carts and writes the merged one in a single
+// transaction, so an item added to the source cart meanwhile makes Spanner
+// retry the merge rather than lose it.
+func (s *spannerCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	log.Infof("MergeCarts called: from=%s, to=%s", fromUserID, toUserID)
+	if fromUserID == toUserID {
+		return nil
+	}
+
+	_, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, tx *spanner.ReadWriteTransaction) error {
+		carts, err := loadSpannerCarts(ctx, tx, []string{fromUserID, toUserID})
+		if err != nil {
+			return err
+		}
+		from, ok := carts[fromUserID]
+		if !ok {
+			return nil
+		}
+		ms := spannerDeleteCart(fromUserID)
+		if len(from.Items) > 0 || len(from.Saved) > 0 {
+			to, ok := carts[toUserID]
+			if !ok {
+				to = storedCart{Items: []cartItem{}}
+			}
+			to.Items = mergeCartItems(to.Items, from.Items)
+			to.Saved = mergeCartItems(to.Saved, from.Saved)
+			if to.Currency == "" {
+				to.Currency = from.Currency
+			}
+			ms = append(ms, spannerCartMutations(toUserID, to, to.Version+1)...)
+		}
+		return tx.BufferWrite(ms)
+	})
+	return spannerError("failed to merge carts", err)
+}
+
+func (s *spannerCartStore) EmptyCart(ctx context.Context, userID string) error {
+	log.Infof("EmptyCart called: userID=%s", userID)
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		*cart = storedCart{Items: []cartItem{}, Saved: cart.Saved}
+		return nil
+	})
+}
+
+func (s *spannerCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	var locked string
+	err := s.updateCart(ctx, userID, func(cart *storedCart) error {
+		if cart.Currency == "" {
+			cart.Currency = currency
+		}
+		locked = cart.Currency
+		return nil
+	})
+	return locked, err
+}
+
+func (s *spannerCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	return s.getCart(ctx, userID)
+}
+
+func (s *spannerCartStore) ImportCart(ctx context.Context, userID string, imported storedCart) error {
+	log.Infof("ImportCart called: userID=%s", userID)
+
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		*cart = importedCart(*cart, imported)
+		return nil
+	})
+}
+
+func (s *spannerCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	log.Infof("SaveForLater called: userID=%s, productID=%s", userID, productID)
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		return saveCartItemForLater(cart, productID)
+	})
+}
+
+func (s *spannerCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	log.Infof("MoveToCart called: userID=%s, productID=%s", userID, productID)
+	return s.updateCart(ctx, userID, func(cart *storedCart) error {
+		return moveSavedItemToCart(cart, productID)
+	})
+}
+
+func (s *spannerCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	cart, err := s.getCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return cartItemsToProto(cart.Saved), nil
+}
+
+// ListCartNames reads the keys from "userID:" up to "userID;", ';' being
+// the character after ':'.
+func (s *spannerCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	keys := spanner.KeyRange{Start: spanner.Key{userID + ":"}, End: spanner.Key{userID + ";"}, Kind: spanner.ClosedOpen}
+	var names []string
+	err := s.client.Single().Read(ctx, "Carts", keys, []string{"UserId"}).Do(func(row *spanner.Row) error {
+		var key string
+		if err := row.Columns(&key); err != nil {
+			return err
+		}
+		if name, ok := cartNameFromKey(userID, key); ok {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, spannerError("failed to list carts", err)
+}
+
+// ListCartKeys pages through the carts in key order. The page token is the
+// last key of the previous page.
+func (s *spannerCartStore) ListCartKeys(ctx context.Context, pageToken string, pageSize int) ([]string, string, error) {
+	after := spanner.KeyRange{Start: spanner.Key{pageToken}, End: spanner.Key{}, Kind: spanner.OpenClosed}
+	var keys []string
+	err := s.client.Single().ReadWithOptions(ctx, "Carts", after, []string{"UserId"}, &spanner.ReadOptions{Limit: pageSize + 1}).Do(func(row *spanner.Row) error {
+		var key string
+		if err := row.Columns(&key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, "", spannerError("failed to list carts", err)
+	}
+	if len(keys) <= pageSize {
+		return keys, "", nil
+	}
+	return keys[:pageSize], keys[pageSize-1], nil
+}
+
+func (s *spannerCartStore) Ping(ctx context.Context) error {
+	err := s.client.Single().Query(ctx, spanner.NewStatement(`SELECT 1`)).Do(func(*spanner.Row) error { return nil })
+	return spannerError("failed to ping Spanner", err)
+}
+
+func (s *spannerCartStore) IdleCarts(ctx context.Context, from, to time.Time) ([]idleCart, error) {
+	stmt := spanner.Statement{
+		SQL:    `SELECT UserId, UpdatedAt FROM Carts WHERE UpdatedAt >= @from AND UpdatedAt < @to`,
+		Params: map[string]interface{}{"from": from, "to": to},
+	}
+	updated := make(map[string]time.Time)
+	var userIDs []string
+	err := s.client.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var userID string
+		var updatedAt time.Time
+		if err := row.Columns(&userID, &updatedAt); err != nil {
+			return err
+		}
+		updated[userID] = updatedAt
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+	if err != nil {
+		return nil, spannerError("failed to find idle carts", err)
+	}
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	found, err := s.loadCarts(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var carts []idleCart
+	for _, userID := range userIDs {
+		// Skip carts emptied since the first query.
+		if cart, ok := found[userID]; ok && len(cart.Items) > 0 {
+			carts = append(carts, idleCart{key: userID, cart: cart, updatedAt: updated[userID]})
+		}
+	}
+	return carts, nil
+}
+
+func (s *spannerCartStore) Close() error {
+	s.client.Close()
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/spanner"
+	"cloud.google.com/go/spanner/spannertest"
+	"cloud.google.com/go/spanner/spansql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// newTestSpannerStore returns a store backed by an in-process spannertest
+// fake holding spannerSchema. The fake doesn't isolate read-write
+// transactions from each other, so tests of racing writes need
+// newTestSpannerEmulatorStore.
+func newTestSpannerStore(t *testing.T) *spannerCartStore {
+	srv, err := spannertest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	ddl, err := spansql.ParseDDL("spannerSchema", strings.Join(spannerSchema, ";\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.UpdateDDL(ddl); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := spanner.NewClient(context.Background(), "projects/test/instances/test/databases/carts", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return &spannerCartStore{client: client}
+}
+
+// newTestSpannerEmulatorStore connects to the emulator database in
+// CARTSERVICE_TEST_SPANNER_DATABASE, skipping the test when it or
+// SPANNER_EMULATOR_HOST isn't set. Every cart is removed before the test
+// runs.
+func newTestSpannerEmulatorStore(t *testing.T) *spannerCartStore {
+	database := os.Getenv("CARTSERVICE_TEST_SPANNER_DATABASE")
+	if database == "" || os.Getenv("SPANNER_EMULATOR_HOST") == "" {
+		t.Skip("CARTSERVICE_TEST_SPANNER_DATABASE or SPANNER_EMULATOR_HOST not set")
+	}
+	store, err := newSpannerCartStore(context.Background(), database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	_, err = store.client.Apply(context.Background(), []*spanner.Mutation{
+		spanner.Delete("CartItems", spanner.AllKeys()),
+		spanner.Delete("SavedItems", spanner.AllKeys()),
+		spanner.Delete("Carts", spanner.AllKeys()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestNewCartStoreSpannerFallback(t *testing.T) {
+	t.Setenv("CART_STORE", "spanner")
+	tests := []struct {
+		name     string
+		database string
+	}{
+		{"no SPANNER_DATABASE", ""},
+		{"malformed SPANNER_DATABASE", "carts"},
+	}
+	for _, tt := range tests {
+		t.Setenv("SPANNER_DATABASE", tt.database)
+		before := testutil.ToFloat64(storeFallbacks)
+		store := newCartStore("")
+		if fs, ok := store.(*failoverCartStore); !ok || !fs.onFallback() {
+			t.Errorf("%s: got %T, want the in-memory fallback", tt.name, store)
+		}
+		if got := testutil.ToFloat64(storeFallbacks); got != before+1 {
+			t.Errorf("%s: got %v fallbacks, want %v", tt.name, got, before+1)
+		}
+		if got := testutil.ToFloat64(storeMode.WithLabelValues(backendSpanner)); got != 0 {
+			t.Errorf("%s: store mode spanner = %v, want 0", tt.name, got)
+		}
+	}
+}
+
+func TestSpannerStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) *spannerCartStore{
+		"spannertest": newTestSpannerStore,
+		"emulator":    newTestSpannerEmulatorStore,
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+
+			if err := store.AddItem(ctx, "guest", "66VCHSJNUP", 2, &pb.Money{CurrencyCode: "USD", Units: 3, Nanos: 500000000}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddItem(ctx, "guest", "66VCHSJNUP", 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddItems(ctx, "guest", []*pb.CartItem{{ProductId: "1YMWWN1N4O", Quantity: 1, Source: "ad"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.UpdateItemQuantity(ctx, "guest", "1YMWWN1N4O", 4); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := store.LockCurrency(ctx, "guest", "EUR"); err != nil || got != "EUR" {
+				t.Fatalf("LockCurrency = %q, %v; want EUR", got, err)
+			}
+			if err := store.AddItem(ctx, "member", "OLJCESPC7Z", 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddItem(ctx, "member", "66VCHSJNUP", 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.MergeCarts(ctx, "guest", "member"); err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := store.CartExists(ctx, "guest"); err != nil || ok {
+				t.Errorf("guest cart exists = %v, %v after merge; want false", ok, err)
+			}
+			data, err := store.ExportCart(ctx, "member")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Lines come back in the order they were added, not product order.
+			var got []string
+			for _, item := range data.Items {
+				got = append(got, item.ProductID)
+			}
+			if want := []string{"OLJCESPC7Z", "66VCHSJNUP", "1YMWWN1N4O"}; !slices.Equal(got, want) {
+				t.Fatalf("got lines %v, want %v", got, want)
+			}
+			if q := data.Items[1].Quantity; q != 4 {
+				t.Errorf("66VCHSJNUP: got quantity %d, want 4", q)
+			}
+			if p := data.Items[1].PriceSnapshot; p == nil || p.CurrencyCode != "USD" || p.Units != 3 || p.Nanos != 500000000 {
+				t.Errorf("66VCHSJNUP: got price snapshot %+v, want USD 3.5 from the guest cart", p)
+			}
+			if item := data.Items[2]; item.Source != "ad" || item.AddedAt == 0 {
+				t.Errorf("1YMWWN1N4O: got source %q, added at %d; want ad and a time", item.Source, item.AddedAt)
+			}
+			if data.Version == 0 || data.UpdatedAt == 0 {
+				t.Errorf("got version %d, updated at %d; want both set", data.Version, data.UpdatedAt)
+			}
+			if got, err := store.LockCurrency(ctx, "member", "USD"); err != nil || got != "EUR" {
+				t.Errorf("merged cart currency = %q, %v; want EUR", got, err)
+			}
+
+			// A write expecting an older version is refused, not retried.
+			stale := withExpectedVersion(ctx, &data.Version)
+			if err := store.AddItem(stale, "member", "OLJCESPC7Z", 1, nil); status.Code(err) != codes.Aborted {
+				t.Errorf("AddItem at a stale version: got %v, want Aborted", err)
+			}
+
+			if data, err = store.ExportCart(ctx, "member"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.EmptyCart(ctx, "member"); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := store.CartExists(ctx, "member"); err != nil || !ok {
+				t.Errorf("emptied cart exists = %v, %v; want true", ok, err)
+			}
+			if err := store.ImportCart(ctx, "member", data); err != nil {
+				t.Fatal(err)
+			}
+			carts, err := store.GetCarts(ctx, []string{"nobody", "member"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(carts[0].Items) != 0 || len(carts[1].Items) != 3 {
+				t.Errorf("got %d and %d items after import, want 0 and 3", len(carts[0].Items), len(carts[1].Items))
+			}
+
+			if err := store.SaveForLater(ctx, "member", "66VCHSJNUP"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.EmptyCart(ctx, "member"); err != nil {
+				t.Fatal(err)
+			}
+			saved, err := store.GetSavedItems(ctx, "member")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved) != 1 || saved[0].ProductId != "66VCHSJNUP" || saved[0].Quantity != 4 {
+				t.Errorf("got saved items %v after EmptyCart, want 4 of 66VCHSJNUP", saved)
+			}
+			if err := store.MoveToCart(ctx, "member", "1YMWWN1N4O"); status.Code(err) != codes.NotFound {
+				t.Errorf("moving an unsaved product: got %v, want NotFound", err)
+			}
+
+			for _, key := range []string{"member:gifts", "member:work", "member2:gifts"} {
+				if err := store.AddItem(ctx, key, "OLJCESPC7Z", 1, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			names, err := store.ListCartNames(ctx, "member")
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(names)
+			if want := []string{"gifts", "work"}; !slices.Equal(names, want) {
+				t.Errorf("got cart names %v, want %v", names, want)
+			}
+			keys, next, err := store.ListCartKeys(ctx, "", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"member", "member2:gifts"}; !slices.Equal(keys, want) || next != "member2:gifts" {
+				t.Fatalf("first page = %v, %q; want %v and a next page", keys, next, want)
+			}
+			if keys, next, err = store.ListCartKeys(ctx, next, 2); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"member:gifts", "member:work"}; !slices.Equal(keys, want) || next != "" {
+				t.Errorf("last page = %v, %q; want %v and no next page", keys, next, want)
+			}
+		})
+	}
+}
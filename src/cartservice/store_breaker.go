@@ -0,0 +1,461 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const (
+	defaultStoreBreakerFailures = 5
+	defaultStoreBreakerOpenFor  = 30 * time.Second
+)
+
+type breakerState int
+
+// The values are those of the cartservice_store_breaker_state gauge.
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var (
+	storeBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "breaker_state",
+		Help:      "State of the cart store circuit breaker: 0 closed, 1 open, 2 half-open.",
+	})
+	storeBreakerRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "breaker_rejections_total",
+		Help:      "Number of cart store calls failed fast while the circuit breaker was open.",
+	})
+	storeStaleReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "stale_reads_total",
+		Help:      "Number of GetCart calls answered from the last-known-good cache.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(storeBreakerState, storeBreakerRejections, storeStaleReads)
+}
+
+// storeBreakerFailuresFromEnv reads STORE_BREAKER_FAILURES, how many store
+// calls in a row must fail to open the circuit. Zero turns the breaker off.
+func storeBreakerFailuresFromEnv() int {
+	v := os.Getenv("STORE_BREAKER_FAILURES")
+	if v == "" {
+		return defaultStoreBreakerFailures
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("Ignoring invalid STORE_BREAKER_FAILURES %q, using %d", v, defaultStoreBreakerFailures)
+		return defaultStoreBreakerFailures
+	}
+	return n
+}
+
+// storeBreakerOpenForFromEnv reads STORE_BREAKER_OPEN_FOR, how long an open
+// circuit fails calls before letting one through to test the store.
+func storeBreakerOpenForFromEnv() time.Duration {
+	v := os.Getenv("STORE_BREAKER_OPEN_FOR")
+	if v == "" {
+		return defaultStoreBreakerOpenFor
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("Ignoring invalid STORE_BREAKER_OPEN_FOR %q, using %v", v, defaultStoreBreakerOpenFor)
+		return defaultStoreBreakerOpenFor
+	}
+	return d
+}
+
+// storeBreakerCacheSizeFromEnv reads STORE_BREAKER_CACHE_SIZE, how many
+// carts to keep for GetCart to fall back on while the store is failing.
+// Unset or zero turns the cache off.
+func storeBreakerCacheSizeFromEnv() int {
+	v := os.Getenv("STORE_BREAKER_CACHE_SIZE")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Warnf("Ignoring invalid STORE_BREAKER_CACHE_SIZE %q, the last-known-good cache is off", v)
+		return 0
+	}
+	return n
+}
+
+// circuitBreaker opens after a run of failures, failing calls fast until
+// openFor has passed. It then lets a single probe through: success closes
+// the circuit again, failure reopens it.
+type circuitBreaker struct {
+	failures int
+	openFor  time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failed   int // consecutive failures while closed
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(failures int, openFor time.Duration) *circuitBreaker {
+	storeBreakerState.Set(float64(breakerClosed))
+	return &circuitBreaker{failures: failures, openFor: openFor, now: time.Now}
+}
+
+// allow reports whether a call may go to the store. Every allowed call must
+// be followed by record.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.openFor {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record notes how an allowed call went.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == breakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			log.Info("Cart store recovered, closing the circuit")
+			b.failed = 0
+			b.setState(breakerClosed)
+		}
+	case !failed:
+		b.failed = 0
+	case b.state == breakerClosed:
+		if b.failed++; b.failed >= b.failures {
+			log.Warnf("Cart store failed %d calls in a row, opening the circuit for %v", b.failed, b.openFor)
+			b.open()
+		}
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	storeBreakerState.Set(float64(state))
+}
+
+// isStoreFailure reports whether err means the store itself is in trouble,
+// rather than the request being bad or its caller giving up.
+func isStoreFailure(ctx context.Context, err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.DeadlineExceeded:
+		return ctx.Err() == nil
+	default:
+		return false
+	}
+}
+
+// breakerCartStore guards the wrapped store with a circuit breaker. While
+// the circuit is open calls fail with Unavailable without reaching the
+// store, except GetCart, which answers from the last-known-good cache when
+// it has the cart. The cache only holds carts read since their last write
+// through this replica, so it can still be stale if another replica
+// changed them.
+type breakerCartStore struct {
+	cartStore
+	breaker *circuitBreaker
+	cache   *cartCache // nil when off
+}
+
+func newBreakerCartStore(store cartStore, failures int, openFor time.Duration, cacheSize int) *breakerCartStore {
+	log.Infof("Cart store circuit breaker opens after %d failures in a row, for %v", failures, openFor)
+	s := &breakerCartStore{cartStore: store, breaker: newCircuitBreaker(failures, openFor)}
+	if cacheSize > 0 {
+		log.Infof("GetCart falls back on the last %d carts read while the store is failing", cacheSize)
+		s.cache = newCartCache(cacheSize)
+	}
+	return s
+}
+
+var errCircuitOpen = status.Error(codes.Unavailable, "cart store is failing, try again later")
+
+// Metadata for reading a cart from the last-known-good cache. A caller that
+// can show an out-of-date cart, such as a cart page, opts in by sending
+// acceptStaleCartHeader set to true; other callers, checkout among them,
+// get the store's error instead. A cart served from the cache carries
+// staleCartTrailer set to true.
+const (
+	acceptStaleCartHeader = "x-accept-stale-cart"
+	staleCartTrailer      = "x-cart-stale"
+)
+
+// acceptsStaleCart reports whether the caller opted in to cached carts.
+func acceptsStaleCart(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(acceptStaleCartHeader)
+	if len(v) == 0 {
+		return false
+	}
+	ok, _ := strconv.ParseBool(v[0])
+	return ok
+}
+
+func (s *breakerCartStore) call(ctx context.Context, fn func() error) error {
+	if !s.breaker.allow() {
+		storeBreakerRejections.Inc()
+		return errCircuitOpen
+	}
+	err := fn()
+	s.breaker.record(isStoreFailure(ctx, err))
+	return err
+}
+
+// write is call for changes to the carts of userIDs, which drops them from
+// the cache once the change is made.
+func (s *breakerCartStore) write(ctx context.Context, fn func() error, userIDs ...string) error {
+	err := s.call(ctx, fn)
+	if err == nil {
+		for _, userID := range userIDs {
+			s.cache.remove(userID)
+		}
+	}
+	return err
+}
+
+func (s *breakerCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	var cart *pb.Cart
+	err := s.call(ctx, func() (err error) {
+		cart, err = s.cartStore.GetCart(ctx, userID)
+		return err
+	})
+	if err == nil {
+		s.cache.put(userID, cart)
+		return cart, nil
+	}
+	if status.Code(err) == codes.Unavailable && acceptsStaleCart(ctx) {
+		if cached, ok := s.cache.get(userID); ok {
+			storeStaleReads.Inc()
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cart.stale", true))
+			if err := grpc.SetTrailer(ctx, metadata.Pairs(staleCartTrailer, "true")); err != nil {
+				log.Debugf("Failed to set stale cart trailer: %v", err)
+			}
+			log.Debugf("Serving cached cart for %s: %v", userID, err)
+			return cached, nil
+		}
+	}
+	return nil, err
+}
+
+func (s *breakerCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.AddItem(ctx, userID, productID, quantity, price)
+	}, userID)
+}
+
+func (s *breakerCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.AddItems(ctx, userID, items)
+	}, userID)
+}
+
+func (s *breakerCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	var carts []*pb.Cart
+	err := s.call(ctx, func() (err error) {
+		carts, err = s.cartStore.GetCarts(ctx, userIDs)
+		return err
+	})
+	return carts, err
+}
+
+func (s *breakerCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	var exists bool
+	err := s.call(ctx, func() (err error) {
+		exists, err = s.cartStore.CartExists(ctx, userID)
+		return err
+	})
+	return exists, err
+}
+
+func (s *breakerCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.MergeCarts(ctx, fromUserID, toUserID)
+	}, fromUserID, toUserID)
+}
+
+func (s *breakerCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.UpdateItemQuantity(ctx, userID, productID, quantity)
+	}, userID)
+}
+
+func (s *breakerCartStore) EmptyCart(ctx context.Context, userID string) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.EmptyCart(ctx, userID)
+	}, userID)
+}
+
+func (s *breakerCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	var locked string
+	err := s.write(ctx, func() (err error) {
+		locked, err = s.cartStore.LockCurrency(ctx, userID, currency)
+		return err
+	}, userID)
+	return locked, err
+}
+
+func (s *breakerCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	var cart storedCart
+	err := s.call(ctx, func() (err error) {
+		cart, err = s.cartStore.ExportCart(ctx, userID)
+		return err
+	})
+	return cart, err
+}
+
+func (s *breakerCartStore) ImportCart(ctx context.Context, userID string, cart storedCart) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.ImportCart(ctx, userID, cart)
+	}, userID)
+}
+
+func (s *breakerCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.SaveForLater(ctx, userID, productID)
+	}, userID)
+}
+
+func (s *breakerCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	return s.write(ctx, func() error {
+		return s.cartStore.MoveToCart(ctx, userID, productID)
+	}, userID)
+}
+
+func (s *breakerCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	var items []*pb.CartItem
+	err := s.call(ctx, func() (err error) {
+		items, err = s.cartStore.GetSavedItems(ctx, userID)
+		return err
+	})
+	return items, err
+}
+
+func (s *breakerCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	var names []string
+	err := s.call(ctx, func() (err error) {
+		names, err = s.cartStore.ListCartNames(ctx, userID)
+		return err
+	})
+	return names, err
+}
+
+// cartCache keeps the most recently read carts, up to size. A nil cache
+// holds nothing.
+type cartCache struct {
+	size int
+
+	mu    sync.Mutex
+	carts map[string]*list.Element // values are *pb.Cart
+	lru   *list.List               // most recently used at the front
+}
+
+func newCartCache(size int) *cartCache {
+	return &cartCache{size: size, carts: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (c *cartCache) put(userID string, cart *pb.Cart) {
+	if c == nil {
+		return
+	}
+	cart = proto.Clone(cart).(*pb.Cart)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.carts[userID]; ok {
+		e.Value = cart
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.carts[userID] = c.lru.PushFront(cart)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.carts, oldest.Value.(*pb.Cart).GetUserId())
+	}
+}
+
+func (c *cartCache) get(userID string) (*pb.Cart, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.carts[userID]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return proto.Clone(e.Value.(*pb.Cart)).(*pb.Cart), true
+}
+
+func (c *cartCache) remove(userID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.carts[userID]; ok {
+		c.lru.Remove(e)
+		delete(c.carts, userID)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// flakyCartStore is an in-memory store whose calls fail with err while it
+// is set.
+type flakyCartStore struct {
+	*memoryCartStore
+	err   error
+	calls int
+}
+
+func (s *flakyCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	s.calls++
+	if s.err != nil {
+		return s.err
+	}
+	return s.memoryCartStore.AddItem(ctx, userID, productID, quantity, price)
+}
+
+func (s *flakyCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.memoryCartStore.GetCart(ctx, userID)
+}
+
+// newTestBreakerStore returns a breaker opening after two failures around a
+// flaky store, with a clock the test moves by hand.
+func newTestBreakerStore(cacheSize int) (*breakerCartStore, *flakyCartStore, *time.Time) {
+	flaky := &flakyCartStore{memoryCartStore: newMemoryCartStore()}
+	s := newBreakerCartStore(flaky, 2, time.Minute, cacheSize)
+	now := time.Unix(1700000000, 0)
+	s.breaker.now = func() time.Time { return now }
+	return s, flaky, &now
+}
+
+func TestStoreBreakerOpensAndRecovers(t *testing.T) {
+	ctx := context.Background()
+	s, flaky, now := newTestBreakerStore(0)
+
+	flaky.err = status.Error(codes.Unavailable, "redis is down")
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetCart(ctx, "user-1"); err != flaky.err {
+			t.Fatalf("call %d: got %v, want the store's error", i, err)
+		}
+	}
+	rejected := testutil.ToFloat64(storeBreakerRejections)
+	if _, err := s.GetCart(ctx, "user-1"); err != errCircuitOpen {
+		t.Fatalf("open circuit: got %v, want %v", err, errCircuitOpen)
+	}
+	if flaky.calls != 2 {
+		t.Errorf("store saw %d calls, want 2", flaky.calls)
+	}
+	if got := testutil.ToFloat64(storeBreakerRejections); got != rejected+1 {
+		t.Errorf("rejections: got %v, want %v", got, rejected+1)
+	}
+	if got := testutil.ToFloat64(storeBreakerState); got != float64(breakerOpen) {
+		t.Errorf("state gauge: got %v, want open", got)
+	}
+
+	// A failed probe reopens the circuit for another full openFor.
+	*now = now.Add(time.Minute)
+	if _, err := s.GetCart(ctx, "user-1"); err != flaky.err {
+		t.Fatalf("probe: got %v, want the store's error", err)
+	}
+	*now = now.Add(time.Minute - time.Second)
+	if _, err := s.GetCart(ctx, "user-1"); err != errCircuitOpen {
+		t.Fatalf("after failed probe: got %v, want %v", err, errCircuitOpen)
+	}
+
+	// A successful one closes it.
+	*now = now.Add(time.Second)
+	flaky.err = nil
+	if _, err := s.GetCart(ctx, "user-1"); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatalf("closed circuit: %v", err)
+	}
+	if got := testutil.ToFloat64(storeBreakerState); got != float64(breakerClosed) {
+		t.Errorf("state gauge: got %v, want closed", got)
+	}
+}
+
+func TestStoreBreakerOneProbeAtATime(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute)
+	now := time.Unix(1700000000, 0)
+	b.now = func() time.Time { return now }
+	b.allow()
+	b.record(true)
+
+	now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("first call after openFor was not let through")
+	}
+	if b.allow() {
+		t.Error("second call was let through while the probe is out")
+	}
+	b.record(false)
+	if !b.allow() {
+		t.Error("call after a successful probe was rejected")
+	}
+}
+
+func TestStoreBreakerIgnoresRequestErrors(t *testing.T) {
+	ctx := context.Background()
+	s, flaky, _ := newTestBreakerStore(0)
+
+	flaky.err = status.Error(codes.InvalidArgument, "bad product")
+	for i := 0; i < 5; i++ {
+		if err := s.AddItem(ctx, "user-1", "", 1, nil); err != flaky.err {
+			t.Fatalf("call %d: got %v, want the store's error", i, err)
+		}
+	}
+}
+
+func TestIsStoreFailure(t *testing.T) {
+	live := context.Background()
+	done, cancel := context.WithCancel(live)
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"ok", live, nil, false},
+		{"unavailable", live, status.Error(codes.Unavailable, "down"), true},
+		{"store deadline", live, status.Error(codes.DeadlineExceeded, "slow"), true},
+		{"caller deadline", done, status.Error(codes.DeadlineExceeded, "slow"), false},
+		{"not found", live, status.Error(codes.NotFound, "no line"), false},
+		{"plain error", live, errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isStoreFailure(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStoreBreakerServesCachedCart(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(acceptStaleCartHeader, "true"))
+	s, flaky, _ := newTestBreakerStore(10)
+
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetCart(ctx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	flaky.err = status.Error(codes.Unavailable, "redis is down")
+
+	stale := testutil.ToFloat64(storeStaleReads)
+	// Served both when the store fails the call and when the circuit is
+	// open.
+	for i := 0; i < 3; i++ {
+		cart, err := s.GetCart(ctx, "user-1")
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 {
+			t.Fatalf("call %d: got items %v, want 2 of OLJCESPC7Z", i, cart.Items)
+		}
+		cart.Items[0].Quantity = 99 // callers can't change the cached copy
+	}
+	if got := testutil.ToFloat64(storeStaleReads); got != stale+3 {
+		t.Errorf("stale reads: got %v, want %v", got, stale+3)
+	}
+	if _, err := s.GetCart(ctx, "user-2"); err != errCircuitOpen {
+		t.Errorf("uncached cart: got %v, want %v", err, errCircuitOpen)
+	}
+}
+
+func TestStoreBreakerStaleCartOptIn(t *testing.T) {
+	ctx := context.Background()
+	store, flaky, _ := newTestBreakerStore(10)
+	srv := grpc.NewServer()
+	pb.RegisterCartServiceServer(srv, &cartServer{store: store})
+	client := pb.NewCartServiceClient(newTestGRPCConn(t, srv))
+
+	if _, err := client.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	var trailer metadata.MD
+	if _, err := client.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if got := firstValue(trailer, staleCartTrailer); got != "" {
+		t.Errorf("fresh cart: got %s %q, want none", staleCartTrailer, got)
+	}
+	flaky.err = status.Error(codes.Unavailable, "redis is down")
+
+	// Checkout doesn't opt in, so it can't charge for an out-of-date cart.
+	if _, err := client.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("without opting in: got %v, want Unavailable", err)
+	}
+
+	optIn := metadata.AppendToOutgoingContext(ctx, acceptStaleCartHeader, "true")
+	cart, err := client.GetCart(optIn, &pb.GetCartRequest{UserId: "user-1"}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 {
+		t.Errorf("got items %v, want the cached 2 of OLJCESPC7Z", cart.Items)
+	}
+	if got := firstValue(trailer, staleCartTrailer); got != "true" {
+		t.Errorf("cached cart: got %s %q, want true", staleCartTrailer, got)
+	}
+}
+
+func TestStoreBreakerWriteDropsCachedCart(t *testing.T) {
+	ctx := context.Background()
+	s, flaky, _ := newTestBreakerStore(10)
+
+	if _, err := s.GetCart(ctx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	flaky.err = status.Error(codes.Unavailable, "redis is down")
+	if _, err := s.GetCart(ctx, "user-1"); err != flaky.err {
+		t.Errorf("got %v, want the store's error rather than the cart from before the write", err)
+	}
+}
+
+func TestCartCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCartCache(2)
+	c.put("user-1", &pb.Cart{UserId: "user-1"})
+	c.put("user-2", &pb.Cart{UserId: "user-2"})
+	c.get("user-1")
+	c.put("user-3", &pb.Cart{UserId: "user-3"})
+
+	for userID, want := range map[string]bool{"user-1": true, "user-2": false, "user-3": true} {
+		if _, ok := c.get(userID); ok != want {
+			t.Errorf("%s cached: got %v, want %v", userID, ok, want)
+		}
+	}
+}
+
+func TestStoreBreakerFromEnv(t *testing.T) {
+	tests := []struct {
+		failures, openFor, cacheSize string
+		wantFailures                 int
+		wantOpenFor                  time.Duration
+		wantCacheSize                int
+	}{
+		{"", "", "", defaultStoreBreakerFailures, defaultStoreBreakerOpenFor, 0},
+		{"0", "5s", "1000", 0, 5 * time.Second, 1000},
+		{"-1", "soon", "lots", defaultStoreBreakerFailures, defaultStoreBreakerOpenFor, 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("STORE_BREAKER_FAILURES", tt.failures)
+		t.Setenv("STORE_BREAKER_OPEN_FOR", tt.openFor)
+		t.Setenv("STORE_BREAKER_CACHE_SIZE", tt.cacheSize)
+		if got := storeBreakerFailuresFromEnv(); got != tt.wantFailures {
+			t.Errorf("STORE_BREAKER_FAILURES=%q: got %d, want %d", tt.failures, got, tt.wantFailures)
+		}
+		if got := storeBreakerOpenForFromEnv(); got != tt.wantOpenFor {
+			t.Errorf("STORE_BREAKER_OPEN_FOR=%q: got %v, want %v", tt.openFor, got, tt.wantOpenFor)
+		}
+		if got := storeBreakerCacheSizeFromEnv(); got != tt.wantCacheSize {
+			t.Errorf("STORE_BREAKER_CACHE_SIZE=%q: got %d, want %d", tt.cacheSize, got, tt.wantCacheSize)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/storetest"
+)
+
+// newConformanceRedisStore connects to the Redis at
+// CARTSERVICE_TEST_REDIS_ADDR, flushing it first, or to a miniredis when it
+// isn't set.
+func newConformanceRedisStore(t *testing.T) *redisCartStore {
+	addr := os.Getenv("CARTSERVICE_TEST_REDIS_ADDR")
+	if addr == "" {
+		store, _ := newTestRedisStore(t)
+		return store
+	}
+	return newFlushedRedisStore(t, addr)
+}
+
+// newFlushedRedisStore connects to the Redis at addr and flushes it, so
+// each subtest starts from an empty store.
+func newFlushedRedisStore(t *testing.T, addr string) *redisCartStore {
+	store, err := newRedisCartStore(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.client.Close() })
+	if err := store.client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testCartStores makes an empty store of every backend, for tests that must
+// hold for all of them. Backends whose test server isn't configured skip:
+// postgres needs CARTSERVICE_TEST_DATABASE_URL and spanner the emulator, which
+// no default run provides. TestCartStoreConformanceContainers, built with the
+// integration tag, starts real Redis and PostgreSQL servers instead. Nothing
+// starts a Spanner emulator, so spanner is untested unless one is set up by
+// hand.
+func testCartStores() map[string]func(t *testing.T) cartStore {
+	return map[string]func(t *testing.T) cartStore{
+		"redis": func(t *testing.T) cartStore { return newConformanceRedisStore(t) },
+		"redis-sharded": func(t *testing.T) cartStore {
+			store, _ := newTestShardedStore(t)
+			return store
+		},
+		"memory": func(*testing.T) cartStore { return newMemoryCartStore() },
+		"memcached": func(t *testing.T) cartStore {
+			store, _ := newTestMemcachedStore(t)
+			return store
+		},
+		"postgres": func(t *testing.T) cartStore { return newTestPostgresStore(t) },
+		"spanner":  func(t *testing.T) cartStore { return newTestSpannerEmulatorStore(t) },
+	}
+}
+
+func TestCartStoreConformance(t *testing.T) {
+	for name, newStore := range testCartStores() {
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) storetest.Store { return newStore(t) })
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/testcontainers/testcontainers-go"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+	tcredis "github.com/testcontainers/testcontainers-go/modules/redis"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/storetest"
+)
+
+// TestCartStoreConformanceContainers runs the conformance suite against a
+// real Redis and PostgreSQL, started in Docker with testcontainers. It is
+// built only with the integration tag, and skips when Docker isn't reachable:
+//
+//	go test -tags integration -run Containers .
+func TestCartStoreConformanceContainers(t *testing.T) {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+
+	redisC, err := tcredis.Run(ctx, "redis:alpine")
+	testcontainers.CleanupContainer(t, redisC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisAddr, err := redisC.Endpoint(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pgC, err := tcpostgres.Run(ctx, "postgres:16-alpine",
+		tcpostgres.WithDatabase("carts"),
+		tcpostgres.WithUsername("carts"),
+		tcpostgres.WithPassword("carts"),
+		tcpostgres.BasicWaitStrategies(),
+	)
+	testcontainers.CleanupContainer(t, pgC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgURL, err := pgC.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]func(t *testing.T) storetest.Store{
+		"redis":    func(t *testing.T) storetest.Store { return newFlushedRedisStore(t, redisAddr) },
+		"postgres": func(t *testing.T) storetest.Store { return newTruncatedPostgresStore(t, pgURL) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, newStore)
+		})
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+const defaultStoreReconnectInterval = 10 * time.Second
+
+// storeReconnectTimeout bounds each attempt to reach the configured backend.
+const storeReconnectTimeout = 5 * time.Second
+
+var storeReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cartservice",
+	Subsystem: "store",
+	Name:      "reconnects_total",
+	Help:      "Times the cart store moved back from the in-memory fallback to its configured backend.",
+})
+
+func init() {
+	metricsRegistry.MustRegister(storeReconnects)
+}
+
+// storeReconnectIntervalFromEnv reads STORE_RECONNECT_INTERVAL, how often a
+// store that fell back to memory retries its configured backend. Zero keeps
+// it on memory for good.
+func storeReconnectIntervalFromEnv() time.Duration {
+	v := os.Getenv("STORE_RECONNECT_INTERVAL")
+	if v == "" {
+		return defaultStoreReconnectInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid STORE_RECONNECT_INTERVAL %q, using %v", v, defaultStoreReconnectInterval)
+		return defaultStoreReconnectInterval
+	}
+	return d
+}
+
+// storeReconnectReplayFromEnv reads STORE_RECONNECT_REPLAY. When true, carts
+// written to memory during the outage are copied to the backend once it is
+// reached; otherwise they are dropped.
+func storeReconnectReplayFromEnv() bool {
+	v := os.Getenv("STORE_RECONNECT_REPLAY")
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid STORE_RECONNECT_REPLAY %q, carts kept in memory are not replayed", v)
+		return false
+	}
+	return b
+}
+
+// failoverCartStore serves carts from memory while its configured backend
+// is unreachable and swaps over to the backend once reconnect reaches it.
+type failoverCartStore struct {
+	backend string
+	connect func(ctx context.Context) (cartStore, error)
+	replay  bool
+
+	mu       sync.RWMutex
+	current  cartStore
+	memory   *memoryCartStore // the fallback, nil once swapped out
+	onSwap   func()
+	promoted bool
+}
+
+func newFailoverCartStore(backend string, connect func(ctx context.Context) (cartStore, error), replay bool) *failoverCartStore {
+	memory := newMemoryCartStore()
+	return &failoverCartStore{
+		backend: backend,
+		connect: connect,
+		replay:  replay,
+		current: memory,
+		memory:  memory,
+	}
+}
+
+func (s *failoverCartStore) store() cartStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// activeBackend names the backend carts currently live in.
+func (s *failoverCartStore) activeBackend() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.promoted {
+		return s.backend
+	}
+	return backendMemory
+}
+
+// onFallback reports whether carts are still held in memory.
+func (s *failoverCartStore) onFallback() bool {
+	return s.activeBackend() == backendMemory
+}
+
+// setOnSwap registers f to be called after the store moves to its backend.
+func (s *failoverCartStore) setOnSwap(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onSwap = f
+}
+
+// reconnect tries the configured backend every interval until it is
+// reached or ctx is done.
+func (s *failoverCartStore) reconnect(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.tryPromote(ctx) {
+			return
+		}
+	}
+}
+
+// tryPromote makes one attempt to reach the backend, swapping to it on
+// success, and reports whether the store now uses it.
+func (s *failoverCartStore) tryPromote(ctx context.Context) bool {
+	connectCtx, cancel := context.WithTimeout(ctx, storeReconnectTimeout)
+	target, err := s.connect(connectCtx)
+	cancel()
+	if err != nil {
+		log.Debugf("Cart store backend %s still unreachable: %v", s.backend, err)
+		return false
+	}
+
+	s.mu.Lock()
+	memory := s.memory
+	s.current = target
+	s.memory = nil
+	s.promoted = true
+	onSwap := s.onSwap
+	s.mu.Unlock()
+
+	storeReconnects.Inc()
+	setStoreMode(s.backend)
+	log.WithFields(logrus.Fields{
+		"from": backendMemory,
+		"to":   s.backend,
+	}).Infof("Reconnected to %s, cart store moved off the in-memory fallback", s.backend)
+	if s.replay {
+		replayMemoryCarts(ctx, memory, target)
+	}
+	if onSwap != nil {
+		onSwap()
+	}
+	return true
+}
+
+// perActiveStore holds a helper tied to a store's backend, such as its
+// idempotency deduper, for whichever store a failover store is using, so
+// the helper moves to the configured backend along with the carts. Each is
+// built on first use.
+type perActiveStore[T any] struct {
+	failover *failoverCartStore
+	build    func(cartStore) T
+
+	mu    sync.Mutex
+	built map[cartStore]T
+}
+
+func newPerActiveStore[T any](failover *failoverCartStore, build func(cartStore) T) *perActiveStore[T] {
+	return &perActiveStore[T]{failover: failover, build: build, built: make(map[cartStore]T)}
+}
+
+// get returns the helper for the store currently in use.
+func (p *perActiveStore[T]) get() T {
+	store := p.failover.store()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.built[store]
+	if !ok {
+		v = p.build(store)
+		p.built[store] = v
+	}
+	return v
+}
+
+// replayMemoryCarts copies the carts held in memory to target. Carts the
+// target doesn't have are imported whole; items of carts it has are added
+// to them. Failures are logged and skipped so one bad cart doesn't hold up
+// the rest.
+func replayMemoryCarts(ctx context.Context, memory *memoryCartStore, target cartStore) {
+	carts := memory.snapshot()
+	replayed := 0
+	for userID, cart := range carts {
+		if err := replayCart(ctx, target, userID, cart); err != nil {
+			log.Warnf("Failed to replay in-memory cart for user %s: %v", userID, err)
+			continue
+		}
+		replayed++
+	}
+	log.Infof("Replayed %d of %d in-memory carts", replayed, len(carts))
+}
+
+func replayCart(ctx context.Context, target cartStore, userID string, cart storedCart) error {
+	exists, err := target.CartExists(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if len(cart.Items) == 0 {
+			return nil
+		}
+		return target.AddItems(ctx, userID, cartItemsToProto(cart.Items))
+	}
+	if err := target.ImportCart(ctx, userID, cart); err != nil {
+		return err
+	}
+	if cart.Currency != "" {
+		if _, err := target.LockCurrency(ctx, userID, cart.Currency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *failoverCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	return s.store().AddItem(ctx, userID, productID, quantity, price)
+}
+
+func (s *failoverCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	return s.store().AddItems(ctx, userID, items)
+}
+
+func (s *failoverCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	return s.store().GetCart(ctx, userID)
+}
+
+func (s *failoverCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	return s.store().GetCarts(ctx, userIDs)
+}
+
+func (s *failoverCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	return s.store().CartExists(ctx, userID)
+}
+
+func (s *failoverCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	return s.store().MergeCarts(ctx, fromUserID, toUserID)
+}
+
+func (s *failoverCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	return s.store().UpdateItemQuantity(ctx, userID, productID, quantity)
+}
+
+func (s *failoverCartStore) EmptyCart(ctx context.Context, userID string) error {
+	return s.store().EmptyCart(ctx, userID)
+}
+
+func (s *failoverCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	return s.store().LockCurrency(ctx, userID, currency)
+}
+
+func (s *failoverCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	return s.store().ExportCart(ctx, userID)
+}
+
+func (s *failoverCartStore) ImportCart(ctx context.Context, userID string, cart storedCart) error {
+	return s.store().ImportCart(ctx, userID, cart)
+}
+
+func (s *failoverCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	return s.store().SaveForLater(ctx, userID, productID)
+}
+
+func (s *failoverCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	return s.store().MoveToCart(ctx, userID, productID)
+}
+
+func (s *failoverCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	return s.store().GetSavedItems(ctx, userID)
+}
+
+func (s *failoverCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	return s.store().ListCartNames(ctx, userID)
+}
+
+func (s *failoverCartStore) Ping(ctx context.Context) error {
+	return s.store().Ping(ctx)
+}
+
+func (s *failoverCartStore) IdleCarts(ctx context.Context, from, to time.Time) ([]idleCart, error) {
+	finder, ok := s.store().(idleCartFinder)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "the %s cart store can't find idle carts", s.activeBackend())
+	}
+	return finder.IdleCarts(ctx, from, to)
+}
+
+func (s *failoverCartStore) ListCartKeys(ctx context.Context, pageToken string, pageSize int) ([]string, string, error) {
+	lister, ok := s.store().(cartLister)
+	if !ok {
+		return nil, "", status.Errorf(codes.Unimplemented, "the %s cart store can't list carts", s.activeBackend())
+	}
+	return lister.ListCartKeys(ctx, pageToken, pageSize)
+}
+
+func (s *failoverCartStore) Close() error {
+	if c, ok := s.store().(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
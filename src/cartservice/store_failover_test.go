@@ -0,0 +1,331 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// testBackend hands out a Redis store backed by mr once up is set.
+type testBackend struct {
+	mr *miniredis.Miniredis
+
+	mu       sync.Mutex
+	up       bool
+	attempts int
+}
+
+func (b *testBackend) setUp() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.up = true
+}
+
+func (b *testBackend) connect(context.Context) (cartStore, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts++
+	if !b.up {
+		return nil, errors.New("connection refused")
+	}
+	return newRedisCartStore(b.mr.Addr())
+}
+
+func newTestFailoverStore(t *testing.T, replay bool) (*failoverCartStore, *testBackend) {
+	t.Helper()
+	backend := &testBackend{mr: miniredis.RunT(t)}
+	s := newFailoverCartStore(backendRedis, backend.connect, replay)
+	t.Cleanup(func() { s.Close() })
+	return s, backend
+}
+
+func TestFailoverPromotesWhenBackendReturns(t *testing.T) {
+	ctx := context.Background()
+	s, backend := newTestFailoverStore(t, false)
+
+	if err := s.AddItem(ctx, "guest", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.tryPromote(ctx) {
+		t.Fatal("promoted while the backend is down")
+	}
+	if !s.onFallback() {
+		t.Fatal("left the fallback while the backend is down")
+	}
+
+	before := testutil.ToFloat64(storeReconnects)
+	backend.setUp()
+	if !s.tryPromote(ctx) {
+		t.Fatal("not promoted once the backend is up")
+	}
+	if got := s.activeBackend(); got != backendRedis {
+		t.Errorf("active backend = %s, want %s", got, backendRedis)
+	}
+	if got := testutil.ToFloat64(storeReconnects); got != before+1 {
+		t.Errorf("got %v reconnects, want %v", got, before+1)
+	}
+	if got := testutil.ToFloat64(storeMode.WithLabelValues(backendRedis)); got != 1 {
+		t.Errorf("store mode redis = %v, want 1", got)
+	}
+
+	// Without replay the cart kept in memory is gone.
+	if exists, err := s.CartExists(ctx, "guest"); err != nil || exists {
+		t.Errorf("CartExists = %v, %v; want false without replay", exists, err)
+	}
+	if err := s.AddItem(ctx, "guest", "1YMWWN1N4O", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.mr.Keys()) == 0 {
+		t.Error("writes after promotion don't reach Redis")
+	}
+}
+
+func TestFailoverReplaysMemoryCarts(t *testing.T) {
+	ctx := context.Background()
+	s, backend := newTestFailoverStore(t, true)
+
+	// Carts written during the outage.
+	if err := s.AddItem(ctx, "guest", "66VCHSJNUP", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "guest", "1YMWWN1N4O", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LockCurrency(ctx, "guest", "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "returning", "66VCHSJNUP", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cart Redis already held from before the outage.
+	redis, err := newRedisCartStore(backend.mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+	if err := redis.AddItem(ctx, "returning", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.setUp()
+	if !s.tryPromote(ctx) {
+		t.Fatal("not promoted once the backend is up")
+	}
+
+	tests := []struct {
+		userID       string
+		wantCurrency string
+		want         map[string]int32
+	}{
+		{"guest", "EUR", map[string]int32{"66VCHSJNUP": 2, "1YMWWN1N4O": 1}},
+		{"returning", "", map[string]int32{"66VCHSJNUP": 3}},
+	}
+	for _, tt := range tests {
+		cart, err := redis.GetCart(ctx, tt.userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cart.GetCurrencyCode() != tt.wantCurrency {
+			t.Errorf("%s: currency = %q, want %q", tt.userID, cart.GetCurrencyCode(), tt.wantCurrency)
+		}
+		got := make(map[string]int32)
+		for _, item := range cart.GetItems() {
+			got[item.GetProductId()] = item.GetQuantity()
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got items %v, want %v", tt.userID, got, tt.want)
+			continue
+		}
+		for id, q := range tt.want {
+			if got[id] != q {
+				t.Errorf("%s: %s quantity = %d, want %d", tt.userID, id, got[id], q)
+			}
+		}
+	}
+}
+
+func TestFailoverReconnectLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, backend := newTestFailoverStore(t, false)
+	swapped := make(chan struct{})
+	s.setOnSwap(func() { close(swapped) })
+
+	done := make(chan struct{})
+	go func() {
+		s.reconnect(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if !s.onFallback() {
+		t.Fatal("left the fallback while the backend is down")
+	}
+	backend.setUp()
+
+	select {
+	case <-swapped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("store never moved to the backend")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconnect kept running after promotion")
+	}
+	backend.mu.Lock()
+	attempts := backend.attempts
+	backend.mu.Unlock()
+	if attempts < 2 {
+		t.Errorf("got %d connection attempts, want retries before success", attempts)
+	}
+}
+
+func TestFailoverHealthReportsFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, backend := newTestFailoverStore(t, false)
+	health := newHealthServer(s)
+	s.setOnSwap(health.storeChanged)
+
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, health)
+	client := grpc_health_v1.NewHealthClient(newTestGRPCConn(t, srv))
+
+	check := func(service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.GetStatus()
+	}
+	// Carts are still served from memory, so only the store service is
+	// down.
+	if got := check(pb.CartService_ServiceDesc.ServiceName); got != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("CartService on fallback: got %s, want SERVING", got)
+	}
+	if got := check(storeHealthService); got != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("store on fallback: got %s, want NOT_SERVING", got)
+	}
+
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{Service: storeHealthService})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("first Watch update = %v, %v; want NOT_SERVING", resp.GetStatus(), err)
+	}
+
+	backend.setUp()
+	if !s.tryPromote(ctx) {
+		t.Fatal("not promoted once the backend is up")
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatalf("Watch update after promotion = %v, %v; want SERVING", resp.GetStatus(), err)
+	}
+	if got := check(storeHealthService); got != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("store after promotion: got %s, want SERVING", got)
+	}
+}
+
+func TestFailoverHelpersFollowPromotion(t *testing.T) {
+	t.Setenv("CART_AUDIT_LOG", "redis")
+	ctx := context.Background()
+	s, backend := newTestFailoverStore(t, false)
+	dedupe := newAddDeduper(s, time.Minute)
+	archive := newCartArchive(s, time.Hour)
+	audit := newAuditLogFromEnv(s)
+	if audit == nil {
+		t.Fatal("CART_AUDIT_LOG=redis is off for a store that can reconnect to Redis")
+	}
+	entry := []*pb.CartAuditEntry{{ProductId: "66VCHSJNUP", NewQuantity: 1}}
+	use := func() {
+		t.Helper()
+		if ok, err := dedupe.claim(ctx, "user-1", "key-1"); err != nil || !ok {
+			t.Fatalf("claim = %v, %v; want a fresh key", ok, err)
+		}
+		if err := archive.save(ctx, "user-1", storedCart{Items: []cartItem{{ProductID: "66VCHSJNUP", Quantity: 1}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := audit.append(ctx, "user-1", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	use()
+	if keys := backend.mr.Keys(); len(keys) != 0 {
+		t.Fatalf("wrote %v to Redis while on the fallback", keys)
+	}
+	if _, err := audit.history(ctx, "user-1", 10); status.Code(err) != codes.Unavailable {
+		t.Errorf("history on the fallback: got %v, want Unavailable", err)
+	}
+
+	backend.setUp()
+	if !s.tryPromote(ctx) {
+		t.Fatal("not promoted once the backend is up")
+	}
+	// Same key as before: what was claimed in memory is left behind.
+	use()
+	var dedupeKeys, archiveKeys int
+	for _, key := range backend.mr.Keys() {
+		switch {
+		case strings.Contains(key, redisIdempotencyKeyPrefix):
+			dedupeKeys++
+		case strings.Contains(key, redisArchiveKeyPrefix):
+			archiveKeys++
+		}
+	}
+	if dedupeKeys != 1 || archiveKeys == 0 {
+		t.Errorf("got keys %v, want idempotency and archive keys in Redis", backend.mr.Keys())
+	}
+	history, err := audit.history(ctx, "user-1", 10)
+	if err != nil || len(history) != 1 {
+		t.Errorf("history after promotion = %v, %v; want the entry written to Redis", history, err)
+	}
+}
+
+func TestStoreReconnectIntervalFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", defaultStoreReconnectInterval},
+		{"30s", 30 * time.Second},
+		{"0", 0},
+		{"-1s", defaultStoreReconnectInterval},
+		{"soon", defaultStoreReconnectInterval},
+	}
+	for _, tt := range tests {
+		t.Setenv("STORE_RECONNECT_INTERVAL", tt.value)
+		if got := storeReconnectIntervalFromEnv(); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
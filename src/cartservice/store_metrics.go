@@ -0,0 +1,187 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+var (
+	// storeOperationDuration records how long each cartStore call takes,
+	// including retries and failed calls.
+	storeOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cartservice",
+		Subsystem: "store",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of cart store operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "backend"})
+
+	storeCartsDesc = prometheus.NewDesc("cartservice_store_carts",
+		"Number of carts held by the cart store.", []string{"backend"}, nil)
+)
+
+func init() {
+	metricsRegistry.MustRegister(storeOperationDuration)
+}
+
+// storeBackend names the backend behind store, as used in metric labels.
+func storeBackend(store cartStore) string {
+	switch store.(type) {
+	case *redisCartStore:
+		return backendRedis
+	case *postgresCartStore:
+		return backendPostgres
+	case *memcachedCartStore:
+		return backendMemcached
+	case *spannerCartStore:
+		return backendSpanner
+	default:
+		return backendMemory
+	}
+}
+
+// timedCartStore records the duration of every call to the wrapped store.
+type timedCartStore struct {
+	cartStore
+	backend string
+}
+
+// instrumentStore wraps store so its calls show up in
+// storeOperationDuration and the OpenTelemetry store duration histogram, and
+// exports its cart count if it can tell.
+func instrumentStore(store cartStore) cartStore {
+	backend := storeBackend(store)
+	if counter, ok := store.(cartCounter); ok {
+		metricsRegistry.MustRegister(&storeCartsCollector{counter: counter, backend: backend})
+	}
+	return &timedCartStore{cartStore: store, backend: backend}
+}
+
+func (s *timedCartStore) observe(ctx context.Context, op string, start time.Time) {
+	seconds := time.Since(start).Seconds()
+	storeOperationDuration.WithLabelValues(op, s.backend).Observe(seconds)
+	otelMetrics.recordStoreDuration(ctx, op, s.backend, seconds)
+}
+
+func (s *timedCartStore) AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error {
+	defer s.observe(ctx, "AddItem", time.Now())
+	return s.cartStore.AddItem(ctx, userID, productID, quantity, price)
+}
+
+func (s *timedCartStore) AddItems(ctx context.Context, userID string, items []*pb.CartItem) error {
+	defer s.observe(ctx, "AddItems", time.Now())
+	return s.cartStore.AddItems(ctx, userID, items)
+}
+
+func (s *timedCartStore) GetCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	defer s.observe(ctx, "GetCart", time.Now())
+	return s.cartStore.GetCart(ctx, userID)
+}
+
+func (s *timedCartStore) GetCarts(ctx context.Context, userIDs []string) ([]*pb.Cart, error) {
+	defer s.observe(ctx, "GetCarts", time.Now())
+	return s.cartStore.GetCarts(ctx, userIDs)
+}
+
+func (s *timedCartStore) CartExists(ctx context.Context, userID string) (bool, error) {
+	defer s.observe(ctx, "CartExists", time.Now())
+	return s.cartStore.CartExists(ctx, userID)
+}
+
+func (s *timedCartStore) MergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	defer s.observe(ctx, "MergeCarts", time.Now())
+	return s.cartStore.MergeCarts(ctx, fromUserID, toUserID)
+}
+
+func (s *timedCartStore) UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error {
+	defer s.observe(ctx, "UpdateItemQuantity", time.Now())
+	return s.cartStore.UpdateItemQuantity(ctx, userID, productID, quantity)
+}
+
+func (s *timedCartStore) EmptyCart(ctx context.Context, userID string) error {
+	defer s.observe(ctx, "EmptyCart", time.Now())
+	return s.cartStore.EmptyCart(ctx, userID)
+}
+
+func (s *timedCartStore) LockCurrency(ctx context.Context, userID, currency string) (string, error) {
+	defer s.observe(ctx, "LockCurrency", time.Now())
+	return s.cartStore.LockCurrency(ctx, userID, currency)
+}
+
+func (s *timedCartStore) ExportCart(ctx context.Context, userID string) (storedCart, error) {
+	defer s.observe(ctx, "ExportCart", time.Now())
+	return s.cartStore.ExportCart(ctx, userID)
+}
+
+func (s *timedCartStore) ImportCart(ctx context.Context, userID string, cart storedCart) error {
+	defer s.observe(ctx, "ImportCart", time.Now())
+	return s.cartStore.ImportCart(ctx, userID, cart)
+}
+
+func (s *timedCartStore) SaveForLater(ctx context.Context, userID, productID string) error {
+	defer s.observe(ctx, "SaveForLater", time.Now())
+	return s.cartStore.SaveForLater(ctx, userID, productID)
+}
+
+func (s *timedCartStore) MoveToCart(ctx context.Context, userID, productID string) error {
+	defer s.observe(ctx, "MoveToCart", time.Now())
+	return s.cartStore.MoveToCart(ctx, userID, productID)
+}
+
+func (s *timedCartStore) GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	defer s.observe(ctx, "GetSavedItems", time.Now())
+	return s.cartStore.GetSavedItems(ctx, userID)
+}
+
+func (s *timedCartStore) ListCartNames(ctx context.Context, userID string) ([]string, error) {
+	defer s.observe(ctx, "ListCartNames", time.Now())
+	return s.cartStore.ListCartNames(ctx, userID)
+}
+
+// cartCounter is implemented by stores that can count their carts cheaply
+// enough to do so on every scrape. Redis and memcached can't without
+// walking the whole keyspace, nor Spanner without a billed scan of Carts.
+type cartCounter interface {
+	CountCarts(ctx context.Context) (int, error)
+}
+
+// storeCartsCollector reports the store's cart count at scrape time.
+type storeCartsCollector struct {
+	counter cartCounter
+	backend string
+}
+
+func (c *storeCartsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storeCartsDesc
+}
+
+// Collect leaves the gauge out of the scrape if the store can't be reached,
+// rather than failing the whole scrape.
+func (c *storeCartsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := c.counter.CountCarts(ctx)
+	if err != nil {
+		log.Warnf("Failed to count carts for metrics: %v", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(storeCartsDesc, prometheus.GaugeValue, float64(n), c.backend)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func storeOperationCount(t *testing.T, op, backend string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := storeOperationDuration.WithLabelValues(op, backend).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestTimedCartStore(t *testing.T) {
+	ctx := context.Background()
+	store := &timedCartStore{cartStore: newMemoryCartStore(), backend: backendMemory}
+
+	tests := []struct {
+		op   string
+		call func() error
+	}{
+		{"AddItem", func() error { return store.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil) }},
+		{"GetCart", func() error { _, err := store.GetCart(ctx, "user-1"); return err }},
+		{"EmptyCart", func() error { return store.EmptyCart(ctx, "user-1") }},
+		// Failed calls are timed too.
+		{"MoveToCart", func() error { store.MoveToCart(ctx, "user-1", "OLJCESPC7Z"); return nil }},
+	}
+	for _, tt := range tests {
+		before := storeOperationCount(t, tt.op, backendMemory)
+		if err := tt.call(); err != nil {
+			t.Fatalf("%s: %v", tt.op, err)
+		}
+		if got := storeOperationCount(t, tt.op, backendMemory); got != before+1 {
+			t.Errorf("%s: got %d observations, want %d", tt.op, got, before+1)
+		}
+	}
+}
+
+func TestStoreCartsCollector(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryCartStore()
+	for _, user := range []string{"user-1", "user-2"} {
+		if err := store.AddItem(ctx, user, "OLJCESPC7Z", 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &storeCartsCollector{counter: store, backend: backendMemory}
+	if got := testutil.ToFloat64(c); got != 2 {
+		t.Errorf("got %v carts, want 2", got)
+	}
+}
+
+func TestStoreBackend(t *testing.T) {
+	redisStore, _ := newTestRedisStore(t)
+	memcachedStore, _ := newTestMemcachedStore(t)
+	tests := []struct {
+		store cartStore
+		want  string
+	}{
+		{redisStore, backendRedis},
+		{memcachedStore, backendMemcached},
+		{&postgresCartStore{}, backendPostgres},
+		{&spannerCartStore{}, backendSpanner},
+		{newMemoryCartStore(), backendMemory},
+	}
+	for _, tt := range tests {
+		if got := storeBackend(tt.store); got != tt.want {
+			t.Errorf("storeBackend(%T) = %s, want %s", tt.store, got, tt.want)
+		}
+	}
+}
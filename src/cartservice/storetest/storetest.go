@@ -0,0 +1,390 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storetest is a conformance suite for cartservice's cart stores.
+// Every backend runs it, so a new one only has to pass Run to be known to
+// behave like the others.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// Store is the part of cartservice's cartStore the suite exercises.
+type Store interface {
+	AddItem(ctx context.Context, userID, productID string, quantity int32, price *pb.Money) error
+	AddItems(ctx context.Context, userID string, items []*pb.CartItem) error
+	GetCart(ctx context.Context, userID string) (*pb.Cart, error)
+	CartExists(ctx context.Context, userID string) (bool, error)
+	MergeCarts(ctx context.Context, fromUserID, toUserID string) error
+	UpdateItemQuantity(ctx context.Context, userID, productID string, quantity int32) error
+	EmptyCart(ctx context.Context, userID string) error
+	LockCurrency(ctx context.Context, userID, currency string) (string, error)
+	SaveForLater(ctx context.Context, userID, productID string) error
+	MoveToCart(ctx context.Context, userID, productID string) error
+	GetSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error)
+}
+
+// Run runs the suite against stores made by newStore, which is called once
+// per subtest and must return an empty store.
+func Run(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"MissingCart", testMissingCart},
+		{"AddItem", testAddItem},
+		{"AddItems", testAddItems},
+		{"UpdateItemQuantity", testUpdateItemQuantity},
+		{"EmptyCart", testEmptyCart},
+		{"LockCurrency", testLockCurrency},
+		{"MergeCarts", testMergeCarts},
+		{"SavedItems", testSavedItems},
+		{"Isolation", testIsolation},
+		{"ConcurrentAddItem", testConcurrentAddItem},
+		{"Limits", testLimits},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+// quantities returns the cart's quantity of each product. It fails the test
+// if a product has more than one line.
+func quantities(t *testing.T, items []*pb.CartItem) map[string]int32 {
+	t.Helper()
+	got := make(map[string]int32, len(items))
+	for _, item := range items {
+		if _, ok := got[item.GetProductId()]; ok {
+			t.Errorf("product %s has more than one line", item.GetProductId())
+		}
+		got[item.GetProductId()] = item.GetQuantity()
+	}
+	return got
+}
+
+// checkCart fails the test unless userID's cart holds exactly want.
+func checkCart(t *testing.T, s Store, userID string, want map[string]int32) {
+	t.Helper()
+	cart, err := s.GetCart(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("GetCart(%q): %v", userID, err)
+	}
+	got := quantities(t, cart.GetItems())
+	if len(got) != len(want) {
+		t.Errorf("cart %q = %v, want %v", userID, got, want)
+		return
+	}
+	for productID, quantity := range want {
+		if got[productID] != quantity {
+			t.Errorf("cart %q = %v, want %v", userID, got, want)
+			return
+		}
+	}
+}
+
+func testMissingCart(t *testing.T, s Store) {
+	ctx := context.Background()
+	cart, err := s.GetCart(ctx, "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.GetUserId() != "nobody" || len(cart.GetItems()) != 0 {
+		t.Errorf("GetCart of a missing cart = %v, want an empty cart for nobody", cart)
+	}
+	if ok, err := s.CartExists(ctx, "nobody"); err != nil || ok {
+		t.Errorf("CartExists of a missing cart = %v, %v; want false", ok, err)
+	}
+}
+
+func testAddItem(t *testing.T, s Store) {
+	ctx := context.Background()
+	for _, add := range []struct {
+		productID string
+		quantity  int32
+	}{
+		{"OLJCESPC7Z", 2},
+		{"66VCHSJNUP", 1},
+		{"OLJCESPC7Z", 3},
+	} {
+		if err := s.AddItem(ctx, "user-1", add.productID, add.quantity, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCart(t, s, "user-1", map[string]int32{"OLJCESPC7Z": 5, "66VCHSJNUP": 1})
+	if ok, err := s.CartExists(ctx, "user-1"); err != nil || !ok {
+		t.Errorf("CartExists after AddItem = %v, %v; want true", ok, err)
+	}
+}
+
+func testAddItems(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	err := s.AddItems(ctx, "user-1", []*pb.CartItem{
+		{ProductId: "OLJCESPC7Z", Quantity: 2},
+		{ProductId: "66VCHSJNUP", Quantity: 1},
+		{ProductId: "66VCHSJNUP", Quantity: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCart(t, s, "user-1", map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 5})
+}
+
+func testUpdateItemQuantity(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "user-1", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		productID string
+		quantity  int32
+		want      map[string]int32
+	}{
+		{"OLJCESPC7Z", 7, map[string]int32{"OLJCESPC7Z": 7, "66VCHSJNUP": 1}},
+		{"1YMWWN1N4O", 4, map[string]int32{"OLJCESPC7Z": 7, "66VCHSJNUP": 1, "1YMWWN1N4O": 4}},
+		{"66VCHSJNUP", 0, map[string]int32{"OLJCESPC7Z": 7, "1YMWWN1N4O": 4}},
+		{"L9ECAV7KIM", 0, map[string]int32{"OLJCESPC7Z": 7, "1YMWWN1N4O": 4}},
+	}
+	for _, tt := range tests {
+		if err := s.UpdateItemQuantity(ctx, "user-1", tt.productID, tt.quantity); err != nil {
+			t.Fatalf("UpdateItemQuantity(%s, %d): %v", tt.productID, tt.quantity, err)
+		}
+		checkCart(t, s, "user-1", tt.want)
+	}
+}
+
+func testEmptyCart(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "user-1", "66VCHSJNUP", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveForLater(ctx, "user-1", "66VCHSJNUP"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LockCurrency(ctx, "user-1", "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EmptyCart(ctx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	checkCart(t, s, "user-1", nil)
+	saved, err := s.GetSavedItems(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quantities(t, saved); len(got) != 1 || got["66VCHSJNUP"] != 1 {
+		t.Errorf("saved items after EmptyCart = %v, want the saved line kept", got)
+	}
+	// The currency lock goes with the items.
+	if got, err := s.LockCurrency(ctx, "user-1", "USD"); err != nil || got != "USD" {
+		t.Errorf("LockCurrency after EmptyCart = %q, %v; want USD", got, err)
+	}
+	if err := s.EmptyCart(ctx, "nobody"); err != nil {
+		t.Errorf("EmptyCart of a missing cart: %v", err)
+	}
+}
+
+func testLockCurrency(t *testing.T, s Store) {
+	ctx := context.Background()
+	for _, tt := range []struct{ currency, want string }{
+		{"EUR", "EUR"},
+		{"USD", "EUR"},
+	} {
+		got, err := s.LockCurrency(ctx, "user-1", tt.currency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("LockCurrency(%s) = %s, want %s", tt.currency, got, tt.want)
+		}
+	}
+	cart, err := s.GetCart(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.GetCurrencyCode() != "EUR" {
+		t.Errorf("cart currency = %q, want EUR", cart.GetCurrencyCode())
+	}
+}
+
+func testMergeCarts(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.AddItem(ctx, "guest", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "guest", "1YMWWN1N4O", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveForLater(ctx, "guest", "1YMWWN1N4O"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "member", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddItem(ctx, "member", "66VCHSJNUP", 3, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.MergeCarts(ctx, "guest", "member"); err != nil {
+		t.Fatal(err)
+	}
+	checkCart(t, s, "member", map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 3})
+	saved, err := s.GetSavedItems(ctx, "member")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quantities(t, saved); len(got) != 1 || got["1YMWWN1N4O"] != 1 {
+		t.Errorf("merged saved items = %v, want the guest's saved line", got)
+	}
+	if ok, err := s.CartExists(ctx, "guest"); err != nil || ok {
+		t.Errorf("CartExists of the merged-from cart = %v, %v; want false", ok, err)
+	}
+
+	// A missing source cart is a no-op.
+	if err := s.MergeCarts(ctx, "nobody", "member"); err != nil {
+		t.Fatal(err)
+	}
+	checkCart(t, s, "member", map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 3})
+}
+
+func testSavedItems(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveForLater(ctx, "user-1", "OLJCESPC7Z"); err != nil {
+		t.Fatal(err)
+	}
+	checkCart(t, s, "user-1", nil)
+	if err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveForLater(ctx, "user-1", "OLJCESPC7Z"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := s.GetSavedItems(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quantities(t, saved); len(got) != 1 || got["OLJCESPC7Z"] != 3 {
+		t.Errorf("saved items = %v, want OLJCESPC7Z:3", got)
+	}
+	if err := s.MoveToCart(ctx, "user-1", "OLJCESPC7Z"); err != nil {
+		t.Fatal(err)
+	}
+	checkCart(t, s, "user-1", map[string]int32{"OLJCESPC7Z": 3})
+
+	for name, move := range map[string]func(context.Context, string, string) error{
+		"SaveForLater": s.SaveForLater,
+		"MoveToCart":   s.MoveToCart,
+	} {
+		if err := move(ctx, "user-1", "66VCHSJNUP"); status.Code(err) != codes.NotFound {
+			t.Errorf("%s of a product that isn't there: got %v, want %s", name, err, codes.NotFound)
+		}
+	}
+	checkCart(t, s, "user-1", map[string]int32{"OLJCESPC7Z": 3})
+}
+
+func testIsolation(t *testing.T, s Store) {
+	ctx := context.Background()
+	users := []string{"user-1", "user-2", "user-1:gifts"}
+	for i, userID := range users {
+		if err := s.AddItem(ctx, userID, "OLJCESPC7Z", int32(i+1), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.EmptyCart(ctx, "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	checkCart(t, s, "user-1", map[string]int32{"OLJCESPC7Z": 1})
+	checkCart(t, s, "user-2", nil)
+	checkCart(t, s, "user-1:gifts", map[string]int32{"OLJCESPC7Z": 3})
+}
+
+// testConcurrentAddItem checks that concurrent adds to one cart are never
+// lost. A store may refuse an add with Aborted when it loses a race, but
+// every add it accepts must be counted.
+func testConcurrentAddItem(t *testing.T, s Store) {
+	ctx := context.Background()
+	const workers = 20
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int32
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.AddItem(ctx, "user-1", "OLJCESPC7Z", 1, nil)
+			if err != nil {
+				if got := status.Code(err); got != codes.Aborted {
+					t.Errorf("AddItem: got %s, want OK or %s", got, codes.Aborted)
+				}
+				return
+			}
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if accepted == 0 {
+		t.Fatal("every concurrent AddItem was refused")
+	}
+	checkCart(t, s, "user-1", map[string]int32{"OLJCESPC7Z": accepted})
+}
+
+// testLimits checks that a cart holds as many lines and as large a quantity
+// as it is given. cartservice's MAX_CART_ITEMS and MAX_ITEM_QUANTITY are
+// enforced above the store and count on it not dropping or capping either.
+func testLimits(t *testing.T, s Store) {
+	ctx := context.Background()
+	const lines = 200
+	items := make([]*pb.CartItem, lines)
+	want := make(map[string]int32, lines)
+	for i := range items {
+		productID := fmt.Sprintf("PRODUCT%04d", i)
+		items[i] = &pb.CartItem{ProductId: productID, Quantity: 1}
+		want[productID] = 1
+	}
+	if err := s.AddItems(ctx, "user-1", items); err != nil {
+		t.Fatal(err)
+	}
+	const large = 1 << 30
+	if err := s.UpdateItemQuantity(ctx, "user-1", "PRODUCT0000", large); err != nil {
+		t.Fatal(err)
+	}
+	want["PRODUCT0000"] = large
+	checkCart(t, s, "user-1", want)
+}
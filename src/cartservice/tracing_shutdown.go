@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	defaultTraceShutdownAttempts = 1
+	defaultTraceShutdownTimeout  = 5 * time.Second
+)
+
+// shutdownExporter wraps the span exporter so that the spans still buffered
+// when the service stops get a few tries at reaching the collector instead of
+// being dropped on the first failure. Exports made while the service is
+// running go straight through.
+type shutdownExporter struct {
+	sdktrace.SpanExporter
+	attempts int
+	timeout  time.Duration
+
+	shuttingDown atomic.Bool
+}
+
+func newShutdownExporter(exporter sdktrace.SpanExporter, attempts int, timeout time.Duration) *shutdownExporter {
+	return &shutdownExporter{SpanExporter: exporter, attempts: max(attempts, 1), timeout: timeout}
+}
+
+// ExportSpans gives each attempt its own timeout once shutdown has started.
+func (e *shutdownExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if !e.shuttingDown.Load() {
+		return e.SpanExporter.ExportSpans(ctx, spans)
+	}
+	var err error
+	for attempt := 1; attempt <= e.attempts; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, e.timeout)
+		err = e.SpanExporter.ExportSpans(attemptCtx, spans)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		log.Warnf("Exporting %d spans on shutdown failed (attempt %d/%d): %v", len(spans), attempt, e.attempts, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return err
+}
+
+// shutdownTracing flushes the spans buffered in tp and shuts it down. The
+// whole shutdown is bounded by the exporter's attempts times its timeout.
+// The flush is done separately because Shutdown alone does not report spans
+// that failed to export.
+func shutdownTracing(tp *sdktrace.TracerProvider, exporter *shutdownExporter) error {
+	exporter.shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(exporter.attempts)*exporter.timeout)
+	defer cancel()
+	return errors.Join(tp.ForceFlush(ctx), tp.Shutdown(ctx))
+}
+
+// traceShutdownAttemptsFromEnv reads TRACE_SHUTDOWN_ATTEMPTS, the number of
+// times a span export is tried while shutting down.
+func traceShutdownAttemptsFromEnv() int {
+	v := os.Getenv("TRACE_SHUTDOWN_ATTEMPTS")
+	if v == "" {
+		return defaultTraceShutdownAttempts
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Warnf("Ignoring invalid TRACE_SHUTDOWN_ATTEMPTS %q, using %d", v, defaultTraceShutdownAttempts)
+		return defaultTraceShutdownAttempts
+	}
+	return n
+}
+
+// traceShutdownTimeoutFromEnv reads TRACE_SHUTDOWN_TIMEOUT, the time each
+// shutdown export attempt is allowed.
+func traceShutdownTimeoutFromEnv() time.Duration {
+	v := os.Getenv("TRACE_SHUTDOWN_TIMEOUT")
+	if v == "" {
+		return defaultTraceShutdownTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Warnf("Ignoring invalid TRACE_SHUTDOWN_TIMEOUT %q, using %v", v, defaultTraceShutdownTimeout)
+		return defaultTraceShutdownTimeout
+	}
+	return d
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func TestUpdateItemQuantity(t *testing.T) {
+	tests := []struct {
+		name      string
+		productID string
+		quantity  int32
+		wantCode  codes.Code
+		want      map[string]int32
+	}{
+		{"raise", "OLJCESPC7Z", 7, codes.OK, map[string]int32{"OLJCESPC7Z": 7, "66VCHSJNUP": 1}},
+		{"lower", "OLJCESPC7Z", 1, codes.OK, map[string]int32{"OLJCESPC7Z": 1, "66VCHSJNUP": 1}},
+		{"zero removes", "OLJCESPC7Z", 0, codes.OK, map[string]int32{"66VCHSJNUP": 1}},
+		{"new product", "1YMWWN1N4O", 2, codes.OK, map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1, "1YMWWN1N4O": 2}},
+		{"zero for missing product", "1YMWWN1N4O", 0, codes.OK, map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}},
+		{"over cap", "OLJCESPC7Z", 11, codes.ResourceExhausted, map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}},
+		{"negative", "OLJCESPC7Z", -1, codes.InvalidArgument, map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}},
+		{"missing product ID", "", 1, codes.InvalidArgument, map[string]int32{"OLJCESPC7Z": 3, "66VCHSJNUP": 1}},
+	}
+	for storeName, newStore := range testCartStores() {
+		for _, tt := range tests {
+			t.Run(storeName+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				s := &cartServer{store: newStore(t), maxItemQuantity: 10}
+				for _, item := range []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 3}, {ProductId: "66VCHSJNUP", Quantity: 1}} {
+					if _, err := s.AddItem(ctx, &pb.AddItemRequest{UserId: "user-1", Item: item}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				_, err := s.UpdateItemQuantity(ctx, &pb.UpdateItemQuantityRequest{UserId: "user-1", ProductId: tt.productID, Quantity: tt.quantity})
+				if got := status.Code(err); got != tt.wantCode {
+					t.Fatalf("got %s, want %s", got, tt.wantCode)
+				}
+
+				cart, err := s.GetCart(ctx, &pb.GetCartRequest{UserId: "user-1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make(map[string]int32)
+				for _, item := range cart.Items {
+					got[item.ProductId] = item.Quantity
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("got cart %v, want %v", got, tt.want)
+				}
+				for id, q := range tt.want {
+					if got[id] != q {
+						t.Errorf("got cart %v, want %v", got, tt.want)
+						break
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+// violations collects what is wrong with a request, field by field.
+type violations []*errdetails.BadRequest_FieldViolation
+
+func (v *violations) add(field, format string, args ...interface{}) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{Field: field, Description: fmt.Sprintf(format, args...)})
+}
+
+func (v *violations) requireID(field, value string) {
+	if value == "" {
+		v.add(field, "must not be empty")
+	}
+}
+
+// checkUserID requires a user ID without ':', which separates the user
+// from the cart name in named cart keys.
+func (v *violations) checkUserID(field, value string) {
+	switch {
+	case value == "":
+		v.add(field, "must not be empty")
+	case strings.Contains(value, ":"):
+		v.add(field, "must not contain ':'")
+	}
+}
+
+func (v *violations) checkSource(field, source string) {
+	if source != "" && !itemSourcePattern.MatchString(source) {
+		v.add(field, "must be lowercase letters, digits and '_', at most 32 long")
+	}
+}
+
+func (v *violations) checkCartName(field, name string) {
+	if name != "" && name != defaultCartName && !cartNamePattern.MatchString(name) {
+		v.add(field, "must be lowercase letters, digits, '-' and '_', at most 64 long")
+	}
+}
+
+// validateCartRequest checks the parts of a CartService request that don't
+// depend on configuration or stored state. Requests of other types pass.
+func validateCartRequest(req interface{}) violations {
+	var v violations
+	switch req := req.(type) {
+	case *pb.AddItemRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		if req.GetItem() == nil {
+			v.add("item", "is required")
+		} else {
+			v.requireID("item.product_id", req.GetItem().GetProductId())
+			if q := req.GetItem().GetQuantity(); q <= 0 {
+				v.add("item.quantity", "must be positive, got %d", q)
+			}
+		}
+		v.checkSource("source", req.GetSource())
+		v.checkCartName("cart_name", req.GetCartName())
+		if len(req.GetIdempotencyKey()) > maxIdempotencyKeyLen {
+			v.add("idempotency_key", "must be at most %d characters", maxIdempotencyKeyLen)
+		}
+	case *pb.AddItemsRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		if len(req.GetItems()) == 0 {
+			v.add("items", "must not be empty")
+		}
+		for i, item := range req.GetItems() {
+			v.requireID(fmt.Sprintf("items[%d].product_id", i), item.GetProductId())
+			if q := item.GetQuantity(); q <= 0 {
+				v.add(fmt.Sprintf("items[%d].quantity", i), "must be positive, got %d", q)
+			}
+			v.checkSource(fmt.Sprintf("items[%d].source", i), item.GetSource())
+		}
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.UpdateItemQuantityRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.requireID("product_id", req.GetProductId())
+		if q := req.GetQuantity(); q < 0 {
+			v.add("quantity", "must not be negative, got %d", q)
+		}
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.GetCartRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.EmptyCartRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.CartExistsRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.BatchGetCartRequest:
+		for i, id := range req.GetUserIds() {
+			v.checkUserID(fmt.Sprintf("user_ids[%d]", i), id)
+		}
+	case *pb.MergeCartsRequest:
+		v.checkUserID("from_user_id", req.GetFromUserId())
+		v.checkUserID("to_user_id", req.GetToUserId())
+	case *pb.ExportCartRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.ImportCartRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		if len(req.GetData()) == 0 {
+			v.add("data", "must not be empty")
+		}
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.SaveForLaterRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.requireID("product_id", req.GetProductId())
+	case *pb.MoveToCartRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.requireID("product_id", req.GetProductId())
+	case *pb.GetSavedItemsRequest:
+		v.checkUserID("user_id", req.GetUserId())
+	case *pb.ListCartsRequest:
+		v.checkUserID("user_id", req.GetUserId())
+	case *pb.RestoreLastCartRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.checkCartName("cart_name", req.GetCartName())
+	case *pb.GetCartHistoryRequest:
+		v.checkUserID("user_id", req.GetUserId())
+		v.checkCartName("cart_name", req.GetCartName())
+		if l := req.GetLimit(); l < 0 || l > maxCartHistoryLimit {
+			v.add("limit", "must be between 0 and %d, got %d", maxCartHistoryLimit, l)
+		}
+	}
+	return v
+}
+
+// invalidArgument turns v into an InvalidArgument status carrying a
+// BadRequest detail, so clients can point at the offending fields.
+func invalidArgument(v violations) error {
+	msgs := make([]string, len(v))
+	for i, fv := range v {
+		msgs[i] = fv.GetField() + " " + fv.GetDescription()
+	}
+	st := status.New(codes.InvalidArgument, "invalid request: "+strings.Join(msgs, "; "))
+	if withDetails, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: v}); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// validationInterceptor rejects malformed CartService requests before they
+// reach the handlers.
+func validationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if v := validateCartRequest(req); len(v) > 0 {
+		return nil, invalidArgument(v)
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/cartservice/genproto"
+)
+
+func violatedFields(v violations) []string {
+	var fields []string
+	for _, fv := range v {
+		fields = append(fields, fv.GetField())
+	}
+	return fields
+}
+
+func TestValidateCartRequest(t *testing.T) {
+	item := func(id string, q int32) *pb.CartItem { return &pb.CartItem{ProductId: id, Quantity: q} }
+	tests := []struct {
+		name string
+		req  interface{}
+		want []string
+	}{
+		{"add ok", &pb.AddItemRequest{UserId: "u", Item: item("OLJCESPC7Z", 1)}, nil},
+		{"add empty user", &pb.AddItemRequest{Item: item("OLJCESPC7Z", 1)}, []string{"user_id"}},
+		{"add colon in user", &pb.AddItemRequest{UserId: "u:gifts", Item: item("OLJCESPC7Z", 1)}, []string{"user_id"}},
+		{"add no item", &pb.AddItemRequest{UserId: "u"}, []string{"item"}},
+		{"add empty product", &pb.AddItemRequest{UserId: "u", Item: item("", 1)}, []string{"item.product_id"}},
+		{"add zero quantity", &pb.AddItemRequest{UserId: "u", Item: item("OLJCESPC7Z", 0)}, []string{"item.quantity"}},
+		{"add negative quantity", &pb.AddItemRequest{UserId: "u", Item: item("OLJCESPC7Z", -3)}, []string{"item.quantity"}},
+		{"add everything wrong", &pb.AddItemRequest{Item: item("", -1), CartName: "Bad"},
+			[]string{"user_id", "item.product_id", "item.quantity", "cart_name"}},
+		{"add long idempotency key", &pb.AddItemRequest{UserId: "u", Item: item("OLJCESPC7Z", 1), IdempotencyKey: strings.Repeat("k", 129)},
+			[]string{"idempotency_key"}},
+		{"add with source", &pb.AddItemRequest{UserId: "u", Item: item("OLJCESPC7Z", 1), Source: "recommendation"}, nil},
+		{"add bad source", &pb.AddItemRequest{UserId: "u", Item: item("OLJCESPC7Z", 1), Source: "Ad Click"}, []string{"source"}},
+		{"add long source", &pb.AddItemRequest{UserId: "u", Item: item("OLJCESPC7Z", 1), Source: strings.Repeat("s", 33)}, []string{"source"}},
+		{"add items ok", &pb.AddItemsRequest{UserId: "u", Items: []*pb.CartItem{item("OLJCESPC7Z", 1), item("66VCHSJNUP", 2)}}, nil},
+		{"add items empty list", &pb.AddItemsRequest{UserId: "u"}, []string{"items"}},
+		{"add items bad entries", &pb.AddItemsRequest{UserId: "u", Items: []*pb.CartItem{item("OLJCESPC7Z", 1), item("", 0)}},
+			[]string{"items[1].product_id", "items[1].quantity"}},
+		{"add items bad source", &pb.AddItemsRequest{UserId: "u", Items: []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1, Source: "a-d"}}},
+			[]string{"items[0].source"}},
+		{"update to zero removes", &pb.UpdateItemQuantityRequest{UserId: "u", ProductId: "OLJCESPC7Z"}, nil},
+		{"update negative", &pb.UpdateItemQuantityRequest{UserId: "u", ProductId: "OLJCESPC7Z", Quantity: -1}, []string{"quantity"}},
+		{"update empty product", &pb.UpdateItemQuantityRequest{UserId: "u", Quantity: 1}, []string{"product_id"}},
+		{"get default cart", &pb.GetCartRequest{UserId: "u", CartName: "default"}, nil},
+		{"get empty user", &pb.GetCartRequest{}, []string{"user_id"}},
+		{"get bad cart name", &pb.GetCartRequest{UserId: "u", CartName: "a:b"}, []string{"cart_name"}},
+		{"empty cart empty user", &pb.EmptyCartRequest{}, []string{"user_id"}},
+		{"exists empty user", &pb.CartExistsRequest{}, []string{"user_id"}},
+		{"batch empty list", &pb.BatchGetCartRequest{}, nil},
+		{"batch empty id", &pb.BatchGetCartRequest{UserIds: []string{"u", ""}}, []string{"user_ids[1]"}},
+		{"batch colon in id", &pb.BatchGetCartRequest{UserIds: []string{"u:gifts"}}, []string{"user_ids[0]"}},
+		{"merge missing both", &pb.MergeCartsRequest{}, []string{"from_user_id", "to_user_id"}},
+		{"export empty user", &pb.ExportCartRequest{}, []string{"user_id"}},
+		{"import no data", &pb.ImportCartRequest{UserId: "u"}, []string{"data"}},
+		{"save empty product", &pb.SaveForLaterRequest{UserId: "u"}, []string{"product_id"}},
+		{"move empty user", &pb.MoveToCartRequest{ProductId: "OLJCESPC7Z"}, []string{"user_id"}},
+		{"saved items empty user", &pb.GetSavedItemsRequest{}, []string{"user_id"}},
+		{"list carts empty user", &pb.ListCartsRequest{}, []string{"user_id"}},
+		{"restore empty user", &pb.RestoreLastCartRequest{CartName: "Wish List"}, []string{"user_id", "cart_name"}},
+		{"history ok", &pb.GetCartHistoryRequest{UserId: "u", CartName: "wishlist", Limit: 10}, nil},
+		{"history bad", &pb.GetCartHistoryRequest{CartName: "Wish List", Limit: 1001}, []string{"user_id", "cart_name", "limit"}},
+		{"other services pass", &pb.Empty{}, nil},
+	}
+	for _, tt := range tests {
+		if got := violatedFields(validateCartRequest(tt.req)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got violations on %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidationInterceptor(t *testing.T) {
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(validationInterceptor))
+	pb.RegisterCartServiceServer(srv, &cartServer{store: newMemoryCartStore()})
+	client := pb.NewCartServiceClient(newTestGRPCConn(t, srv))
+	ctx := context.Background()
+
+	_, err := client.AddItem(ctx, &pb.AddItemRequest{Item: &pb.CartItem{ProductId: "OLJCESPC7Z"}})
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	var fields []string
+	for _, d := range st.Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, fv := range br.GetFieldViolations() {
+				fields = append(fields, fv.GetField())
+			}
+		}
+	}
+	if want := []string{"user_id", "item.quantity"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("got field violations %v, want %v", fields, want)
+	}
+
+	if _, err := client.AddItem(ctx, &pb.AddItemRequest{UserId: "u", Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}}); err != nil {
+		t.Errorf("valid request rejected: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eventbus publishes domain events to the message broker picked by
+// EVENT_BUS, so services can announce what happened without knowing who
+// listens. It is kept identical in cartservice and checkoutservice.
+package eventbus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/protobuf/proto"
+)
+
+// EventTypeHeader is the header holding an event's full protobuf name, such
+// as "hipstershop.CartItemAdded", so consumers of a topic carrying several
+// events know how to decode each one.
+const EventTypeHeader = "event-type"
+
+// Message is one encoded event.
+type Message struct {
+	// Key groups related events, such as one user's. Brokers that can
+	// keep order, Kafka and Pub/Sub, keep it among events sharing a key.
+	Key     string
+	Data    []byte
+	Headers map[string]string
+}
+
+// Publisher sends messages to a broker.
+type Publisher interface {
+	// Publish sends msg to topic and waits until the broker has it.
+	Publish(ctx context.Context, topic string, msg Message) error
+	// Close flushes pending messages and releases the connection.
+	Close() error
+}
+
+// NewMessage encodes event as a message keyed by key, carrying the event
+// type and the trace context of ctx in its headers.
+func NewMessage(ctx context.Context, key string, event proto.Message) (Message, error) {
+	data, err := proto.Marshal(event)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to encode %s: %w", proto.MessageName(event), err)
+	}
+	headers := map[string]string{EventTypeHeader: string(proto.MessageName(event))}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+	return Message{Key: key, Data: data, Headers: headers}, nil
+}
+
+// FromEnv returns the publisher EVENT_BUS selects: "kafka", "nats",
+// "pubsub" or "memory". It returns nil when EVENT_BUS is unset, meaning
+// events are off, except that KAFKA_BROKERS alone still selects Kafka.
+func FromEnv(ctx context.Context) (Publisher, error) {
+	kind := os.Getenv("EVENT_BUS")
+	if kind == "" && os.Getenv("KAFKA_BROKERS") != "" {
+		kind = "kafka"
+	}
+	switch kind {
+	case "":
+		return nil, nil
+	case "kafka":
+		brokers := splitList(os.Getenv("KAFKA_BROKERS"))
+		if len(brokers) == 0 {
+			return nil, fmt.Errorf("EVENT_BUS=kafka needs KAFKA_BROKERS")
+		}
+		return NewKafka(brokers), nil
+	case "nats":
+		return NewNATS(os.Getenv("NATS_URL"))
+	case "pubsub":
+		project := os.Getenv("PUBSUB_PROJECT_ID")
+		if project == "" {
+			project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+		}
+		if project == "" {
+			return nil, fmt.Errorf("EVENT_BUS=pubsub needs PUBSUB_PROJECT_ID or GOOGLE_CLOUD_PROJECT")
+		}
+		return NewPubSub(ctx, project)
+	case "memory":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unsupported EVENT_BUS %q", kind)
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventbus
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS publishes to NATS subjects named after the topic. Core NATS has no
+// partitions, so message keys are only passed along as the "event-key"
+// header.
+type NATS struct {
+	conn *nats.Conn
+}
+
+// NewNATS connects to url, or to the local default server when url is
+// empty.
+func NewNATS(url string) (*NATS, error) {
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err := nats.Connect(url, nats.Name("hipstershop"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{conn: conn}, nil
+}
+
+func (n *NATS) Publish(ctx context.Context, topic string, msg Message) error {
+	nm := nats.NewMsg(topic)
+	nm.Data = msg.Data
+	for name, value := range msg.Headers {
+		nm.Header.Set(name, value)
+	}
+	if msg.Key != "" {
+		nm.Header.Set("event-key", msg.Key)
+	}
+	if err := n.conn.PublishMsg(nm); err != nil {
+		return err
+	}
+	// Wait for the server to have it, like the other publishers do.
+	return n.conn.FlushWithContext(ctx)
+}
+
+func (n *NATS) Close() error {
+	return n.conn.Drain()
+}
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -30,6 +32,7 @@ import (
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/status"
 
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/eventbus"
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
 	money "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/money"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
@@ -85,6 +88,9 @@ type checkoutService struct {
 
 	paymentSvcAddr string
 	paymentSvcConn *grpc.ClientConn
+
+	// events, when set, publishes an OrderPlaced event for every order.
+	events *orderPublisher
 }
 
 func main() {
@@ -127,6 +133,15 @@ func main() {
 	mustConnGRPC(ctx, &svc.emailSvcConn, svc.emailSvcAddr)
 	mustConnGRPC(ctx, &svc.paymentSvcConn, svc.paymentSvcAddr)
 
+	bus, err := eventbus.FromEnv(ctx)
+	if err != nil {
+		log.Warnf("failed to set up the event bus, order events are off: %+v", err)
+	} else if bus != nil {
+		topic := orderEventsTopicFromEnv()
+		svc.events = newOrderPublisher(bus, topic)
+		log.Infof("publishing order events to topic %s", topic)
+	}
+
 	log.Infof("service config: %+v", svc)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
@@ -143,9 +158,21 @@ func main() {
 	pb.RegisterCheckoutServiceServer(srv, svc)
 	healthcheck := health.NewServer()
 	healthpb.RegisterHealthServer(srv, healthcheck)
+	registerDebugServices(srv, false)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		log.Info("shutting down, finishing in-flight orders")
+		srv.GracefulStop()
+	}()
 	log.Infof("starting to listen on tcp: %q", lis.Addr().String())
-	err = srv.Serve(lis)
-	log.Fatal(err)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+	if svc.events != nil {
+		svc.events.close()
+	}
 }
 
 func initTracing(ctx context.Context, serviceName string) (*sdktrace.TracerProvider, error) {
@@ -268,6 +295,7 @@ func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderReq
 	} else {
 		log.Infof("order confirmation email sent to %q", req.Email)
 	}
+	cs.publishOrderPlaced(ctx, req.UserId, orderResult, &total, txID)
 	resp := &pb.PlaceOrderResponse{Order: orderResult}
 	return resp, nil
 }
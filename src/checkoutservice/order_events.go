@@ -0,0 +1,133 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/eventbus"
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const defaultOrderEventsTopic = "order-events"
+
+// orderEventQueueSize is how many events may wait to be published before
+// new ones are dropped.
+const orderEventQueueSize = 1024
+
+// orderEventPublishTimeout bounds each publish, so a broker that stops
+// answering holds up the queue only so long.
+const orderEventPublishTimeout = 5 * time.Second
+
+// orderEventsTopicFromEnv reads ORDER_EVENTS_TOPIC, the topic, or NATS
+// subject, order events go to.
+func orderEventsTopicFromEnv() string {
+	if topic := os.Getenv("ORDER_EVENTS_TOPIC"); topic != "" {
+		return topic
+	}
+	return defaultOrderEventsTopic
+}
+
+// orderPublisher publishes order events to one topic of an event bus.
+// Events are queued and published by a single goroutine, so a slow or
+// unreachable broker never holds up PlaceOrder once the card is charged.
+type orderPublisher struct {
+	bus   eventbus.Publisher
+	topic string
+	done  chan struct{}
+
+	mu sync.Mutex
+	// queue is nil once closed.
+	queue chan eventbus.Message
+}
+
+func newOrderPublisher(bus eventbus.Publisher, topic string) *orderPublisher {
+	p := &orderPublisher{
+		bus:   bus,
+		topic: topic,
+		queue: make(chan eventbus.Message, orderEventQueueSize),
+		done:  make(chan struct{}),
+	}
+	go p.run(p.queue)
+	return p
+}
+
+// publish queues msg without waiting for the broker, dropping it if the
+// queue is full or the publisher closed.
+func (p *orderPublisher) publish(msg eventbus.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queue == nil {
+		log.Warnf("event publisher is closed, dropping OrderPlaced for user %s", msg.Key)
+		return
+	}
+	select {
+	case p.queue <- msg:
+	default:
+		log.Warnf("order event queue is full, dropping OrderPlaced for user %s", msg.Key)
+	}
+}
+
+func (p *orderPublisher) run(queue <-chan eventbus.Message) {
+	defer close(p.done)
+	for msg := range queue {
+		ctx, cancel := context.WithTimeout(context.Background(), orderEventPublishTimeout)
+		if err := p.bus.Publish(ctx, p.topic, msg); err != nil {
+			log.Warnf("failed to publish OrderPlaced for user %s: %+v", msg.Key, err)
+		}
+		cancel()
+	}
+}
+
+// close publishes the events still queued, then closes the bus.
+func (p *orderPublisher) close() {
+	p.mu.Lock()
+	if p.queue != nil {
+		close(p.queue)
+		p.queue = nil
+	}
+	p.mu.Unlock()
+	<-p.done
+	if err := p.bus.Close(); err != nil {
+		log.Warnf("failed to close the event bus: %+v", err)
+	}
+}
+
+// publishOrderPlaced announces a completed order on the event bus, if one
+// is configured. The order has already gone through, so the event is
+// queued rather than awaited, and a failure is only logged.
+func (cs *checkoutService) publishOrderPlaced(ctx context.Context, userID string, order *pb.OrderResult, total *pb.Money, txID string) {
+	if cs.events == nil {
+		return
+	}
+	// Encoded now, to carry the request's trace context.
+	msg, err := eventbus.NewMessage(ctx, userID, &pb.OrderPlaced{
+		UserId:        userID,
+		Order:         order,
+		Total:         total,
+		TransactionId: txID,
+		OccurredAt:    timestamppb.Now(),
+	})
+	if err != nil {
+		log.Errorf("failed to encode order event: %+v", err)
+		return
+	}
+	cs.events.publish(msg)
+}
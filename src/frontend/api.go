@@ -0,0 +1,534 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/validator"
+)
+
+// maxAPIBodyBytes caps the JSON bodies the API reads.
+const maxAPIBodyBytes = 64 << 10
+
+// registerAPIRoutes adds the JSON API, a headless counterpart of the HTML
+// pages for mobile and single-page clients, under baseUrl+"/api/v1". It
+// keeps the user's session and currency in the same cookies as the pages.
+func (fe *frontendServer) registerAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix(baseUrl + "/api/v1").Subrouter()
+	api.HandleFunc("/products", fe.apiListProductsHandler).Methods(http.MethodGet)
+	api.HandleFunc("/products/{id}", fe.apiGetProductHandler).Methods(http.MethodGet)
+	api.HandleFunc("/cart", fe.apiGetCartHandler).Methods(http.MethodGet)
+	api.HandleFunc("/cart", fe.apiEmptyCartHandler).Methods(http.MethodDelete)
+	api.HandleFunc("/cart/items", fe.apiAddCartItemHandler).Methods(http.MethodPost)
+	api.HandleFunc("/cart/items/{id}", fe.apiUpdateCartItemHandler).Methods(http.MethodPut)
+	api.HandleFunc("/cart/restore", fe.apiRestoreCartHandler).Methods(http.MethodPost)
+	api.HandleFunc("/checkout", fe.apiPlaceOrderHandler).Methods(http.MethodPost)
+	api.HandleFunc("/currencies", fe.apiCurrenciesHandler).Methods(http.MethodGet)
+	api.HandleFunc("/currency", fe.apiSetCurrencyHandler).Methods(http.MethodPut)
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusNotFound, apiErrorBody{Error: apiError{Status: http.StatusNotFound, Message: "no such API endpoint"}})
+	})
+}
+
+type apiMoney struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+}
+
+func newAPIMoney(m *pb.Money) *apiMoney {
+	if m == nil {
+		return nil
+	}
+	return &apiMoney{CurrencyCode: m.GetCurrencyCode(), Units: m.GetUnits(), Nanos: m.GetNanos()}
+}
+
+type apiProduct struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Picture     string    `json:"picture"`
+	Categories  []string  `json:"categories"`
+	Price       *apiMoney `json:"price"`
+}
+
+func newAPIProduct(p *pb.Product, price *pb.Money) apiProduct {
+	return apiProduct{
+		ID:          p.GetId(),
+		Name:        p.GetName(),
+		Description: p.GetDescription(),
+		Picture:     p.GetPicture(),
+		Categories:  p.GetCategories(),
+		Price:       newAPIMoney(price),
+	}
+}
+
+type apiCartItem struct {
+	Product  apiProduct `json:"product"`
+	Quantity int32      `json:"quantity"`
+	// Total is the product's price times the quantity.
+	Total *apiMoney `json:"total"`
+}
+
+type apiCart struct {
+	Items        []apiCartItem `json:"items"`
+	Currency     string        `json:"currency"`
+	ShippingCost *apiMoney     `json:"shipping_cost"`
+	TotalCost    *apiMoney     `json:"total_cost"`
+	// Version goes back in cart_version to refuse changes to a cart that
+	// changed since it was read.
+	Version int64 `json:"version"`
+	// Stale is set when the cart is a cached copy served while cartservice
+	// is failing.
+	Stale bool `json:"stale,omitempty"`
+}
+
+type apiOrderItem struct {
+	ProductID string    `json:"product_id"`
+	Quantity  int32     `json:"quantity"`
+	Cost      *apiMoney `json:"cost"`
+}
+
+type apiOrder struct {
+	OrderID            string         `json:"order_id"`
+	ShippingTrackingID string         `json:"shipping_tracking_id"`
+	ShippingCost       *apiMoney      `json:"shipping_cost"`
+	Items              []apiOrderItem `json:"items"`
+	TotalPaid          *apiMoney      `json:"total_paid"`
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// Reason names a failure clients may handle specially, using the
+	// cart page's notice keys such as "cart-full" or "cart-changed".
+	Reason string `json:"reason,omitempty"`
+}
+
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiErrorStatus maps a backend error to the HTTP status the API answers
+// with, and the reason to report for it, if any.
+func apiErrorStatus(err error) (int, string) {
+	if notice := cartLimitNotice(err); notice != "" {
+		return http.StatusConflict, notice
+	}
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest, ""
+	case codes.NotFound:
+		return http.StatusNotFound, ""
+	case codes.AlreadyExists:
+		return http.StatusConflict, ""
+	case codes.Aborted:
+		return http.StatusConflict, cartChangedNotice
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed, ""
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized, ""
+	case codes.PermissionDenied:
+		return http.StatusForbidden, ""
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable, ""
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout, ""
+	}
+	return http.StatusInternalServerError, ""
+}
+
+// writeAPIError answers with err as a JSON error body. Server errors are
+// logged as errors, client errors only at debug level.
+func writeAPIError(log logrus.FieldLogger, w http.ResponseWriter, err error, code int, reason string) {
+	if code >= http.StatusInternalServerError {
+		log.WithField("error", err).Error("request error")
+	} else {
+		log.WithField("error", err).Debug("request refused")
+	}
+	writeJSON(w, code, apiErrorBody{Error: apiError{
+		Status:  code,
+		Message: strings.TrimSpace(err.Error()),
+		Reason:  reason,
+	}})
+}
+
+// writeAPIBackendError answers with the status matching the backend error
+// err, described by msg.
+func writeAPIBackendError(log logrus.FieldLogger, w http.ResponseWriter, err error, msg string) {
+	code, reason := apiErrorStatus(err)
+	writeAPIError(log, w, errors.Wrap(err, msg), code, reason)
+}
+
+// decodeAPIBody reads the JSON request body into v.
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)).Decode(v); err != nil {
+		return errors.Wrap(err, "invalid JSON body")
+	}
+	return nil
+}
+
+func (fe *frontendServer) apiListProductsHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	products, err := fe.getProducts(r.Context())
+	if err != nil {
+		writeAPIBackendError(log, w, err, "could not retrieve products")
+		return
+	}
+	views, partial, err := fe.productViews(r.Context(), log, "api", products, currentCurrency(r))
+	if err != nil {
+		writeAPIBackendError(log, w, err, "could not price products")
+		return
+	}
+	out := make([]apiProduct, len(views))
+	for i, v := range views {
+		out[i] = newAPIProduct(v.Item, v.Price)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Products []apiProduct `json:"products"`
+		// Partial is set when some products were left out because they
+		// could not be priced.
+		Partial bool `json:"partial,omitempty"`
+	}{out, partial})
+}
+
+func (fe *frontendServer) apiGetProductHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	id := mux.Vars(r)["id"]
+	if err := validateProductID(id); err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	p, err := fe.getProduct(r.Context(), id)
+	if err != nil {
+		writeAPIBackendError(log, w, err, "could not retrieve product")
+		return
+	}
+	price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
+	if err != nil {
+		writeAPIBackendError(log, w, err, "failed to convert currency")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIProduct(p, price))
+}
+
+// cartView reads the user's cart priced in currency, with shipping and the
+// total, for the API's cart responses.
+func (fe *frontendServer) cartView(ctx context.Context, userID, currency string) (*apiCart, error) {
+	c, stale, err := fe.getCartWithFallback(ctx, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve cart")
+	}
+	shippingCost, err := fe.getShippingQuote(ctx, c.GetItems(), currency)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get shipping quote")
+	}
+	view := &apiCart{
+		Items:        make([]apiCartItem, 0, len(c.GetItems())),
+		Currency:     currency,
+		ShippingCost: newAPIMoney(shippingCost),
+		Version:      c.GetVersion(),
+		Stale:        stale,
+	}
+	total := pb.Money{CurrencyCode: currency}
+	for _, item := range c.GetItems() {
+		p, err := fe.getProduct(ctx, item.GetProductId())
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId())
+		}
+		price, err := fe.convertCurrency(ctx, p.GetPriceUsd(), currency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId())
+		}
+		line := money.MultiplySlow(*price, uint32(item.GetQuantity()))
+		view.Items = append(view.Items, apiCartItem{
+			Product:  newAPIProduct(p, price),
+			Quantity: item.GetQuantity(),
+			Total:    newAPIMoney(&line),
+		})
+		total = money.Must(money.Sum(total, line))
+	}
+	total = money.Must(money.Sum(total, *shippingCost))
+	view.TotalCost = newAPIMoney(&total)
+	return view, nil
+}
+
+// writeAPICart answers with the user's cart, as read after a change.
+func (fe *frontendServer) writeAPICart(log logrus.FieldLogger, w http.ResponseWriter, r *http.Request) {
+	view, err := fe.cartView(r.Context(), cartUserID(r), currentCurrency(r))
+	if err != nil {
+		code, reason := apiErrorStatus(errors.Cause(err))
+		writeAPIError(log, w, err, code, reason)
+		return
+	}
+	if view.Stale {
+		log.Warn("serving stale cart, cartservice read failed")
+		w.Header().Set(cartStaleHeader, "true")
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (fe *frontendServer) apiGetCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	fe.writeAPICart(log, w, r)
+}
+
+func (fe *frontendServer) apiAddCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	var body struct {
+		ProductID      string      `json:"product_id"`
+		Quantity       json.Number `json:"quantity"`
+		IdempotencyKey string      `json:"idempotency_key"`
+		Source         string      `json:"source"`
+	}
+	if err := decodeAPIBody(w, r, &body); err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	quantity, err := parseQuantity(body.Quantity.String(), fe.maxItemQuantity)
+	if err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	if err := validateProductID(body.ProductID); err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	payload := validator.AddToCartPayload{
+		Quantity:       quantity,
+		ProductID:      body.ProductID,
+		IdempotencyKey: body.IdempotencyKey,
+	}
+	if err := payload.Validate(); err != nil {
+		writeAPIError(log, w, validator.ValidationErrorResponse(err), http.StatusBadRequest, "")
+		return
+	}
+
+	p, err := fe.getProduct(r.Context(), payload.ProductID)
+	if err != nil {
+		writeAPIBackendError(log, w, err, "could not retrieve product")
+		return
+	}
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.insertCart(r.Context(), cartUserID(r), p.GetId(), int32(payload.Quantity), p.GetPriceUsd(), currentCurrency(r), payload.IdempotencyKey, normalizeItemSource(body.Source)); err != nil {
+		writeAPIBackendError(log, w, err, "failed to add to cart")
+		return
+	}
+	fe.writeAPICart(log, w, r)
+}
+
+func (fe *frontendServer) apiUpdateCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	productID := mux.Vars(r)["id"]
+	if err := validateProductID(productID); err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	var body struct {
+		Quantity    json.Number `json:"quantity"`
+		CartVersion *int64      `json:"cart_version"`
+	}
+	if err := decodeAPIBody(w, r, &body); err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	// As on the cart page, a quantity of 0 removes the item.
+	quantity, err := parseQuantityInRange(body.Quantity.String(), 0, fe.maxItemQuantity)
+	if err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.updateCartItemQuantity(r.Context(), cartUserID(r), productID, int32(quantity), body.CartVersion); err != nil {
+		writeAPIBackendError(log, w, err, "failed to update cart")
+		return
+	}
+	fe.writeAPICart(log, w, r)
+}
+
+// apiEmptyCartHandler empties the cart, keeping it for /cart/restore. The
+// cart_version query parameter makes it conditional, as on the cart page.
+func (fe *frontendServer) apiEmptyCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	version, err := expectedCartVersion(r)
+	if err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.emptyCart(r.Context(), cartUserID(r), version, true); err != nil {
+		writeAPIBackendError(log, w, err, "failed to empty cart")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fe *frontendServer) apiRestoreCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.restoreLastCart(r.Context(), cartUserID(r)); err != nil {
+		if code := status.Code(err); code == codes.NotFound || code == codes.FailedPrecondition {
+			writeAPIError(log, w, errors.New("there is no emptied cart to restore"), http.StatusNotFound, restoreGoneNotice)
+			return
+		}
+		writeAPIBackendError(log, w, err, "failed to restore cart")
+		return
+	}
+	fe.writeAPICart(log, w, r)
+}
+
+func (fe *frontendServer) apiPlaceOrderHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	var body struct {
+		Email                     string `json:"email"`
+		StreetAddress             string `json:"street_address"`
+		ZipCode                   int64  `json:"zip_code"`
+		City                      string `json:"city"`
+		State                     string `json:"state"`
+		Country                   string `json:"country"`
+		CreditCardNumber          string `json:"credit_card_number"`
+		CreditCardExpirationMonth int64  `json:"credit_card_expiration_month"`
+		CreditCardExpirationYear  int64  `json:"credit_card_expiration_year"`
+		CreditCardCVV             int64  `json:"credit_card_cvv"`
+	}
+	if err := decodeAPIBody(w, r, &body); err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	payload := validator.PlaceOrderPayload{
+		Email:         body.Email,
+		StreetAddress: body.StreetAddress,
+		ZipCode:       body.ZipCode,
+		City:          body.City,
+		State:         body.State,
+		Country:       body.Country,
+		CcNumber:      body.CreditCardNumber,
+		CcMonth:       body.CreditCardExpirationMonth,
+		CcYear:        body.CreditCardExpirationYear,
+		CcCVV:         body.CreditCardCVV,
+	}
+	if err := payload.Validate(); err != nil {
+		writeAPIError(log, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity, "")
+		return
+	}
+
+	// Read first, so the cleanup after the order never empties items
+	// added to the cart since.
+	orderedVersion := fe.orderedCartVersion(r.Context(), log, cartUserID(r))
+	resp, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).
+		PlaceOrder(r.Context(), &pb.PlaceOrderRequest{
+			Email: payload.Email,
+			CreditCard: &pb.CreditCardInfo{
+				CreditCardNumber:          payload.CcNumber,
+				CreditCardExpirationMonth: int32(payload.CcMonth),
+				CreditCardExpirationYear:  int32(payload.CcYear),
+				CreditCardCvv:             int32(payload.CcCVV)},
+			UserId:       cartUserID(r),
+			UserCurrency: currentCurrency(r),
+			Address: &pb.Address{
+				StreetAddress: payload.StreetAddress,
+				City:          payload.City,
+				State:         payload.State,
+				ZipCode:       int32(payload.ZipCode),
+				Country:       payload.Country},
+		})
+	if err != nil {
+		writeAPIBackendError(log, w, err, "failed to complete the order")
+		return
+	}
+	order := resp.GetOrder()
+	log.WithField("order", order.GetOrderId()).Info("order placed")
+	fe.emptyCartAfterCheckout(r.Context(), log, cartUserID(r), orderedVersion)
+	fe.invalidateCachedCart(cartUserID(r))
+
+	out := apiOrder{
+		OrderID:            order.GetOrderId(),
+		ShippingTrackingID: order.GetShippingTrackingId(),
+		ShippingCost:       newAPIMoney(order.GetShippingCost()),
+		Items:              make([]apiOrderItem, 0, len(order.GetItems())),
+	}
+	totalPaid := *order.GetShippingCost()
+	for _, v := range order.GetItems() {
+		out.Items = append(out.Items, apiOrderItem{
+			ProductID: v.GetItem().GetProductId(),
+			Quantity:  v.GetItem().GetQuantity(),
+			Cost:      newAPIMoney(v.GetCost()),
+		})
+		multPrice := money.MultiplySlow(*v.GetCost(), uint32(v.GetItem().GetQuantity()))
+		totalPaid = money.Must(money.Sum(totalPaid, multPrice))
+	}
+	out.TotalPaid = newAPIMoney(&totalPaid)
+	writeJSON(w, http.StatusCreated, out)
+}
+
+func (fe *frontendServer) apiCurrenciesHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		writeAPIBackendError(log, w, err, "could not retrieve currencies")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Currencies []string `json:"currencies"`
+		Current    string   `json:"current"`
+	}{currencies, currentCurrency(r)})
+}
+
+// apiSetCurrencyHandler switches the currency prices are shown in, through
+// the same cookie as the currency picker.
+func (fe *frontendServer) apiSetCurrencyHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	var body struct {
+		CurrencyCode string `json:"currency_code"`
+	}
+	if err := decodeAPIBody(w, r, &body); err != nil {
+		writeAPIError(log, w, err, http.StatusBadRequest, "")
+		return
+	}
+	payload := validator.SetCurrencyPayload{Currency: body.CurrencyCode}
+	if err := payload.Validate(); err != nil {
+		writeAPIError(log, w, validator.ValidationErrorResponse(err), http.StatusBadRequest, "")
+		return
+	}
+	if !whitelistedCurrencies[payload.Currency] {
+		writeAPIError(log, w, errors.Errorf("currency %s is not supported", payload.Currency), http.StatusBadRequest, "")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieCurrency,
+		Value:  payload.Currency,
+		MaxAge: cookieMaxAge,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
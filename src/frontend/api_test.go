@@ -0,0 +1,232 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// newAPITestServer serves the JSON API from fakes holding one product.
+func newAPITestServer(t *testing.T) (http.Handler, *fakeCartService) {
+	t.Helper()
+	carts := newFakeCartService()
+	catalog := &fakeCatalogService{products: []*pb.Product{
+		{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+	}}
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, catalog)
+		pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		pb.RegisterShippingServiceServer(s, fakeShippingService{})
+		pb.RegisterCheckoutServiceServer(s, fakeCheckoutService{})
+	})
+	fe := &frontendServer{
+		cartSvcConn:           conn,
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		shippingSvcConn:       conn,
+		checkoutSvcConn:       conn,
+	}
+	r := mux.NewRouter()
+	fe.registerAPIRoutes(r)
+	return r, carts
+}
+
+// serveAPI sends an API request for session s1 and decodes the JSON answer,
+// if any, into out.
+func serveAPI(t *testing.T, h http.Handler, method, path, body string, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, path, rd).WithContext(newHomeRequest("s1", "").Context())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if out != nil && w.Body.Len() > 0 {
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s %s: got Content-Type %q", method, path, ct)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, w.Body.String())
+		}
+	}
+	return w
+}
+
+func TestAPIProducts(t *testing.T) {
+	h, _ := newAPITestServer(t)
+
+	var list struct{ Products []apiProduct }
+	if w := serveAPI(t, h, http.MethodGet, "/api/v1/products", "", &list); w.Code != http.StatusOK {
+		t.Fatalf("list: got status %d: %s", w.Code, w.Body.String())
+	}
+	if len(list.Products) != 1 || list.Products[0].ID != "OLJCESPC7Z" || list.Products[0].Price.Units != 19 {
+		t.Errorf("list: got %+v", list.Products)
+	}
+
+	var p apiProduct
+	if w := serveAPI(t, h, http.MethodGet, "/api/v1/products/OLJCESPC7Z", "", &p); w.Code != http.StatusOK || p.Name != "Sunglasses" {
+		t.Errorf("get: got status %d, product %+v", w.Code, p)
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/api/v1/products/AAAAAAAAAA", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/products/nope", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/nope", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		var body apiErrorBody
+		w := serveAPI(t, h, tt.method, tt.path, "", &body)
+		if w.Code != tt.want || body.Error.Status != tt.want || body.Error.Message == "" {
+			t.Errorf("%s %s: got status %d, body %+v, want %d", tt.method, tt.path, w.Code, body, tt.want)
+		}
+	}
+}
+
+func TestAPICart(t *testing.T) {
+	h, carts := newAPITestServer(t)
+
+	var cart apiCart
+	w := serveAPI(t, h, http.MethodPost, "/api/v1/cart/items", `{"product_id":"OLJCESPC7Z","quantity":2,"source":"ad"}`, &cart)
+	if w.Code != http.StatusOK {
+		t.Fatalf("add: got status %d: %s", w.Code, w.Body.String())
+	}
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 || cart.Items[0].Total.Units != 38 {
+		t.Errorf("add: got items %+v", cart.Items)
+	}
+	// 2 x 19 plus 8 shipping.
+	if cart.TotalCost.Units != 46 {
+		t.Errorf("add: got total %+v, want 46", cart.TotalCost)
+	}
+	if got := carts.addSources; len(got) != 1 || got[0] != "ad" {
+		t.Errorf("add: recorded sources %v, want [ad]", got)
+	}
+
+	// A stale cart_version is refused with the cart page's notice key.
+	var failed apiErrorBody
+	if w := serveAPI(t, h, http.MethodPut, "/api/v1/cart/items/OLJCESPC7Z", `{"quantity":3,"cart_version":0}`, &failed); w.Code != http.StatusConflict || failed.Error.Reason != cartChangedNotice {
+		t.Errorf("stale update: got status %d, body %+v", w.Code, failed)
+	}
+	body := `{"quantity":3,"cart_version":` + jsonInt(cart.Version) + `}`
+	if w := serveAPI(t, h, http.MethodPut, "/api/v1/cart/items/OLJCESPC7Z", body, &cart); w.Code != http.StatusOK || cart.Items[0].Quantity != 3 {
+		t.Errorf("update: got status %d, items %+v", w.Code, cart.Items)
+	}
+	if w := serveAPI(t, h, http.MethodPut, "/api/v1/cart/items/OLJCESPC7Z", `{"quantity":99}`, &failed); w.Code != http.StatusBadRequest {
+		t.Errorf("update over limit: got status %d", w.Code)
+	}
+
+	if w := serveAPI(t, h, http.MethodDelete, "/api/v1/cart", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("empty: got status %d: %s", w.Code, w.Body.String())
+	}
+	if w := serveAPI(t, h, http.MethodPost, "/api/v1/cart/restore", "", &cart); w.Code != http.StatusOK || len(cart.Items) != 1 {
+		t.Errorf("restore: got status %d, items %+v", w.Code, cart.Items)
+	}
+	failed = apiErrorBody{}
+	if w := serveAPI(t, h, http.MethodPost, "/api/v1/cart/restore", "", &failed); w.Code != http.StatusNotFound || failed.Error.Reason != restoreGoneNotice {
+		t.Errorf("second restore: got status %d, body %+v", w.Code, failed)
+	}
+
+	carts.addErr = cartLimitStatus(t, "CART_ITEM_LIMIT")
+	failed = apiErrorBody{}
+	if w := serveAPI(t, h, http.MethodPost, "/api/v1/cart/items", `{"product_id":"OLJCESPC7Z","quantity":1}`, &failed); w.Code != http.StatusConflict || failed.Error.Reason != "cart-full" {
+		t.Errorf("add to full cart: got status %d, body %+v", w.Code, failed)
+	}
+}
+
+func jsonInt(n int64) string {
+	b, _ := json.Marshal(n)
+	return string(b)
+}
+
+func TestAPIBadBodies(t *testing.T) {
+	h, _ := newAPITestServer(t)
+	tests := []struct {
+		name, path, body string
+		want             int
+	}{
+		{"not JSON", "/api/v1/cart/items", `quantity=1`, http.StatusBadRequest},
+		{"zero quantity", "/api/v1/cart/items", `{"product_id":"OLJCESPC7Z","quantity":0}`, http.StatusBadRequest},
+		{"bad product", "/api/v1/cart/items", `{"product_id":"x","quantity":1}`, http.StatusBadRequest},
+		{"incomplete order", "/api/v1/checkout", `{"email":"someone@example.com"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		var body apiErrorBody
+		if w := serveAPI(t, h, http.MethodPost, tt.path, tt.body, &body); w.Code != tt.want || body.Error.Message == "" {
+			t.Errorf("%s: got status %d, body %+v, want %d", tt.name, w.Code, body, tt.want)
+		}
+	}
+}
+
+func TestAPIPlaceOrder(t *testing.T) {
+	h, carts := newAPITestServer(t)
+	carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+
+	var order apiOrder
+	w := serveAPI(t, h, http.MethodPost, "/api/v1/checkout", `{
+		"email": "someone@example.com",
+		"street_address": "1600 Amphitheatre Parkway",
+		"zip_code": 94043,
+		"city": "Mountain View",
+		"state": "CA",
+		"country": "United States",
+		"credit_card_number": "4432801561520454",
+		"credit_card_expiration_month": 1,
+		"credit_card_expiration_year": 2030,
+		"credit_card_cvv": 672
+	}`, &order)
+	if w.Code != http.StatusCreated || order.OrderID != "order-1" || order.TotalPaid.Units != 8 {
+		t.Fatalf("got status %d, order %+v: %s", w.Code, order, w.Body.String())
+	}
+	if len(carts.carts["s1"]) != 0 {
+		t.Errorf("cart holds %v after checkout", carts.carts["s1"])
+	}
+}
+
+func TestAPICurrencies(t *testing.T) {
+	h, _ := newAPITestServer(t)
+	var got struct {
+		Currencies []string
+		Current    string
+	}
+	if w := serveAPI(t, h, http.MethodGet, "/api/v1/currencies", "", &got); w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if strings.Join(got.Currencies, ",") != "USD,EUR" || got.Current != defaultCurrency {
+		t.Errorf("got %+v", got)
+	}
+
+	w := serveAPI(t, h, http.MethodPut, "/api/v1/currency", `{"currency_code":"EUR"}`, nil)
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Set-Cookie"), cookieCurrency+"=EUR") {
+		t.Errorf("set: got status %d, cookie %q", w.Code, w.Header().Get("Set-Cookie"))
+	}
+	var failed apiErrorBody
+	if w := serveAPI(t, h, http.MethodPut, "/api/v1/currency", `{"currency_code":"XYZ"}`, &failed); w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported currency: got status %d", w.Code)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAssistantConnectTimeout   = 3 * time.Second
+	defaultAssistantMaxResponseBytes = 1 << 20
+)
+
+var errAssistantResponseTooLarge = errors.New("shopping assistant response exceeds the size limit")
+
+// dialAssistant opens connections to the shopping assistant. Tests replace
+// it to simulate an assistant that never answers.
+var dialAssistant = (&net.Dialer{}).DialContext
+
+// connectAssistant checks that the shopping assistant at addr accepts
+// connections within timeout, so a missing assistant is noticed at startup
+// instead of on the first chat. The returned client applies the same
+// timeout to every connection it opens.
+func connectAssistant(ctx context.Context, addr string, timeout time.Duration) (*http.Client, error) {
+	if addr == "" {
+		return nil, errors.New("SHOPPING_ASSISTANT_SERVICE_ADDR is not set")
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dialAssistant(ctx, network, addr)
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to the shopping assistant at %s within %v", addr, timeout)
+	}
+	conn.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+	return &http.Client{Transport: transport}, nil
+}
+
+// readAssistantResponse reads an assistant reply of at most max bytes and
+// returns errAssistantResponseTooLarge for anything longer, so a misbehaving
+// assistant cannot make the frontend buffer an unbounded payload. A max of
+// zero reads the whole body.
+func readAssistantResponse(body io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return io.ReadAll(body)
+	}
+	b, err := io.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, errAssistantResponseTooLarge
+	}
+	return b, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectAssistantTimeout(t *testing.T) {
+	defer func(d func(context.Context, string, string) (net.Conn, error)) { dialAssistant = d }(dialAssistant)
+	// An assistant that never completes the handshake.
+	dialAssistant = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	client, err := connectAssistant(context.Background(), "shoppingassistantservice:80", 50*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want a connect timeout", err)
+	}
+	if client != nil {
+		t.Error("got a client for an unreachable assistant")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connect took %v, want it bounded by the timeout", elapsed)
+	}
+
+	if _, err := connectAssistant(context.Background(), "", time.Second); err == nil {
+		t.Error("connected with no assistant address")
+	}
+}
+
+func TestChatBotHandler(t *testing.T) {
+	assistant := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"content": "Try the sunglasses."}`)
+	}))
+	defer assistant.Close()
+	addr := strings.TrimPrefix(assistant.URL, "http://")
+
+	client, err := connectAssistant(context.Background(), addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		client   *http.Client
+		wantCode int
+	}{
+		{"assistant connected", client, http.StatusOK},
+		{"assistant disabled", nil, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		fe := &frontendServer{shoppingAssistantSvcAddr: addr, assistantClient: tt.client}
+		r := newHomeRequest("s1", "")
+		r.Method = http.MethodPost
+		r.Body = http.NoBody
+		w := httptest.NewRecorder()
+		fe.chatBotHandler(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if tt.wantCode == http.StatusOK && !strings.Contains(w.Body.String(), "Try the sunglasses.") {
+			t.Errorf("%s: got body %q", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestChatBotHandlerOversizedResponse(t *testing.T) {
+	reply := `{"content": "` + strings.Repeat("a", 4096) + `"}`
+	assistant := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, reply)
+	}))
+	defer assistant.Close()
+	addr := strings.TrimPrefix(assistant.URL, "http://")
+
+	client, err := connectAssistant(context.Background(), addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		max      int64
+		wantCode int
+	}{
+		{"under the limit", int64(len(reply)), http.StatusOK},
+		{"over the limit", 1024, http.StatusBadGateway},
+		{"no limit", 0, http.StatusOK},
+	}
+	for _, tt := range tests {
+		fe := &frontendServer{
+			shoppingAssistantSvcAddr:  addr,
+			assistantClient:           client,
+			assistantMaxResponseBytes: tt.max,
+		}
+		r := newHomeRequest("s1", "")
+		r.Method = http.MethodPost
+		r.Body = http.NoBody
+		w := httptest.NewRecorder()
+		fe.chatBotHandler(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if tt.wantCode != http.StatusOK && strings.Contains(w.Body.String(), "aaaa") {
+			t.Errorf("%s: oversized reply was forwarded", tt.name)
+		}
+	}
+}
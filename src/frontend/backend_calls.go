@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// backendCallPolicy is how long the frontend waits on a backend's calls and
+// how many times it tries each one.
+type backendCallPolicy struct {
+	rpcTimeout       time.Duration
+	maxRetryAttempts int
+}
+
+// backendCallDefaults tune each backend's calls by what a page needs from
+// it, keyed by the prefix of the backend's settings. Pages can't render
+// without the catalog, currencies or cart, so those are retried. Pages
+// render without recommendations and ads, so those give up quickly rather
+// than hold the page up. PlaceOrder charges the card, so it is given time
+// but never retried.
+var backendCallDefaults = map[string]backendCallPolicy{
+	"PRODUCT_CATALOG_SERVICE": {rpcTimeout: 3 * time.Second, maxRetryAttempts: 4},
+	"CURRENCY_SERVICE":        {rpcTimeout: 2 * time.Second, maxRetryAttempts: 4},
+	"CART_SERVICE":            {rpcTimeout: 3 * time.Second, maxRetryAttempts: 4},
+	"SHIPPING_SERVICE":        {rpcTimeout: 3 * time.Second, maxRetryAttempts: 4},
+	"RECOMMENDATION_SERVICE":  {rpcTimeout: time.Second, maxRetryAttempts: 2},
+	"AD_SERVICE":              {rpcTimeout: 500 * time.Millisecond, maxRetryAttempts: 1},
+	"CHECKOUT_SERVICE":        {rpcTimeout: 15 * time.Second, maxRetryAttempts: 1},
+}
+
+// backendClientConfig returns base tuned for the backend whose settings
+// start with prefix, such as "CART_SERVICE". The backend gets its entry in
+// backendCallDefaults, except where RPC_TIMEOUT or GRPC_MAX_RETRY_ATTEMPTS
+// set a value for every backend, and <prefix>_RPC_TIMEOUT and
+// <prefix>_MAX_RETRY_ATTEMPTS override both for this backend alone.
+func backendClientConfig(base grpcClientConfig, prefix string) (grpcClientConfig, error) {
+	cfg := base
+	if d, ok := backendCallDefaults[prefix]; ok {
+		if os.Getenv("RPC_TIMEOUT") == "" {
+			cfg.rpcTimeout = d.rpcTimeout
+		}
+		if os.Getenv("GRPC_MAX_RETRY_ATTEMPTS") == "" {
+			cfg.maxRetryAttempts = d.maxRetryAttempts
+		}
+	}
+	if v := os.Getenv(prefix + "_RPC_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return grpcClientConfig{}, fmt.Errorf("failed to parse %s_RPC_TIMEOUT (%s) as a non-negative time.Duration", prefix, v)
+		}
+		cfg.rpcTimeout = d
+	}
+	if v := os.Getenv(prefix + "_MAX_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return grpcClientConfig{}, fmt.Errorf("failed to parse %s_MAX_RETRY_ATTEMPTS (%s) as a non-negative integer", prefix, v)
+		}
+		cfg.maxRetryAttempts = n
+	}
+	return cfg, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackendClientConfig(t *testing.T) {
+	base := grpcClientConfig{maxRetryAttempts: 4, rpcTimeout: 5 * time.Second, keepaliveTime: time.Minute}
+	tests := []struct {
+		name        string
+		prefix      string
+		env         map[string]string
+		wantTimeout time.Duration
+		wantRetries int
+		wantErr     bool
+	}{
+		{"backend default", "AD_SERVICE", nil, 500 * time.Millisecond, 1, false},
+		{"no default", "OTHER_SERVICE", nil, 5 * time.Second, 4, false},
+		{
+			"global settings beat the default",
+			"AD_SERVICE",
+			map[string]string{"RPC_TIMEOUT": "5s", "GRPC_MAX_RETRY_ATTEMPTS": "4"},
+			5 * time.Second, 4, false,
+		},
+		{
+			"backend settings beat both",
+			"CART_SERVICE",
+			map[string]string{"RPC_TIMEOUT": "5s", "CART_SERVICE_RPC_TIMEOUT": "750ms", "CART_SERVICE_MAX_RETRY_ATTEMPTS": "0"},
+			750 * time.Millisecond, 0, false,
+		},
+		{
+			"other backends' settings don't apply",
+			"CART_SERVICE",
+			map[string]string{"AD_SERVICE_RPC_TIMEOUT": "1m"},
+			3 * time.Second, 4, false,
+		},
+		{"bad timeout", "CART_SERVICE", map[string]string{"CART_SERVICE_RPC_TIMEOUT": "-1s"}, 0, 0, true},
+		{"bad attempts", "CART_SERVICE", map[string]string{"CART_SERVICE_MAX_RETRY_ATTEMPTS": "many"}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"RPC_TIMEOUT", "GRPC_MAX_RETRY_ATTEMPTS"} {
+				t.Setenv(k, "")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := backendClientConfig(base, tt.prefix)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.rpcTimeout != tt.wantTimeout || cfg.maxRetryAttempts != tt.wantRetries {
+				t.Errorf("got timeout %v and %d attempts, want %v and %d", cfg.rpcTimeout, cfg.maxRetryAttempts, tt.wantTimeout, tt.wantRetries)
+			}
+			if cfg.keepaliveTime != base.keepaliveTime {
+				t.Errorf("keepalive changed to %v", cfg.keepaliveTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// cartStaleHeader is set on responses rendered from a cached cart.
+const cartStaleHeader = "X-Cart-Stale"
+
+// cartCache remembers the last cart successfully read for each session so
+// that a transient cartservice (or Redis) read failure can be answered with
+// the recent copy instead of an error page.
+type cartCache struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]cachedCart
+	lastSweep time.Time
+}
+
+type cachedCart struct {
+	cart      *pb.Cart
+	fetchedAt time.Time
+}
+
+func newCartCache(window time.Duration) *cartCache {
+	return &cartCache{
+		window:    window,
+		entries:   make(map[string]cachedCart),
+		lastSweep: time.Now(),
+	}
+}
+
+func (c *cartCache) put(userID string, cart *pb.Cart) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.entries[userID] = cachedCart{cart: cart, fetchedAt: now}
+
+	// Drop expired sessions once per window so the map doesn't grow forever.
+	if now.Sub(c.lastSweep) > c.window {
+		for k, v := range c.entries {
+			if now.Sub(v.fetchedAt) > c.window {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+}
+
+// get returns the cached cart for userID if it is younger than the window.
+func (c *cartCache) get(userID string) (*pb.Cart, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[userID]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(v.fetchedAt) > c.window {
+		delete(c.entries, userID)
+		return nil, false
+	}
+	return v.cart, true
+}
+
+// invalidate forgets the cached cart after a mutation so a stale copy is
+// never served in place of a cart the user has since changed.
+func (c *cartCache) invalidate(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
+
+// isTransientCartError reports whether err looks like a passing backend
+// failure rather than a problem with the request itself.
+func isTransientCartError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// getCartWithFallback reads the cart and, when the read fails transiently
+// and a copy younger than CART_STALE_WINDOW is cached, returns that copy with
+// stale set to true. It is also stale when cartservice answered from its own
+// last-known-good copy. Callers must not treat a stale cart as
+// authoritative.
+func (fe *frontendServer) getCartWithFallback(ctx context.Context, userID string) (cart *pb.Cart, stale bool, err error) {
+	cart, stale, err = fe.getCartAcceptStale(ctx, userID)
+	if fe.cartCache == nil || stale {
+		return cart, stale, err
+	}
+	if err == nil {
+		fe.cartCache.put(userID, cart)
+		return cart, false, nil
+	}
+	if !isTransientCartError(err) {
+		return nil, false, err
+	}
+	cached, ok := fe.cartCache.get(userID)
+	if !ok {
+		return nil, false, err
+	}
+	return cached, true, nil
+}
+
+// invalidateCachedCart is called after every cart mutation.
+func (fe *frontendServer) invalidateCachedCart(userID string) {
+	if fe.cartCache != nil {
+		fe.cartCache.invalidate(userID)
+	}
+}
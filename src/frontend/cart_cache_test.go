@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func newCartCacheTestServer(t *testing.T, window time.Duration) (*frontendServer, *fakeCartService) {
+	t.Helper()
+	carts := newFakeCartService()
+	fe := &frontendServer{
+		cartSvcConn: newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) }),
+		cartCache:   newCartCache(window),
+	}
+	return fe, carts
+}
+
+func TestGetCartWithFallbackServesStaleCart(t *testing.T) {
+	fe, carts := newCartCacheTestServer(t, time.Minute)
+	ctx := context.Background()
+	carts.carts["u1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+
+	// Warm the cache with a successful read.
+	if _, stale, err := fe.getCartWithFallback(ctx, "u1"); err != nil || stale {
+		t.Fatalf("warm read: stale=%v err=%v", stale, err)
+	}
+
+	carts.setGetErr(status.Error(codes.Internal, "failed to get cart: dial tcp: connection refused"))
+	cart, stale, err := fe.getCartWithFallback(ctx, "u1")
+	if err != nil {
+		t.Fatalf("got error %v, want stale cart", err)
+	}
+	if !stale {
+		t.Error("cart was not marked stale")
+	}
+	items := cart.GetItems()
+	if len(items) != 1 || items[0].GetProductId() != "OLJCESPC7Z" || items[0].GetQuantity() != 2 {
+		t.Errorf("got %v, want cached cart", items)
+	}
+}
+
+func TestGetCartWithFallbackCartserviceStale(t *testing.T) {
+	fe, carts := newCartCacheTestServer(t, time.Minute)
+	ctx := context.Background()
+	carts.carts["u1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	carts.stale = true
+
+	cart, stale, err := fe.getCartWithFallback(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale || len(cart.GetItems()) != 1 {
+		t.Errorf("got stale=%v items=%v, want cartservice's stale cart", stale, cart.GetItems())
+	}
+	// Reads that can't use a stale cart, like the one before checkout,
+	// don't opt in.
+	if _, err := fe.getCart(ctx, "u1"); status.Code(err) != codes.Unavailable {
+		t.Errorf("getCart: got %v, want Unavailable", err)
+	}
+}
+
+func TestGetCartWithFallbackErrors(t *testing.T) {
+	transient := status.Error(codes.Unavailable, "cartservice unavailable")
+	tests := []struct {
+		name    string
+		window  time.Duration
+		warm    bool
+		mutate  bool
+		readErr error
+	}{
+		{"cold cache", time.Minute, false, false, transient},
+		{"expired entry", time.Nanosecond, true, false, transient},
+		{"invalidated by mutation", time.Minute, true, true, transient},
+		{"non-transient error", time.Minute, true, false, status.Error(codes.InvalidArgument, "bad user id")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe, carts := newCartCacheTestServer(t, tt.window)
+			ctx := context.Background()
+			carts.carts["u1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+			if tt.warm {
+				if _, _, err := fe.getCartWithFallback(ctx, "u1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.mutate {
+				fe.invalidateCachedCart("u1")
+			}
+			time.Sleep(time.Millisecond)
+
+			carts.setGetErr(tt.readErr)
+			_, stale, err := fe.getCartWithFallback(ctx, "u1")
+			if got, want := status.Code(err), status.Code(tt.readErr); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+			if stale {
+				t.Error("got stale cart, want error")
+			}
+		})
+	}
+}
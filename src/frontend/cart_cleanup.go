@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultCheckoutEmptyCartRetries = 2
+	cartReconcileInterval           = 30 * time.Second
+
+	// maxPendingCartReconciles bounds the reconcile queue, so an outage
+	// can't grow it without limit.
+	maxPendingCartReconciles = 10000
+)
+
+// emptyCartRetryDelay is the pause before each retry of the post-checkout
+// EmptyCart, multiplied by the attempt number.
+var emptyCartRetryDelay = 100 * time.Millisecond
+
+// cartReconciler remembers users whose cart could not be emptied after
+// their order went through, with the cart's version when it was ordered, so
+// it can be emptied in the background.
+type cartReconciler struct {
+	mu      sync.Mutex
+	pending map[string]int64
+}
+
+func newCartReconciler() *cartReconciler {
+	return &cartReconciler{pending: make(map[string]int64)}
+}
+
+// add queues userID's cart, as it was at version, and reports whether there
+// was room for it.
+func (c *cartReconciler) add(userID string, version int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[userID]; !ok && len(c.pending) >= maxPendingCartReconciles {
+		return false
+	}
+	c.pending[userID] = version
+	return true
+}
+
+func (c *cartReconciler) remove(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, userID)
+}
+
+func (c *cartReconciler) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.pending)
+}
+
+// orderedCartVersion reads the version of the cart about to be ordered, so
+// that the cleanup after the order empties the cart only as it was ordered.
+// It is nil if the cart can't be read.
+func (fe *frontendServer) orderedCartVersion(ctx context.Context, log logrus.FieldLogger, userID string) *int64 {
+	c, err := fe.getCart(ctx, userID)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to read cart before checkout, leaving its cleanup to checkoutservice")
+		return nil
+	}
+	version := c.GetVersion()
+	return &version
+}
+
+// emptyCartAfterCheckout empties the cart of a user whose order has been
+// placed, if it is still at version, retrying up to
+// checkoutEmptyCartRetries times. checkoutservice empties the cart itself,
+// so a cart that has moved on, whether emptied by it or changed by the
+// user since, is left alone. If the cart still can't be emptied it is
+// handed to the reconciler. A nil version skips the cleanup.
+func (fe *frontendServer) emptyCartAfterCheckout(ctx context.Context, log logrus.FieldLogger, userID string, version *int64) {
+	if version == nil {
+		return
+	}
+	var err error
+	for attempt := 0; attempt <= fe.checkoutEmptyCartRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * emptyCartRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+		if err = fe.emptyCart(ctx, userID, version, false); err == nil || status.Code(err) == codes.Aborted {
+			return
+		}
+		log.WithField("error", err).WithField("attempt", attempt+1).Warn("failed to empty cart after checkout")
+	}
+	if fe.cartReconciler == nil {
+		log.WithField("error", err).Error("cart not emptied after checkout")
+		return
+	}
+	if !fe.cartReconciler.add(userID, *version) {
+		log.WithField("error", err).Error("cart not emptied after checkout, reconcile queue is full")
+		return
+	}
+	log.WithField("error", err).Error("cart not emptied after checkout, queued for background reconcile")
+}
+
+// reconcileCarts retries emptying the queued carts every interval until ctx
+// is cancelled. A cart that changed since it was queued is dropped from the
+// queue untouched.
+func (fe *frontendServer) reconcileCarts(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for userID, version := range fe.cartReconciler.snapshot() {
+			err := fe.emptyCart(ctx, userID, &version, false)
+			if status.Code(err) == codes.Aborted {
+				fe.cartReconciler.remove(userID)
+				log.Info("cart left behind by checkout changed since, leaving it")
+				continue
+			}
+			if err != nil {
+				log.WithField("error", err).Warn("background cart reconcile failed, will retry")
+				continue
+			}
+			fe.cartReconciler.remove(userID)
+			fe.invalidateCachedCart(userID)
+			log.Info("emptied cart left behind by checkout")
+		}
+	}
+}
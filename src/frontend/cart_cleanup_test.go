@@ -0,0 +1,192 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// flakyEmptyCartService fails its first few EmptyCart calls.
+type flakyEmptyCartService struct {
+	*fakeCartService
+
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (f *flakyEmptyCartService) EmptyCart(ctx context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	f.calls++
+	fail := f.calls <= f.failures
+	f.mu.Unlock()
+	if fail {
+		return nil, status.Error(codes.Internal, "redis timeout")
+	}
+	return f.fakeCartService.EmptyCart(ctx, req)
+}
+
+func (f *flakyEmptyCartService) emptyCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+type fakeCheckoutService struct {
+	pb.UnimplementedCheckoutServiceServer
+}
+
+func (fakeCheckoutService) PlaceOrder(context.Context, *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+	return &pb.PlaceOrderResponse{Order: &pb.OrderResult{
+		OrderId:      "order-1",
+		ShippingCost: &pb.Money{CurrencyCode: "USD", Units: 8},
+	}}, nil
+}
+
+func newPlaceOrderRequest(session string) *http.Request {
+	r := newHomeRequest(session, "")
+	r.Method = http.MethodPost
+	r.Form = url.Values{
+		"email":                        {"someone@example.com"},
+		"street_address":               {"1600 Amphitheatre Parkway"},
+		"zip_code":                     {"94043"},
+		"city":                         {"Mountain View"},
+		"state":                        {"CA"},
+		"country":                      {"United States"},
+		"credit_card_number":           {"4432801561520454"},
+		"credit_card_expiration_month": {"1"},
+		"credit_card_expiration_year":  {"2030"},
+		"credit_card_cvv":              {"672"},
+	}
+	return r
+}
+
+func TestPlaceOrderEmptiesCart(t *testing.T) {
+	defer func(d time.Duration) { emptyCartRetryDelay = d }(emptyCartRetryDelay)
+	emptyCartRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name       string
+		failures   int
+		wantCalls  int
+		wantQueued bool
+		// addAfter has the user add an item after the order is placed,
+		// which the reconcile must keep.
+		addAfter bool
+	}{
+		{"first try succeeds", 0, 1, false, false},
+		{"retry succeeds", 2, 3, false, false},
+		{"retries exhausted", 5, 3, true, false},
+		{"cart changed after checkout", 5, 3, true, true},
+	}
+	for _, tt := range tests {
+		carts := &flakyEmptyCartService{fakeCartService: newFakeCartService(), failures: tt.failures}
+		carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+		conn := newTestConn(t, func(s *grpc.Server) {
+			pb.RegisterCartServiceServer(s, carts)
+			pb.RegisterCheckoutServiceServer(s, fakeCheckoutService{})
+			pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+			pb.RegisterRecommendationServiceServer(s, pb.UnimplementedRecommendationServiceServer{})
+		})
+		fe := &frontendServer{
+			cartSvcConn:              conn,
+			checkoutSvcConn:          conn,
+			currencySvcConn:          conn,
+			recommendationSvcConn:    conn,
+			checkoutEmptyCartRetries: 2,
+			cartReconciler:           newCartReconciler(),
+		}
+
+		w := httptest.NewRecorder()
+		fe.placeOrderHandler(w, newPlaceOrderRequest("s1"))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "order-1") {
+			t.Fatalf("%s: got status %d, want the order confirmation", tt.name, w.Code)
+		}
+		if got := carts.emptyCalls(); got != tt.wantCalls {
+			t.Errorf("%s: got %d EmptyCart calls, want %d", tt.name, got, tt.wantCalls)
+		}
+		if got := len(fe.cartReconciler.snapshot()) == 1; got != tt.wantQueued {
+			t.Errorf("%s: queued for reconcile = %v, want %v", tt.name, got, tt.wantQueued)
+		}
+		if !tt.wantQueued {
+			continue
+		}
+
+		if tt.addAfter {
+			_, err := carts.AddItem(context.Background(), &pb.AddItemRequest{UserId: "s1", Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The background reconcile empties the cart once cartservice
+		// recovers, unless it changed since.
+		log := logrus.New()
+		log.Out = io.Discard
+		ctx, cancel := context.WithCancel(context.Background())
+		go fe.reconcileCarts(ctx, log, time.Millisecond)
+		deadline := time.Now().Add(5 * time.Second)
+		for len(fe.cartReconciler.snapshot()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		if n := len(fe.cartReconciler.snapshot()); n != 0 {
+			t.Errorf("%s: %d carts still queued after reconcile", tt.name, n)
+		}
+		carts.mu.Lock()
+		cart := carts.carts["s1"]
+		carts.mu.Unlock()
+		if tt.addAfter {
+			if !slices.ContainsFunc(cart, func(item *pb.CartItem) bool { return item.GetProductId() == "66VCHSJNUP" }) {
+				t.Errorf("%s: cart holds %v after reconcile, want the item added after checkout kept", tt.name, cart)
+			}
+		} else if len(cart) != 0 {
+			t.Errorf("%s: cart still holds %v after reconcile", tt.name, cart)
+		}
+	}
+}
+
+func TestCartReconcilerIsBounded(t *testing.T) {
+	c := newCartReconciler()
+	for i := 0; i < maxPendingCartReconciles; i++ {
+		if !c.add(strconv.Itoa(i), 1) {
+			t.Fatalf("add %d refused before the queue was full", i)
+		}
+	}
+	if c.add("one-too-many", 1) {
+		t.Error("add accepted a cart past maxPendingCartReconciles")
+	}
+	// Queued carts can still be updated.
+	if !c.add("0", 2) || c.snapshot()["0"] != 2 {
+		t.Error("add refused to update a queued cart")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cartLimitDomain matches the ErrorInfo domain cartservice puts on
+// RESOURCE_EXHAUSTED errors when a change would exceed a cart limit.
+const cartLimitDomain = "cartservice.hipstershop"
+
+// cartNotices are the messages the cart page shows for its notice query
+// parameter. Only these keys are ever rendered.
+var cartNotices = map[string]string{
+	"cart-full":       "Your cart is full. Remove an item or save one for later to make room.",
+	"item-limit":      "You already have as many of that product as a cart can hold.",
+	cartChangedNotice: "Your cart was changed in another tab or window. Review it and try again.",
+	cartEmptiedNotice: "Your cart was emptied.",
+	restoreGoneNotice: "Your emptied cart can no longer be restored.",
+}
+
+// cartLimitNotice returns the cart page notice for err if cartservice
+// refused a change because of a cart limit, or "" otherwise.
+func cartLimitNotice(err error) string {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return ""
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.GetDomain() == cartLimitDomain {
+			if info.GetReason() == "ITEM_QUANTITY_LIMIT" {
+				return "item-limit"
+			}
+			return "cart-full"
+		}
+	}
+	return "cart-full"
+}
+
+// redirectOnCartLimit sends the user back to the cart page with a notice
+// explaining the limit if err is a cart limit error, and reports whether it
+// did.
+func redirectOnCartLimit(w http.ResponseWriter, err error) bool {
+	notice := cartLimitNotice(err)
+	if notice == "" {
+		return false
+	}
+	w.Header().Set("location", baseUrl+"/cart?notice="+notice)
+	w.WriteHeader(http.StatusFound)
+	return true
+}
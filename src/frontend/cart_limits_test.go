@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func cartLimitStatus(t *testing.T, reason string) error {
+	t.Helper()
+	st, err := status.New(codes.ResourceExhausted, "limit reached").WithDetails(&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: cartLimitDomain,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Err()
+}
+
+func TestAddToCartLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantCode     int
+		wantLocation string
+	}{
+		{"cart full", cartLimitStatus(t, "CART_ITEMS_LIMIT"), http.StatusFound, "/cart?notice=cart-full"},
+		{"item limit", cartLimitStatus(t, "ITEM_QUANTITY_LIMIT"), http.StatusFound, "/cart?notice=item-limit"},
+		{"no detail", status.Error(codes.ResourceExhausted, "full"), http.StatusFound, "/cart?notice=cart-full"},
+		{"other error", status.Error(codes.Unavailable, "down"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carts := newFakeCartService()
+			carts.addErr = tt.err
+			catalog := &fakeCatalogService{products: []*pb.Product{
+				{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+			}}
+			conn := newTestConn(t, func(s *grpc.Server) {
+				pb.RegisterCartServiceServer(s, carts)
+				pb.RegisterProductCatalogServiceServer(s, catalog)
+			})
+			fe := &frontendServer{cartSvcConn: conn, productCatalogSvcConn: conn}
+
+			r := newHomeRequest("s1", "")
+			r.Method = http.MethodPost
+			r.Form = url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}}
+			w := httptest.NewRecorder()
+			fe.addToCartHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := w.Header().Get("location"); got != tt.wantLocation {
+				t.Errorf("redirected to %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestCartPageShowsNotice(t *testing.T) {
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, newFakeCartService())
+		pb.RegisterProductCatalogServiceServer(s, &fakeCatalogService{})
+		pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		pb.RegisterShippingServiceServer(s, fakeShippingService{})
+		pb.RegisterRecommendationServiceServer(s, pb.UnimplementedRecommendationServiceServer{})
+	})
+	fe := &frontendServer{
+		cartSvcConn:           conn,
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		shippingSvcConn:       conn,
+		recommendationSvcConn: conn,
+	}
+	tests := []struct {
+		notice string
+		want   string
+	}{
+		{"cart-full", cartNotices["cart-full"]},
+		{"item-limit", cartNotices["item-limit"]},
+		{"<script>", ""},
+	}
+	for _, tt := range tests {
+		r := newHomeRequest("s1", "")
+		r.URL.RawQuery = url.Values{"notice": {tt.notice}}.Encode()
+		w := httptest.NewRecorder()
+		fe.viewCartHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", tt.notice, w.Code, w.Body.String())
+		}
+		body := w.Body.String()
+		if tt.want != "" && !strings.Contains(body, tt.want) {
+			t.Errorf("%s: page is missing %q", tt.notice, tt.want)
+		}
+		if tt.want == "" && strings.Contains(body, `alert alert-info`) {
+			t.Errorf("%s: unknown notice rendered an alert", tt.notice)
+		}
+	}
+}
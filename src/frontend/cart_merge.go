@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// cookieCartMerged marks a session whose guest cart has been merged into a
+// logged-in user's cart. It holds a hash of the user rather than the user
+// ID itself.
+const cookieCartMerged = cookiePrefix + "cart-merged"
+
+func (fe *frontendServer) mergeCarts(ctx context.Context, fromUserID, toUserID string) error {
+	_, err := pb.NewCartServiceClient(fe.cartSvcConn).MergeCarts(ctx, &pb.MergeCartsRequest{
+		FromUserId: fromUserID,
+		ToUserId:   toUserID,
+	})
+	return err
+}
+
+func cartMergeMarker(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:16])
+}
+
+// mergeGuestCart moves the session's guest cart into the user's cart the
+// first time the session shows up logged in, so items added before login
+// aren't left behind. It must run inside resolveCartUser. A failed merge is
+// logged and tried again on the next request rather than failing this one.
+func (fe *frontendServer) mergeGuestCart(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merged, _ := r.Cookie(cookieCartMerged)
+		user, ok := r.Context().Value(ctxKeyCartUserID{}).(string)
+		if !ok {
+			// Back to being a guest: merge again on the next login.
+			if merged != nil {
+				http.SetCookie(w, &http.Cookie{Name: cookieCartMerged, MaxAge: -1})
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session := sessionID(r)
+		marker := cartMergeMarker(user)
+		if user != session && (merged == nil || merged.Value != marker) {
+			log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+			if err := fe.mergeCarts(r.Context(), session, user); err != nil {
+				log.WithField("error", err).Warn("failed to merge guest cart")
+			} else {
+				log.Debug("merged guest cart into user cart")
+				fe.invalidateCachedCart(session)
+				fe.invalidateCachedCart(user)
+				http.SetCookie(w, &http.Cookie{Name: cookieCartMerged, Value: marker, MaxAge: cookieMaxAge})
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestMergeGuestCart(t *testing.T) {
+	carts := newFakeCartService()
+	fe := &frontendServer{cartSvcConn: newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) })}
+	auth, err := newJWTAuth(context.Background(), jwtAuthConfig{secret: testJWTSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.resolveCartUser(fe.mergeGuestCart(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	token := "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"sub": "user-42", "exp": time.Now().Add(time.Hour).Unix()})
+
+	carts.carts["session-1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}, {ProductId: "66VCHSJNUP", Quantity: 2}}
+	carts.carts["user-42"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 3}}
+
+	// serve runs one request and returns the merge cookie it was answered
+	// with, if any.
+	var cookie *http.Cookie
+	serve := func(authorization string) *http.Cookie {
+		r := newHomeRequest("session-1", "")
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == cookieCartMerged {
+				return c
+			}
+		}
+		return nil
+	}
+
+	if c := serve(""); c != nil || carts.merges != 0 {
+		t.Fatalf("guest request merged %d times and set %v", carts.merges, c)
+	}
+	if cookie = serve(token); cookie == nil || carts.merges != 1 {
+		t.Fatalf("login merged %d times and set cookie %v, want 1 merge and a cookie", carts.merges, cookie)
+	}
+	want := map[string]int32{"OLJCESPC7Z": 4, "66VCHSJNUP": 2}
+	if got := carts.carts["user-42"]; len(got) != len(want) {
+		t.Errorf("user cart has %d lines, want %d", len(got), len(want))
+	}
+	for _, item := range carts.carts["user-42"] {
+		if item.GetQuantity() != want[item.GetProductId()] {
+			t.Errorf("%s: got quantity %d, want %d", item.GetProductId(), item.GetQuantity(), want[item.GetProductId()])
+		}
+	}
+	if _, ok := carts.carts["session-1"]; ok {
+		t.Error("guest cart was not deleted")
+	}
+
+	serve(token)
+	if carts.merges != 1 {
+		t.Errorf("got %d merges after a second logged-in request, want 1", carts.merges)
+	}
+	if c := serve(""); c == nil || c.MaxAge >= 0 {
+		t.Errorf("guest request after login left merge cookie %v in place", c)
+	}
+}
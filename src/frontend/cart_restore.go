@@ -0,0 +1,56 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// cartEmptiedNotice is shown after the user empties their cart, along
+	// with a button to undo it.
+	cartEmptiedNotice = "cart-emptied"
+
+	// restoreGoneNotice is shown when undoing an emptied cart comes too
+	// late, or cartservice isn't keeping emptied carts.
+	restoreGoneNotice = "restore-gone"
+)
+
+// restoreCartHandler puts back the items of the user's last emptied cart.
+func (fe *frontendServer) restoreCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log.Debug("restoring emptied cart")
+
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.restoreLastCart(r.Context(), cartUserID(r)); err != nil {
+		if code := status.Code(err); code == codes.NotFound || code == codes.FailedPrecondition {
+			w.Header().Set("location", baseUrl+"/cart?notice="+restoreGoneNotice)
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		if redirectOnCartLimit(w, err) {
+			return
+		}
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to restore cart"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
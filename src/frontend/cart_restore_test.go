@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestEmptyAndRestoreCart(t *testing.T) {
+	carts := newFakeCartService()
+	carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) })
+	fe := &frontendServer{cartSvcConn: conn}
+
+	post := func(handler http.HandlerFunc) string {
+		t.Helper()
+		r := newHomeRequest("s1", "")
+		r.Method = http.MethodPost
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusFound, w.Body.String())
+		}
+		return w.Header().Get("location")
+	}
+
+	if got, want := post(fe.emptyCartHandler), "/cart?notice="+cartEmptiedNotice; got != want {
+		t.Errorf("empty redirected to %q, want %q", got, want)
+	}
+	if len(carts.carts["s1"]) != 0 {
+		t.Fatalf("cart holds %v after emptying", carts.carts["s1"])
+	}
+	if got, want := post(fe.restoreCartHandler), "/cart"; got != want {
+		t.Errorf("restore redirected to %q, want %q", got, want)
+	}
+	if items := carts.carts["s1"]; len(items) != 1 || items[0].GetQuantity() != 2 {
+		t.Errorf("cart holds %v after restoring, want 2 OLJCESPC7Z", items)
+	}
+	// Nothing left to restore.
+	if got, want := post(fe.restoreCartHandler), "/cart?notice="+restoreGoneNotice; got != want {
+		t.Errorf("second restore redirected to %q, want %q", got, want)
+	}
+}
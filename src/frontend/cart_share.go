@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// maxShareTokenLen bounds the cart snapshots accepted from share links, well
+// above what a full cart encodes to.
+const maxShareTokenLen = 16 << 10
+
+// decodeShareToken returns the cart snapshot in a share link token, a
+// base64url-encoded CartSnapshot.
+func decodeShareToken(token string) ([]byte, bool) {
+	if token == "" || len(token) > maxShareTokenLen {
+		return nil, false
+	}
+	snapshot, err := base64.RawURLEncoding.DecodeString(token)
+	return snapshot, err == nil
+}
+
+// cartShareLink returns the link the cart page offers for sharing the cart
+// in the shared query parameter, or "" if there is none.
+func cartShareLink(r *http.Request) string {
+	token := r.URL.Query().Get("shared")
+	if _, ok := decodeShareToken(token); !ok {
+		return ""
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + baseUrl + "/cart?" + url.Values{"import": {token}}.Encode()
+}
+
+// cartImportToken returns the share link token in the import query
+// parameter, which the cart page offers to take on, or "" if there is none.
+func cartImportToken(r *http.Request) string {
+	token := r.URL.Query().Get("import")
+	if _, ok := decodeShareToken(token); !ok {
+		return ""
+	}
+	return token
+}
+
+func (fe *frontendServer) exportCartSnapshot(ctx context.Context, userID string) ([]byte, error) {
+	resp, err := pb.NewCartServiceClient(fe.cartSvcConn).ExportCart(ctx, &pb.ExportCartRequest{
+		UserId: userID,
+		Format: pb.CartExportFormat_CART_EXPORT_FORMAT_SNAPSHOT,
+	})
+	return resp.GetData(), err
+}
+
+// importSharedCart replaces the user's cart items with those in snapshot,
+// keeping the user's own saved list.
+func (fe *frontendServer) importSharedCart(ctx context.Context, userID string, snapshot []byte) error {
+	_, err := pb.NewCartServiceClient(fe.cartSvcConn).ImportCart(ctx, &pb.ImportCartRequest{
+		UserId:    userID,
+		Data:      snapshot,
+		KeepSaved: true,
+	})
+	return err
+}
+
+// shareCartHandler snapshots the cart and returns to the cart page, which
+// shows the link to it.
+func (fe *frontendServer) shareCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log.Debug("sharing cart")
+
+	snapshot, err := fe.exportCartSnapshot(r.Context(), cartUserID(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to export cart"), http.StatusInternalServerError)
+		return
+	}
+	q := url.Values{"shared": {base64.RawURLEncoding.EncodeToString(snapshot)}}
+	w.Header().Set("location", baseUrl+"/cart?"+q.Encode())
+	w.WriteHeader(http.StatusFound)
+}
+
+// importCartHandler takes on the cart of a share link the user confirmed on
+// the cart page.
+func (fe *frontendServer) importCartHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	snapshot, ok := decodeShareToken(r.FormValue("token"))
+	if !ok {
+		renderHTTPError(log, r, w, errors.New("invalid shared cart"), http.StatusBadRequest)
+		return
+	}
+	log.Debug("importing shared cart")
+
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.importSharedCart(r.Context(), cartUserID(r), snapshot); err != nil {
+		code := http.StatusInternalServerError
+		if status.Code(err) == codes.InvalidArgument {
+			code = http.StatusBadRequest
+		}
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to import shared cart"), code)
+		return
+	}
+	w.Header().Set("location", baseUrl+"/cart")
+	w.WriteHeader(http.StatusFound)
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestShareAndImportCart(t *testing.T) {
+	carts := newFakeCartService()
+	carts.carts["alice"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	carts.saved["alice"] = []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}}
+	carts.carts["bob"] = []*pb.CartItem{{ProductId: "L9ECAV7KIM", Quantity: 1}}
+	carts.saved["bob"] = []*pb.CartItem{{ProductId: "1YMWWN1N4O", Quantity: 1}}
+	conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) })
+	fe := &frontendServer{cartSvcConn: conn}
+
+	r := newHomeRequest("alice", "")
+	r.Method = http.MethodPost
+	w := httptest.NewRecorder()
+	fe.shareCartHandler(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("share: got status %d: %s", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := location.Query().Get("shared")
+
+	r = newHomeRequest("alice", "")
+	r.URL.RawQuery = location.RawQuery
+	link := cartShareLink(r)
+	if !strings.HasSuffix(link, "/cart?"+url.Values{"import": {token}}.Encode()) {
+		t.Errorf("got share link %q, want one importing the shared token", link)
+	}
+
+	r = newHomeRequest("bob", "")
+	r.Method = http.MethodPost
+	r.Form = url.Values{"token": {token}}
+	w = httptest.NewRecorder()
+	fe.importCartHandler(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("import: got status %d: %s", w.Code, w.Body.String())
+	}
+	if got := carts.carts["bob"]; len(got) != 1 || got[0].GetProductId() != "OLJCESPC7Z" {
+		t.Errorf("bob's cart is %v after import, want alice's", got)
+	}
+	if got := carts.saved["bob"]; len(got) != 1 || got[0].GetProductId() != "1YMWWN1N4O" {
+		t.Errorf("bob's saved items are %v after import, want his own kept", got)
+	}
+}
+
+func TestImportCartRejectsBadToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"missing", ""},
+		{"not base64url", "not/base64+"},
+		{"too long", strings.Repeat("A", maxShareTokenLen+1)},
+		{"not a snapshot", "_w"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carts := newFakeCartService()
+			carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+			conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) })
+			fe := &frontendServer{cartSvcConn: conn}
+
+			r := newHomeRequest("s1", "")
+			r.Method = http.MethodPost
+			r.Form = url.Values{"token": {tt.token}}
+			w := httptest.NewRecorder()
+			fe.importCartHandler(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if len(carts.carts["s1"]) != 1 {
+				t.Errorf("rejected import changed the cart to %v", carts.carts["s1"])
+			}
+		})
+	}
+}
+
+func TestCartPageOffersSharedCart(t *testing.T) {
+	carts := newFakeCartService()
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, &fakeCatalogService{})
+		pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		pb.RegisterShippingServiceServer(s, fakeShippingService{})
+		pb.RegisterRecommendationServiceServer(s, pb.UnimplementedRecommendationServiceServer{})
+	})
+	fe := &frontendServer{
+		cartSvcConn:           conn,
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		shippingSvcConn:       conn,
+		recommendationSvcConn: conn,
+	}
+
+	r := newHomeRequest("s1", "")
+	r.URL.RawQuery = url.Values{"import": {"CAE"}}.Encode()
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("cart page: got status %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, want := range []string{"/cart/import", `name="token" value="CAE"`, "Use Shared Cart"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("cart page is missing %q", want)
+		}
+	}
+}
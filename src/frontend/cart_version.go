@@ -0,0 +1,56 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cartChangedNotice is shown when a change made from the cart page was
+// refused because the cart changed since the page was rendered, as when
+// the user edits it in another tab.
+const cartChangedNotice = "cart-changed"
+
+// expectedCartVersion reads the cart_version the cart page puts in its
+// forms. It is nil when the form has none, so the change is made whatever
+// the cart's version.
+func expectedCartVersion(r *http.Request) (*int64, error) {
+	v := r.FormValue("cart_version")
+	if v == "" {
+		return nil, nil
+	}
+	version, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || version < 0 {
+		return nil, errors.Errorf("invalid cart_version %q", v)
+	}
+	return &version, nil
+}
+
+// redirectOnCartConflict sends the user back to the cart page, with a notice
+// to look it over, if err is cartservice refusing a change because the cart
+// is no longer at the version the page showed. It reports whether it did.
+func redirectOnCartConflict(w http.ResponseWriter, err error) bool {
+	if status.Code(err) != codes.Aborted {
+		return false
+	}
+	w.Header().Set("location", baseUrl+"/cart?notice="+cartChangedNotice)
+	w.WriteHeader(http.StatusFound)
+	return true
+}
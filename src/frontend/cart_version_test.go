@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestCartVersionConflicts(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      string
+		wantCode     int
+		wantLocation string
+		wantQuantity int32
+	}{
+		{"no version", "", http.StatusFound, "/cart", 5},
+		{"current version", "1", http.StatusFound, "/cart", 5},
+		{"stale version", "0", http.StatusFound, "/cart?notice=cart-changed", 2},
+		{"invalid version", "one", http.StatusBadRequest, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carts := newFakeCartService()
+			carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+			carts.versions["s1"] = 1
+			conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) })
+			fe := &frontendServer{cartSvcConn: conn}
+
+			r := newHomeRequest("s1", "")
+			r.Method = http.MethodPost
+			r.Form = url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"5"}, "cart_version": {tt.version}}
+			w := httptest.NewRecorder()
+			fe.updateCartItemHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := w.Header().Get("location"); got != tt.wantLocation {
+				t.Errorf("redirected to %q, want %q", got, tt.wantLocation)
+			}
+			if got := carts.carts["s1"][0].GetQuantity(); got != tt.wantQuantity {
+				t.Errorf("cart holds %d, want %d", got, tt.wantQuantity)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCooldown         = 30 * time.Second
+)
+
+// errBreakerOpen is returned for calls skipped because the backend's
+// breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker sheds calls to a backend that keeps failing, so pages stop
+// paying its timeout on every render: those that can do without the backend
+// render without it, the others fail fast. After threshold
+// consecutive failures it opens and fails calls immediately; once cooldown
+// has passed it lets a single probe call through, closing again if the
+// probe succeeds and reopening if it fails. A nil breaker lets every call
+// through.
+type circuitBreaker struct {
+	backend   string
+	threshold int
+	cooldown  time.Duration
+	log       logrus.FieldLogger
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(backend string, threshold int, cooldown time.Duration, log logrus.FieldLogger) *circuitBreaker {
+	breakerStates.WithLabelValues(backend).Set(float64(breakerClosed))
+	return &circuitBreaker{backend: backend, threshold: threshold, cooldown: cooldown, log: log}
+}
+
+// isBackendFailure reports whether err means the backend is in trouble, as
+// opposed to answering that the request itself can't be served, such as a
+// product that doesn't exist or a full cart.
+func isBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.OK, codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.Unauthenticated, codes.FailedPrecondition, codes.Aborted,
+		codes.OutOfRange, codes.ResourceExhausted:
+		return false
+	}
+	return true
+}
+
+// call runs fn unless the breaker is shedding calls, and records whether the
+// backend failed. A call cancelled by its caller says nothing about the
+// backend and isn't counted.
+func (b *circuitBreaker) call(ctx context.Context, fn func(context.Context) error) error {
+	if b == nil {
+		return fn(ctx)
+	}
+	if !b.allow(ctx) {
+		breakerRejections.WithLabelValues(b.backend).Inc()
+		trace.SpanFromContext(ctx).AddEvent("circuit breaker skipped call",
+			trace.WithAttributes(attribute.String("backend", b.backend)))
+		return errors.Wrapf(errBreakerOpen, "%s backend", b.backend)
+	}
+	err := fn(ctx)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		b.release()
+		return err
+	}
+	if isBackendFailure(err) {
+		b.record(ctx, err)
+	} else {
+		b.record(ctx, nil)
+	}
+	return err
+}
+
+// interceptor runs every call made on a connection through b. Skipped calls
+// fail with UNAVAILABLE, as they would had they reached a backend that is
+// down.
+func (b *circuitBreaker) interceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := b.call(ctx, func(ctx context.Context) error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+		if errors.Is(err, errBreakerOpen) {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		return err
+	}
+}
+
+// allow reports whether a call may go ahead, moving an open breaker whose
+// cooldown has passed to half-open for a single probe.
+func (b *circuitBreaker) allow(ctx context.Context) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(ctx, breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// The probe is still in flight.
+		return false
+	}
+	return true
+}
+
+// release gives back a half-open probe that ended without a verdict.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		breakerStates.WithLabelValues(b.backend).Set(float64(breakerOpen))
+	}
+}
+
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(ctx, breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			b.transition(ctx, breakerOpen)
+		}
+	}
+}
+
+// transition moves the breaker to state. The caller must hold b.mu.
+func (b *circuitBreaker) transition(ctx context.Context, state breakerState) {
+	from := b.state
+	b.state = state
+	breakerStates.WithLabelValues(b.backend).Set(float64(state))
+	log := b.log.WithFields(logrus.Fields{
+		"backend":  b.backend,
+		"from":     from.String(),
+		"to":       state.String(),
+		"failures": b.failures,
+	})
+	if state == breakerClosed {
+		log.Infof("circuit breaker for %s backend closed, calls resume", b.backend)
+	} else {
+		log.Warnf("circuit breaker for %s backend is now %s", b.backend, state)
+	}
+	trace.SpanFromContext(ctx).AddEvent("circuit breaker state change", trace.WithAttributes(
+		attribute.String("backend", b.backend),
+		attribute.String("from", from.String()),
+		attribute.String("to", state.String()),
+	))
+}
+
+// breakerStatus is one breaker as the debug endpoint shows it.
+type breakerStatus struct {
+	Backend  string `json:"backend"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	// OpenedAt is when the breaker last opened, unset if it never has.
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := breakerStatus{Backend: b.backend, State: b.state.String(), Failures: b.failures}
+	if !b.openedAt.IsZero() {
+		openedAt := b.openedAt
+		st.OpenedAt = &openedAt
+	}
+	return st
+}
+
+// breakersHandler lists the state of every backend's breaker, for a look at
+// which backends the frontend is currently skipping. It is served on
+// METRICS_PORT alongside /metrics, not on the storefront.
+func (fe *frontendServer) breakersHandler(w http.ResponseWriter, _ *http.Request) {
+	statuses := make([]breakerStatus, 0, len(fe.breakers))
+	for _, b := range fe.breakers {
+		statuses = append(statuses, b.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,218 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func newTestBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	log := logrus.New()
+	log.Out = io.Discard
+	return newCircuitBreaker("ad", threshold, cooldown, log)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	errDown := errors.New("adservice unavailable")
+	b := newTestBreaker(3, cooldown)
+	ctx := context.Background()
+
+	calls := 0
+	failing := func(context.Context) error { calls++; return errDown }
+	healthy := func(context.Context) error { calls++; return nil }
+
+	// Failures below the threshold still reach the backend.
+	for i := 0; i < 3; i++ {
+		if err := b.call(ctx, failing); !errors.Is(err, errDown) {
+			t.Fatalf("call %d: got %v, want the backend error", i, err)
+		}
+	}
+	if b.state != breakerOpen {
+		t.Fatalf("got state %s after 3 failures, want open", b.state)
+	}
+
+	// While open, calls are shed without touching the backend.
+	calls = 0
+	if err := b.call(ctx, healthy); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("open breaker: got %v, want errBreakerOpen", err)
+	}
+	if calls != 0 {
+		t.Errorf("open breaker called the backend %d times", calls)
+	}
+
+	// After the cooldown a failed probe reopens the breaker at once.
+	time.Sleep(cooldown)
+	if err := b.call(ctx, failing); !errors.Is(err, errDown) {
+		t.Errorf("probe: got %v, want the backend error", err)
+	}
+	if b.state != breakerOpen {
+		t.Errorf("got state %s after a failed probe, want open", b.state)
+	}
+
+	// A successful probe closes it.
+	time.Sleep(cooldown)
+	if err := b.call(ctx, healthy); err != nil {
+		t.Errorf("probe: got %v, want success", err)
+	}
+	if b.state != breakerClosed {
+		t.Errorf("got state %s after a successful probe, want closed", b.state)
+	}
+}
+
+func TestCircuitBreakerHalfOpenSingleProbe(t *testing.T) {
+	b := newTestBreaker(1, time.Millisecond)
+	ctx := context.Background()
+	b.call(ctx, func(context.Context) error { return errors.New("down") })
+	time.Sleep(time.Millisecond)
+
+	probing, release := make(chan struct{}), make(chan struct{})
+	go b.call(ctx, func(context.Context) error {
+		close(probing)
+		<-release
+		return nil
+	})
+	<-probing
+	if err := b.call(ctx, func(context.Context) error { return nil }); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("second call during the probe: got %v, want errBreakerOpen", err)
+	}
+	close(release)
+}
+
+func TestCircuitBreakerSpanEvents(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := tp.Tracer("test").Start(context.Background(), "GET /")
+
+	b := newTestBreaker(1, time.Hour)
+	b.call(ctx, func(context.Context) error { return errors.New("down") })
+	b.call(ctx, func(context.Context) error { return nil })
+	span.End()
+
+	var names []string
+	for _, e := range recorder.Ended()[0].Events() {
+		names = append(names, e.Name)
+	}
+	want := []string{"circuit breaker state change", "circuit breaker skipped call"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Errorf("got span events %v, want %v", names, want)
+	}
+}
+
+func TestCircuitBreakerConcurrent(t *testing.T) {
+	b := newTestBreaker(5, time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.call(context.Background(), func(context.Context) error {
+				if i%2 == 0 {
+					return errors.New("down")
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var b *circuitBreaker
+	called := false
+	if err := b.call(context.Background(), func(context.Context) error { called = true; return nil }); err != nil || !called {
+		t.Errorf("nil breaker: got err %v, called %v", err, called)
+	}
+}
+
+func TestCircuitBreakerIgnoresRequestErrors(t *testing.T) {
+	b := newTestBreaker(1, time.Hour)
+	ctx := context.Background()
+	for _, code := range []codes.Code{codes.NotFound, codes.InvalidArgument, codes.ResourceExhausted, codes.Aborted} {
+		b.call(ctx, func(context.Context) error { return status.Error(code, "no") })
+		if b.state != breakerClosed {
+			t.Fatalf("got state %s after a %s error, want closed", b.state, code)
+		}
+	}
+	b.call(ctx, func(context.Context) error { return status.Error(codes.Unavailable, "down") })
+	if b.state != breakerOpen {
+		t.Errorf("got state %s after an UNAVAILABLE error, want open", b.state)
+	}
+}
+
+// failingRecommendationService counts its calls and fails them all.
+type failingRecommendationService struct {
+	pb.UnimplementedRecommendationServiceServer
+	calls atomic.Int32
+}
+
+func (s *failingRecommendationService) ListRecommendations(context.Context, *pb.ListRecommendationsRequest) (*pb.ListRecommendationsResponse, error) {
+	s.calls.Add(1)
+	return nil, status.Error(codes.Unavailable, "recommendationservice is down")
+}
+
+func TestCircuitBreakerInterceptor(t *testing.T) {
+	backend := &failingRecommendationService{}
+	b := newCircuitBreaker("recommendation-test", 2, time.Hour, logrus.New())
+	cfg := grpcClientConfig{breaker: b}
+	conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterRecommendationServiceServer(s, backend) }, cfg.dialOptions()...)
+	fe := &frontendServer{recommendationSvcConn: conn, breakers: []*circuitBreaker{b}}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := fe.getRecommendations(ctx, "u1", nil)
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("call %d: got %v, want UNAVAILABLE", i, err)
+		}
+	}
+	if n := backend.calls.Load(); n != 2 {
+		t.Errorf("backend got %d calls, want 2 before the breaker opened", n)
+	}
+	if got := testutil.ToFloat64(breakerStates.WithLabelValues("recommendation-test")); got != float64(breakerOpen) {
+		t.Errorf("state metric is %v, want %v", got, float64(breakerOpen))
+	}
+	if got := testutil.ToFloat64(breakerRejections.WithLabelValues("recommendation-test")); got != 1 {
+		t.Errorf("rejections metric is %v, want 1", got)
+	}
+
+	w := httptest.NewRecorder()
+	fe.breakersHandler(w, httptest.NewRequest(http.MethodGet, "/_debug/breakers", nil))
+	var statuses []breakerStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Backend != "recommendation-test" || statuses[0].State != "open" || statuses[0].Failures != 2 || statuses[0].OpenedAt == nil {
+		t.Errorf("debug endpoint got %+v, want the open recommendation breaker", statuses)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const defaultCurrencyCacheSize = 1000
+
+// conversionKey identifies a conversion of one exact amount into a currency.
+type conversionKey struct {
+	from  string
+	units int64
+	nanos int32
+	to    string
+}
+
+func newConversionKey(m *pb.Money, to string) conversionKey {
+	return conversionKey{from: m.GetCurrencyCode(), units: m.GetUnits(), nanos: m.GetNanos(), to: to}
+}
+
+// currencyCache is a fixed-size LRU of currency conversion results. Catalog
+// prices are a small fixed set, so most conversions repeat; the size cap
+// keeps arbitrary amounts (cart totals, shipping) from growing it forever.
+type currencyCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	ll      *list.List // front is most recently used
+	entries map[conversionKey]*list.Element
+}
+
+type currencyCacheEntry struct {
+	key    conversionKey
+	result *pb.Money
+}
+
+func newCurrencyCache(maxEntries int) *currencyCache {
+	return &currencyCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    make(map[conversionKey]*list.Element),
+	}
+}
+
+func (c *currencyCache) get(key conversionKey) (*pb.Money, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*currencyCacheEntry).result, true
+}
+
+func (c *currencyCache) put(key conversionKey, result *pb.Money) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*currencyCacheEntry).result = result
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&currencyCacheEntry{key: key, result: result})
+	if c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*currencyCacheEntry).key)
+	}
+}
+
+func (c *currencyCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
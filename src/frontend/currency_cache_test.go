@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// countingCurrencyService counts Convert calls on top of fakeCurrencyService.
+type countingCurrencyService struct {
+	fakeCurrencyService
+	calls atomic.Int32
+}
+
+func (c *countingCurrencyService) Convert(ctx context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	c.calls.Add(1)
+	return c.fakeCurrencyService.Convert(ctx, req)
+}
+
+func TestCurrencyCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCurrencyCache(2)
+	a := conversionKey{from: "USD", units: 1, to: "EUR"}
+	b := conversionKey{from: "USD", units: 2, to: "EUR"}
+	d := conversionKey{from: "USD", units: 3, to: "EUR"}
+
+	c.put(a, &pb.Money{CurrencyCode: "EUR", Units: 1})
+	c.put(b, &pb.Money{CurrencyCode: "EUR", Units: 2})
+	c.get(a) // a is now more recently used than b
+	c.put(d, &pb.Money{CurrencyCode: "EUR", Units: 3})
+
+	if got := c.len(); got != 2 {
+		t.Errorf("cache holds %d entries, want 2", got)
+	}
+	for _, tt := range []struct {
+		key  conversionKey
+		want bool
+	}{{a, true}, {b, false}, {d, true}} {
+		if _, ok := c.get(tt.key); ok != tt.want {
+			t.Errorf("units=%d: cached=%v, want %v", tt.key.units, ok, tt.want)
+		}
+	}
+}
+
+func TestConvertCurrencyUsesCache(t *testing.T) {
+	currency := &countingCurrencyService{}
+	fe := &frontendServer{
+		currencySvcConn: newTestConn(t, func(s *grpc.Server) { pb.RegisterCurrencyServiceServer(s, currency) }),
+		currencyCache:   newCurrencyCache(1),
+	}
+	ctx := context.Background()
+	one := &pb.Money{CurrencyCode: "USD", Units: 1}
+	two := &pb.Money{CurrencyCode: "USD", Units: 2}
+
+	steps := []struct {
+		from      *pb.Money
+		wantUnits int64
+		wantCalls int32
+	}{
+		{one, 1, 1},
+		{one, 1, 1}, // cached
+		{two, 2, 2}, // evicts one
+		{one, 1, 3}, // converted again, still correct
+	}
+	for i, st := range steps {
+		got, err := fe.convertCurrency(ctx, st.from, "EUR")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.GetCurrencyCode() != "EUR" || got.GetUnits() != st.wantUnits {
+			t.Errorf("step %d: got %v, want %d EUR", i, got, st.wantUnits)
+		}
+		if n := currency.calls.Load(); n != st.wantCalls {
+			t.Errorf("step %d: %d Convert calls, want %d", i, n, st.wantCalls)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultFallbackMessage = "We're experiencing issues right now. Please try again in a few minutes."
+
+// fallbackRetryAfter is sent with the maintenance page, in seconds.
+const fallbackRetryAfter = "30"
+
+// renderFallback answers with a plain 503 maintenance page instead of the
+// debugging error page. It is used when every backend a page needs is
+// failing, so nothing useful could be shown anyway.
+func (fe *frontendServer) renderFallback(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, page string, err error) {
+	log.WithField("error", err).Error("all backends failed, rendering fallback page")
+	fallbackRenders.WithLabelValues(page).Inc()
+
+	msg := fe.fallbackMessage
+	if msg == "" {
+		msg = defaultFallbackMessage
+	}
+	w.Header().Set("Retry-After", fallbackRetryAfter)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if templateErr := templates.ExecuteTemplate(w, "maintenance", injectCommonTemplateData(r, map[string]interface{}{
+		"message": msg,
+	})); templateErr != nil {
+		log.Println(templateErr)
+	}
+}
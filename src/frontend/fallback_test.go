@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// newDownConn returns a client connection whose every dial fails, as if the
+// backend were unreachable.
+func newDownConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.NewClient("passthrough:///down",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return nil, errors.New("connection refused")
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHomeFallbackWhenAllBackendsDown(t *testing.T) {
+	tests := []struct {
+		name         string
+		catalogDown  bool
+		currencyDown bool
+		wantCode     int
+		wantFallback bool
+	}{
+		{"all backends down", true, true, http.StatusServiceUnavailable, true},
+		{"only currency down", false, true, http.StatusInternalServerError, false},
+		{"only catalog down", true, false, http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe, _, _ := newPageCacheTestServer(t)
+			fe.pageCache = nil
+			fe.fallbackMessage = "Back soon"
+			if tt.catalogDown {
+				fe.productCatalogSvcConn = newDownConn(t)
+			}
+			if tt.currencyDown {
+				fe.currencySvcConn = newDownConn(t)
+			}
+			before := testutil.ToFloat64(fallbackRenders.WithLabelValues("home"))
+
+			w := httptest.NewRecorder()
+			fe.homeHandler(w, newHomeRequest("s1", ""))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := strings.Contains(w.Body.String(), "Back soon"); got != tt.wantFallback {
+				t.Errorf("fallback message shown = %v, want %v", got, tt.wantFallback)
+			}
+			delta := testutil.ToFloat64(fallbackRenders.WithLabelValues("home")) - before
+			if want := map[bool]float64{true: 1, false: 0}[tt.wantFallback]; delta != want {
+				t.Errorf("fallback counter moved by %v, want %v", delta, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMaxItemQuantity matches cartservice's default MAX_ITEM_QUANTITY.
+const defaultMaxItemQuantity = 10
+
+// productIDPattern is the format of product catalog IDs, e.g. "OLJCESPC7Z".
+var productIDPattern = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+
+// quantityLimit is the most units of one product a form may ask for: max,
+// or defaultMaxItemQuantity when max is not positive.
+func quantityLimit(max int) int {
+	if max <= 0 {
+		return defaultMaxItemQuantity
+	}
+	return max
+}
+
+// parseQuantity parses a quantity form value, which must be an integer in
+// [1, max]. A non-positive max means defaultMaxItemQuantity.
+func parseQuantity(v string, max int) (uint64, error) {
+	return parseQuantityInRange(v, 1, max)
+}
+
+// parseQuantityInRange is parseQuantity with a configurable lower bound, so
+// the cart page can accept 0 to remove an item.
+func parseQuantityInRange(v string, min, max int) (uint64, error) {
+	max = quantityLimit(max)
+	if v == "" {
+		return 0, errors.New("quantity is required")
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, errors.Errorf("quantity must be between %d and %d", min, max)
+	}
+	if err != nil {
+		return 0, errors.Errorf("quantity %q is not a whole number", v)
+	}
+	if n < int64(min) || n > int64(max) {
+		return 0, errors.Errorf("quantity must be between %d and %d", min, max)
+	}
+	return uint64(n), nil
+}
+
+// validateProductID checks that a product_id form value looks like a catalog
+// ID before it is sent to any backend.
+func validateProductID(id string) error {
+	if id == "" {
+		return errors.New("product_id is required")
+	}
+	if !productIDPattern.MatchString(id) {
+		return errors.Errorf("product_id %q is not a valid product ID", id)
+	}
+	return nil
+}
+
+// itemSources are the places a product page can be reached from, recorded
+// with the items added to the cart from it. Anything else counts as the
+// product page itself.
+var itemSources = map[string]bool{
+	"product_page":   true,
+	"recommendation": true,
+	"ad":             true,
+	"search":         true,
+}
+
+// normalizeItemSource returns source if it is one of itemSources, and
+// "product_page" otherwise, so a hand-edited link can't put arbitrary text
+// in the cart.
+func normalizeItemSource(source string) string {
+	if itemSources[source] {
+		return source
+	}
+	return "product_page"
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		max     int
+		want    uint64
+		wantErr string
+	}{
+		{"minimum", "1", 10, 1, ""},
+		{"maximum", "10", 10, 10, ""},
+		{"default maximum", "10", 0, 10, ""},
+		{"configured maximum", "25", 50, 25, ""},
+		{"empty", "", 10, 0, "required"},
+		{"zero", "0", 10, 0, "between 1 and 10"},
+		{"negative", "-3", 10, 0, "between 1 and 10"},
+		{"above maximum", "11", 10, 0, "between 1 and 10"},
+		{"overflowing", "99999999999999999999", 10, 0, "between 1 and 10"},
+		{"overflowing int32", "2147483648", 10, 0, "between 1 and 10"},
+		{"non-numeric", "two", 10, 0, "not a whole number"},
+		{"fractional", "1.5", 10, 0, "not a whole number"},
+		{"padded", " 1", 10, 0, "not a whole number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseQuantity(tt.in, tt.max)
+			if tt.wantErr == "" {
+				if err != nil || got != tt.want {
+					t.Errorf("parseQuantity(%q, %d) = %d, %v; want %d", tt.in, tt.max, got, err, tt.want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseQuantity(%q, %d) error = %v, want it to mention %q", tt.in, tt.max, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateProductID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"OLJCESPC7Z", true},
+		{"66VCHSJNUP", true},
+		{"", false},
+		{"oljcespc7z", false},
+		{"OLJCESPC7", false},
+		{"OLJCESPC7Z1", false},
+		{"OLJCESPC7Z<", false},
+		{"../admin", false},
+	}
+	for _, tt := range tests {
+		if err := validateProductID(tt.id); (err == nil) != tt.valid {
+			t.Errorf("validateProductID(%q) = %v, want valid=%v", tt.id, err, tt.valid)
+		}
+	}
+}
+
+func TestAddToCartHandlerRejectsInvalidInput(t *testing.T) {
+	// No backends are wired up: invalid input must be rejected before any
+	// RPC is attempted.
+	fe := &frontendServer{maxItemQuantity: 5}
+	tests := []struct {
+		name      string
+		productID string
+		quantity  string
+	}{
+		{"empty quantity", "OLJCESPC7Z", ""},
+		{"negative quantity", "OLJCESPC7Z", "-1"},
+		{"zero quantity", "OLJCESPC7Z", "0"},
+		{"quantity over the limit", "OLJCESPC7Z", "6"},
+		{"overflowing quantity", "OLJCESPC7Z", "18446744073709551616"},
+		{"non-numeric quantity", "OLJCESPC7Z", "lots"},
+		{"empty product ID", "", "1"},
+		{"malformed product ID", "not-a-product", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newHomeRequest("s1", "")
+			r.Method = http.MethodPost
+			r.Form = url.Values{"product_id": {tt.productID}, "quantity": {tt.quantity}}
+			w := httptest.NewRecorder()
+			fe.addToCartHandler(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
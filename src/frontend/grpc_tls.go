@@ -0,0 +1,72 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// backendTLSConfig returns the TLS config for the backend whose variables
+// start with prefix, such as CART_SERVICE, or nil for plaintext. With
+// <prefix>_TLS=true the backend's certificate is checked against the CA
+// bundle in <prefix>_TLS_CA_FILE, or the system roots, for the host name in
+// <prefix>_TLS_SERVER_NAME, or the one in the address. <prefix>_TLS_CERT_FILE
+// and <prefix>_TLS_KEY_FILE hold the client certificate for backends
+// requiring mutual TLS.
+func backendTLSConfig(prefix string) (*tls.Config, error) {
+	on := false
+	if v := os.Getenv(prefix + "_TLS"); v != "" {
+		var err error
+		if on, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("failed to parse %s_TLS (%s) as a bool", prefix, v)
+		}
+	}
+	caFile := os.Getenv(prefix + "_TLS_CA_FILE")
+	certFile, keyFile := os.Getenv(prefix+"_TLS_CERT_FILE"), os.Getenv(prefix+"_TLS_KEY_FILE")
+	if !on {
+		if caFile != "" || certFile != "" || keyFile != "" {
+			return nil, fmt.Errorf("%s TLS files are set but TLS is off: set %s_TLS=true", prefix, prefix)
+		}
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: os.Getenv(prefix + "_TLS_SERVER_NAME")}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s_TLS_CA_FILE: %v", prefix, err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s_TLS_CA_FILE %s holds no PEM certificates", prefix, caFile)
+		}
+		cfg.RootCAs = roots
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s_TLS_CERT_FILE and %s_TLS_KEY_FILE must be set together", prefix, prefix)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s client certificate: %v", prefix, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key as PEM
+// files, returning their paths.
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	junk := filepath.Join(t.TempDir(), "junk.pem")
+	if err := os.WriteFile(junk, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantTLS    bool
+		wantCA     bool
+		wantClient bool
+		wantErr    string
+	}{
+		{name: "off"},
+		{name: "system roots", env: map[string]string{"CART_SERVICE_TLS": "true"}, wantTLS: true},
+		{name: "custom CA", env: map[string]string{"CART_SERVICE_TLS": "true", "CART_SERVICE_TLS_CA_FILE": certFile}, wantTLS: true, wantCA: true},
+		{name: "mutual TLS", env: map[string]string{"CART_SERVICE_TLS": "true", "CART_SERVICE_TLS_CA_FILE": certFile, "CART_SERVICE_TLS_CERT_FILE": certFile, "CART_SERVICE_TLS_KEY_FILE": keyFile}, wantTLS: true, wantCA: true, wantClient: true},
+		{name: "invalid switch", env: map[string]string{"CART_SERVICE_TLS": "maybe"}, wantErr: "CART_SERVICE_TLS"},
+		{name: "files without TLS", env: map[string]string{"CART_SERVICE_TLS_CA_FILE": certFile}, wantErr: "TLS is off"},
+		{name: "CA file without certificates", env: map[string]string{"CART_SERVICE_TLS": "true", "CART_SERVICE_TLS_CA_FILE": junk}, wantErr: "no PEM certificates"},
+		{name: "cert without key", env: map[string]string{"CART_SERVICE_TLS": "true", "CART_SERVICE_TLS_CERT_FILE": certFile}, wantErr: "must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"CART_SERVICE_TLS", "CART_SERVICE_TLS_CA_FILE", "CART_SERVICE_TLS_CERT_FILE", "CART_SERVICE_TLS_KEY_FILE"} {
+				t.Setenv(k, tt.env[k])
+			}
+			cfg, err := backendTLSConfig("CART_SERVICE")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg != nil; got != tt.wantTLS {
+				t.Fatalf("got TLS %v, want %v", got, tt.wantTLS)
+			}
+			if got := cfg != nil && cfg.RootCAs != nil; got != tt.wantCA {
+				t.Errorf("got custom CA %v, want %v", got, tt.wantCA)
+			}
+			if got := cfg != nil && len(cfg.Certificates) > 0; got != tt.wantClient {
+				t.Errorf("got client certificate %v, want %v", got, tt.wantClient)
+			}
+		})
+	}
+}
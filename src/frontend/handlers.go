@@ -15,11 +15,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
 	"math/rand"
 	"net"
 	"net/http"
@@ -28,9 +28,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
@@ -56,38 +59,61 @@ var (
 
 var validEnvs = []string{"local", "gcp", "azure", "aws", "onprem", "alibaba"}
 
+type productView struct {
+	Item  *pb.Product
+	Price *pb.Money
+}
+
 func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.WithField("currency", currentCurrency(r)).Info("home")
-	currencies, err := fe.getCurrencies(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+	c, cartStale, cartErr := fe.getCartWithFallback(r.Context(), cartUserID(r))
+	cart := c.GetItems()
+	if cartStale {
+		log.Warn("serving stale cart, cartservice read failed")
+		w.Header().Set(cartStaleHeader, "true")
+	}
+
+	// Visitors with something in their cart see their own badge, so only
+	// empty-cart pages are shared through the page cache.
+	cacheKey, keyed := newPageCacheKey(r, "home")
+	cacheable := fe.pageCache != nil && keyed && cartErr == nil && !cartStale && len(cart) == 0
+	if cacheable {
+		if body, ok := fe.pageCache.get(cacheKey); ok {
+			writeCachedPage(w, r, body, true)
+			return
+		}
+	}
+
+	currencies, currenciesErr := fe.getCurrencies(r.Context())
+	products, productsErr := fe.getProducts(r.Context())
+	if currenciesErr != nil && productsErr != nil {
+		fe.renderFallback(log, r, w, "home", errors.Wrap(productsErr, "could not retrieve currencies or products"))
 		return
 	}
-	products, err := fe.getProducts(r.Context())
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
+	if currenciesErr != nil {
+		renderHTTPError(log, r, w, errors.Wrap(currenciesErr, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+	if productsErr != nil {
+		renderHTTPError(log, r, w, errors.Wrap(productsErr, "could not retrieve products"), http.StatusInternalServerError)
 		return
 	}
-
-	type productView struct {
-		Item  *pb.Product
-		Price *pb.Money
+	if cartErr != nil {
+		renderHTTPError(log, r, w, errors.Wrap(cartErr, "could not retrieve cart"), http.StatusInternalServerError)
+		return
 	}
-	ps := make([]productView, len(products))
-	for i, p := range products {
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId()), http.StatusInternalServerError)
-			return
-		}
-		ps[i] = productView{p, price}
+	if fe.pageCache != nil {
+		fe.pageCache.noteCatalog(products)
+	}
+
+	ps, catalogPartial, err := fe.productViews(r.Context(), log, "home", products, currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusInternalServerError)
+		return
 	}
+	// A partial page must not be shared, or it would outlive the problem.
+	cacheable = cacheable && !catalogPartial
 
 	// Set ENV_PLATFORM (default to local if not set; use env var if set; otherwise detect GCP, which overrides env)_
 	var env = os.Getenv("ENV_PLATFORM")
@@ -107,14 +133,26 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	plat = platformDetails{}
 	plat.setPlatformDetails(strings.ToLower(env))
 
-	if err := templates.ExecuteTemplate(w, "home", injectCommonTemplateData(r, map[string]interface{}{
-		"show_currency": true,
-		"currencies":    currencies,
-		"products":      ps,
-		"cart_size":     cartSize(cart),
-		"banner_color":  os.Getenv("BANNER_COLOR"), // illustrates canary deployments
-		"ad":            fe.chooseAd(r.Context(), []string{}, log),
-	})); err != nil {
+	data := injectCommonTemplateData(r, map[string]interface{}{
+		"show_currency":   true,
+		"currencies":      currencies,
+		"products":        ps,
+		"catalog_partial": catalogPartial,
+		"cart_size":       cartSize(cart),
+		"banner_color":    os.Getenv("BANNER_COLOR"), // illustrates canary deployments
+		"ad":              fe.chooseAd(r.Context(), []string{}, log),
+	})
+	if cacheable {
+		var buf bytes.Buffer
+		if err := templates.ExecuteTemplate(&buf, "home", withPageCacheHoles(data)); err != nil {
+			log.Error(err)
+			return
+		}
+		fe.pageCache.put(cacheKey, buf.Bytes())
+		writeCachedPage(w, r, buf.Bytes(), false)
+		return
+	}
+	if err := templates.ExecuteTemplate(w, "home", data); err != nil {
 		log.Error(err)
 	}
 }
@@ -162,11 +200,16 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	c, cartStale, err := fe.getCartWithFallback(r.Context(), cartUserID(r))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
 	}
+	cart := c.GetItems()
+	if cartStale {
+		log.Warn("serving stale cart, cartservice read failed")
+		w.Header().Set(cartStaleHeader, "true")
+	}
 
 	price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
 	if err != nil {
@@ -180,10 +223,13 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 		log.WithField("error", err).Warn("failed to get product recommendations")
 	}
 
-	product := struct {
-		Item  *pb.Product
-		Price *pb.Money
-	}{p, price}
+	// ignores the error retrieving related products since it is not critical
+	related, err := fe.getRelatedProducts(r.Context(), p, currentCurrency(r))
+	if err != nil {
+		log.WithField("error", err).Warn("failed to get related products")
+	}
+
+	product := productView{p, price}
 
 	// Fetch packaging info (weight/dimensions) of the product
 	// The packaging service is an optional microservice you can run as part of a Google Cloud demo.
@@ -201,8 +247,11 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 		"currencies":      currencies,
 		"product":         product,
 		"recommendations": recommendations,
+		"related":         related,
 		"cart_size":       cartSize(cart),
 		"packagingInfo":   packagingInfo,
+		"idempotency_key": uuid.NewString(),
+		"source":          normalizeItemSource(r.URL.Query().Get("source")),
 	})); err != nil {
 		log.Println(err)
 	}
@@ -210,14 +259,25 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 
 func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
-	quantity, _ := strconv.ParseUint(r.FormValue("quantity"), 10, 32)
+	quantity, err := parseQuantity(r.FormValue("quantity"), fe.maxItemQuantity)
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
 	productID := r.FormValue("product_id")
+	if err := validateProductID(productID); err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
 	payload := validator.AddToCartPayload{
 		Quantity:  quantity,
 		ProductID: productID,
+		// Set by the product page's form, so that a resubmitted form
+		// doesn't add the item twice.
+		IdempotencyKey: r.FormValue("idempotency_key"),
 	}
 	if err := payload.Validate(); err != nil {
-		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusBadRequest)
 		return
 	}
 	log.WithField("product", payload.ProductID).WithField("quantity", payload.Quantity).Debug("adding to cart")
@@ -228,7 +288,11 @@ func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), int32(payload.Quantity)); err != nil {
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.insertCart(r.Context(), cartUserID(r), p.GetId(), int32(payload.Quantity), p.GetPriceUsd(), currentCurrency(r), payload.IdempotencyKey, normalizeItemSource(r.FormValue("source"))); err != nil {
+		if redirectOnCartLimit(w, err) {
+			return
+		}
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to add to cart"), http.StatusInternalServerError)
 		return
 	}
@@ -236,15 +300,96 @@ func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Reques
 	w.WriteHeader(http.StatusFound)
 }
 
+func (fe *frontendServer) updateCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	quantity, err := parseQuantityInRange(r.FormValue("quantity"), 0, fe.maxItemQuantity)
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
+	productID := r.FormValue("product_id")
+	if err := validateProductID(productID); err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
+	version, err := expectedCartVersion(r)
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
+	log.WithField("product", productID).WithField("quantity", quantity).Debug("updating cart item")
+
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.updateCartItemQuantity(r.Context(), cartUserID(r), productID, int32(quantity), version); err != nil {
+		if redirectOnCartLimit(w, err) || redirectOnCartConflict(w, err) {
+			return
+		}
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to update cart"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("location", baseUrl + "/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
+func (fe *frontendServer) saveForLaterHandler(w http.ResponseWriter, r *http.Request) {
+	fe.moveCartItem(w, r, "saving item for later", fe.saveForLater)
+}
+
+func (fe *frontendServer) moveToCartHandler(w http.ResponseWriter, r *http.Request) {
+	fe.moveCartItem(w, r, "moving saved item to cart", fe.moveToCart)
+}
+
+// moveCartItem moves the posted product between the cart and the saved list
+// with move, then returns to the cart page.
+func (fe *frontendServer) moveCartItem(w http.ResponseWriter, r *http.Request, action string, move func(context.Context, string, string, *int64) error) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	productID := r.FormValue("product_id")
+	if err := validateProductID(productID); err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
+	version, err := expectedCartVersion(r)
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
+	log.WithField("product", productID).Debug(action)
+
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := move(r.Context(), cartUserID(r), productID, version); err != nil {
+		if redirectOnCartLimit(w, err) || redirectOnCartConflict(w, err) {
+			return
+		}
+		code := http.StatusInternalServerError
+		if status.Code(err) == codes.NotFound {
+			code = http.StatusNotFound
+		}
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed "+action), code)
+		return
+	}
+	w.Header().Set("location", baseUrl + "/cart")
+	w.WriteHeader(http.StatusFound)
+}
+
 func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("emptying cart")
+	version, err := expectedCartVersion(r)
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusBadRequest)
+		return
+	}
 
-	if err := fe.emptyCart(r.Context(), sessionID(r)); err != nil {
+	fe.invalidateCachedCart(cartUserID(r))
+	if err := fe.emptyCart(r.Context(), cartUserID(r), version, true); err != nil {
+		if redirectOnCartConflict(w, err) {
+			return
+		}
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to empty cart"), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("location", baseUrl + "/")
+	// Back to the cart page, which offers to undo.
+	w.Header().Set("location", baseUrl+"/cart?notice="+cartEmptiedNotice)
 	w.WriteHeader(http.StatusFound)
 }
 
@@ -256,11 +401,16 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	c, cartStale, err := fe.getCartWithFallback(r.Context(), cartUserID(r))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
 	}
+	cart := c.GetItems()
+	if cartStale {
+		log.Warn("serving stale cart, cartservice read failed")
+		w.Header().Set(cartStaleHeader, "true")
+	}
 
 	// ignores the error retrieving recommendations since it is not critical
 	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), cartIDs(cart))
@@ -268,6 +418,13 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		log.WithField("error", err).Warn("failed to get product recommendations")
 	}
 
+	// the saved list is secondary to the cart, so failing to load it only
+	// hides it
+	saved, err := fe.savedItemViews(r.Context(), cartUserID(r), currentCurrency(r))
+	if err != nil {
+		log.WithField("error", err).Warn("failed to get saved items")
+	}
+
 	shippingCost, err := fe.getShippingQuote(r.Context(), cart, currentCurrency(r))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get shipping quote"), http.StatusInternalServerError)
@@ -278,6 +435,9 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		Item     *pb.Product
 		Quantity int32
 		Price    *pb.Money
+		// PriceWhenAdded is the unit price at add time, set only when it
+		// differs from the current one.
+		PriceWhenAdded *pb.Money
 	}
 	items := make([]cartItemView, len(cart))
 	totalPrice := pb.Money{CurrencyCode: currentCurrency(r)}
@@ -298,6 +458,14 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 			Item:     p,
 			Quantity: item.GetQuantity(),
 			Price:    &multPrice}
+		if priceChanged(item.GetPriceSnapshot(), p.GetPriceUsd()) {
+			was, err := fe.convertCurrency(r.Context(), item.GetPriceSnapshot(), currentCurrency(r))
+			if err != nil {
+				log.WithField("error", err).Warn("failed to convert price snapshot")
+			} else {
+				items[i].PriceWhenAdded = was
+			}
+		}
 		totalPrice = money.Must(money.Sum(totalPrice, multPrice))
 	}
 	totalPrice = money.Must(money.Sum(totalPrice, *shippingCost))
@@ -307,16 +475,54 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		"currencies":       currencies,
 		"recommendations":  recommendations,
 		"cart_size":        cartSize(cart),
+		"cart_stale":       cartStale,
+		"cart_currency":    lockedCartCurrency(c, currentCurrency(r)),
 		"shipping_cost":    shippingCost,
 		"show_currency":    true,
 		"total_cost":       totalPrice,
 		"items":            items,
 		"expiration_years": []int{year, year + 1, year + 2, year + 3, year + 4},
+		"show_product_id":  fe.showProductID,
+		"max_quantity":     quantityLimit(fe.maxItemQuantity),
+		"saved_items":      saved,
+		"cart_notice":      cartNotices[r.URL.Query().Get("notice")],
+		"can_restore":      r.URL.Query().Get("notice") == cartEmptiedNotice,
+		"cart_version":     c.GetVersion(),
+		"share_link":       cartShareLink(r),
+		"import_token":     cartImportToken(r),
 	})); err != nil {
 		log.Println(err)
 	}
 }
 
+type savedItemView struct {
+	Item     *pb.Product
+	Quantity int32
+	// Price is the current unit price.
+	Price *pb.Money
+}
+
+// savedItemViews loads the user's saved-for-later list with current prices.
+func (fe *frontendServer) savedItemViews(ctx context.Context, userID, currency string) ([]savedItemView, error) {
+	saved, err := fe.getSavedItems(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]savedItemView, 0, len(saved))
+	for _, item := range saved {
+		p, err := fe.getProduct(ctx, item.GetProductId())
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId())
+		}
+		price, err := fe.convertCurrency(ctx, p.GetPriceUsd(), currency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId())
+		}
+		views = append(views, savedItemView{Item: p, Quantity: item.GetQuantity(), Price: price})
+	}
+	return views, nil
+}
+
 func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("placing order")
@@ -351,6 +557,9 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Read first, so the cleanup after the order never empties items
+	// added to the cart since.
+	orderedVersion := fe.orderedCartVersion(r.Context(), log, cartUserID(r))
 	order, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).
 		PlaceOrder(r.Context(), &pb.PlaceOrderRequest{
 			Email: payload.Email,
@@ -359,7 +568,7 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 				CreditCardExpirationMonth: int32(payload.CcMonth),
 				CreditCardExpirationYear:  int32(payload.CcYear),
 				CreditCardCvv:             int32(payload.CcCVV)},
-			UserId:       sessionID(r),
+			UserId:       cartUserID(r),
 			UserCurrency: currentCurrency(r),
 			Address: &pb.Address{
 				StreetAddress: payload.StreetAddress,
@@ -373,6 +582,8 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	log.WithField("order", order.GetOrder().GetOrderId()).Info("order placed")
+	fe.emptyCartAfterCheckout(r.Context(), log, cartUserID(r), orderedVersion)
+	fe.invalidateCachedCart(cartUserID(r))
 
 	order.GetOrder().GetItems()
 	recommendations, _ := fe.getRecommendations(r.Context(), sessionID(r), nil)
@@ -395,6 +606,7 @@ func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Reque
 		"order":           order.GetOrder(),
 		"total_paid":      &totalPaid,
 		"recommendations": recommendations,
+		"show_product_id": fe.showProductID,
 	})); err != nil {
 		log.Println(err)
 	}
@@ -461,6 +673,10 @@ func (fe *frontendServer) chatBotHandler(w http.ResponseWriter, r *http.Request)
 
 	var response LLMResponse
 
+	if fe.assistantClient == nil {
+		renderHTTPError(log, r, w, errors.New("shopping assistant is disabled"), http.StatusServiceUnavailable)
+		return
+	}
 	url := "http://" + fe.shoppingAssistantSvcAddr
 	req, err := http.NewRequest(http.MethodPost, url, r.Body)
 	if err != nil {
@@ -469,13 +685,19 @@ func (fe *frontendServer) chatBotHandler(w http.ResponseWriter, r *http.Request)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	res, err := http.DefaultClient.Do(req)
+	res, err := fe.assistantClient.Do(req)
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to send request"), http.StatusInternalServerError)
 		return
 	}
 
-	body, err := io.ReadAll(res.Body)
+	defer res.Body.Close()
+	body, err := readAssistantResponse(res.Body, fe.assistantMaxResponseBytes)
+	if errors.Cause(err) == errAssistantResponseTooLarge {
+		log.WithField("limit_bytes", fe.assistantMaxResponseBytes).Warn("dropping oversized shopping assistant response")
+		renderHTTPError(log, r, w, err, http.StatusBadGateway)
+		return
+	}
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to read response"), http.StatusInternalServerError)
 		return
@@ -501,7 +723,11 @@ func (fe *frontendServer) setCurrencyHandler(w http.ResponseWriter, r *http.Requ
 	cur := r.FormValue("currency_code")
 	payload := validator.SetCurrencyPayload{Currency: cur}
 	if err := payload.Validate(); err != nil {
-		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusUnprocessableEntity)
+		renderHTTPError(log, r, w, validator.ValidationErrorResponse(err), http.StatusBadRequest)
+		return
+	}
+	if !whitelistedCurrencies[payload.Currency] {
+		renderHTTPError(log, r, w, errors.Errorf("currency %s is not supported", payload.Currency), http.StatusBadRequest)
 		return
 	}
 	log.WithField("curr.new", payload.Currency).WithField("curr.old", currentCurrency(r)).
@@ -594,6 +820,16 @@ func cartIDs(c []*pb.CartItem) []string {
 	return out
 }
 
+// lockedCartCurrency returns the currency the cart was created in when it
+// differs from the one the user is browsing in, and "" otherwise. Carts are
+// only locked to a currency when cartservice runs with CART_CURRENCY_LOCK.
+func lockedCartCurrency(c *pb.Cart, current string) string {
+	if locked := c.GetCurrencyCode(); locked != "" && locked != current {
+		return locked
+	}
+	return ""
+}
+
 // get total # of items in cart
 func cartSize(c []*pb.CartItem) int {
 	cartSize := 0
@@ -0,0 +1,144 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type ctxKeyCartUserID struct{}
+
+const defaultJWTSubjectClaim = "sub"
+
+// jwtAuthConfig configures cart keys taken from JWTs verified at the edge.
+// Exactly one of jwksURL and secret is set.
+type jwtAuthConfig struct {
+	jwksURL  string
+	secret   string
+	claim    string
+	issuer   string
+	audience string
+}
+
+// jwtAuth verifies bearer tokens and reads the claim that keys the cart.
+type jwtAuth struct {
+	keyfunc jwt.Keyfunc
+	parser  *jwt.Parser
+	claim   string
+}
+
+func newJWTAuth(ctx context.Context, cfg jwtAuthConfig) (*jwtAuth, error) {
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired()}
+	if cfg.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.issuer))
+	}
+	if cfg.audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.audience))
+	}
+	a := &jwtAuth{claim: cfg.claim}
+	if a.claim == "" {
+		a.claim = defaultJWTSubjectClaim
+	}
+	switch {
+	case cfg.jwksURL != "" && cfg.secret != "":
+		return nil, errors.New("JWT_JWKS_URL and JWT_SECRET are mutually exclusive")
+	case cfg.jwksURL != "":
+		k, err := keyfunc.NewDefaultCtx(ctx, []string{cfg.jwksURL})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load JWKS from %s", cfg.jwksURL)
+		}
+		a.keyfunc = k.Keyfunc
+		opts = append(opts, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}))
+	case cfg.secret != "":
+		secret := []byte(cfg.secret)
+		a.keyfunc = func(*jwt.Token) (any, error) { return secret, nil }
+		opts = append(opts, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+	default:
+		return nil, errors.New("either JWT_JWKS_URL or JWT_SECRET is required")
+	}
+	a.parser = jwt.NewParser(opts...)
+	return a, nil
+}
+
+// cartUser verifies token and returns its cart key claim, escaped by
+// escapeCartUser.
+func (a *jwtAuth) cartUser(token string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keyfunc); err != nil {
+		return "", err
+	}
+	user, _ := claims[a.claim].(string)
+	if user == "" {
+		return "", errors.Errorf("token has no %q claim", a.claim)
+	}
+	return escapeCartUser(user), nil
+}
+
+// cartUserEscaper escapes '%' first, so distinct claims stay distinct.
+var cartUserEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+// escapeCartUser maps a claim to a cart user ID without ':', which
+// cartservice reserves to key named carts as "user:name". URN and SPIFFE
+// style subjects ("urn:example:user:42") would otherwise name another
+// user's cart. Claims without ':' or '%' are used as they are.
+func escapeCartUser(claim string) string {
+	return cartUserEscaper.Replace(claim)
+}
+
+// resolveCartUser keys the cart of requests carrying a valid bearer token by
+// the token's claim, so a logged-in user sees the same cart on every device.
+// Requests without a token keep using their session ID. A token that fails
+// verification is rejected with 401 rather than quietly ignored.
+func (a *jwtAuth) resolveCartUser(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, err := a.cartUser(token)
+		if err != nil {
+			log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+			renderHTTPError(log, r, w, errors.Wrap(err, "invalid authorization token"), http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), ctxKeyCartUserID{}, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// cartUserID is the key of the request's cart: the verified JWT claim when
+// JWT auth is configured and a token was sent, the session ID otherwise.
+func cartUserID(r *http.Request) string {
+	if v, ok := r.Context().Value(ctxKeyCartUserID{}).(string); ok {
+		return v
+	}
+	return sessionID(r)
+}
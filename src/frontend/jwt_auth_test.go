@@ -0,0 +1,139 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testJWTSecret = "not-a-real-secret"
+
+func signHS256(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// cartUserFor runs a request with the given Authorization header through
+// auth and returns the status and the cart key the handler saw.
+func cartUserFor(auth *jwtAuth, authorization string) (int, string) {
+	var got string
+	handler := auth.resolveCartUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = cartUserID(r)
+	}))
+	r := newHomeRequest("session-1", "")
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code, got
+}
+
+func TestResolveCartUser(t *testing.T) {
+	auth, err := newJWTAuth(context.Background(), jwtAuthConfig{secret: testJWTSecret, issuer: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := jwt.MapClaims{"sub": "user-42", "iss": "edge", "exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name          string
+		authorization string
+		wantCode      int
+		wantUser      string
+	}{
+		{"missing token", "", http.StatusOK, "session-1"},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", http.StatusOK, "session-1"},
+		{"valid token", "Bearer " + signHS256(t, testJWTSecret, valid), http.StatusOK, "user-42"},
+		{"wrong secret", "Bearer " + signHS256(t, "another-secret", valid), http.StatusUnauthorized, ""},
+		{"expired", "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"sub": "user-42", "iss": "edge", "exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized, ""},
+		{"no expiry", "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"sub": "user-42", "iss": "edge"}), http.StatusUnauthorized, ""},
+		{"wrong issuer", "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"sub": "user-42", "iss": "elsewhere", "exp": time.Now().Add(time.Hour).Unix()}), http.StatusUnauthorized, ""},
+		{"colon in subject", "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"sub": "user-42:wishlist", "iss": "edge", "exp": time.Now().Add(time.Hour).Unix()}), http.StatusOK, "user-42%3Awishlist"},
+		{"URN subject", "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"sub": "urn:example:user:42", "iss": "edge", "exp": time.Now().Add(time.Hour).Unix()}), http.StatusOK, "urn%3Aexample%3Auser%3A42"},
+		{"escaped colon in subject", "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"sub": "user-42%3Awishlist", "iss": "edge", "exp": time.Now().Add(time.Hour).Unix()}), http.StatusOK, "user-42%253Awishlist"},
+		{"no subject", "Bearer " + signHS256(t, testJWTSecret, jwt.MapClaims{"iss": "edge", "exp": time.Now().Add(time.Hour).Unix()}), http.StatusUnauthorized, ""},
+		{"garbage", "Bearer not.a.jwt", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		code, user := cartUserFor(auth, tt.authorization)
+		if code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, code, tt.wantCode)
+		}
+		if user != tt.wantUser {
+			t.Errorf("%s: got cart user %q, want %q", tt.name, user, tt.wantUser)
+		}
+	}
+}
+
+func TestResolveCartUserJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"keys": [{"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig", "n": %q, "e": %q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	}))
+	defer jwks.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auth, err := newJWTAuth(ctx, jwtAuthConfig{jwksURL: jwks.URL, claim: "email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"email": "shopper@example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, user := cartUserFor(auth, "Bearer "+signed); code != http.StatusOK || user != "shopper@example.com" {
+		t.Errorf("RS256 token: got status %d and cart user %q", code, user)
+	}
+
+	// A shared-secret token must not pass against a JWKS.
+	hs := signHS256(t, testJWTSecret, jwt.MapClaims{"email": "shopper@example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	if code, _ := cartUserFor(auth, "Bearer "+hs); code != http.StatusUnauthorized {
+		t.Errorf("HS256 token against JWKS: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestNewJWTAuthConfig(t *testing.T) {
+	if _, err := newJWTAuth(context.Background(), jwtAuthConfig{}); err == nil {
+		t.Error("accepted a config with neither JWKS URL nor secret")
+	}
+	if _, err := newJWTAuth(context.Background(), jwtAuthConfig{jwksURL: "http://jwks", secret: testJWTSecret}); err == nil {
+		t.Error("accepted a config with both JWKS URL and secret")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// backendLatencyWindow is how far back readiness looks when judging
+	// whether a backend is slow.
+	backendLatencyWindow = time.Minute
+
+	// minLatencySamples keeps a single slow call to an otherwise idle
+	// backend from marking it degraded.
+	minLatencySamples = 5
+
+	// maxLatencySamples bounds the memory kept per backend under heavy load.
+	maxLatencySamples = 1000
+)
+
+type latencySample struct {
+	at time.Time
+	d  time.Duration
+}
+
+// latencyTracker keeps the recent call latencies of each backend.
+type latencyTracker struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	samples map[string][]latencySample
+}
+
+func newLatencyTracker(window time.Duration) *latencyTracker {
+	return &latencyTracker{window: window, samples: make(map[string][]latencySample)}
+}
+
+func (t *latencyTracker) observe(backend string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := append(t.expire(backend, time.Now()), latencySample{time.Now(), d})
+	if len(s) > maxLatencySamples {
+		s = s[len(s)-maxLatencySamples:]
+	}
+	t.samples[backend] = s
+}
+
+// average returns the mean latency of backend's calls within the window,
+// and false when there are too few of them to judge.
+func (t *latencyTracker) average(backend string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.expire(backend, time.Now())
+	t.samples[backend] = s
+	if len(s) < minLatencySamples {
+		return 0, false
+	}
+	var total time.Duration
+	for _, sample := range s {
+		total += sample.d
+	}
+	return total / time.Duration(len(s)), true
+}
+
+// expire drops backend's samples older than the window. The caller must
+// hold t.mu.
+func (t *latencyTracker) expire(backend string, now time.Time) []latencySample {
+	s := t.samples[backend]
+	i := 0
+	for i < len(s) && now.Sub(s[i].at) > t.window {
+		i++
+	}
+	return s[i:]
+}
+
+// backendFromMethod names the backend serving a gRPC method the way
+// backends() does, e.g. "/hipstershop.CartService/GetCart" is "cart".
+func backendFromMethod(method string) string {
+	service, _, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		service = service[i+1:]
+	}
+	return strings.ToLower(strings.TrimSuffix(service, "Service"))
+}
+
+// latencyInterceptor records how long each call took, retries included, in
+// backendRequestDuration and, when tracker is set, for readiness.
+func latencyInterceptor(tracker *latencyTracker) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		d := time.Since(start)
+		backend := backendFromMethod(method)
+		backendRequestDuration.WithLabelValues(backend).Observe(d.Seconds())
+		if tracker != nil {
+			tracker.observe(backend, d)
+		}
+		return err
+	}
+}
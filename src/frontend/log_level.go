@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultLogLevel keeps the frontend as chatty as it has always been. Busy
+// deployments will want LOG_LEVEL=info, as every request is logged.
+const defaultLogLevel = logrus.DebugLevel
+
+// parseLogLevel turns LOG_LEVEL, a logrus level name such as "info", into a
+// level. Empty means defaultLogLevel.
+func parseLogLevel(v string) (logrus.Level, error) {
+	if v == "" {
+		return defaultLogLevel, nil
+	}
+	return logrus.ParseLevel(v)
+}
+
+// toggleDebugOnSIGHUP switches log between debug logging and base on every
+// SIGHUP, for a closer look at a running pod without a restart. With base
+// itself debug, it switches to info instead.
+func toggleDebugOnSIGHUP(log *logrus.Logger, base logrus.Level) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.SetLevel(nextLogLevel(log.GetLevel(), base))
+		log.Warnf("SIGHUP received, log level is now %s", log.GetLevel())
+	}
+}
+
+// nextLogLevel is the level a SIGHUP switches current to.
+func nextLogLevel(current, base logrus.Level) logrus.Level {
+	if current != logrus.DebugLevel {
+		return logrus.DebugLevel
+	}
+	if base == logrus.DebugLevel {
+		return logrus.InfoLevel
+	}
+	return base
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    logrus.Level
+		wantErr bool
+	}{
+		{"", defaultLogLevel, false},
+		{"info", logrus.InfoLevel, false},
+		{"ERROR", logrus.ErrorLevel, false},
+		{"chatty", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLogLevel(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseLogLevel(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNextLogLevel(t *testing.T) {
+	tests := []struct {
+		current, base, want logrus.Level
+	}{
+		{logrus.InfoLevel, logrus.InfoLevel, logrus.DebugLevel},
+		{logrus.DebugLevel, logrus.InfoLevel, logrus.InfoLevel},
+		{logrus.DebugLevel, logrus.DebugLevel, logrus.InfoLevel},
+	}
+	for _, tt := range tests {
+		if got := nextLogLevel(tt.current, tt.base); got != tt.want {
+			t.Errorf("nextLogLevel(%s, %s) = %s, want %s", tt.current, tt.base, got, tt.want)
+		}
+	}
+}
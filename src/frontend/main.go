@@ -16,9 +16,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"maps"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -28,13 +36,14 @@ import (
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 )
 
 const (
@@ -48,6 +57,8 @@ const (
 )
 
 var (
+	// whitelistedCurrencies is replaced at startup when SUPPORTED_CURRENCIES
+	// is set.
 	whitelistedCurrencies = map[string]bool{
 		"USD": true,
 		"EUR": true,
@@ -85,12 +96,74 @@ type frontendServer struct {
 	adSvcConn *grpc.ClientConn
 
 	shoppingAssistantSvcAddr string
+	// assistantClient talks to the shopping assistant. It is nil while the
+	// assistant is disabled.
+	assistantClient *http.Client
+	// assistantMaxResponseBytes caps how much of an assistant reply is
+	// buffered. Zero means no limit.
+	assistantMaxResponseBytes int64
+
+	// cartCache, when non-nil, serves recently read carts while cartservice
+	// reads are failing. Enabled by setting CART_STALE_WINDOW.
+	cartCache *cartCache
+
+	// relatedProductsCount caps the "more in this category" section on the
+	// product page. Zero hides the section.
+	relatedProductsCount int
+
+	// pageCache, when non-nil, shares the rendered home page between
+	// anonymous visitors. Enabled by setting PAGE_CACHE_TTL.
+	pageCache *pageCache
+
+	// currencyCache, when non-nil, remembers conversion results. Its size
+	// is set with CURRENCY_CACHE_SIZE; zero disables it.
+	currencyCache *currencyCache
+
+	// fallbackMessage is shown on the maintenance page served when every
+	// backend a page needs is down. Set with FALLBACK_MESSAGE.
+	fallbackMessage string
+
+	// partialCatalog lets pages render the catalog products that could be
+	// displayed when others are malformed or fail to convert. On unless
+	// PARTIAL_CATALOG is false.
+	partialCatalog bool
+
+	// checkoutEmptyCartRetries is how many more times the cart is emptied
+	// after checkout if the first try fails. Set with
+	// CHECKOUT_EMPTY_CART_RETRIES.
+	checkoutEmptyCartRetries int
+
+	// cartReconciler, when non-nil, keeps trying to empty carts left
+	// behind by a successful checkout, unless they changed since.
+	cartReconciler *cartReconciler
+
+	// showProductID renders product IDs on the cart and order confirmation
+	// pages for support troubleshooting. Set with SHOW_PRODUCT_ID.
+	showProductID bool
+
+	// readyLatencyThreshold, when non-zero, makes /_readyz report backends
+	// whose recent calls average slower than it. backendLatencies holds
+	// those recent calls. Set with READY_LATENCY_THRESHOLD.
+	readyLatencyThreshold time.Duration
+	backendLatencies      *latencyTracker
+	// readyLatencyStrict fails readiness with 503 on slow backends instead
+	// of only flagging them. Set with READY_LATENCY_STRICT.
+	readyLatencyStrict bool
+
+	// breakers shed calls to each backend while it keeps failing, one per
+	// backend connection. Empty when BREAKER_FAILURE_THRESHOLD is 0.
+	breakers []*circuitBreaker
+
+	// maxItemQuantity caps the quantity accepted by the add-to-cart form.
+	// Set with MAX_ITEM_QUANTITY to match cartservice's limit.
+	maxItemQuantity int
 }
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	log := logrus.New()
-	log.Level = logrus.DebugLevel
+	log.Level = defaultLogLevel
 	log.Formatter = &logrus.JSONFormatter{
 		FieldMap: logrus.FieldMap{
 			logrus.FieldKeyTime:  "timestamp",
@@ -100,6 +173,12 @@ func main() {
 		TimestampFormat: time.RFC3339Nano,
 	}
 	log.Out = os.Stdout
+	if level, err := parseLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		log.Warnf("ignoring invalid LOG_LEVEL: %v", err)
+	} else {
+		log.SetLevel(level)
+	}
+	go toggleDebugOnSIGHUP(log, log.GetLevel())
 
 	svc := new(frontendServer)
 
@@ -110,14 +189,40 @@ func main() {
 
 	baseUrl = os.Getenv("BASE_URL")
 
+	traceShutdownCfg := defaultTraceShutdownConfig
+	if v := os.Getenv("TRACE_SHUTDOWN_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("failed to parse TRACE_SHUTDOWN_ATTEMPTS (%s) as a positive integer", v)
+		}
+		traceShutdownCfg.attempts = n
+	}
+	if v := os.Getenv("TRACE_SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("failed to parse TRACE_SHUTDOWN_TIMEOUT (%s) as a positive time.Duration", v)
+		}
+		traceShutdownCfg.timeout = d
+	}
+	shutdownGracePeriod := defaultShutdownGracePeriod
+	if v := os.Getenv("SHUTDOWN_GRACE_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("failed to parse SHUTDOWN_GRACE_PERIOD (%s) as a positive time.Duration", v)
+		}
+		shutdownGracePeriod = d
+	}
+
 	// Initialize tracing - always enabled for OpenChoreo
-	tp, err := initTracing(ctx, log, "frontend")
+	tp, exporter, err := initTracing(ctx, log, "frontend", traceShutdownCfg)
 	if err != nil {
 		log.Warnf("Failed to initialize tracing: %v", err)
 	} else {
 		defer func() {
-			if err := tp.Shutdown(ctx); err != nil {
-				log.Warnf("Error shutting down tracer provider: %v", err)
+			if err := shutdownTracing(tp, exporter); err != nil {
+				log.Warnf("Error shutting down tracer provider, buffered spans may be lost: %v", err)
+			} else {
+				log.Info("Tracer provider shut down, buffered spans flushed")
 			}
 		}()
 	}
@@ -134,15 +239,248 @@ func main() {
 	mustMapEnv(&svc.checkoutSvcAddr, "CHECKOUT_SERVICE_ADDR")
 	mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
 	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
-	mustMapEnv(&svc.shoppingAssistantSvcAddr, "SHOPPING_ASSISTANT_SERVICE_ADDR")
+	svc.shoppingAssistantSvcAddr = os.Getenv("SHOPPING_ASSISTANT_SERVICE_ADDR")
+
+	if v := os.Getenv("CART_STALE_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse CART_STALE_WINDOW (%s) as time.Duration: %+v", v, err)
+		}
+		if window > 0 {
+			svc.cartCache = newCartCache(window)
+			log.Infof("stale cart fallback enabled (window: %v)", window)
+		}
+	}
+
+	if v := os.Getenv("PAGE_CACHE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse PAGE_CACHE_TTL (%s) as time.Duration: %+v", v, err)
+		}
+		if ttl > 0 {
+			svc.pageCache = newPageCache(ttl)
+			log.Infof("home page cache enabled (ttl: %v)", ttl)
+		}
+	}
+
+	svc.fallbackMessage = os.Getenv("FALLBACK_MESSAGE")
+
+	sessionIDBytes := defaultSessionIDBytes
+	if v := os.Getenv("SESSION_ID_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse SESSION_ID_BYTES (%s) as an integer", v)
+		}
+		sessionIDBytes = n
+	}
+	newSessionID, err := newSessionIDGenerator(os.Getenv("SESSION_ID_SCHEME"), sessionIDBytes)
+	if err != nil {
+		log.Fatalf("invalid session ID configuration: %+v", err)
+	}
 
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
-	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
+	var auth *jwtAuth
+	if jwksURL, secret := os.Getenv("JWT_JWKS_URL"), os.Getenv("JWT_SECRET"); jwksURL != "" || secret != "" {
+		auth, err = newJWTAuth(ctx, jwtAuthConfig{
+			jwksURL:  jwksURL,
+			secret:   secret,
+			claim:    os.Getenv("JWT_SUBJECT_CLAIM"),
+			issuer:   os.Getenv("JWT_ISSUER"),
+			audience: os.Getenv("JWT_AUDIENCE"),
+		})
+		if err != nil {
+			log.Fatalf("invalid JWT auth configuration: %+v", err)
+		}
+		log.Info("keying carts of authenticated requests by their JWT claim")
+	}
+
+	if assistantEnabled {
+		connectTimeout := defaultAssistantConnectTimeout
+		if v := os.Getenv("ASSISTANT_CONNECT_TIMEOUT"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				log.Fatalf("failed to parse ASSISTANT_CONNECT_TIMEOUT (%s) as a positive time.Duration", v)
+			}
+			connectTimeout = d
+		}
+		svc.assistantMaxResponseBytes = defaultAssistantMaxResponseBytes
+		if v := os.Getenv("ASSISTANT_MAX_RESPONSE_BYTES"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				log.Fatalf("failed to parse ASSISTANT_MAX_RESPONSE_BYTES (%s) as a positive integer", v)
+			}
+			svc.assistantMaxResponseBytes = n
+		}
+		client, err := connectAssistant(ctx, svc.shoppingAssistantSvcAddr, connectTimeout)
+		if err != nil {
+			log.Warnf("shopping assistant disabled: %+v", err)
+			assistantEnabled = false
+		} else {
+			svc.assistantClient = client
+		}
+	}
+
+	svc.checkoutEmptyCartRetries = defaultCheckoutEmptyCartRetries
+	if v := os.Getenv("CHECKOUT_EMPTY_CART_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("failed to parse CHECKOUT_EMPTY_CART_RETRIES (%s) as a non-negative integer", v)
+		}
+		svc.checkoutEmptyCartRetries = n
+	}
+	svc.cartReconciler = newCartReconciler()
+
+	svc.maxItemQuantity = defaultMaxItemQuantity
+	if v := os.Getenv("MAX_ITEM_QUANTITY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("failed to parse MAX_ITEM_QUANTITY (%s) as a positive integer", v)
+		}
+		svc.maxItemQuantity = n
+	}
+
+	svc.partialCatalog = true
+	if v := os.Getenv("PARTIAL_CATALOG"); v != "" {
+		partial, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse PARTIAL_CATALOG (%s) as a bool: %+v", v, err)
+		}
+		svc.partialCatalog = partial
+	}
+
+	if v := os.Getenv("SHOW_PRODUCT_ID"); v != "" {
+		show, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse SHOW_PRODUCT_ID (%s) as a bool: %+v", v, err)
+		}
+		svc.showProductID = show
+	}
+
+	if v := os.Getenv("SUPPORTED_CURRENCIES"); v != "" {
+		currencies, err := parseSupportedCurrencies(v)
+		if err != nil {
+			log.Fatalf("failed to parse SUPPORTED_CURRENCIES (%s): %+v", v, err)
+		}
+		whitelistedCurrencies = currencies
+	}
+	log.Infof("supported currencies: %s", strings.Join(slices.Sorted(maps.Keys(whitelistedCurrencies)), ","))
+
+	currencyCacheSize := defaultCurrencyCacheSize
+	if v := os.Getenv("CURRENCY_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("failed to parse CURRENCY_CACHE_SIZE (%s) as a non-negative integer", v)
+		}
+		currencyCacheSize = n
+	}
+	if currencyCacheSize > 0 {
+		svc.currencyCache = newCurrencyCache(currencyCacheSize)
+	}
+
+	svc.relatedProductsCount = defaultRelatedProductsCount
+	if v := os.Getenv("RELATED_PRODUCTS_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("failed to parse RELATED_PRODUCTS_COUNT (%s) as a non-negative integer", v)
+		}
+		svc.relatedProductsCount = n
+	}
+
+	grpcCfg := defaultGRPCClientConfig
+	if v := os.Getenv("GRPC_MAX_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("failed to parse GRPC_MAX_RETRY_ATTEMPTS (%s) as a non-negative integer", v)
+		}
+		grpcCfg.maxRetryAttempts = n
+	}
+	if v := os.Getenv("RPC_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse RPC_TIMEOUT (%s) as time.Duration: %+v", v, err)
+		}
+		grpcCfg.rpcTimeout = d
+	}
+	if v := os.Getenv("GRPC_KEEPALIVE_TIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse GRPC_KEEPALIVE_TIME (%s) as time.Duration: %+v", v, err)
+		}
+		grpcCfg.keepaliveTime = d
+	}
+	if v := os.Getenv("GRPC_KEEPALIVE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("failed to parse GRPC_KEEPALIVE_TIMEOUT (%s) as a positive time.Duration", v)
+		}
+		grpcCfg.keepaliveTimeout = d
+	}
+	if v := os.Getenv("GRPC_KEEPALIVE_WITHOUT_CALLS"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse GRPC_KEEPALIVE_WITHOUT_CALLS (%s) as a bool", v)
+		}
+		grpcCfg.keepaliveWithoutCalls = on
+	}
+	if v := os.Getenv("READY_LATENCY_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("failed to parse READY_LATENCY_THRESHOLD (%s) as a positive time.Duration", v)
+		}
+		svc.readyLatencyThreshold = d
+		svc.backendLatencies = newLatencyTracker(backendLatencyWindow)
+		grpcCfg.latencies = svc.backendLatencies
+	}
+	if v := os.Getenv("READY_LATENCY_STRICT"); v != "" {
+		strict, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("failed to parse READY_LATENCY_STRICT (%s) as a bool", v)
+		}
+		svc.readyLatencyStrict = strict
+	}
+
+	breakerThreshold := defaultBreakerFailureThreshold
+	if v := os.Getenv("BREAKER_FAILURE_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("failed to parse BREAKER_FAILURE_THRESHOLD (%s) as a non-negative integer", v)
+		}
+		breakerThreshold = n
+	}
+	breakerCooldown := defaultBreakerCooldown
+	if v := os.Getenv("BREAKER_COOLDOWN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("failed to parse BREAKER_COOLDOWN (%s) as a positive time.Duration", v)
+		}
+		breakerCooldown = d
+	}
+	// backendCfg tunes the connection to the backend called name, whose
+	// settings start with prefix.
+	backendCfg := func(name, prefix string) grpcClientConfig {
+		cfg, err := backendClientConfig(grpcCfg, prefix)
+		if err != nil {
+			log.Fatalf("invalid %s call settings: %v", prefix, err)
+		}
+		log.Infof("%s calls: timeout %v, %d attempts", prefix, cfg.rpcTimeout, max(cfg.maxRetryAttempts, 1))
+		if breakerThreshold > 0 {
+			cfg.breaker = newCircuitBreaker(name, breakerThreshold, breakerCooldown, log)
+			svc.breakers = append(svc.breakers, cfg.breaker)
+		}
+		return cfg
+	}
+	mustConnGRPC(&svc.currencySvcConn, svc.currencySvcAddr, backendCfg("currency", "CURRENCY_SERVICE"))
+	mustConnGRPC(&svc.productCatalogSvcConn, svc.productCatalogSvcAddr, backendCfg("productcatalog", "PRODUCT_CATALOG_SERVICE"))
+	cartCfg := backendCfg("cart", "CART_SERVICE")
+	if cartCfg.tls, err = backendTLSConfig("CART_SERVICE"); err != nil {
+		log.Fatalf("invalid cart service TLS settings: %v", err)
+	}
+	mustConnGRPC(&svc.cartSvcConn, svc.cartSvcAddr, cartCfg)
+	mustConnGRPC(&svc.recommendationSvcConn, svc.recommendationSvcAddr, backendCfg("recommendation", "RECOMMENDATION_SERVICE"))
+	mustConnGRPC(&svc.shippingSvcConn, svc.shippingSvcAddr, backendCfg("shipping", "SHIPPING_SERVICE"))
+	mustConnGRPC(&svc.checkoutSvcConn, svc.checkoutSvcAddr, backendCfg("checkout", "CHECKOUT_SERVICE"))
+	mustConnGRPC(&svc.adSvcConn, svc.adSvcAddr, backendCfg("ad", "AD_SERVICE"))
+
+	go svc.reconcileCarts(ctx, log, cartReconcileInterval)
 
 	r := mux.NewRouter()
 	r.HandleFunc(baseUrl+"/", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
@@ -150,6 +488,12 @@ func main() {
 	r.HandleFunc(baseUrl+"/cart", svc.viewCartHandler).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc(baseUrl+"/cart", svc.addToCartHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl+"/cart/empty", svc.emptyCartHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/restore", svc.restoreCartHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/update", svc.updateCartItemHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/save", svc.saveForLaterHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/move", svc.moveToCartHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/share", svc.shareCartHandler).Methods(http.MethodPost)
+	r.HandleFunc(baseUrl+"/cart/import", svc.importCartHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl+"/setCurrency", svc.setCurrencyHandler).Methods(http.MethodPost)
 	r.HandleFunc(baseUrl+"/logout", svc.logoutHandler).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl+"/cart/checkout", svc.placeOrderHandler).Methods(http.MethodPost)
@@ -157,34 +501,66 @@ func main() {
 	r.PathPrefix(baseUrl + "/static/").Handler(http.StripPrefix(baseUrl+"/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc(baseUrl+"/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
 	r.HandleFunc(baseUrl+"/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	r.HandleFunc(baseUrl+"/_readyz", svc.readyHandler).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl+"/product-meta/{ids}", svc.getProductByID).Methods(http.MethodGet)
 	r.HandleFunc(baseUrl+"/bot", svc.chatBotHandler).Methods(http.MethodPost)
+	svc.registerAPIRoutes(r)
+	if disabled := parseDisabledRoutes(os.Getenv("ROUTE_DISABLED")); len(disabled) > 0 {
+		log.Infof("disabled routes: %v", os.Getenv("ROUTE_DISABLED"))
+		r.Use(disableRoutes(disabled))
+	}
 
 	var handler http.Handler = r
+	if auth != nil {
+		handler = svc.mergeGuestCart(handler)   // merge guest cart on login
+		handler = auth.resolveCartUser(handler) // key carts by JWT claim
+	}
+	handler = recoverPanics(handler)                   // recover from handler panics
 	handler = &logHandler{log: log, next: handler}     // add logging
-	handler = ensureSessionID(handler)                 // add session ID
+	handler = ensureSessionID(handler, newSessionID)   // add session ID
 	handler = otelhttp.NewHandler(handler, "frontend") // add OTel tracing
 
+	if metricsPort := metricsPortFromEnv(); metricsPort != "" {
+		metricsMux := newMetricsMux()
+		metricsMux.HandleFunc("/_debug/breakers", svc.breakersHandler)
+		go func() {
+			if err := serveMetrics(log, metricsPort, metricsMux); err != nil {
+				log.Errorf("metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	lis, err := net.Listen("tcp", addr+":"+srvPort)
+	if err != nil {
+		log.Fatalf("failed to listen on %s:%s: %v", addr, srvPort, err)
+	}
 	log.Infof("starting server on %s:%s", addr, srvPort)
-	log.Fatal(http.ListenAndServe(addr+":"+srvPort, handler))
+	if err := serveUntilDone(ctx, log, &http.Server{Handler: handler}, lis, shutdownGracePeriod); err != nil {
+		log.Errorf("server stopped: %v", err)
+	}
+	svc.closeConns(log)
+	log.Info("frontend stopped")
 }
-func initTracing(ctx context.Context, log logrus.FieldLogger, serviceName string) (*sdktrace.TracerProvider, error) {
+func initTracing(ctx context.Context, log logrus.FieldLogger, serviceName string, shutdownCfg traceShutdownConfig) (*sdktrace.TracerProvider, *shutdownExporter, error) {
 	// Get collector endpoint from env, default to OpenChoreo's collector
-	collectorAddr := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
-	if collectorAddr == "" {
-		collectorAddr = "opentelemetry-collector:4317"
+	exporterCfg, err := otlpExporterConfigFromEnv()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	log.Infof("Initializing tracing for %s, exporting to %s", serviceName, collectorAddr)
+	log.Infof("Initializing tracing for %s, exporting to %s", serviceName, exporterCfg)
+
+	sampler, err := samplerFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Create OTLP exporter
-	exporter, err := otlptracegrpc.New(ctx,
-		otlptracegrpc.WithEndpoint(collectorAddr),
-		otlptracegrpc.WithInsecure(),
-	)
+	otlpExporter, err := newOTLPTraceExporter(ctx, exporterCfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		return nil, nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
+	exporter := newShutdownExporter(otlpExporter, shutdownCfg, log)
 
 	// Create resource with service information
 	res, err := resource.Merge(
@@ -197,19 +573,67 @@ func initTracing(ctx context.Context, log logrus.FieldLogger, serviceName string
 		),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create resource: %w", err)
+		return nil, nil, fmt.Errorf("failed to create resource: %w", err)
 	}
 
 	// Create trace provider
 	tp := sdktrace.NewTracerProvider(
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(sampler),
 	)
 	otel.SetTracerProvider(tp)
 
 	log.Info("Tracing initialized successfully")
-	return tp, nil
+	return tp, exporter, nil
+}
+
+// samplerFromEnv builds the trace sampler from OTEL_TRACES_SAMPLER and
+// OTEL_TRACES_SAMPLER_ARG. The default, parent-based ratio sampling at 1.0,
+// samples everything while still following an upstream service's decision so
+// traces stay whole across service hops.
+func samplerFromEnv() (sdktrace.Sampler, error) {
+	ratio := 1.0
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q: want a number between 0 and 1", v)
+		}
+		ratio = r
+	}
+
+	switch v := os.Getenv("OTEL_TRACES_SAMPLER"); v {
+	case "", "parentbased_traceidratio":
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", v)
+	}
+}
+
+// parseSupportedCurrencies turns a comma-separated list of ISO 4217 codes
+// into a currency whitelist.
+func parseSupportedCurrencies(v string) (map[string]bool, error) {
+	out := make(map[string]bool)
+	for _, c := range strings.Split(v, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c == "" {
+			continue
+		}
+		if len(c) != 3 || strings.Trim(c, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return nil, fmt.Errorf("%q is not a currency code", c)
+		}
+		out[c] = true
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no currencies listed")
+	}
+	return out, nil
 }
 
 func mustMapEnv(target *string, envKey string) {
@@ -220,13 +644,112 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
+// grpcClientConfig tunes the connections the frontend opens to backends.
+type grpcClientConfig struct {
+	// maxRetryAttempts is the total number of tries, including the first,
+	// for an RPC that fails with UNAVAILABLE. Values below 2 disable retries.
+	maxRetryAttempts int
+	// keepaliveTime is how long a connection may be idle before it is
+	// pinged. Zero disables keepalive pings.
+	keepaliveTime time.Duration
+	// keepaliveTimeout is how long to wait for a ping's answer before
+	// closing the connection.
+	keepaliveTimeout time.Duration
+	// keepaliveWithoutCalls pings connections with no RPCs in flight too,
+	// keeping them from going stale behind L4 load balancers. Backends
+	// must permit it, or they close connections pinged too often.
+	keepaliveWithoutCalls bool
+	// rpcTimeout bounds every outbound unary call, retries included, so a
+	// stuck backend surfaces as DeadlineExceeded. Zero means no bound.
+	rpcTimeout time.Duration
+	// latencies, when set, collects call latencies for readiness.
+	latencies *latencyTracker
+	// tls, when set, secures the connection. Nil means plaintext.
+	tls *tls.Config
+	// breaker, when set, sheds calls while the backend keeps failing.
+	breaker *circuitBreaker
+}
+
+var defaultGRPCClientConfig = grpcClientConfig{
+	maxRetryAttempts: 4,
+	keepaliveTime:    30 * time.Second,
+	keepaliveTimeout: 10 * time.Second,
+	rpcTimeout:       5 * time.Second,
+}
+
+// grpcRetryServiceConfig retries methods on UNAVAILABLE, which is what a
+// restarting backend pod returns, backing off from 100ms up to 1s. Adding
+// to the cart and placing an order are never retried: UNAVAILABLE doesn't
+// always mean the call had no effect, and a retry could add the item twice
+// or charge the card again. The more specific entry wins over the default.
+const grpcRetryServiceConfig = `{
+	"methodConfig": [{
+		"name": [{}],
+		"retryPolicy": {
+			"maxAttempts": %d,
+			"initialBackoff": "0.1s",
+			"maxBackoff": "1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}, {
+		"name": [
+			{"service": "hipstershop.CartService", "method": "AddItem"},
+			{"service": "hipstershop.CartService", "method": "AddItems"},
+			{"service": "hipstershop.CheckoutService", "method": "PlaceOrder"}
+		]
+	}]
+}`
+
+func (c grpcClientConfig) dialOptions() []grpc.DialOption {
+	creds := insecure.NewCredentials()
+	if c.tls != nil {
+		creds = credentials.NewTLS(c.tls)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	}
+	if c.breaker != nil {
+		// Outermost, so skipped calls record no latency and the breaker
+		// sees each call's final result, after retries and timeout.
+		opts = append(opts, grpc.WithChainUnaryInterceptor(c.breaker.interceptor()))
+	}
+	opts = append(opts, grpc.WithChainUnaryInterceptor(latencyInterceptor(c.latencies), requestIDInterceptor))
+	if c.maxRetryAttempts >= 2 {
+		opts = append(opts, grpc.WithDefaultServiceConfig(fmt.Sprintf(grpcRetryServiceConfig, c.maxRetryAttempts)))
+	} else {
+		opts = append(opts, grpc.WithDisableRetry())
+	}
+	if c.rpcTimeout > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(timeoutInterceptor(c.rpcTimeout)))
+	}
+	if c.keepaliveTime > 0 {
+		// Unless keepaliveWithoutCalls is set, pings are only sent while
+		// RPCs are in flight, so backends with the default enforcement
+		// policy won't treat them as abusive.
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                c.keepaliveTime,
+			Timeout:             c.keepaliveTimeout,
+			PermitWithoutStream: c.keepaliveWithoutCalls,
+		}))
+	}
+	return opts
+}
+
+// timeoutInterceptor gives each call at most timeout. A caller that already
+// set a shorter deadline, like getAd, keeps it.
+func timeoutInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func mustConnGRPC(conn **grpc.ClientConn, addr string, cfg grpcClientConfig) {
 	var err error
-	_, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	*conn, err = grpc.NewClient(addr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	*conn, err = grpc.NewClient(addr, cfg.dialOptions()...)
 	if err != nil {
 		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
 	}
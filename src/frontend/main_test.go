@@ -0,0 +1,793 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// newTestConn starts an in-memory gRPC server with whatever services
+// register adds and returns a client connection to it. opts replace the
+// default insecure credentials.
+func newTestConn(t *testing.T, register func(*grpc.Server), opts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// fakeCartService is an in-memory CartService whose reads can be made to
+// fail by setting getErr. Like cartservice with CART_CURRENCY_LOCK, it locks
+// each cart to the currency of its first AddItem, and like cartservice it
+// versions carts and refuses changes made against a stale version.
+type fakeCartService struct {
+	pb.UnimplementedCartServiceServer
+
+	mu         sync.Mutex
+	carts      map[string][]*pb.CartItem
+	currencies map[string]string
+	saved      map[string][]*pb.CartItem
+	archived   map[string][]*pb.CartItem
+	versions   map[string]int64
+	getErr     error
+	addErr     error
+	merges     int
+	// addKeys records the idempotency key of every AddItem.
+	addKeys []string
+	// addSources records the source of every AddItem.
+	addSources []string
+	// stale makes GetCart answer callers that accept it as if from
+	// cartservice's last-known-good cache, and fail the others.
+	stale bool
+}
+
+func newFakeCartService() *fakeCartService {
+	return &fakeCartService{
+		carts:      make(map[string][]*pb.CartItem),
+		currencies: make(map[string]string),
+		saved:      make(map[string][]*pb.CartItem),
+		archived:   make(map[string][]*pb.CartItem),
+		versions:   make(map[string]int64),
+	}
+}
+
+// bumpVersion checks expected against userID's cart version and advances it.
+// The caller must hold the service's mu.
+func (f *fakeCartService) bumpVersion(userID string, expected *int64) error {
+	if expected != nil && *expected != f.versions[userID] {
+		return status.Errorf(codes.Aborted, "cart is at version %d, not the expected %d", f.versions[userID], *expected)
+	}
+	f.versions[userID]++
+	return nil
+}
+
+func (f *fakeCartService) setGetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.getErr = err
+}
+
+func (f *fakeCartService) AddItem(_ context.Context, req *pb.AddItemRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.addErr != nil {
+		return nil, f.addErr
+	}
+	if err := f.bumpVersion(req.GetUserId(), req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	f.addKeys = append(f.addKeys, req.GetIdempotencyKey())
+	f.addSources = append(f.addSources, req.GetSource())
+	f.carts[req.GetUserId()] = append(f.carts[req.GetUserId()], req.GetItem())
+	if f.currencies[req.GetUserId()] == "" {
+		f.currencies[req.GetUserId()] = req.GetCurrencyCode()
+	}
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeCartService) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stale {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get("x-accept-stale-cart"); len(v) == 0 || v[0] != "true" {
+			return nil, status.Error(codes.Unavailable, "cart store is failing, try again later")
+		}
+		grpc.SetTrailer(ctx, metadata.Pairs("x-cart-stale", "true"))
+	} else if f.getErr != nil {
+		return nil, f.getErr
+	}
+	return &pb.Cart{UserId: req.GetUserId(), Items: f.carts[req.GetUserId()], CurrencyCode: f.currencies[req.GetUserId()], Version: f.versions[req.GetUserId()]}, nil
+}
+
+func (f *fakeCartService) EmptyCart(_ context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.bumpVersion(req.GetUserId(), req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	if req.GetArchive() && len(f.carts[req.GetUserId()]) > 0 {
+		f.archived[req.GetUserId()] = f.carts[req.GetUserId()]
+	}
+	delete(f.carts, req.GetUserId())
+	delete(f.currencies, req.GetUserId())
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeCartService) RestoreLastCart(_ context.Context, req *pb.RestoreLastCartRequest) (*pb.RestoreLastCartResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items, ok := f.archived[req.GetUserId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no emptied cart to restore for user %s", req.GetUserId())
+	}
+	delete(f.archived, req.GetUserId())
+	f.versions[req.GetUserId()]++
+	f.carts[req.GetUserId()] = append(f.carts[req.GetUserId()], items...)
+	return &pb.RestoreLastCartResponse{Items: items}, nil
+}
+
+func (f *fakeCartService) UpdateItemQuantity(_ context.Context, req *pb.UpdateItemQuantityRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.bumpVersion(req.GetUserId(), req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	items := f.carts[req.GetUserId()][:0:0]
+	for _, item := range f.carts[req.GetUserId()] {
+		if item.GetProductId() != req.GetProductId() {
+			items = append(items, item)
+		}
+	}
+	if req.GetQuantity() > 0 {
+		items = append(items, &pb.CartItem{ProductId: req.GetProductId(), Quantity: req.GetQuantity()})
+	}
+	f.carts[req.GetUserId()] = items
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeCartService) MergeCarts(_ context.Context, req *pb.MergeCartsRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.merges++
+	from, to := req.GetFromUserId(), req.GetToUserId()
+	for _, item := range f.carts[from] {
+		merged := false
+		for _, existing := range f.carts[to] {
+			if existing.GetProductId() == item.GetProductId() {
+				existing.Quantity += item.GetQuantity()
+				merged = true
+			}
+		}
+		if !merged {
+			f.carts[to] = append(f.carts[to], item)
+		}
+	}
+	delete(f.carts, from)
+	return &pb.Empty{}, nil
+}
+
+// moveLine moves productID's line between a fakeCartService's carts and
+// saved lists. The caller must hold the service's mu.
+func moveLine(from, to map[string][]*pb.CartItem, userID, productID string) error {
+	for i, item := range from[userID] {
+		if item.GetProductId() == productID {
+			from[userID] = append(from[userID][:i:i], from[userID][i+1:]...)
+			to[userID] = append(to[userID], item)
+			return nil
+		}
+	}
+	return status.Errorf(codes.NotFound, "product %s not found", productID)
+}
+
+func (f *fakeCartService) SaveForLater(_ context.Context, req *pb.SaveForLaterRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.bumpVersion(req.GetUserId(), req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, moveLine(f.carts, f.saved, req.GetUserId(), req.GetProductId())
+}
+
+func (f *fakeCartService) MoveToCart(_ context.Context, req *pb.MoveToCartRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.bumpVersion(req.GetUserId(), req.ExpectedVersion); err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, moveLine(f.saved, f.carts, req.GetUserId(), req.GetProductId())
+}
+
+func (f *fakeCartService) GetSavedItems(_ context.Context, req *pb.GetSavedItemsRequest) (*pb.GetSavedItemsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.GetSavedItemsResponse{Items: f.saved[req.GetUserId()]}, nil
+}
+
+// ExportCart always returns a CartSnapshot.
+func (f *fakeCartService) ExportCart(_ context.Context, req *pb.ExportCartRequest) (*pb.ExportCartResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := proto.Marshal(&pb.CartSnapshot{Version: 1, Items: f.carts[req.GetUserId()], Saved: f.saved[req.GetUserId()]})
+	return &pb.ExportCartResponse{Data: data}, err
+}
+
+// ImportCart only takes a CartSnapshot.
+func (f *fakeCartService) ImportCart(_ context.Context, req *pb.ImportCartRequest) (*pb.Empty, error) {
+	var snapshot pb.CartSnapshot
+	if err := proto.Unmarshal(req.GetData(), &snapshot); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad snapshot: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.carts[req.GetUserId()] = snapshot.GetItems()
+	if !req.GetKeepSaved() {
+		f.saved[req.GetUserId()] = snapshot.GetSaved()
+	}
+	return &pb.Empty{}, nil
+}
+
+// fakeCatalogService serves a fixed product list.
+type fakeCatalogService struct {
+	pb.UnimplementedProductCatalogServiceServer
+	products []*pb.Product
+}
+
+func (f *fakeCatalogService) ListProducts(context.Context, *pb.Empty) (*pb.ListProductsResponse, error) {
+	return &pb.ListProductsResponse{Products: f.products}, nil
+}
+
+func (f *fakeCatalogService) GetProduct(_ context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	for _, p := range f.products {
+		if p.GetId() == req.GetId() {
+			return p, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.GetId())
+}
+
+// fakeCurrencyService "converts" by relabelling the currency code, which is
+// enough to tell converted prices apart in tests.
+type fakeCurrencyService struct {
+	pb.UnimplementedCurrencyServiceServer
+}
+
+func (fakeCurrencyService) GetSupportedCurrencies(context.Context, *pb.Empty) (*pb.GetSupportedCurrenciesResponse, error) {
+	return &pb.GetSupportedCurrenciesResponse{CurrencyCodes: []string{"USD", "EUR"}}, nil
+}
+
+func (fakeCurrencyService) Convert(_ context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	return &pb.Money{
+		CurrencyCode: req.GetToCode(),
+		Units:        req.GetFrom().GetUnits(),
+		Nanos:        req.GetFrom().GetNanos(),
+	}, nil
+}
+
+func TestSamplerFromEnv(t *testing.T) {
+	tests := []struct {
+		sampler string
+		arg     string
+		want    sdktrace.Sampler // nil means an error is expected
+	}{
+		{"", "", sdktrace.ParentBased(sdktrace.TraceIDRatioBased(1))},
+		{"", "0.25", sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0.25))},
+		{"parentbased_traceidratio", "0.1", sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0.1))},
+		{"traceidratio", "0.5", sdktrace.TraceIDRatioBased(0.5)},
+		{"always_on", "", sdktrace.AlwaysSample()},
+		{"always_off", "", sdktrace.NeverSample()},
+		{"", "1.5", nil},
+		{"", "half", nil},
+		{"sometimes", "", nil},
+	}
+	for _, tt := range tests {
+		t.Setenv("OTEL_TRACES_SAMPLER", tt.sampler)
+		t.Setenv("OTEL_TRACES_SAMPLER_ARG", tt.arg)
+		got, err := samplerFromEnv()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("sampler=%q arg=%q: got %s, want error", tt.sampler, tt.arg, got.Description())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sampler=%q arg=%q: %v", tt.sampler, tt.arg, err)
+			continue
+		}
+		if got.Description() != tt.want.Description() {
+			t.Errorf("sampler=%q arg=%q: got %s, want %s", tt.sampler, tt.arg, got.Description(), tt.want.Description())
+		}
+	}
+}
+
+// unavailableCartService fails the first failures GetCart calls with
+// UNAVAILABLE, like a backend pod that is still restarting.
+type unavailableCartService struct {
+	pb.UnimplementedCartServiceServer
+
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (f *unavailableCartService) GetCart(_ context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, status.Error(codes.Unavailable, "backend restarting")
+	}
+	return &pb.Cart{UserId: req.GetUserId()}, nil
+}
+
+func (f *unavailableCartService) AddItem(context.Context, *pb.AddItemRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return nil, status.Error(codes.Unavailable, "store unavailable")
+}
+
+func TestGRPCClientDoesNotRetryAddItem(t *testing.T) {
+	carts := &unavailableCartService{}
+	cfg := grpcClientConfig{maxRetryAttempts: 4, keepaliveTime: time.Minute}
+	conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) }, cfg.dialOptions()...)
+
+	_, err := pb.NewCartServiceClient(conn).AddItem(context.Background(), &pb.AddItemRequest{UserId: "u1"})
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Errorf("got %s, want %s", got, codes.Unavailable)
+	}
+	if carts.calls != 1 {
+		t.Errorf("server saw %d calls, want 1", carts.calls)
+	}
+}
+
+func TestGRPCClientRetriesUnavailable(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		failures  int
+		wantCode  codes.Code
+		wantCalls int
+	}{
+		{"retry succeeds", 4, 2, codes.OK, 3},
+		{"retries exhausted", 3, 5, codes.Unavailable, 3},
+		{"retries disabled", 0, 1, codes.Unavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carts := &unavailableCartService{failures: tt.failures}
+			cfg := grpcClientConfig{maxRetryAttempts: tt.attempts, keepaliveTime: time.Minute}
+			conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) }, cfg.dialOptions()...)
+
+			_, err := pb.NewCartServiceClient(conn).GetCart(context.Background(), &pb.GetCartRequest{UserId: "u1"})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+			if carts.calls != tt.wantCalls {
+				t.Errorf("server saw %d calls, want %d", carts.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// stuckRecommendationService never answers until the call is cancelled.
+type stuckRecommendationService struct {
+	pb.UnimplementedRecommendationServiceServer
+}
+
+func (stuckRecommendationService) ListRecommendations(ctx context.Context, _ *pb.ListRecommendationsRequest) (*pb.ListRecommendationsResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRPCTimeoutFailsSoftForRecommendations(t *testing.T) {
+	fe, _, _ := newPageCacheTestServer(t)
+	cfg := grpcClientConfig{rpcTimeout: 50 * time.Millisecond}
+	fe.recommendationSvcConn = newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterRecommendationServiceServer(s, stuckRecommendationService{})
+	}, cfg.dialOptions()...)
+
+	_, err := fe.getRecommendations(context.Background(), "s1", nil)
+	if got := status.Code(err); got != codes.DeadlineExceeded {
+		t.Fatalf("got %s, want %s", got, codes.DeadlineExceeded)
+	}
+
+	// The product page still renders without recommendations.
+	r := mux.SetURLVars(newHomeRequest("s1", ""), map[string]string{"id": "OLJCESPC7Z"})
+	w := httptest.NewRecorder()
+	start := time.Now()
+	fe.productHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("product page took %v with a stuck backend", elapsed)
+	}
+}
+
+func TestParseSupportedCurrencies(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"USD,EUR", []string{"EUR", "USD"}, false},
+		{" inr , brl,", []string{"BRL", "INR"}, false},
+		{"USD,DOLLARS", nil, true},
+		{"U$D", nil, true},
+		{" , ", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSupportedCurrencies(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !slices.Equal(slices.Sorted(maps.Keys(got)), tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSetCurrencyHandlerRejectsUnsupported(t *testing.T) {
+	fe := &frontendServer{}
+	tests := []struct {
+		currency string
+		want     int
+	}{
+		{"EUR", http.StatusFound},
+		{"INR", http.StatusBadRequest},
+		{"XYZ", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := newHomeRequest("s1", "")
+		r.Method = http.MethodPost
+		r.Form = url.Values{"currency_code": {tt.currency}}
+		w := httptest.NewRecorder()
+		fe.setCurrencyHandler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.currency, w.Code, tt.want)
+		}
+	}
+}
+
+type fakeShippingService struct {
+	pb.UnimplementedShippingServiceServer
+}
+
+func (fakeShippingService) GetQuote(context.Context, *pb.GetQuoteRequest) (*pb.GetQuoteResponse, error) {
+	return &pb.GetQuoteResponse{CostUsd: &pb.Money{CurrencyCode: "USD", Units: 8}}, nil
+}
+
+func TestShowProductID(t *testing.T) {
+	carts := newFakeCartService()
+	carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	catalog := &fakeCatalogService{products: []*pb.Product{
+		{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+	}}
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, catalog)
+		pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		pb.RegisterShippingServiceServer(s, fakeShippingService{})
+		pb.RegisterRecommendationServiceServer(s, pb.UnimplementedRecommendationServiceServer{})
+	})
+	order := &pb.OrderResult{
+		OrderId:      "order-1",
+		ShippingCost: &pb.Money{CurrencyCode: "USD", Units: 8},
+		Items:        []*pb.OrderItem{{Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1}, Cost: &pb.Money{CurrencyCode: "USD", Units: 19}}},
+	}
+
+	for _, show := range []bool{false, true} {
+		fe := &frontendServer{
+			cartSvcConn:           conn,
+			productCatalogSvcConn: conn,
+			currencySvcConn:       conn,
+			shippingSvcConn:       conn,
+			recommendationSvcConn: conn,
+			showProductID:         show,
+		}
+		w := httptest.NewRecorder()
+		fe.viewCartHandler(w, newHomeRequest("s1", ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("cart page: got status %d: %s", w.Code, w.Body.String())
+		}
+		if got := strings.Contains(w.Body.String(), "SKU #OLJCESPC7Z"); got != show {
+			t.Errorf("SHOW_PRODUCT_ID=%v: cart page shows product ID: %v", show, got)
+		}
+
+		var buf bytes.Buffer
+		if err := templates.ExecuteTemplate(&buf, "order", map[string]interface{}{
+			"order":           order,
+			"total_paid":      order.ShippingCost,
+			"show_product_id": show,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), "SKU #OLJCESPC7Z"); got != show {
+			t.Errorf("SHOW_PRODUCT_ID=%v: order page shows product ID: %v", show, got)
+		}
+	}
+}
+
+func TestCartCurrencyMismatchWarning(t *testing.T) {
+	carts := newFakeCartService()
+	catalog := &fakeCatalogService{products: []*pb.Product{
+		{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+	}}
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, catalog)
+		pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		pb.RegisterShippingServiceServer(s, fakeShippingService{})
+		pb.RegisterRecommendationServiceServer(s, pb.UnimplementedRecommendationServiceServer{})
+	})
+	fe := &frontendServer{
+		cartSvcConn:           conn,
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		shippingSvcConn:       conn,
+		recommendationSvcConn: conn,
+	}
+
+	// The cart is created while the user browses in EUR.
+	r := newHomeRequest("s1", "EUR")
+	r.Method = http.MethodPost
+	r.Form = url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}}
+	w := httptest.NewRecorder()
+	fe.addToCartHandler(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("add to cart: got status %d: %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		currency string
+		warn     bool
+	}{
+		{"EUR", false},
+		{"USD", true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		fe.viewCartHandler(w, newHomeRequest("s1", tt.currency))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: cart page: got status %d: %s", tt.currency, w.Code, w.Body.String())
+		}
+		if got := strings.Contains(w.Body.String(), "Your cart was priced in EUR"); got != tt.warn {
+			t.Errorf("viewing in %s: currency warning shown = %v, want %v", tt.currency, got, tt.warn)
+		}
+	}
+}
+
+func TestAddToCartIdempotencyKey(t *testing.T) {
+	carts := newFakeCartService()
+	catalog := &fakeCatalogService{products: []*pb.Product{
+		{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+	}}
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, catalog)
+	})
+	fe := &frontendServer{cartSvcConn: conn, productCatalogSvcConn: conn}
+
+	tests := []struct {
+		key      string
+		wantCode int
+	}{
+		{"3f1c2a4e-0000-4000-8000-000000000001", http.StatusFound},
+		{"", http.StatusFound},
+		{strings.Repeat("k", 129), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := newHomeRequest("s1", "USD")
+		r.Method = http.MethodPost
+		r.Form = url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}, "idempotency_key": {tt.key}}
+		w := httptest.NewRecorder()
+		fe.addToCartHandler(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("key %q: got status %d, want %d", tt.key, w.Code, tt.wantCode)
+		}
+	}
+	if want := []string{"3f1c2a4e-0000-4000-8000-000000000001", ""}; !slices.Equal(carts.addKeys, want) {
+		t.Errorf("cartservice got keys %q, want %q", carts.addKeys, want)
+	}
+}
+
+func TestAddToCartSource(t *testing.T) {
+	carts := newFakeCartService()
+	catalog := &fakeCatalogService{products: []*pb.Product{
+		{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+	}}
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, catalog)
+	})
+	fe := &frontendServer{cartSvcConn: conn, productCatalogSvcConn: conn}
+
+	sources := []string{"ad", "recommendation", "search", "product_page", "", "<script>"}
+	for _, source := range sources {
+		r := newHomeRequest("s1", "USD")
+		r.Method = http.MethodPost
+		r.Form = url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {"1"}, "source": {source}}
+		w := httptest.NewRecorder()
+		fe.addToCartHandler(w, r)
+		if w.Code != http.StatusFound {
+			t.Errorf("source %q: got status %d, want %d", source, w.Code, http.StatusFound)
+		}
+	}
+	want := []string{"ad", "recommendation", "search", "product_page", "product_page", "product_page"}
+	if !slices.Equal(carts.addSources, want) {
+		t.Errorf("cartservice got sources %q, want %q", carts.addSources, want)
+	}
+}
+
+func TestUpdateCartItemHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity string
+		wantCode int
+		want     int32 // quantity left in the cart; 0 means removed
+	}{
+		{"set", "4", http.StatusFound, 4},
+		{"remove", "0", http.StatusFound, 0},
+		{"negative", "-1", http.StatusBadRequest, 2},
+		{"over the limit", "11", http.StatusBadRequest, 2},
+		{"non-numeric", "many", http.StatusBadRequest, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carts := newFakeCartService()
+			carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+			conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) })
+			fe := &frontendServer{cartSvcConn: conn}
+
+			r := newHomeRequest("s1", "")
+			r.Method = http.MethodPost
+			r.Form = url.Values{"product_id": {"OLJCESPC7Z"}, "quantity": {tt.quantity}}
+			w := httptest.NewRecorder()
+			fe.updateCartItemHandler(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+
+			var got int32
+			for _, item := range carts.carts["s1"] {
+				if item.GetProductId() == "OLJCESPC7Z" {
+					got = item.GetQuantity()
+				}
+			}
+			if got != tt.want {
+				t.Errorf("cart holds %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveForLaterHandlers(t *testing.T) {
+	tests := []struct {
+		name      string
+		save      bool
+		productID string
+		wantCode  int
+		wantCart  int // lines left in the cart
+		wantSaved int
+	}{
+		{"save", true, "OLJCESPC7Z", http.StatusFound, 0, 2},
+		{"move back", false, "66VCHSJNUP", http.StatusFound, 2, 0},
+		{"save product not in cart", true, "1YMWWN1N4O", http.StatusNotFound, 1, 1},
+		{"invalid product ID", false, "../etc", http.StatusBadRequest, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			carts := newFakeCartService()
+			carts.carts["s1"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+			carts.saved["s1"] = []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}}
+			conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) })
+			fe := &frontendServer{cartSvcConn: conn}
+
+			r := newHomeRequest("s1", "")
+			r.Method = http.MethodPost
+			r.Form = url.Values{"product_id": {tt.productID}}
+			w := httptest.NewRecorder()
+			if tt.save {
+				fe.saveForLaterHandler(w, r)
+			} else {
+				fe.moveToCartHandler(w, r)
+			}
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := len(carts.carts["s1"]); got != tt.wantCart {
+				t.Errorf("cart has %d lines, want %d", got, tt.wantCart)
+			}
+			if got := len(carts.saved["s1"]); got != tt.wantSaved {
+				t.Errorf("saved list has %d lines, want %d", got, tt.wantSaved)
+			}
+		})
+	}
+}
+
+func TestCartPageShowsSavedItems(t *testing.T) {
+	carts := newFakeCartService()
+	carts.saved["s1"] = []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}}
+	catalog := &fakeCatalogService{products: []*pb.Product{
+		{Id: "66VCHSJNUP", Name: "Tank Top", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 18}},
+	}}
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, catalog)
+		pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		pb.RegisterShippingServiceServer(s, fakeShippingService{})
+		pb.RegisterRecommendationServiceServer(s, pb.UnimplementedRecommendationServiceServer{})
+	})
+	fe := &frontendServer{
+		cartSvcConn:           conn,
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		shippingSvcConn:       conn,
+		recommendationSvcConn: conn,
+	}
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newHomeRequest("s1", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cart page: got status %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, want := range []string{"Your shopping cart is empty!", "Saved for later (1)", "Tank Top", "/cart/move"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("cart page is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// metricsRegistry holds every frontend metric; it is served on /metrics at
+// METRICS_PORT.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	// fallbackRenders counts pages answered with the maintenance page
+	// because every backend they depend on was failing.
+	fallbackRenders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frontend",
+		Name:      "fallback_renders_total",
+		Help:      "Number of pages rendered as the maintenance fallback because all their backends failed.",
+	}, []string{"page"})
+
+	// catalogPartialFetches counts pages rendered with some catalog
+	// products left out because they could not be displayed.
+	catalogPartialFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frontend",
+		Name:      "catalog_partial_fetches_total",
+		Help:      "Number of pages rendered with only part of the product catalog.",
+	}, []string{"page"})
+
+	// backendRequestDuration is the latency of unary calls to each backend,
+	// retries included.
+	backendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frontend",
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of gRPC calls from the frontend to each backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	// breakerStates is each backend's circuit breaker state: 0 closed,
+	// 1 open, 2 half-open.
+	breakerStates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "frontend",
+		Name:      "circuit_breaker_state",
+		Help:      "State of each backend's circuit breaker: 0 closed, 1 open, 2 half-open.",
+	}, []string{"backend"})
+
+	// breakerRejections counts calls skipped because the backend's breaker
+	// was open.
+	breakerRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frontend",
+		Name:      "circuit_breaker_rejections_total",
+		Help:      "Number of backend calls skipped by an open circuit breaker.",
+	}, []string{"backend"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(fallbackRenders, catalogPartialFetches, backendRequestDuration, breakerStates, breakerRejections)
+}
+
+// newMetricsMux serves metricsRegistry on /metrics. It is only ever served on
+// METRICS_PORT, never on the storefront router, so shoppers cannot read it;
+// other operator-only endpoints are added to it for the same reason.
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// serveMetrics serves mux on port. It only returns if the listener fails.
+func serveMetrics(log logrus.FieldLogger, port string, mux http.Handler) error {
+	log.Infof("serving metrics on port %s", port)
+	return http.ListenAndServe(":"+port, mux)
+}
+
+// metricsPortFromEnv returns METRICS_PORT. Empty disables the metrics
+// listener entirely.
+func metricsPortFromEnv() string {
+	return os.Getenv("METRICS_PORT")
+}
@@ -17,16 +17,57 @@ package main
 import (
 	"context"
 	"net/http"
+	"strings"
 	"time"
 	"os"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type ctxKeyLog struct{}
 type ctxKeyRequestID struct{}
 
+// requestIDHeader carries the correlation ID of a request. A client or proxy
+// may set it; otherwise the frontend generates one. It is echoed on the
+// response and forwarded to backends as gRPC metadata.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds a client-supplied request ID, which ends up in
+// every log line of the request.
+const maxRequestIDLength = 128
+
+// incomingRequestID returns the request's X-Request-ID if it is a sensible
+// value, and a fresh UUID otherwise.
+func incomingRequestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= maxRequestIDLength && isPrintableASCII(id) {
+		return id
+	}
+	return uuid.NewString()
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDInterceptor forwards the request ID in ctx to backends as
+// x-request-id metadata.
+func requestIDInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if id, ok := ctx.Value(ctxKeyRequestID{}).(string); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(requestIDHeader), id)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
 type logHandler struct {
 	log  *logrus.Logger
 	next http.Handler
@@ -56,15 +97,17 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 
 func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	requestID, _ := uuid.NewRandom()
-	ctx = context.WithValue(ctx, ctxKeyRequestID{}, requestID.String())
+	requestID := incomingRequestID(r)
+	ctx = context.WithValue(ctx, ctxKeyRequestID{}, requestID)
+	w.Header().Set(requestIDHeader, requestID)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("http.request_id", requestID))
 
 	start := time.Now()
 	rr := &responseRecorder{w: w}
 	log := lh.log.WithFields(logrus.Fields{
 		"http.req.path":   r.URL.Path,
 		"http.req.method": r.Method,
-		"http.req.id":     requestID.String(),
+		"http.req.id":     requestID,
 	})
 	if v, ok := r.Context().Value(ctxKeySessionID{}).(string); ok {
 		log = log.WithField("session", v)
@@ -82,7 +125,7 @@ func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	lh.next.ServeHTTP(rr, r)
 }
 
-func ensureSessionID(next http.Handler) http.HandlerFunc {
+func ensureSessionID(next http.Handler, newSessionID sessionIDGenerator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var sessionID string
 		c, err := r.Cookie(cookieSessionID)
@@ -91,8 +134,11 @@ func ensureSessionID(next http.Handler) http.HandlerFunc {
 				// Hard coded user id, shared across sessions
 				sessionID = "12345678-1234-1234-1234-123456789123"
 			} else {
-				u, _ := uuid.NewRandom()
-				sessionID = u.String()
+				sessionID, err = newSessionID()
+				if err != nil {
+					http.Error(w, "failed to start a session", http.StatusInternalServerError)
+					return
+				}
 			}
 			http.SetCookie(w, &http.Cookie{
 				Name:   cookieSessionID,
@@ -0,0 +1,114 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestLogHandlerRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"client ID", "req-7f3a9c", true},
+		{"no ID", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"control characters", "req\n7f3a9c", false},
+	}
+	for _, tt := range tests {
+		log, hook := logtest.NewNullLogger()
+		log.SetLevel(logrus.DebugLevel)
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		ctx, span := tp.Tracer("test").Start(context.Background(), "GET /")
+
+		var seen string
+		lh := &logHandler{log: log, next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen, _ = r.Context().Value(ctxKeyRequestID{}).(string)
+		})}
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		if tt.incoming != "" {
+			r.Header.Set(requestIDHeader, tt.incoming)
+		}
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, r)
+		span.End()
+
+		if seen == "" || (seen == tt.incoming) != tt.keep {
+			t.Errorf("%s: handler saw request ID %q", tt.name, seen)
+		}
+		if got := w.Header().Get(requestIDHeader); got != seen {
+			t.Errorf("%s: response echoed %q, want %q", tt.name, got, seen)
+		}
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["http.req.id"] != seen {
+				t.Errorf("%s: log line %q has request ID %v, want %q", tt.name, entry.Message, entry.Data["http.req.id"], seen)
+			}
+		}
+		want := attribute.String("http.request_id", seen)
+		found := false
+		for _, a := range recorder.Ended()[0].Attributes() {
+			found = found || a == want
+		}
+		if !found {
+			t.Errorf("%s: span is missing %v", tt.name, want)
+		}
+	}
+}
+
+// metadataCartService records the x-request-id metadata of GetCart calls.
+type metadataCartService struct {
+	pb.UnimplementedCartServiceServer
+	requestIDs []string
+}
+
+func (s *metadataCartService) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.requestIDs = md.Get("x-request-id")
+	return &pb.Cart{UserId: req.GetUserId()}, nil
+}
+
+func TestRequestIDInterceptor(t *testing.T) {
+	carts := &metadataCartService{}
+	conn := newTestConn(t, func(s *grpc.Server) { pb.RegisterCartServiceServer(s, carts) },
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(requestIDInterceptor))
+	fe := &frontendServer{cartSvcConn: conn}
+
+	ctx := context.WithValue(context.Background(), ctxKeyRequestID{}, "req-7f3a9c")
+	if _, err := fe.getCart(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(carts.requestIDs) != 1 || carts.requestIDs[0] != "req-7f3a9c" {
+		t.Errorf("cartservice got x-request-id %v, want [req-7f3a9c]", carts.requestIDs)
+	}
+}
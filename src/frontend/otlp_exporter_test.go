@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestOTLPExporterConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		endpoint string
+		insecure string
+		want     otlpExporterConfig
+		wantErr  bool
+	}{
+		{"defaults", "", "", "", otlpExporterConfig{protocol: otlpProtocolGRPC, endpoint: defaultOTLPGRPCEndpoint, insecure: true}, false},
+		{"grpc host:port", "grpc", "collector:4317", "", otlpExporterConfig{protocol: otlpProtocolGRPC, endpoint: "collector:4317", insecure: true}, false},
+		{"grpc secure host:port", "grpc", "collector:4317", "false", otlpExporterConfig{protocol: otlpProtocolGRPC, endpoint: "collector:4317"}, false},
+		{"grpc https", "", "https://collector:4317", "true", otlpExporterConfig{protocol: otlpProtocolGRPC, endpoint: "collector:4317"}, false},
+		{"http defaults", "http/protobuf", "", "", otlpExporterConfig{protocol: otlpProtocolHTTP, endpoint: defaultOTLPHTTPEndpoint, urlPath: "/v1/traces", insecure: true}, false},
+		{"http plaintext", "http/protobuf", "http://collector:4318", "", otlpExporterConfig{protocol: otlpProtocolHTTP, endpoint: "collector:4318", urlPath: "/v1/traces", insecure: true}, false},
+		{"http https with base path", "http/protobuf", "https://otel.example.com/otlp/", "", otlpExporterConfig{protocol: otlpProtocolHTTP, endpoint: "otel.example.com", urlPath: "/otlp/v1/traces"}, false},
+		{"unknown protocol", "http/json", "", "", otlpExporterConfig{}, true},
+		{"bad insecure flag", "", "", "maybe", otlpExporterConfig{}, true},
+		{"endpoint without host", "", "https://", "", otlpExporterConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", tt.protocol)
+			t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tt.endpoint)
+			t.Setenv("OTEL_EXPORTER_OTLP_INSECURE", tt.insecure)
+			t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", "")
+			got, err := otlpExporterConfigFromEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOTLPExporterCertificate(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "https://collector:4317")
+	t.Setenv("OTEL_EXPORTER_OTLP_INSECURE", "")
+
+	bad := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bad, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", bad)
+	if _, err := otlpExporterConfigFromEnv(); err == nil {
+		t.Error("accepted a certificate file with no certificates")
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", filepath.Join(t.TempDir(), "missing.pem"))
+	if _, err := otlpExporterConfigFromEnv(); err == nil {
+		t.Error("accepted a missing certificate file")
+	}
+}
+
+func TestOTLPHTTPExporter(t *testing.T) {
+	paths := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_INSECURE", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_CERTIFICATE", "")
+	cfg, err := otlpExporterConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := newOTLPTraceExporter(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	_, span := tp.Tracer("test").Start(context.Background(), "op")
+	span.End()
+	if got := <-paths; got != "/v1/traces" {
+		t.Errorf("exported to %q, want /v1/traces", got)
+	}
+}
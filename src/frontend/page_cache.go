@@ -0,0 +1,217 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// pageCacheHeader reports whether a page was served from the page cache.
+const pageCacheHeader = "X-Page-Cache"
+
+// Cached pages are rendered with these markers in place of the per-request
+// values, which are filled back in each time the page is served.
+const (
+	sessionIDHole = "__page_cache_session_id__"
+	requestIDHole = "__page_cache_request_id__"
+)
+
+// maxPageCacheEntries bounds the page cache. Keys come from request headers
+// and cookies, so without a bound any client could fill memory with pages.
+const maxPageCacheEntries = 256
+
+// pageCache holds fully rendered HTML for pages that look the same to every
+// anonymous visitor with an empty cart. Entries are keyed by currency and
+// locale, expire after ttl, and the oldest is evicted once
+// maxPageCacheEntries are held.
+type pageCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	entries   map[pageCacheKey]cachedPage
+	lastSweep time.Time
+	// catalog fingerprints the products the cached pages were rendered
+	// from.
+	catalog [sha256.Size]byte
+}
+
+type pageCacheKey struct {
+	page     string
+	currency string
+	locale   string
+}
+
+type cachedPage struct {
+	body       []byte
+	renderedAt time.Time
+}
+
+func newPageCache(ttl time.Duration) *pageCache {
+	return &pageCache{
+		ttl:       ttl,
+		entries:   make(map[pageCacheKey]cachedPage),
+		lastSweep: time.Now(),
+	}
+}
+
+func (c *pageCache) put(key pageCacheKey, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+
+	// Drop expired pages once per ttl so odd locales don't pile up.
+	if now.Sub(c.lastSweep) > c.ttl {
+		c.sweep(now)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxPageCacheEntries {
+		c.sweep(now)
+		if len(c.entries) >= maxPageCacheEntries {
+			c.evictOldest()
+		}
+	}
+	c.entries[key] = cachedPage{body: body, renderedAt: now}
+}
+
+// sweep drops expired pages. c.mu must be held.
+func (c *pageCache) sweep(now time.Time) {
+	for k, v := range c.entries {
+		if now.Sub(v.renderedAt) > c.ttl {
+			delete(c.entries, k)
+		}
+	}
+	c.lastSweep = now
+}
+
+// evictOldest drops the page rendered longest ago. c.mu must be held.
+func (c *pageCache) evictOldest() {
+	var oldest pageCacheKey
+	var oldestAt time.Time
+	for k, v := range c.entries {
+		if oldestAt.IsZero() || v.renderedAt.Before(oldestAt) {
+			oldest, oldestAt = k, v.renderedAt
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// get returns the cached page for key if it is younger than the ttl.
+func (c *pageCache) get(key pageCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(v.renderedAt) > c.ttl {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return v.body, true
+}
+
+// purge drops every cached page.
+func (c *pageCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// noteCatalog purges the cache when products, freshly read from the
+// catalog, differ from those the cached pages were rendered from. The
+// frontend keeps no catalog of its own, so every page rendered without the
+// cache is the refresh that invalidates it, and a change reaches pages in
+// every currency and locale at once rather than as each expires.
+func (c *pageCache) noteCatalog(products []*pb.Product) {
+	h := sha256.New()
+	for _, p := range products {
+		b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(p)
+		h.Write(b)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sum != c.catalog {
+		clear(c.entries)
+		c.catalog = sum
+	}
+}
+
+// newPageCacheKey keys a request by page, currency and the primary language
+// subtag of its Accept-Language header, so "en-US" and "en-GB" share pages.
+// It reports false, and the page is not cached, for a currency that isn't
+// supported or a language that isn't a two or three letter code.
+func newPageCacheKey(r *http.Request, page string) (pageCacheKey, bool) {
+	locale := r.Header.Get("Accept-Language")
+	if i := strings.IndexAny(locale, ",;-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	currency := currentCurrency(r)
+	if !whitelistedCurrencies[currency] || !isLanguageCode(locale) {
+		return pageCacheKey{}, false
+	}
+	return pageCacheKey{page: page, currency: currency, locale: locale}, true
+}
+
+// isLanguageCode reports whether s looks like an ISO 639 language code. An
+// empty s, from a request without Accept-Language, is its own locale.
+func isLanguageCode(s string) bool {
+	if s == "" {
+		return true
+	}
+	if len(s) < 2 || len(s) > 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// withPageCacheHoles replaces the per-request values in template data with
+// markers so the rendered page can be shared between visitors.
+func withPageCacheHoles(data map[string]interface{}) map[string]interface{} {
+	data["session_id"] = sessionIDHole
+	data["request_id"] = requestIDHole
+	return data
+}
+
+// writeCachedPage fills the holes of a cached page for r and writes it.
+func writeCachedPage(w http.ResponseWriter, r *http.Request, body []byte, hit bool) {
+	requestID, _ := r.Context().Value(ctxKeyRequestID{}).(string)
+	body = bytes.ReplaceAll(body, []byte(sessionIDHole), []byte(html.EscapeString(sessionID(r))))
+	body = bytes.ReplaceAll(body, []byte(requestIDHole), []byte(html.EscapeString(requestID)))
+	if hit {
+		w.Header().Set(pageCacheHeader, "hit")
+	} else {
+		w.Header().Set(pageCacheHeader, "miss")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
+}
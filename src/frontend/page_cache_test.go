@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func newPageCacheTestServer(t *testing.T) (*frontendServer, *fakeCartService, *fakeCatalogService) {
+	t.Helper()
+	carts := newFakeCartService()
+	catalog := &fakeCatalogService{products: []*pb.Product{
+		{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+	}}
+	conn := newTestConn(t, func(s *grpc.Server) {
+		pb.RegisterCartServiceServer(s, carts)
+		pb.RegisterProductCatalogServiceServer(s, catalog)
+		pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		pb.RegisterAdServiceServer(s, pb.UnimplementedAdServiceServer{})
+	})
+	fe := &frontendServer{
+		cartSvcConn:           conn,
+		productCatalogSvcConn: conn,
+		currencySvcConn:       conn,
+		adSvcConn:             conn,
+		pageCache:             newPageCache(time.Minute),
+	}
+	return fe, carts, catalog
+}
+
+// newHomeRequest builds a home page request carrying what the middleware
+// would normally put in its context.
+func newHomeRequest(session, currency string) *http.Request {
+	log := logrus.New()
+	log.Out = io.Discard
+	ctx := context.WithValue(context.Background(), ctxKeyLog{}, logrus.FieldLogger(log))
+	ctx = context.WithValue(ctx, ctxKeySessionID{}, session)
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	if currency != "" {
+		r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: currency})
+	}
+	return r
+}
+
+// getHome renders the home page for session and returns the page cache
+// header and body.
+func getHome(t *testing.T, fe *frontendServer, session, currency string) (string, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newHomeRequest(session, currency))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	return w.Header().Get(pageCacheHeader), w.Body.String()
+}
+
+func TestHomePageCache(t *testing.T) {
+	fe, carts, catalog := newPageCacheTestServer(t)
+	carts.carts["with-cart"] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+
+	steps := []struct {
+		name     string
+		session  string
+		currency string
+		purge    bool
+		newPrice int64 // when set, the catalog's price changes first
+		want     string
+	}{
+		{"first visit renders", "s1", "", false, 0, "miss"},
+		{"second visitor shares page", "s2", "", false, 0, "hit"},
+		{"other currency renders", "s3", "EUR", false, 0, "miss"},
+		{"non-empty cart bypasses", "with-cart", "", false, 0, ""},
+		{"purge drops pages", "s4", "", true, 0, "miss"},
+		{"unchanged catalog keeps pages", "with-cart", "", false, 0, ""},
+		{"shared again", "s5", "", false, 0, "hit"},
+		// Rendering for a visitor with a cart sees the new catalog.
+		{"catalog change seen", "with-cart", "", false, 25, ""},
+		{"catalog change drops pages", "s6", "", false, 0, "miss"},
+		{"other currency dropped too", "s7", "EUR", false, 0, "miss"},
+	}
+	for _, st := range steps {
+		if st.purge {
+			fe.pageCache.purge()
+		}
+		if st.newPrice != 0 {
+			catalog.products = []*pb.Product{
+				{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: st.newPrice}},
+			}
+		}
+		got, body := getHome(t, fe, st.session, st.currency)
+		if got != st.want {
+			t.Errorf("%s: got %s %q, want %q", st.name, pageCacheHeader, got, st.want)
+		}
+		if !strings.Contains(body, "session-id: "+st.session) {
+			t.Errorf("%s: page does not show the visitor's own session ID", st.name)
+		}
+		if strings.Contains(body, sessionIDHole) || strings.Contains(body, requestIDHole) {
+			t.Errorf("%s: page still contains a cache hole marker", st.name)
+		}
+	}
+}
+
+func TestPageCacheBounded(t *testing.T) {
+	c := newPageCache(time.Minute)
+	key := func(lang, currency string) (pageCacheKey, bool) {
+		r := newHomeRequest("s1", currency)
+		r.Header.Set("Accept-Language", lang)
+		return newPageCacheKey(r, "home")
+	}
+
+	// Every distinct language code is a new entry, up to the bound.
+	for i := 0; i < 2*maxPageCacheEntries; i++ {
+		lang := string([]byte{'a' + byte(i/676%26), 'a' + byte(i/26%26), 'a' + byte(i%26)})
+		k, ok := key(lang+"-XX,en;q=0.5", "")
+		if !ok {
+			t.Fatalf("Accept-Language %q not cacheable", lang)
+		}
+		c.put(k, []byte("page"))
+	}
+	if n := len(c.entries); n > maxPageCacheEntries {
+		t.Errorf("cache holds %d pages, want at most %d", n, maxPageCacheEntries)
+	}
+
+	tests := []struct {
+		lang, currency string
+		want           bool
+	}{
+		{"en-US,en;q=0.9", "", true},
+		{"", "EUR", true},
+		{"notalanguage", "", false},
+		{"e1-US", "", false},
+		{"en", "XYZ", false},
+	}
+	for _, tt := range tests {
+		if _, got := key(tt.lang, tt.currency); got != tt.want {
+			t.Errorf("Accept-Language %q, currency %q: cacheable = %v, want %v", tt.lang, tt.currency, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// productViews prices products in currency for display. With partialCatalog
+// set, products that are malformed or fail to convert are left out and the
+// page renders with the rest; it is only an error when none are left. The
+// second result reports whether anything was left out.
+func (fe *frontendServer) productViews(ctx context.Context, log logrus.FieldLogger, page string, products []*pb.Product, currency string) ([]productView, bool, error) {
+	ps := make([]productView, 0, len(products))
+	var skipped []string
+	var lastErr error
+	for _, p := range products {
+		if p.GetId() == "" || p.GetPriceUsd() == nil {
+			lastErr = errors.Errorf("malformed product %q in catalog response", p.GetId())
+		} else if price, err := fe.convertCurrency(ctx, p.GetPriceUsd(), currency); err != nil {
+			lastErr = errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId())
+		} else {
+			ps = append(ps, productView{p, price})
+			continue
+		}
+		if !fe.partialCatalog {
+			return nil, false, lastErr
+		}
+		skipped = append(skipped, p.GetId())
+	}
+	if len(skipped) == 0 {
+		return ps, false, nil
+	}
+	if len(ps) == 0 {
+		return nil, false, errors.Wrap(lastErr, "no product in the catalog could be rendered")
+	}
+
+	catalogPartialFetches.WithLabelValues(page).Inc()
+	log.WithFields(logrus.Fields{
+		"rendered": len(ps),
+		"skipped":  skipped,
+		"error":    lastErr,
+	}).Warn("rendering partial catalog")
+	return ps, true, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// brokenRateCurrencyService fails conversions from "XXX", a currency it has
+// no rate for.
+type brokenRateCurrencyService struct {
+	fakeCurrencyService
+}
+
+func (s brokenRateCurrencyService) Convert(ctx context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	if req.GetFrom().GetCurrencyCode() == "XXX" {
+		return nil, status.Error(codes.Internal, "no rate for XXX")
+	}
+	return s.fakeCurrencyService.Convert(ctx, req)
+}
+
+func TestHomePartialCatalog(t *testing.T) {
+	good := &pb.Product{Id: "OLJCESPC7Z", Name: "Sunglasses", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}}
+	unpriced := &pb.Product{Id: "66VCHSJNUP", Name: "Tank Top"}
+	unconvertible := &pb.Product{Id: "1YMWWN1N4O", Name: "Watch", PriceUsd: &pb.Money{CurrencyCode: "XXX", Units: 109}}
+
+	tests := []struct {
+		name        string
+		partial     bool
+		products    []*pb.Product
+		wantCode    int
+		wantPartial bool
+	}{
+		{"partial catalog rendered", true, []*pb.Product{good, unpriced, unconvertible}, http.StatusOK, true},
+		{"strict mode fails the page", false, []*pb.Product{good, unpriced, unconvertible}, http.StatusInternalServerError, false},
+		{"nothing renderable", true, []*pb.Product{unpriced, unconvertible}, http.StatusInternalServerError, false},
+		{"complete catalog", true, []*pb.Product{good}, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		conn := newTestConn(t, func(s *grpc.Server) {
+			pb.RegisterCartServiceServer(s, newFakeCartService())
+			pb.RegisterProductCatalogServiceServer(s, &fakeCatalogService{products: tt.products})
+			pb.RegisterCurrencyServiceServer(s, brokenRateCurrencyService{})
+			pb.RegisterAdServiceServer(s, pb.UnimplementedAdServiceServer{})
+		})
+		fe := &frontendServer{
+			cartSvcConn:           conn,
+			productCatalogSvcConn: conn,
+			currencySvcConn:       conn,
+			adSvcConn:             conn,
+			pageCache:             newPageCache(time.Minute),
+			partialCatalog:        tt.partial,
+		}
+		counter := catalogPartialFetches.WithLabelValues("home")
+		before := testutil.ToFloat64(counter)
+
+		w := httptest.NewRecorder()
+		fe.homeHandler(w, newHomeRequest("s1", ""))
+		if w.Code != tt.wantCode {
+			t.Fatalf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "Sunglasses") {
+			t.Errorf("%s: renderable product missing from the page", tt.name)
+		}
+		gotPartial := strings.Contains(body, "Some products couldn't be loaded")
+		if gotPartial != tt.wantPartial {
+			t.Errorf("%s: got partial warning %v, want %v", tt.name, gotPartial, tt.wantPartial)
+		}
+		wantCount := before
+		if tt.wantPartial {
+			wantCount++
+			if got := w.Header().Get(pageCacheHeader); got != "" {
+				t.Errorf("%s: partial page went through the page cache (%s)", tt.name, got)
+			}
+		}
+		if got := testutil.ToFloat64(counter); got != wantCount {
+			t.Errorf("%s: got %v partial fetches, want %v", tt.name, got, wantCount)
+		}
+	}
+}
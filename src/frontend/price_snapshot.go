@@ -0,0 +1,31 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// priceChanged reports whether the price recorded when an item was added to
+// the cart differs from its current catalog price. Carts without a snapshot
+// (cartservice running without PRICE_SNAPSHOT) never report a change.
+func priceChanged(snapshot, current *pb.Money) bool {
+	if snapshot == nil || current == nil {
+		return false
+	}
+	return snapshot.GetCurrencyCode() != current.GetCurrencyCode() ||
+		snapshot.GetUnits() != current.GetUnits() ||
+		snapshot.GetNanos() != current.GetNanos()
+}
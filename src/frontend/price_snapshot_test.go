@@ -0,0 +1,40 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestPriceChanged(t *testing.T) {
+	current := &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}
+	tests := []struct {
+		name     string
+		snapshot *pb.Money
+		want     bool
+	}{
+		{"no snapshot", nil, false},
+		{"same price", &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}, false},
+		{"units changed", &pb.Money{CurrencyCode: "USD", Units: 24, Nanos: 990000000}, true},
+		{"nanos changed", &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 500000000}, true},
+	}
+	for _, tt := range tests {
+		if got := priceChanged(tt.snapshot, current); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// backend is a downstream service the frontend holds a connection to.
+// Pages keep working, only less complete, while an optional backend is down.
+type backend struct {
+	name     string
+	conn     *grpc.ClientConn
+	required bool
+}
+
+// backends lists the downstream connections checked for readiness.
+func (fe *frontendServer) backends() []backend {
+	return []backend{
+		{"productcatalog", fe.productCatalogSvcConn, true},
+		{"currency", fe.currencySvcConn, true},
+		{"cart", fe.cartSvcConn, true},
+		{"checkout", fe.checkoutSvcConn, true},
+		{"shipping", fe.shippingSvcConn, true},
+		{"recommendation", fe.recommendationSvcConn, false},
+		{"ad", fe.adSvcConn, false},
+	}
+}
+
+type backendState struct {
+	Backend string `json:"backend"`
+	State   string `json:"state"`
+}
+
+// slowBackend is a backend whose recent calls averaged over the readiness
+// latency threshold.
+type slowBackend struct {
+	Backend   string `json:"backend"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+type readinessResponse struct {
+	Status string `json:"status"`
+	// NotReady lists the required backends that are not READY.
+	NotReady []backendState `json:"not_ready"`
+	// Degraded lists the optional backends that are not READY. They don't
+	// fail readiness.
+	Degraded []backendState `json:"degraded,omitempty"`
+	// Slow lists the backends answering slower than READY_LATENCY_THRESHOLD.
+	// They only fail readiness with READY_LATENCY_STRICT.
+	Slow []slowBackend `json:"slow,omitempty"`
+}
+
+// readyHandler reports whether every required backend connection is READY,
+// answering 503 otherwise so traffic is held until dependencies are
+// reachable. Idle connections are asked to connect so a later probe can pass.
+// With a latency threshold set, backends that are up but slow mark the
+// frontend degraded, which is still 200 unless the strict mode is on.
+func (fe *frontendServer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	resp := readinessResponse{Status: "ready", NotReady: []backendState{}}
+	for _, b := range fe.backends() {
+		state := "NOT_CONNECTED"
+		if avg, ok := fe.backendLatency(b.name); ok && avg > fe.readyLatencyThreshold {
+			resp.Slow = append(resp.Slow, slowBackend{b.name, avg.Milliseconds()})
+		}
+		if b.conn != nil {
+			s := b.conn.GetState()
+			if s == connectivity.Ready {
+				continue
+			}
+			if s == connectivity.Idle {
+				b.conn.Connect()
+			}
+			state = s.String()
+		}
+		if b.required {
+			resp.NotReady = append(resp.NotReady, backendState{b.name, state})
+		} else {
+			resp.Degraded = append(resp.Degraded, backendState{b.name, state})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case len(resp.NotReady) > 0:
+		resp.Status = "not ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case len(resp.Slow) > 0:
+		resp.Status = "degraded"
+		if fe.readyLatencyStrict {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// backendLatency returns the backend's recent average latency, and false
+// when latency isn't tracked or there is too little traffic to judge.
+func (fe *frontendServer) backendLatency(backend string) (time.Duration, bool) {
+	if fe.readyLatencyThreshold <= 0 || fe.backendLatencies == nil {
+		return 0, false
+	}
+	return fe.backendLatencies.average(backend)
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// newReadyConn returns a connection to an empty server that has finished
+// connecting.
+func newReadyConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	conn := newTestConn(t, func(*grpc.Server) {})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn.Connect()
+	for s := conn.GetState(); s != connectivity.Ready; s = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, s) {
+			t.Fatalf("connection stuck in %s", s)
+		}
+	}
+	return conn
+}
+
+func TestReadyHandler(t *testing.T) {
+	up, down := newReadyConn(t), newDownConn(t)
+	tests := []struct {
+		name         string
+		cartDown     bool
+		adDown       bool
+		wantCode     int
+		wantNotReady []string
+		wantDegraded []string
+	}{
+		{"all backends ready", false, false, http.StatusOK, nil, nil},
+		{"optional backend down", false, true, http.StatusOK, nil, []string{"ad"}},
+		{"required backend down", true, false, http.StatusServiceUnavailable, []string{"cart"}, nil},
+	}
+	for _, tt := range tests {
+		fe := &frontendServer{
+			productCatalogSvcConn: up,
+			currencySvcConn:       up,
+			cartSvcConn:           up,
+			checkoutSvcConn:       up,
+			shippingSvcConn:       up,
+			recommendationSvcConn: up,
+			adSvcConn:             up,
+		}
+		if tt.cartDown {
+			fe.cartSvcConn = down
+		}
+		if tt.adDown {
+			fe.adSvcConn = down
+		}
+
+		w := httptest.NewRecorder()
+		fe.readyHandler(w, httptest.NewRequest(http.MethodGet, "/_readyz", nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		var resp readinessResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := backendNames(resp.NotReady); !slices.Equal(got, tt.wantNotReady) {
+			t.Errorf("%s: got not_ready %v, want %v", tt.name, got, tt.wantNotReady)
+		}
+		if got := backendNames(resp.Degraded); !slices.Equal(got, tt.wantDegraded) {
+			t.Errorf("%s: got degraded %v, want %v", tt.name, got, tt.wantDegraded)
+		}
+	}
+}
+
+func backendNames(states []backendState) []string {
+	var names []string
+	for _, s := range states {
+		names = append(names, s.Backend)
+	}
+	return names
+}
+
+func TestReadyHandlerLatency(t *testing.T) {
+	up := newReadyConn(t)
+	tests := []struct {
+		name     string
+		latency  time.Duration
+		samples  int
+		strict   bool
+		wantCode int
+		wantSlow []string
+	}{
+		{"below threshold", 10 * time.Millisecond, minLatencySamples, false, http.StatusOK, nil},
+		{"above threshold", 300 * time.Millisecond, minLatencySamples, false, http.StatusOK, []string{"cart"}},
+		{"above threshold, strict", 300 * time.Millisecond, minLatencySamples, true, http.StatusServiceUnavailable, []string{"cart"}},
+		{"too few samples", 300 * time.Millisecond, minLatencySamples - 1, true, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		fe := &frontendServer{
+			productCatalogSvcConn: up,
+			currencySvcConn:       up,
+			cartSvcConn:           up,
+			checkoutSvcConn:       up,
+			shippingSvcConn:       up,
+			recommendationSvcConn: up,
+			adSvcConn:             up,
+			readyLatencyThreshold: 100 * time.Millisecond,
+			backendLatencies:      newLatencyTracker(time.Minute),
+			readyLatencyStrict:    tt.strict,
+		}
+		for i := 0; i < tt.samples; i++ {
+			fe.backendLatencies.observe("cart", tt.latency)
+			fe.backendLatencies.observe("currency", 10*time.Millisecond)
+		}
+
+		w := httptest.NewRecorder()
+		fe.readyHandler(w, httptest.NewRequest(http.MethodGet, "/_readyz", nil))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		var resp readinessResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var slow []string
+		for _, s := range resp.Slow {
+			slow = append(slow, s.Backend)
+		}
+		if !slices.Equal(slow, tt.wantSlow) {
+			t.Errorf("%s: got slow %v, want %v", tt.name, slow, tt.wantSlow)
+		}
+		wantStatus := "ready"
+		if len(tt.wantSlow) > 0 {
+			wantStatus = "degraded"
+		}
+		if resp.Status != wantStatus {
+			t.Errorf("%s: got status %q, want %q", tt.name, resp.Status, wantStatus)
+		}
+	}
+}
+
+func TestLatencyInterceptor(t *testing.T) {
+	tracker := newLatencyTracker(time.Minute)
+	interceptor := latencyInterceptor(tracker)
+	invoker := func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	for i := 0; i < minLatencySamples; i++ {
+		if err := interceptor(context.Background(), "/hipstershop.ProductCatalogService/ListProducts", nil, nil, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	avg, ok := tracker.average("productcatalog")
+	if !ok || avg < 20*time.Millisecond {
+		t.Errorf("got average %v (ok=%v), want at least 20ms", avg, ok)
+	}
+
+	// Samples older than the window no longer count.
+	tracker.window = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, ok := tracker.average("productcatalog"); ok {
+		t.Error("expired samples still counted")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recoverPanics turns a panic in next into a logged error and a 500 error
+// page, where net/http would otherwise drop the connection and leave the user
+// with a blank response. It must run inside logHandler, whose logger it uses,
+// and inside the OTel handler, whose span records the panic.
+func recoverPanics(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate aborts keep net/http's behaviour.
+				panic(v)
+			}
+			err := errors.Errorf("panic: %v", v)
+
+			span := trace.SpanFromContext(r.Context())
+			span.RecordError(err, trace.WithStackTrace(true))
+			span.SetStatus(codes.Error, err.Error())
+
+			log, ok := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+			if !ok {
+				log = logrus.StandardLogger()
+			}
+			log = log.WithField("stack", string(debug.Stack()))
+			if sc := span.SpanContext(); sc.HasTraceID() {
+				log = log.WithField("trace_id", sc.TraceID().String())
+			}
+
+			// Once the handler has started its response the status line is
+			// gone, so the best left to do is log.
+			if rr, ok := w.(*responseRecorder); ok && rr.status != 0 {
+				log.WithField("error", err).Error("handler panicked after writing its response")
+				return
+			}
+			log.WithField("error", err).Error("recovered from handler panic")
+			renderHTTPError(log, r, w, errors.New("something went wrong while loading this page"), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantPage   bool
+	}{
+		{
+			name:       "panic before writing",
+			handler:    func(http.ResponseWriter, *http.Request) { panic("catalog returned a nil product") },
+			wantStatus: http.StatusInternalServerError,
+			wantPage:   true,
+		},
+		{
+			name: "panic after writing",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				panic("currency conversion failed mid-page")
+			},
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		recorder := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		ctx, span := tp.Tracer("test").Start(context.Background(), "GET /")
+		ctx = context.WithValue(ctx, ctxKeySessionID{}, "s1")
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		handler := &logHandler{log: log, next: recoverPanics(tt.handler)}
+		handler.ServeHTTP(w, r)
+		span.End()
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		if got := strings.Contains(w.Body.String(), "something went wrong"); got != tt.wantPage {
+			t.Errorf("%s: error page rendered = %v, want %v", tt.name, got, tt.wantPage)
+		}
+		spans := recorder.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("%s: got %d spans, want 1", tt.name, len(spans))
+		}
+		if got := spans[0].Status().Code; got != codes.Error {
+			t.Errorf("%s: span status %v, want %v", tt.name, got, codes.Error)
+		}
+		events := spans[0].Events()
+		if len(events) != 1 || events[0].Name != "exception" {
+			t.Errorf("%s: got span events %v, want one exception", tt.name, events)
+		}
+	}
+}
+
+func TestRecoverPanicsKeepsAbort(t *testing.T) {
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("got panic %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	handler := recoverPanics(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic(http.ErrAbortHandler) }))
+	handler.ServeHTTP(httptest.NewRecorder(), newHomeRequest("s1", ""))
+}
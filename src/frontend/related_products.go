@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const defaultRelatedProductsCount = 4
+
+// sameCategoryProducts returns up to max products from all that share at
+// least one category with p. The product itself is never included, and a
+// product without categories has no related products.
+func sameCategoryProducts(all []*pb.Product, p *pb.Product, max int) []*pb.Product {
+	if max <= 0 || len(p.GetCategories()) == 0 {
+		return nil
+	}
+	categories := make(map[string]bool, len(p.GetCategories()))
+	for _, c := range p.GetCategories() {
+		categories[c] = true
+	}
+
+	var out []*pb.Product
+	for _, candidate := range all {
+		if candidate.GetId() == p.GetId() {
+			continue
+		}
+		for _, c := range candidate.GetCategories() {
+			if categories[c] {
+				out = append(out, candidate)
+				break
+			}
+		}
+		if len(out) == max {
+			break
+		}
+	}
+	return out
+}
+
+// getRelatedProducts lists catalog products in the same category as p,
+// priced in the given currency.
+func (fe *frontendServer) getRelatedProducts(ctx context.Context, p *pb.Product, currency string) ([]productView, error) {
+	if fe.relatedProductsCount <= 0 || len(p.GetCategories()) == 0 {
+		return nil, nil
+	}
+	products, err := fe.getProducts(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve products")
+	}
+
+	related := sameCategoryProducts(products, p, fe.relatedProductsCount)
+	out := make([]productView, len(related))
+	for i, rp := range related {
+		price, err := fe.convertCurrency(ctx, rp.GetPriceUsd(), currency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to do currency conversion for product %s", rp.GetId())
+		}
+		out[i] = productView{rp, price}
+	}
+	return out, nil
+}
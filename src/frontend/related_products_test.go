@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var relatedTestCatalog = []*pb.Product{
+	{Id: "sunglasses", Categories: []string{"accessories"}, PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19}},
+	{Id: "tank-top", Categories: []string{"clothing", "tops"}, PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 18}},
+	{Id: "watch", Categories: []string{"accessories"}, PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 109}},
+	{Id: "loafers", Categories: []string{"footwear"}, PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 89}},
+	{Id: "hairdryer", Categories: []string{"hair", "beauty"}, PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 24}},
+	{Id: "candle-holder", Categories: []string{"decor", "accessories"}, PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 18}},
+	{Id: "uncategorized", PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 1}},
+}
+
+func productIDs(ps []*pb.Product) []string {
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = p.GetId()
+	}
+	return out
+}
+
+func TestSameCategoryProducts(t *testing.T) {
+	tests := []struct {
+		name    string
+		product *pb.Product
+		max     int
+		want    []string
+	}{
+		{"shared category", relatedTestCatalog[0], 4, []string{"watch", "candle-holder"}},
+		{"capped", relatedTestCatalog[0], 1, []string{"watch"}},
+		{"disabled", relatedTestCatalog[0], 0, nil},
+		{"no other product in category", relatedTestCatalog[3], 4, nil},
+		{"no categories", relatedTestCatalog[6], 4, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := productIDs(sameCategoryProducts(relatedTestCatalog, tt.product, tt.max))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+				if got[i] == tt.product.GetId() {
+					t.Errorf("current product %s included in related products", got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetRelatedProductsPricesInCurrency(t *testing.T) {
+	fe := &frontendServer{
+		productCatalogSvcConn: newTestConn(t, func(s *grpc.Server) {
+			pb.RegisterProductCatalogServiceServer(s, &fakeCatalogService{products: relatedTestCatalog})
+		}),
+		currencySvcConn: newTestConn(t, func(s *grpc.Server) {
+			pb.RegisterCurrencyServiceServer(s, fakeCurrencyService{})
+		}),
+		relatedProductsCount: defaultRelatedProductsCount,
+	}
+
+	related, err := fe.getRelatedProducts(context.Background(), relatedTestCatalog[2], "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(related) != 2 {
+		t.Fatalf("got %d related products, want 2", len(related))
+	}
+	for _, rp := range related {
+		if rp.Item.GetId() == "watch" {
+			t.Error("current product included in related products")
+		}
+		if got := rp.Price.GetCurrencyCode(); got != "EUR" {
+			t.Errorf("product %s priced in %s, want EUR", rp.Item.GetId(), got)
+		}
+	}
+}
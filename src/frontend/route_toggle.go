@@ -0,0 +1,52 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// parseDisabledRoutes turns ROUTE_DISABLED, a comma-separated list of route
+// templates such as "/assistant,/bot", into a set. Templates are written
+// without BASE_URL.
+func parseDisabledRoutes(v string) map[string]bool {
+	disabled := make(map[string]bool)
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			disabled[p] = true
+		}
+	}
+	return disabled
+}
+
+// disableRoutes is a router middleware answering 404 for any route whose
+// path template is in disabled, as if the feature didn't exist. Every method
+// registered on a disabled path is turned off.
+func disableRoutes(disabled map[string]bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil && disabled[strings.TrimPrefix(tmpl, baseUrl)] {
+					http.NotFound(w, r)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
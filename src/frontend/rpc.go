@@ -21,6 +21,8 @@ import (
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 
 	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
@@ -54,34 +56,105 @@ func (fe *frontendServer) getProduct(ctx context.Context, id string) (*pb.Produc
 	return resp, err
 }
 
-func (fe *frontendServer) getCart(ctx context.Context, userID string) ([]*pb.CartItem, error) {
-	resp, err := pb.NewCartServiceClient(fe.cartSvcConn).GetCart(ctx, &pb.GetCartRequest{UserId: userID})
-	return resp.GetItems(), err
+func (fe *frontendServer) getCart(ctx context.Context, userID string) (*pb.Cart, error) {
+	return pb.NewCartServiceClient(fe.cartSvcConn).GetCart(ctx, &pb.GetCartRequest{UserId: userID})
 }
 
-func (fe *frontendServer) emptyCart(ctx context.Context, userID string) error {
-	_, err := pb.NewCartServiceClient(fe.cartSvcConn).EmptyCart(ctx, &pb.EmptyCartRequest{UserId: userID})
+// getCartAcceptStale is getCart for display only: while cartservice's store
+// is failing it may answer from its last-known-good copy, reporting so with
+// stale set to true.
+func (fe *frontendServer) getCartAcceptStale(ctx context.Context, userID string) (cart *pb.Cart, stale bool, err error) {
+	var trailer metadata.MD
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-accept-stale-cart", "true")
+	cart, err = pb.NewCartServiceClient(fe.cartSvcConn).GetCart(ctx, &pb.GetCartRequest{UserId: userID}, grpc.Trailer(&trailer))
+	if err != nil {
+		return nil, false, err
+	}
+	v := trailer.Get("x-cart-stale")
+	return cart, len(v) > 0 && v[0] == "true", nil
+}
+
+// emptyCart empties the user's cart. With expectedVersion set, it fails with
+// Aborted if the cart has changed since it was at that version. With
+// archive set, cartservice keeps the items for restoreLastCart.
+func (fe *frontendServer) emptyCart(ctx context.Context, userID string, expectedVersion *int64, archive bool) error {
+	_, err := pb.NewCartServiceClient(fe.cartSvcConn).EmptyCart(ctx, &pb.EmptyCartRequest{UserId: userID, ExpectedVersion: expectedVersion, Archive: archive})
 	return err
 }
 
-func (fe *frontendServer) insertCart(ctx context.Context, userID, productID string, quantity int32) error {
+// restoreLastCart adds back the items of the user's last cart emptied with
+// archive set.
+func (fe *frontendServer) restoreLastCart(ctx context.Context, userID string) error {
+	_, err := pb.NewCartServiceClient(fe.cartSvcConn).RestoreLastCart(ctx, &pb.RestoreLastCartRequest{UserId: userID})
+	return err
+}
+
+func (fe *frontendServer) insertCart(ctx context.Context, userID, productID string, quantity int32, price *pb.Money, currency, idempotencyKey, source string) error {
 	_, err := pb.NewCartServiceClient(fe.cartSvcConn).AddItem(ctx, &pb.AddItemRequest{
 		UserId: userID,
 		Item: &pb.CartItem{
-			ProductId: productID,
-			Quantity:  quantity},
+			ProductId:     productID,
+			Quantity:      quantity,
+			PriceSnapshot: price},
+		CurrencyCode:   currency,
+		IdempotencyKey: idempotencyKey,
+		Source:         source,
+	})
+	return err
+}
+
+func (fe *frontendServer) updateCartItemQuantity(ctx context.Context, userID, productID string, quantity int32, expectedVersion *int64) error {
+	_, err := pb.NewCartServiceClient(fe.cartSvcConn).UpdateItemQuantity(ctx, &pb.UpdateItemQuantityRequest{
+		UserId:          userID,
+		ProductId:       productID,
+		Quantity:        quantity,
+		ExpectedVersion: expectedVersion,
+	})
+	return err
+}
+
+func (fe *frontendServer) saveForLater(ctx context.Context, userID, productID string, expectedVersion *int64) error {
+	_, err := pb.NewCartServiceClient(fe.cartSvcConn).SaveForLater(ctx, &pb.SaveForLaterRequest{
+		UserId:          userID,
+		ProductId:       productID,
+		ExpectedVersion: expectedVersion,
+	})
+	return err
+}
+
+func (fe *frontendServer) moveToCart(ctx context.Context, userID, productID string, expectedVersion *int64) error {
+	_, err := pb.NewCartServiceClient(fe.cartSvcConn).MoveToCart(ctx, &pb.MoveToCartRequest{
+		UserId:          userID,
+		ProductId:       productID,
+		ExpectedVersion: expectedVersion,
 	})
 	return err
 }
 
+func (fe *frontendServer) getSavedItems(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	resp, err := pb.NewCartServiceClient(fe.cartSvcConn).GetSavedItems(ctx, &pb.GetSavedItemsRequest{UserId: userID})
+	return resp.GetItems(), err
+}
+
 func (fe *frontendServer) convertCurrency(ctx context.Context, money *pb.Money, currency string) (*pb.Money, error) {
 	if avoidNoopCurrencyConversionRPC && money.GetCurrencyCode() == currency {
 		return money, nil
 	}
-	return pb.NewCurrencyServiceClient(fe.currencySvcConn).
+	var key conversionKey
+	if fe.currencyCache != nil {
+		key = newConversionKey(money, currency)
+		if v, ok := fe.currencyCache.get(key); ok {
+			return v, nil
+		}
+	}
+	v, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
 		Convert(ctx, &pb.CurrencyConversionRequest{
 			From:   money,
 			ToCode: currency})
+	if err == nil && fe.currencyCache != nil {
+		fe.currencyCache.put(key, v)
+	}
+	return v, err
 }
 
 func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, currency string) (*pb.Money, error) {
@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Session ID schemes selectable with SESSION_ID_SCHEME.
+const (
+	sessionIDSchemeUUID      = "uuid"
+	sessionIDSchemeRandomHex = "random-hex"
+)
+
+const defaultSessionIDBytes = 16
+
+// sessionIDPattern is the shape every generated session ID must have. The
+// ID is sent to backends as the user ID, so it is kept to characters that
+// are safe as a Redis key and in logs.
+var sessionIDPattern = regexp.MustCompile(`^[0-9A-Za-z-]{16,128}$`)
+
+// sessionIDGenerator returns a new session ID for a visitor without one.
+type sessionIDGenerator func() (string, error)
+
+// newSessionIDGenerator returns the generator for scheme. n is the number of
+// random bytes in a random-hex ID and is ignored for UUIDs. The generator is
+// tried once so misconfigurations surface at startup.
+func newSessionIDGenerator(scheme string, n int) (sessionIDGenerator, error) {
+	var gen sessionIDGenerator
+	switch scheme {
+	case "", sessionIDSchemeUUID:
+		gen = func() (string, error) {
+			u, err := uuid.NewRandom()
+			return u.String(), err
+		}
+	case sessionIDSchemeRandomHex:
+		gen = func() (string, error) {
+			b := make([]byte, n)
+			if _, err := rand.Read(b); err != nil {
+				return "", err
+			}
+			return hex.EncodeToString(b), nil
+		}
+	default:
+		return nil, errors.Errorf("unknown session ID scheme %q", scheme)
+	}
+
+	id, err := gen()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate a session ID")
+	}
+	if !validSessionID(id) {
+		return nil, errors.Errorf("%s session IDs of %d bytes do not match %s", scheme, n, sessionIDPattern)
+	}
+	return gen, nil
+}
+
+func validSessionID(id string) bool {
+	return sessionIDPattern.MatchString(id)
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSessionIDSchemes(t *testing.T) {
+	tests := []struct {
+		scheme  string
+		bytes   int
+		wantLen int // 0 means the configuration is rejected
+	}{
+		{"", 0, 36},
+		{"uuid", 64, 36},
+		{"random-hex", 16, 32},
+		{"random-hex", 32, 64},
+		{"random-hex", 4, 0},
+		{"random-hex", 65, 0},
+		{"base64", 16, 0},
+	}
+	for _, tt := range tests {
+		gen, err := newSessionIDGenerator(tt.scheme, tt.bytes)
+		if tt.wantLen == 0 {
+			if err == nil {
+				t.Errorf("%q/%d: configuration accepted, want an error", tt.scheme, tt.bytes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q/%d: %v", tt.scheme, tt.bytes, err)
+		}
+		a, _ := gen()
+		b, _ := gen()
+		if len(a) != tt.wantLen || !validSessionID(a) {
+			t.Errorf("%q/%d: got %q, want a valid ID of length %d", tt.scheme, tt.bytes, a, tt.wantLen)
+		}
+		if a == b {
+			t.Errorf("%q/%d: generated the same ID twice", tt.scheme, tt.bytes)
+		}
+		if tt.wantLen == 36 {
+			if _, err := uuid.Parse(a); err != nil {
+				t.Errorf("%q: %q is not a UUID: %v", tt.scheme, a, err)
+			}
+		}
+	}
+}
+
+func TestEnsureSessionIDUsesGenerator(t *testing.T) {
+	gen, err := newSessionIDGenerator(sessionIDSchemeRandomHex, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	handler := ensureSessionID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = sessionID(r)
+	}), gen)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(got) != 48 || !validSessionID(got) {
+		t.Errorf("got session ID %q, want 48 hex characters", got)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieSessionID || cookies[0].Value != got {
+		t.Errorf("got cookies %v, want %s=%s", cookies, cookieSessionID, got)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultShutdownGracePeriod bounds how long in-flight requests may take to
+// finish once the frontend has been asked to stop. It leaves room within
+// Kubernetes' default 30s termination grace period for flushing traces
+// afterwards.
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// serveUntilDone serves srv on lis until ctx is cancelled, then stops
+// accepting connections and waits up to timeout for in-flight requests
+// before closing the connections still open. It never blocks for much
+// longer than timeout after ctx is done.
+func serveUntilDone(ctx context.Context, log logrus.FieldLogger, srv *http.Server, lis net.Listener, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(lis) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down, waiting up to %v for in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Warnf("in-flight requests did not finish in time, closing their connections: %v", err)
+		return srv.Close()
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// closeConns closes the connections to every backend, once no request is
+// left to use them.
+func (fe *frontendServer) closeConns(log logrus.FieldLogger) {
+	for _, b := range fe.backends() {
+		if b.conn == nil {
+			continue
+		}
+		if err := b.conn.Close(); err != nil {
+			log.Warnf("failed to close connection to %s service: %v", b.name, err)
+		}
+	}
+	if fe.assistantClient != nil {
+		fe.assistantClient.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// startSlowServer serves a handler that answers only once release is
+// closed, and returns the listener's address, a channel closed when the
+// request has reached the handler, and serveUntilDone's result.
+func startSlowServer(t *testing.T, ctx context.Context, timeout time.Duration, release chan struct{}) (string, chan struct{}, chan error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		io.WriteString(w, "done")
+	})}
+	log := logrus.New()
+	log.Out = io.Discard
+	done := make(chan error, 1)
+	go func() { done <- serveUntilDone(ctx, log, srv, lis, timeout) }()
+	return lis.Addr().String(), started, done
+}
+
+func TestServeUntilDoneDrainsInFlightRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	addr, started, done := startSlowServer(t, ctx, 5*time.Second, release)
+
+	resp := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + addr)
+		if err != nil {
+			resp <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		resp <- string(body)
+	}()
+	<-started
+	cancel()
+
+	// New connections are refused while the request drains.
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting connections after shutdown started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	if got := <-resp; got != "done" {
+		t.Errorf("in-flight request got %q, want it to finish", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("serveUntilDone: %v", err)
+	}
+}
+
+func TestServeUntilDoneGivesUpAfterTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	addr, started, done := startSlowServer(t, ctx, 100*time.Millisecond, release)
+
+	go func() {
+		if res, err := http.Get("http://" + addr); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveUntilDone still waiting for a request past its timeout")
+	}
+}
+
+func TestCloseConns(t *testing.T) {
+	dial := func() *grpc.ClientConn {
+		conn, err := grpc.NewClient("passthrough:///unused", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	fe := &frontendServer{
+		productCatalogSvcConn: dial(),
+		currencySvcConn:       dial(),
+		cartSvcConn:           dial(),
+		checkoutSvcConn:       dial(),
+		shippingSvcConn:       dial(),
+		recommendationSvcConn: dial(),
+		// No ad service connection: closeConns skips it.
+		assistantClient: &http.Client{},
+	}
+	log := logrus.New()
+	log.Out = io.Discard
+	fe.closeConns(log)
+	for _, b := range fe.backends() {
+		if b.conn != nil && b.conn.GetState() != connectivity.Shutdown {
+			t.Errorf("%s connection is %v, want Shutdown", b.name, b.conn.GetState())
+		}
+	}
+}
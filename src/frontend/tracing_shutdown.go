@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// traceShutdownConfig bounds the final span flush when the frontend stops.
+type traceShutdownConfig struct {
+	attempts int
+	timeout  time.Duration // per attempt
+}
+
+var defaultTraceShutdownConfig = traceShutdownConfig{
+	attempts: 1,
+	timeout:  5 * time.Second,
+}
+
+// shutdownExporter wraps the span exporter so that the spans still buffered
+// when the frontend stops get a few tries at reaching the collector instead
+// of being dropped on the first failure. Exports made while serving go
+// straight through.
+type shutdownExporter struct {
+	sdktrace.SpanExporter
+	cfg traceShutdownConfig
+	log logrus.FieldLogger
+
+	shuttingDown atomic.Bool
+}
+
+func newShutdownExporter(exporter sdktrace.SpanExporter, cfg traceShutdownConfig, log logrus.FieldLogger) *shutdownExporter {
+	cfg.attempts = max(cfg.attempts, 1)
+	return &shutdownExporter{SpanExporter: exporter, cfg: cfg, log: log}
+}
+
+// ExportSpans gives each attempt its own timeout once shutdown has started.
+func (e *shutdownExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if !e.shuttingDown.Load() {
+		return e.SpanExporter.ExportSpans(ctx, spans)
+	}
+	var err error
+	for attempt := 1; attempt <= e.cfg.attempts; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, e.cfg.timeout)
+		err = e.SpanExporter.ExportSpans(attemptCtx, spans)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		e.log.Warnf("exporting %d spans on shutdown failed (attempt %d/%d): %v", len(spans), attempt, e.cfg.attempts, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return err
+}
+
+// shutdownTracing flushes the spans buffered in tp and shuts it down, bounded
+// by the configured attempts times the per-attempt timeout. The flush is done
+// separately because Shutdown alone does not report spans that failed to
+// export.
+func shutdownTracing(tp *sdktrace.TracerProvider, exporter *shutdownExporter) error {
+	exporter.shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(exporter.cfg.attempts)*exporter.cfg.timeout)
+	defer cancel()
+	return errors.Join(tp.ForceFlush(ctx), tp.Shutdown(ctx))
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// flakyExporter fails its first few exports, as a collector that is
+// briefly unreachable would, and records the spans of the rest.
+type flakyExporter struct {
+	*tracetest.InMemoryExporter
+	failures int
+	calls    int
+}
+
+func (e *flakyExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.calls++
+	if e.calls <= e.failures {
+		return errors.New("collector unavailable")
+	}
+	return e.InMemoryExporter.ExportSpans(ctx, spans)
+}
+
+// Shutdown keeps the recorded spans, which InMemoryExporter would drop.
+func (e *flakyExporter) Shutdown(context.Context) error { return nil }
+
+func TestShutdownTracingRetriesExport(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		wantErr   bool
+		wantSpans int
+	}{
+		{"healthy collector", 0, 1, false, 1},
+		{"single attempt drops spans", 1, 1, true, 0},
+		{"retry recovers spans", 2, 3, false, 1},
+		{"retries exhausted", 3, 3, true, 0},
+	}
+	log := logrus.New()
+	log.Out = io.Discard
+	for _, tt := range tests {
+		flaky := &flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter(), failures: tt.failures}
+		exporter := newShutdownExporter(flaky, traceShutdownConfig{attempts: tt.attempts, timeout: time.Second}, log)
+		tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+		_, span := tp.Tracer("test").Start(context.Background(), "GET /")
+		span.End()
+
+		err := shutdownTracing(tp, exporter)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if got := len(flaky.GetSpans()); got != tt.wantSpans {
+			t.Errorf("%s: collector got %d spans, want %d", tt.name, got, tt.wantSpans)
+		}
+	}
+}
+
+func TestShutdownExporterPassesThroughWhileRunning(t *testing.T) {
+	log := logrus.New()
+	log.Out = io.Discard
+	flaky := &flakyExporter{InMemoryExporter: tracetest.NewInMemoryExporter(), failures: 1}
+	exporter := newShutdownExporter(flaky, traceShutdownConfig{attempts: 3, timeout: time.Second}, log)
+	if err := exporter.ExportSpans(context.Background(), nil); err == nil {
+		t.Error("export while running was retried, want the error passed through")
+	}
+	if flaky.calls != 1 {
+		t.Errorf("got %d export calls, want 1", flaky.calls)
+	}
+}
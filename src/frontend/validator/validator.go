@@ -35,8 +35,11 @@ type Payload interface {
 }
 
 type AddToCartPayload struct {
-	Quantity  uint64 `validate:"required,gte=1,lte=10"`
+	Quantity  uint64 `validate:"required,gte=1"`
 	ProductID string `validate:"required"`
+	// IdempotencyKey is optional; cartservice rejects keys over 128
+	// characters.
+	IdempotencyKey string `validate:"omitempty,max=128"`
 }
 
 type PlaceOrderPayload struct {
@@ -129,7 +129,6 @@ func TestAddToCartFailsValidation(t *testing.T) {
 		productID string
 	}{
 		{"invalid min quantity", 0, "OLJCESPC7Z"},
-		{"invalid max quantity", 11, "OLJCESPC7Z"},
 		{"invalid product id", 1, ""},
 		{"invalid quantity and product id", 0, ""},
 	}
@@ -0,0 +1,56 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"google.golang.org/grpc"
+	channelz "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/reflection"
+)
+
+// registerDebugServices registers gRPC server reflection and channelz on
+// srv as ENABLE_REFLECTION and ENABLE_CHANNELZ say, so grpcurl and grpcdebug
+// work against a running deployment without rebuilding the image. Channelz
+// is off unless asked for; reflectionDefault applies when ENABLE_REFLECTION
+// is unset. This file is kept identical in checkoutservice,
+// productcatalogservice and shippingservice.
+func registerDebugServices(srv *grpc.Server, reflectionDefault bool) {
+	if boolFromEnv("ENABLE_REFLECTION", reflectionDefault) {
+		log.Info("gRPC server reflection enabled")
+		reflection.Register(srv)
+	}
+	if boolFromEnv("ENABLE_CHANNELZ", false) {
+		log.Info("gRPC channelz service enabled")
+		channelz.RegisterChannelzServiceToServer(srv)
+	}
+}
+
+// boolFromEnv parses the boolean variable key, falling back to def when it
+// is unset or invalid.
+func boolFromEnv(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid %s %q", key, v)
+		return def
+	}
+	return on
+}
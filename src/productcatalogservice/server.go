@@ -142,6 +142,7 @@ func run(port string) string {
 	pb.RegisterProductCatalogServiceServer(srv, svc)
 	healthcheck := health.NewServer()
 	healthpb.RegisterHealthServer(srv, healthcheck)
+	registerDebugServices(srv, false)
 	go srv.Serve(listener)
 
 	return listener.Addr().String()
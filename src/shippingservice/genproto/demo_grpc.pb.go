@@ -33,9 +33,22 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	CartService_AddItem_FullMethodName   = "/hipstershop.CartService/AddItem"
-	CartService_GetCart_FullMethodName   = "/hipstershop.CartService/GetCart"
-	CartService_EmptyCart_FullMethodName = "/hipstershop.CartService/EmptyCart"
+	CartService_AddItem_FullMethodName            = "/hipstershop.CartService/AddItem"
+	CartService_AddItems_FullMethodName           = "/hipstershop.CartService/AddItems"
+	CartService_GetCart_FullMethodName            = "/hipstershop.CartService/GetCart"
+	CartService_EmptyCart_FullMethodName          = "/hipstershop.CartService/EmptyCart"
+	CartService_BatchGetCart_FullMethodName       = "/hipstershop.CartService/BatchGetCart"
+	CartService_CartExists_FullMethodName         = "/hipstershop.CartService/CartExists"
+	CartService_MergeCarts_FullMethodName         = "/hipstershop.CartService/MergeCarts"
+	CartService_ExportCart_FullMethodName         = "/hipstershop.CartService/ExportCart"
+	CartService_ImportCart_FullMethodName         = "/hipstershop.CartService/ImportCart"
+	CartService_UpdateItemQuantity_FullMethodName = "/hipstershop.CartService/UpdateItemQuantity"
+	CartService_SaveForLater_FullMethodName       = "/hipstershop.CartService/SaveForLater"
+	CartService_MoveToCart_FullMethodName         = "/hipstershop.CartService/MoveToCart"
+	CartService_GetSavedItems_FullMethodName      = "/hipstershop.CartService/GetSavedItems"
+	CartService_ListCarts_FullMethodName          = "/hipstershop.CartService/ListCarts"
+	CartService_GetCartHistory_FullMethodName     = "/hipstershop.CartService/GetCartHistory"
+	CartService_RestoreLastCart_FullMethodName    = "/hipstershop.CartService/RestoreLastCart"
 )
 
 // CartServiceClient is the client API for CartService service.
@@ -43,8 +56,29 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type CartServiceClient interface {
 	AddItem(ctx context.Context, in *AddItemRequest, opts ...grpc.CallOption) (*Empty, error)
+	// AddItems adds several items in one call. Either every item is added
+	// or, on error, none is.
+	AddItems(ctx context.Context, in *AddItemsRequest, opts ...grpc.CallOption) (*Empty, error)
 	GetCart(ctx context.Context, in *GetCartRequest, opts ...grpc.CallOption) (*Cart, error)
 	EmptyCart(ctx context.Context, in *EmptyCartRequest, opts ...grpc.CallOption) (*Empty, error)
+	BatchGetCart(ctx context.Context, in *BatchGetCartRequest, opts ...grpc.CallOption) (*BatchGetCartResponse, error)
+	CartExists(ctx context.Context, in *CartExistsRequest, opts ...grpc.CallOption) (*CartExistsResponse, error)
+	MergeCarts(ctx context.Context, in *MergeCartsRequest, opts ...grpc.CallOption) (*Empty, error)
+	ExportCart(ctx context.Context, in *ExportCartRequest, opts ...grpc.CallOption) (*ExportCartResponse, error)
+	ImportCart(ctx context.Context, in *ImportCartRequest, opts ...grpc.CallOption) (*Empty, error)
+	UpdateItemQuantity(ctx context.Context, in *UpdateItemQuantityRequest, opts ...grpc.CallOption) (*Empty, error)
+	SaveForLater(ctx context.Context, in *SaveForLaterRequest, opts ...grpc.CallOption) (*Empty, error)
+	MoveToCart(ctx context.Context, in *MoveToCartRequest, opts ...grpc.CallOption) (*Empty, error)
+	GetSavedItems(ctx context.Context, in *GetSavedItemsRequest, opts ...grpc.CallOption) (*GetSavedItemsResponse, error)
+	ListCarts(ctx context.Context, in *ListCartsRequest, opts ...grpc.CallOption) (*ListCartsResponse, error)
+	// GetCartHistory returns the changes recorded in the cart audit log,
+	// newest first. It fails with FailedPrecondition when cartservice's
+	// CART_AUDIT_LOG is unset.
+	GetCartHistory(ctx context.Context, in *GetCartHistoryRequest, opts ...grpc.CallOption) (*GetCartHistoryResponse, error)
+	// RestoreLastCart adds back the items of the cart's last EmptyCart made
+	// with archive set, and forgets them. It fails with NotFound when there
+	// is nothing to restore, including once the archive has expired.
+	RestoreLastCart(ctx context.Context, in *RestoreLastCartRequest, opts ...grpc.CallOption) (*RestoreLastCartResponse, error)
 }
 
 type cartServiceClient struct {
@@ -65,6 +99,16 @@ func (c *cartServiceClient) AddItem(ctx context.Context, in *AddItemRequest, opt
 	return out, nil
 }
 
+func (c *cartServiceClient) AddItems(ctx context.Context, in *AddItemsRequest, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, CartService_AddItems_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *cartServiceClient) GetCart(ctx context.Context, in *GetCartRequest, opts ...grpc.CallOption) (*Cart, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(Cart)
@@ -85,13 +129,154 @@ func (c *cartServiceClient) EmptyCart(ctx context.Context, in *EmptyCartRequest,
 	return out, nil
 }
 
+func (c *cartServiceClient) BatchGetCart(ctx context.Context, in *BatchGetCartRequest, opts ...grpc.CallOption) (*BatchGetCartResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchGetCartResponse)
+	err := c.cc.Invoke(ctx, CartService_BatchGetCart_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) CartExists(ctx context.Context, in *CartExistsRequest, opts ...grpc.CallOption) (*CartExistsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CartExistsResponse)
+	err := c.cc.Invoke(ctx, CartService_CartExists_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) MergeCarts(ctx context.Context, in *MergeCartsRequest, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, CartService_MergeCarts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) ExportCart(ctx context.Context, in *ExportCartRequest, opts ...grpc.CallOption) (*ExportCartResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ExportCartResponse)
+	err := c.cc.Invoke(ctx, CartService_ExportCart_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) ImportCart(ctx context.Context, in *ImportCartRequest, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, CartService_ImportCart_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) UpdateItemQuantity(ctx context.Context, in *UpdateItemQuantityRequest, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, CartService_UpdateItemQuantity_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) SaveForLater(ctx context.Context, in *SaveForLaterRequest, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, CartService_SaveForLater_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) MoveToCart(ctx context.Context, in *MoveToCartRequest, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, CartService_MoveToCart_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) GetSavedItems(ctx context.Context, in *GetSavedItemsRequest, opts ...grpc.CallOption) (*GetSavedItemsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetSavedItemsResponse)
+	err := c.cc.Invoke(ctx, CartService_GetSavedItems_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) ListCarts(ctx context.Context, in *ListCartsRequest, opts ...grpc.CallOption) (*ListCartsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListCartsResponse)
+	err := c.cc.Invoke(ctx, CartService_ListCarts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) GetCartHistory(ctx context.Context, in *GetCartHistoryRequest, opts ...grpc.CallOption) (*GetCartHistoryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetCartHistoryResponse)
+	err := c.cc.Invoke(ctx, CartService_GetCartHistory_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartServiceClient) RestoreLastCart(ctx context.Context, in *RestoreLastCartRequest, opts ...grpc.CallOption) (*RestoreLastCartResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RestoreLastCartResponse)
+	err := c.cc.Invoke(ctx, CartService_RestoreLastCart_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CartServiceServer is the server API for CartService service.
 // All implementations must embed UnimplementedCartServiceServer
 // for forward compatibility.
 type CartServiceServer interface {
 	AddItem(context.Context, *AddItemRequest) (*Empty, error)
+	// AddItems adds several items in one call. Either every item is added
+	// or, on error, none is.
+	AddItems(context.Context, *AddItemsRequest) (*Empty, error)
 	GetCart(context.Context, *GetCartRequest) (*Cart, error)
 	EmptyCart(context.Context, *EmptyCartRequest) (*Empty, error)
+	BatchGetCart(context.Context, *BatchGetCartRequest) (*BatchGetCartResponse, error)
+	CartExists(context.Context, *CartExistsRequest) (*CartExistsResponse, error)
+	MergeCarts(context.Context, *MergeCartsRequest) (*Empty, error)
+	ExportCart(context.Context, *ExportCartRequest) (*ExportCartResponse, error)
+	ImportCart(context.Context, *ImportCartRequest) (*Empty, error)
+	UpdateItemQuantity(context.Context, *UpdateItemQuantityRequest) (*Empty, error)
+	SaveForLater(context.Context, *SaveForLaterRequest) (*Empty, error)
+	MoveToCart(context.Context, *MoveToCartRequest) (*Empty, error)
+	GetSavedItems(context.Context, *GetSavedItemsRequest) (*GetSavedItemsResponse, error)
+	ListCarts(context.Context, *ListCartsRequest) (*ListCartsResponse, error)
+	// GetCartHistory returns the changes recorded in the cart audit log,
+	// newest first. It fails with FailedPrecondition when cartservice's
+	// CART_AUDIT_LOG is unset.
+	GetCartHistory(context.Context, *GetCartHistoryRequest) (*GetCartHistoryResponse, error)
+	// RestoreLastCart adds back the items of the cart's last EmptyCart made
+	// with archive set, and forgets them. It fails with NotFound when there
+	// is nothing to restore, including once the archive has expired.
+	RestoreLastCart(context.Context, *RestoreLastCartRequest) (*RestoreLastCartResponse, error)
 	mustEmbedUnimplementedCartServiceServer()
 }
 
@@ -105,12 +290,51 @@ type UnimplementedCartServiceServer struct{}
 func (UnimplementedCartServiceServer) AddItem(context.Context, *AddItemRequest) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method AddItem not implemented")
 }
+func (UnimplementedCartServiceServer) AddItems(context.Context, *AddItemsRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddItems not implemented")
+}
 func (UnimplementedCartServiceServer) GetCart(context.Context, *GetCartRequest) (*Cart, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetCart not implemented")
 }
 func (UnimplementedCartServiceServer) EmptyCart(context.Context, *EmptyCartRequest) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method EmptyCart not implemented")
 }
+func (UnimplementedCartServiceServer) BatchGetCart(context.Context, *BatchGetCartRequest) (*BatchGetCartResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGetCart not implemented")
+}
+func (UnimplementedCartServiceServer) CartExists(context.Context, *CartExistsRequest) (*CartExistsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CartExists not implemented")
+}
+func (UnimplementedCartServiceServer) MergeCarts(context.Context, *MergeCartsRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MergeCarts not implemented")
+}
+func (UnimplementedCartServiceServer) ExportCart(context.Context, *ExportCartRequest) (*ExportCartResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportCart not implemented")
+}
+func (UnimplementedCartServiceServer) ImportCart(context.Context, *ImportCartRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ImportCart not implemented")
+}
+func (UnimplementedCartServiceServer) UpdateItemQuantity(context.Context, *UpdateItemQuantityRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateItemQuantity not implemented")
+}
+func (UnimplementedCartServiceServer) SaveForLater(context.Context, *SaveForLaterRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SaveForLater not implemented")
+}
+func (UnimplementedCartServiceServer) MoveToCart(context.Context, *MoveToCartRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MoveToCart not implemented")
+}
+func (UnimplementedCartServiceServer) GetSavedItems(context.Context, *GetSavedItemsRequest) (*GetSavedItemsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSavedItems not implemented")
+}
+func (UnimplementedCartServiceServer) ListCarts(context.Context, *ListCartsRequest) (*ListCartsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCarts not implemented")
+}
+func (UnimplementedCartServiceServer) GetCartHistory(context.Context, *GetCartHistoryRequest) (*GetCartHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCartHistory not implemented")
+}
+func (UnimplementedCartServiceServer) RestoreLastCart(context.Context, *RestoreLastCartRequest) (*RestoreLastCartResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreLastCart not implemented")
+}
 func (UnimplementedCartServiceServer) mustEmbedUnimplementedCartServiceServer() {}
 func (UnimplementedCartServiceServer) testEmbeddedByValue()                     {}
 
@@ -150,6 +374,24 @@ func _CartService_AddItem_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CartService_AddItems_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddItemsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).AddItems(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_AddItems_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).AddItems(ctx, req.(*AddItemsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _CartService_GetCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(GetCartRequest)
 	if err := dec(in); err != nil {
@@ -186,6 +428,222 @@ func _CartService_EmptyCart_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CartService_BatchGetCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).BatchGetCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_BatchGetCart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).BatchGetCart(ctx, req.(*BatchGetCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_CartExists_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CartExistsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).CartExists(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_CartExists_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).CartExists(ctx, req.(*CartExistsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_MergeCarts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MergeCartsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).MergeCarts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_MergeCarts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).MergeCarts(ctx, req.(*MergeCartsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_ExportCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).ExportCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_ExportCart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).ExportCart(ctx, req.(*ExportCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_ImportCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).ImportCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_ImportCart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).ImportCart(ctx, req.(*ImportCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_UpdateItemQuantity_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateItemQuantityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).UpdateItemQuantity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_UpdateItemQuantity_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).UpdateItemQuantity(ctx, req.(*UpdateItemQuantityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_SaveForLater_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SaveForLaterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).SaveForLater(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_SaveForLater_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).SaveForLater(ctx, req.(*SaveForLaterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_MoveToCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MoveToCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).MoveToCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_MoveToCart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).MoveToCart(ctx, req.(*MoveToCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_GetSavedItems_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSavedItemsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).GetSavedItems(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_GetSavedItems_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).GetSavedItems(ctx, req.(*GetSavedItemsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_ListCarts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCartsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).ListCarts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_ListCarts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).ListCarts(ctx, req.(*ListCartsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_GetCartHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCartHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).GetCartHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_GetCartHistory_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).GetCartHistory(ctx, req.(*GetCartHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartService_RestoreLastCart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RestoreLastCartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServiceServer).RestoreLastCart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartService_RestoreLastCart_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServiceServer).RestoreLastCart(ctx, req.(*RestoreLastCartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // CartService_ServiceDesc is the grpc.ServiceDesc for CartService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -197,6 +655,10 @@ var CartService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "AddItem",
 			Handler:    _CartService_AddItem_Handler,
 		},
+		{
+			MethodName: "AddItems",
+			Handler:    _CartService_AddItems_Handler,
+		},
 		{
 			MethodName: "GetCart",
 			Handler:    _CartService_GetCart_Handler,
@@ -205,6 +667,240 @@ var CartService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "EmptyCart",
 			Handler:    _CartService_EmptyCart_Handler,
 		},
+		{
+			MethodName: "BatchGetCart",
+			Handler:    _CartService_BatchGetCart_Handler,
+		},
+		{
+			MethodName: "CartExists",
+			Handler:    _CartService_CartExists_Handler,
+		},
+		{
+			MethodName: "MergeCarts",
+			Handler:    _CartService_MergeCarts_Handler,
+		},
+		{
+			MethodName: "ExportCart",
+			Handler:    _CartService_ExportCart_Handler,
+		},
+		{
+			MethodName: "ImportCart",
+			Handler:    _CartService_ImportCart_Handler,
+		},
+		{
+			MethodName: "UpdateItemQuantity",
+			Handler:    _CartService_UpdateItemQuantity_Handler,
+		},
+		{
+			MethodName: "SaveForLater",
+			Handler:    _CartService_SaveForLater_Handler,
+		},
+		{
+			MethodName: "MoveToCart",
+			Handler:    _CartService_MoveToCart_Handler,
+		},
+		{
+			MethodName: "GetSavedItems",
+			Handler:    _CartService_GetSavedItems_Handler,
+		},
+		{
+			MethodName: "ListCarts",
+			Handler:    _CartService_ListCarts_Handler,
+		},
+		{
+			MethodName: "GetCartHistory",
+			Handler:    _CartService_GetCartHistory_Handler,
+		},
+		{
+			MethodName: "RestoreLastCart",
+			Handler:    _CartService_RestoreLastCart_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "demo.proto",
+}
+
+const (
+	CartAdminService_ListCarts_FullMethodName    = "/hipstershop.CartAdminService/ListCarts"
+	CartAdminService_GetCartStats_FullMethodName = "/hipstershop.CartAdminService/GetCartStats"
+	CartAdminService_SetLogLevel_FullMethodName  = "/hipstershop.CartAdminService/SetLogLevel"
+)
+
+// CartAdminServiceClient is the client API for CartAdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Operator-only view of every cart. cartservice serves it when ADMIN_TOKEN
+// is set, to callers sending that token as "authorization: Bearer <token>"
+// metadata.
+type CartAdminServiceClient interface {
+	ListCarts(ctx context.Context, in *AdminListCartsRequest, opts ...grpc.CallOption) (*AdminListCartsResponse, error)
+	GetCartStats(ctx context.Context, in *GetCartStatsRequest, opts ...grpc.CallOption) (*CartStats, error)
+	SetLogLevel(ctx context.Context, in *SetLogLevelRequest, opts ...grpc.CallOption) (*SetLogLevelResponse, error)
+}
+
+type cartAdminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCartAdminServiceClient(cc grpc.ClientConnInterface) CartAdminServiceClient {
+	return &cartAdminServiceClient{cc}
+}
+
+func (c *cartAdminServiceClient) ListCarts(ctx context.Context, in *AdminListCartsRequest, opts ...grpc.CallOption) (*AdminListCartsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AdminListCartsResponse)
+	err := c.cc.Invoke(ctx, CartAdminService_ListCarts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartAdminServiceClient) GetCartStats(ctx context.Context, in *GetCartStatsRequest, opts ...grpc.CallOption) (*CartStats, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CartStats)
+	err := c.cc.Invoke(ctx, CartAdminService_GetCartStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartAdminServiceClient) SetLogLevel(ctx context.Context, in *SetLogLevelRequest, opts ...grpc.CallOption) (*SetLogLevelResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SetLogLevelResponse)
+	err := c.cc.Invoke(ctx, CartAdminService_SetLogLevel_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CartAdminServiceServer is the server API for CartAdminService service.
+// All implementations must embed UnimplementedCartAdminServiceServer
+// for forward compatibility.
+//
+// Operator-only view of every cart. cartservice serves it when ADMIN_TOKEN
+// is set, to callers sending that token as "authorization: Bearer <token>"
+// metadata.
+type CartAdminServiceServer interface {
+	ListCarts(context.Context, *AdminListCartsRequest) (*AdminListCartsResponse, error)
+	GetCartStats(context.Context, *GetCartStatsRequest) (*CartStats, error)
+	SetLogLevel(context.Context, *SetLogLevelRequest) (*SetLogLevelResponse, error)
+	mustEmbedUnimplementedCartAdminServiceServer()
+}
+
+// UnimplementedCartAdminServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCartAdminServiceServer struct{}
+
+func (UnimplementedCartAdminServiceServer) ListCarts(context.Context, *AdminListCartsRequest) (*AdminListCartsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCarts not implemented")
+}
+func (UnimplementedCartAdminServiceServer) GetCartStats(context.Context, *GetCartStatsRequest) (*CartStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCartStats not implemented")
+}
+func (UnimplementedCartAdminServiceServer) SetLogLevel(context.Context, *SetLogLevelRequest) (*SetLogLevelResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetLogLevel not implemented")
+}
+func (UnimplementedCartAdminServiceServer) mustEmbedUnimplementedCartAdminServiceServer() {}
+func (UnimplementedCartAdminServiceServer) testEmbeddedByValue()                          {}
+
+// UnsafeCartAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CartAdminServiceServer will
+// result in compilation errors.
+type UnsafeCartAdminServiceServer interface {
+	mustEmbedUnimplementedCartAdminServiceServer()
+}
+
+func RegisterCartAdminServiceServer(s grpc.ServiceRegistrar, srv CartAdminServiceServer) {
+	// If the following call pancis, it indicates UnimplementedCartAdminServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&CartAdminService_ServiceDesc, srv)
+}
+
+func _CartAdminService_ListCarts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AdminListCartsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartAdminServiceServer).ListCarts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartAdminService_ListCarts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartAdminServiceServer).ListCarts(ctx, req.(*AdminListCartsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartAdminService_GetCartStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCartStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartAdminServiceServer).GetCartStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartAdminService_GetCartStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartAdminServiceServer).GetCartStats(ctx, req.(*GetCartStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CartAdminService_SetLogLevel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetLogLevelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartAdminServiceServer).SetLogLevel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CartAdminService_SetLogLevel_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartAdminServiceServer).SetLogLevel(ctx, req.(*SetLogLevelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// CartAdminService_ServiceDesc is the grpc.ServiceDesc for CartAdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var CartAdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hipstershop.CartAdminService",
+	HandlerType: (*CartAdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListCarts",
+			Handler:    _CartAdminService_ListCarts_Handler,
+		},
+		{
+			MethodName: "GetCartStats",
+			Handler:    _CartAdminService_GetCartStats_Handler,
+		},
+		{
+			MethodName: "SetLogLevel",
+			Handler:    _CartAdminService_SetLogLevel_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "demo.proto",
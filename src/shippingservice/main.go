@@ -33,7 +33,6 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
-	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/shippingservice/genproto"
@@ -102,8 +101,8 @@ func main() {
 	healthpb.RegisterHealthServer(srv, healthcheck)
 	log.Infof("Shipping Service listening on port %s", port)
 
-	// Register reflection service on gRPC server.
-	reflection.Register(srv)
+	// Reflection stays on by default, as it always has been here.
+	registerDebugServices(srv, true)
 	if err := srv.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}